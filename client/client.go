@@ -0,0 +1,253 @@
+// Package client is a Go client for the Bower registry API.
+//
+//	c := client.New("https://registry.bower.io")
+//	pkg, err := c.Lookup("jquery")
+//
+// Reads are retried on network errors and 5xx responses and can be cached in
+// memory; Register is never retried.
+package client
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNotFound is returned by Lookup for packages that are not registered.
+var ErrNotFound = errors.New("package not found")
+
+// Package is a registered package.
+type Package struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// CanonicalName is set when the package was looked up through an alias.
+	CanonicalName string `json:"canonical_name,omitempty"`
+}
+
+// Changes is a page of package changes, see Client.Changes.
+type Changes struct {
+	Packages []ChangedPackage `json:"packages"`
+	Deleted  []DeletedPackage `json:"deleted"`
+	// Cursor is the since of the next call. More is set when further
+	// changes can be fetched right away.
+	Cursor string `json:"cursor"`
+	More   bool   `json:"more"`
+}
+
+// ChangedPackage is a package that was registered or changed.
+type ChangedPackage struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// DeletedPackage is a package that was unregistered.
+type DeletedPackage struct {
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// Error is a non-2xx response from the registry.
+type Error struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("registry: %d %s", e.StatusCode, e.Message)
+}
+
+// Client talks to one registry. Its fields must not be changed once it is in
+// use.
+type Client struct {
+	BaseURL    string
+	HTTPClient *http.Client
+	// Retries is the number of extra attempts for failed reads, waiting
+	// RetryWait, then twice as long, and so on between attempts.
+	Retries   int
+	RetryWait time.Duration
+	// CacheTTL keeps successful reads in memory; zero disables caching.
+	CacheTTL time.Duration
+	// Token is sent as a bearer token, e.g. an organization token for
+	// registering scoped packages.
+	Token string
+
+	mu    sync.Mutex
+	cache map[string]cacheEntry
+}
+
+type cacheEntry struct {
+	body    []byte
+	expires time.Time
+}
+
+// New returns a client with retries and a one minute cache.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimSuffix(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		Retries:    3,
+		RetryWait:  200 * time.Millisecond,
+		CacheTTL:   time.Minute,
+	}
+}
+
+// Lookup returns the package registered under name or one of its aliases.
+func (c *Client) Lookup(name string) (*Package, error) {
+	var p Package
+	if err := c.get("/packages/"+escapeName(name), &p); err != nil {
+		if e, ok := err.(*Error); ok && e.StatusCode == http.StatusNotFound {
+			return nil, ErrNotFound
+		}
+		return nil, err
+	}
+	return &p, nil
+}
+
+// List returns every registered package.
+func (c *Client) List() ([]Package, error) {
+	var packages []Package
+	return packages, c.get("/packages", &packages)
+}
+
+// Changes returns the packages changed and deleted since the cursor of a
+// previous call, or since "0" for every package. Changes are never cached.
+func (c *Client) Changes(since string) (*Changes, error) {
+	body, err := c.fetch("/packages?since=" + url.QueryEscape(since))
+	if err != nil {
+		return nil, err
+	}
+	var changes Changes
+	if err := json.Unmarshal(body, &changes); err != nil {
+		return nil, err
+	}
+	return &changes, nil
+}
+
+// Search returns the packages matching query, best matches first.
+func (c *Client) Search(query string) ([]Package, error) {
+	var packages []Package
+	return packages, c.get("/packages/search/"+url.PathEscape(query), &packages)
+}
+
+// Register adds a package. The registry checks that the repository exists.
+func (c *Client) Register(name, repoURL string) error {
+	form := url.Values{"name": {name}, "url": {repoURL}}
+	req, err := http.NewRequest(http.MethodPost, c.BaseURL+"/packages", strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, err := c.do(req); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	c.cache = nil
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *Client) get(path string, v interface{}) error {
+	if body, ok := c.cached(path); ok {
+		return json.Unmarshal(body, v)
+	}
+
+	body, err := c.fetch(path)
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return err
+	}
+	if c.CacheTTL > 0 {
+		c.mu.Lock()
+		if c.cache == nil {
+			c.cache = map[string]cacheEntry{}
+		}
+		c.cache[path] = cacheEntry{body, time.Now().Add(c.CacheTTL)}
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// fetch reads path, retrying as configured.
+func (c *Client) fetch(path string) ([]byte, error) {
+	var body []byte
+	var err error
+	wait := c.RetryWait
+	for attempt := 0; ; attempt++ {
+		var req *http.Request
+		req, err = http.NewRequest(http.MethodGet, c.BaseURL+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		body, err = c.do(req)
+		if err == nil || attempt >= c.Retries || !retryable(err) {
+			break
+		}
+		time.Sleep(wait)
+		wait *= 2
+	}
+	return body, err
+}
+
+func (c *Client) cached(path string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.cache[path]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(c.cache, path)
+		return nil, false
+	}
+	return entry.body, true
+}
+
+func (c *Client) do(req *http.Request) ([]byte, error) {
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	httpClient := c.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return nil, &Error{StatusCode: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return body, nil
+}
+
+// retryable reports whether a read may succeed when repeated: network errors,
+// rate limiting and server errors.
+func retryable(err error) bool {
+	e, ok := err.(*Error)
+	return !ok || e.StatusCode == http.StatusTooManyRequests || e.StatusCode >= 500
+}
+
+// escapeName keeps the slash of scoped names like @org/name.
+func escapeName(name string) string {
+	if strings.HasPrefix(name, "@") {
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			return "@" + url.PathEscape(name[1:i]) + "/" + url.PathEscape(name[i+1:])
+		}
+	}
+	return url.PathEscape(name)
+}
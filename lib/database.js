@@ -73,15 +73,15 @@ var query = function (query, parameters, callback) {
 
 // TODO: Prepared statements? Or straight to Couch?
 exports.getPackage = function (name, callback) {
-    query('SELECT name, url FROM packages WHERE name = $1', [name], callback);
+    query("SELECT name, url FROM packages WHERE tenant = '' AND name = $1", [name], callback);
 };
 
 exports.getPackages = function (callback) {
-    query('SELECT name, url FROM packages ORDER BY name', callback);
+    query("SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY name", callback);
 };
 
 exports.getPackagesCount = function (callback) {
-    query('SELECT count(*) FROM packages', callback);
+    query("SELECT count(*) FROM packages WHERE tenant = '' AND visibility = 'public'", callback);
 };
 
 function purgeCloudflareCache(name) {
@@ -138,7 +138,7 @@ exports.insertPackage = function (name, url, callback) {
 };
 
 exports.deletePackage = function (name, callback) {
-    query('DELETE FROM packages WHERE name = $1', [name], removeCacheAndReturn(name, callback));
+    query("DELETE FROM packages WHERE tenant = '' AND name = $1", [name], removeCacheAndReturn(name, callback));
 };
 
 exports.hit = function (name) {
@@ -147,9 +147,9 @@ exports.hit = function (name) {
 
 exports.searchPackages = function (term, limit, callback) {
     if (term) {
-        query('SELECT name, url FROM packages WHERE name ILIKE $1 OR url ILIKE $1 ORDER BY similarity(name, $3) DESC LIMIT $2', ['%' + term + '%', limit, term], callback);
+        query("SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' AND (name ILIKE $1 OR url ILIKE $1) ORDER BY similarity(name, $3) DESC LIMIT $2", ['%' + term + '%', limit, term], callback);
     } else {
-        query('SELECT name, url FROM packages ORDER BY hits DESC LIMIT $1', [limit], callback);
+        query("SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY hits DESC LIMIT $1", [limit], callback);
     }
 };
 
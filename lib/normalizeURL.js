@@ -10,10 +10,15 @@ module.exports = function(suppliedUrl) {
 
   var SshUrl = require('ssh-url');
   var Url = require('url');
-  var url = suppliedUrl;
+  var url = suppliedUrl.trim();
   var parsedUrl;
 
-  parsedUrl = Url.parse(suppliedUrl);
+  // owner/repo shorthand
+  if (/^[A-Za-z0-9][A-Za-z0-9-]*\/[A-Za-z0-9._-]+$/.test(url)) {
+    url = 'https://github.com/' + url;
+  }
+
+  parsedUrl = Url.parse(url);
 
   if (!parsedUrl.protocol) {
     parsedUrl = SshUrl.parse(url);
@@ -21,12 +26,10 @@ module.exports = function(suppliedUrl) {
 
   if (parsedUrl.hostname.match(/((www\.)|^)github.com$/)) {
     var pathname = parsedUrl.pathname;
-    var ext;
 
-    pathname = pathname.replace(/\/?$/,'');
-    ext = pathname.match(/\.git$/) ? '' : '.git';
+    pathname = pathname.replace(/\/*$/, '').replace(/\.git$/, '');
 
-    url = 'https://github.com' + pathname + ext;
+    url = 'https://github.com' + pathname;
   }
 
   return url;
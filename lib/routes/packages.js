@@ -211,6 +211,9 @@ exports.create = function (request, response) {
                 if (error) {
                     console.error(error);
                     serverStatus.errors.createPackageQuery++;
+                    if (error.constraint === 'packages_normalized_url_unique') {
+                        return response.status(403).send('Repository already registered as another package');
+                    }
                     return response.status(403).send('Package already registered');
                 }
 
@@ -23,6 +23,10 @@ module.exports = function(name) {
   if (!name.match(/^[^._-].*[^._-]$/)) {
       errors.push('not start or end with dashes, dots, or underscores');
   }
+  // Routes under /packages/ that would shadow packages of the same name.
+  if (['broken', 'prefix', 'search', 'top', 'trending'].indexOf(name.toLowerCase()) !== -1) {
+      errors.push('not be broken, prefix, search, top or trending');
+  }
 
   length = errors.length;
 
@@ -0,0 +1,7 @@
+package main
+
+import "github.com/bower/registry/registry"
+
+func main() {
+	registry.Main()
+}
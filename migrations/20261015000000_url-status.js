@@ -0,0 +1,19 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.text('status').notNullable().defaultTo('ok');
+    table.integer('check_failures').notNullable().defaultTo(0);
+    table.timestamp('checked_at', true);
+    table.timestamp('next_check_at', true).index('packages_next_check_at_index');
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.dropColumn('status');
+    table.dropColumn('check_failures');
+    table.dropColumn('checked_at');
+    table.dropColumn('next_check_at');
+  });
+};
@@ -0,0 +1,31 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('tenants', function (table) {
+    table.text('name').primary();
+    table.specificType('hosts', 'text[]').notNullable().defaultTo('{}');
+    table.text('admin_token_hash').notNullable();
+    table.timestamp('created_at', true).defaultTo(knex.fn.now());
+  })
+  .then(function () {
+    return knex.schema.table('packages', function (table) {
+      table.text('tenant').notNullable().defaultTo('');
+      table.dropUnique(['name']);
+      table.unique(['tenant', 'name']);
+    });
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex('packages').where('tenant', '<>', '').del()
+  .then(function () {
+    return knex.schema.table('packages', function (table) {
+      table.dropUnique(['tenant', 'name']);
+      table.unique(['name']);
+      table.dropColumn('tenant');
+    });
+  })
+  .then(function () {
+    return knex.schema.dropTable('tenants');
+  });
+};
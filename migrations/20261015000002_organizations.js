@@ -0,0 +1,23 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('organizations', function (table) {
+    table.text('name').primary();
+    table.text('token_hash').notNullable();
+    table.timestamp('created_at', true).defaultTo(knex.fn.now());
+  })
+  .then(function () {
+    return knex.schema.table('packages', function (table) {
+      table.text('organization').references('organizations.name').index('packages_organization_index');
+    });
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.dropColumn('organization');
+  })
+  .then(function () {
+    return knex.schema.dropTable('organizations');
+  });
+};
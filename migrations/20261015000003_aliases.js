@@ -0,0 +1,13 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('aliases', function (table) {
+    table.text('alias').primary();
+    table.text('package').notNullable().index('aliases_package_index');
+    table.timestamp('created_at', true).defaultTo(knex.fn.now());
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('aliases');
+};
@@ -0,0 +1,13 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.text('description');
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.dropColumn('description');
+  });
+};
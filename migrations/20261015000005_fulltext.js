@@ -0,0 +1,42 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.specificType('keywords', 'text[]').notNullable().defaultTo('{}');
+    table.specificType('search_vector', 'tsvector');
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE FUNCTION packages_search_vector() RETURNS trigger AS $$ BEGIN ' +
+      "NEW.search_vector := setweight(to_tsvector('simple', coalesce(NEW.name, '')), 'A') || " +
+      "setweight(to_tsvector('simple', array_to_string(NEW.keywords, ' ')), 'B') || " +
+      "setweight(to_tsvector('simple', coalesce(NEW.description, '')), 'C'); " +
+      'RETURN NEW; END $$ LANGUAGE plpgsql'
+    );
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE TRIGGER packages_search_vector_update BEFORE INSERT OR UPDATE OF name, description, keywords ' +
+      'ON packages FOR EACH ROW EXECUTE PROCEDURE packages_search_vector()'
+    );
+  })
+  .then(function () {
+    return knex.raw('UPDATE packages SET name = name');
+  })
+  .then(function () {
+    return knex.raw('CREATE INDEX packages_search_vector_index ON packages USING gin (search_vector)');
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw('DROP TRIGGER IF EXISTS packages_search_vector_update ON packages')
+    .then(function () {
+      return knex.raw('DROP FUNCTION IF EXISTS packages_search_vector()');
+    })
+    .then(function () {
+      return knex.schema.table('packages', function (table) {
+        table.dropColumn('search_vector');
+        table.dropColumn('keywords');
+      });
+    });
+};
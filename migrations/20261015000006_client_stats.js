@@ -0,0 +1,15 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('client_stats', function (table) {
+    table.date('day').notNullable();
+    table.text('client').notNullable();
+    table.text('version').notNullable();
+    table.bigInteger('requests').notNullable().defaultTo(0);
+    table.primary(['day', 'client', 'version']);
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('client_stats');
+};
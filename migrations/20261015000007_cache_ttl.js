@@ -0,0 +1,13 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.integer('cache_ttl');
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.dropColumn('cache_ttl');
+  });
+};
@@ -0,0 +1,27 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.raw(
+    'CREATE FUNCTION packages_notify_invalidation() RETURNS trigger AS $$ ' +
+    'DECLARE urls text[]; BEGIN ' +
+    "IF current_setting('registry.skip_invalidation', true) = 'on' THEN RETURN NULL; END IF; " +
+    "IF TG_OP = 'INSERT' THEN urls := ARRAY[NEW.url]; " +
+    "ELSIF TG_OP = 'DELETE' THEN urls := ARRAY[OLD.url]; " +
+    'ELSE urls := ARRAY[OLD.url, NEW.url]; END IF; ' +
+    "PERFORM pg_notify('registry_invalidations', json_build_object('keys', json_build_array('packages', 'packages_count'), 'urls', urls)::text); " +
+    'RETURN NULL; END $$ LANGUAGE plpgsql'
+  )
+  .then(function () {
+    return knex.raw(
+      'CREATE TRIGGER packages_notify_invalidation AFTER INSERT OR UPDATE OF name, url OR DELETE ' +
+      'ON packages FOR EACH ROW EXECUTE PROCEDURE packages_notify_invalidation()'
+    );
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw('DROP TRIGGER IF EXISTS packages_notify_invalidation ON packages')
+    .then(function () {
+      return knex.raw('DROP FUNCTION IF EXISTS packages_notify_invalidation()');
+    });
+};
@@ -0,0 +1,33 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.raw(
+    'CREATE FUNCTION packages_notify_event() RETURNS trigger AS $$ BEGIN ' +
+    "IF TG_OP = 'DELETE' THEN " +
+    "IF OLD.tenant = '' THEN PERFORM pg_notify('registry_events', json_build_object('type', 'deleted', 'name', OLD.name, 'url', OLD.url)::text); END IF; " +
+    'RETURN NULL; END IF; ' +
+    "IF NEW.tenant <> '' THEN RETURN NULL; END IF; " +
+    "IF TG_OP = 'INSERT' THEN " +
+    "PERFORM pg_notify('registry_events', json_build_object('type', 'created', 'name', NEW.name, 'url', NEW.url)::text); " +
+    'ELSIF OLD.name <> NEW.name THEN ' +
+    "PERFORM pg_notify('registry_events', json_build_object('type', 'updated', 'name', NEW.name, 'url', NEW.url, 'old_name', OLD.name)::text); " +
+    'ELSE ' +
+    "PERFORM pg_notify('registry_events', json_build_object('type', 'updated', 'name', NEW.name, 'url', NEW.url)::text); " +
+    'END IF; ' +
+    'RETURN NULL; END $$ LANGUAGE plpgsql'
+  )
+  .then(function () {
+    // Hits and URL check results change constantly and are left out.
+    return knex.raw(
+      'CREATE TRIGGER packages_notify_event AFTER INSERT OR UPDATE OF name, url, description, keywords OR DELETE ' +
+      'ON packages FOR EACH ROW EXECUTE PROCEDURE packages_notify_event()'
+    );
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw('DROP TRIGGER IF EXISTS packages_notify_event ON packages')
+    .then(function () {
+      return knex.raw('DROP FUNCTION IF EXISTS packages_notify_event()');
+    });
+};
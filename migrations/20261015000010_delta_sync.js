@@ -0,0 +1,82 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.timestamp('updated_at', true).defaultTo(knex.fn.now());
+  })
+  .then(function () {
+    return knex.raw('UPDATE packages SET updated_at = coalesce(created_at, now())');
+  })
+  .then(function () {
+    return knex.raw('CREATE INDEX packages_updated_at_index ON packages (updated_at, name)');
+  })
+  .then(function () {
+    return knex.schema.createTable('package_tombstones', function (table) {
+      table.text('name').primary();
+      table.text('url').notNullable();
+      table.timestamp('deleted_at', true).notNullable().defaultTo(knex.fn.now());
+      table.index(['deleted_at', 'name']);
+    });
+  })
+  .then(function () {
+    // clock_timestamp rather than now(), which is the start of the
+    // transaction, keeps the stamps close to when the changes commit.
+    return knex.raw(
+      'CREATE FUNCTION packages_touch() RETURNS trigger AS $$ BEGIN ' +
+      "IF TG_OP = 'INSERT' THEN NEW.updated_at := clock_timestamp(); " +
+      'ELSIF NEW.name IS DISTINCT FROM OLD.name OR NEW.url IS DISTINCT FROM OLD.url ' +
+      'OR NEW.description IS DISTINCT FROM OLD.description OR NEW.keywords IS DISTINCT FROM OLD.keywords THEN ' +
+      'NEW.updated_at := clock_timestamp(); END IF; ' +
+      'RETURN NEW; END $$ LANGUAGE plpgsql'
+    );
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE TRIGGER packages_touch BEFORE INSERT OR UPDATE ON packages ' +
+      'FOR EACH ROW EXECUTE PROCEDURE packages_touch()'
+    );
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE FUNCTION packages_tombstone() RETURNS trigger AS $$ BEGIN ' +
+      "IF TG_OP = 'DELETE' THEN " +
+      "IF OLD.tenant = '' THEN " +
+      'INSERT INTO package_tombstones (name, url, deleted_at) VALUES (OLD.name, OLD.url, clock_timestamp()) ' +
+      'ON CONFLICT (name) DO UPDATE SET url = excluded.url, deleted_at = excluded.deleted_at; ' +
+      'END IF; RETURN NULL; END IF; ' +
+      "IF NEW.tenant <> '' THEN RETURN NULL; END IF; " +
+      'DELETE FROM package_tombstones WHERE name = NEW.name; ' +
+      "IF TG_OP = 'UPDATE' AND OLD.name <> NEW.name THEN " +
+      'INSERT INTO package_tombstones (name, url, deleted_at) VALUES (OLD.name, OLD.url, clock_timestamp()) ' +
+      'ON CONFLICT (name) DO UPDATE SET url = excluded.url, deleted_at = excluded.deleted_at; ' +
+      'END IF; RETURN NULL; END $$ LANGUAGE plpgsql'
+    );
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE TRIGGER packages_tombstone AFTER INSERT OR UPDATE OF name OR DELETE ON packages ' +
+      'FOR EACH ROW EXECUTE PROCEDURE packages_tombstone()'
+    );
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw('DROP TRIGGER IF EXISTS packages_tombstone ON packages')
+    .then(function () {
+      return knex.raw('DROP FUNCTION IF EXISTS packages_tombstone()');
+    })
+    .then(function () {
+      return knex.raw('DROP TRIGGER IF EXISTS packages_touch ON packages');
+    })
+    .then(function () {
+      return knex.raw('DROP FUNCTION IF EXISTS packages_touch()');
+    })
+    .then(function () {
+      return knex.schema.dropTable('package_tombstones');
+    })
+    .then(function () {
+      return knex.schema.table('packages', function (table) {
+        table.dropColumn('updated_at');
+      });
+    });
+};
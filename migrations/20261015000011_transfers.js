@@ -0,0 +1,29 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('package_transfers', function (table) {
+    table.text('package').primary();
+    table.text('from_org').notNullable().references('organizations.name');
+    table.text('to_org').notNullable().references('organizations.name');
+    table.text('token_hash').notNullable();
+    table.timestamp('created_at', true).notNullable();
+    table.timestamp('expires_at', true).notNullable();
+  })
+  .then(function () {
+    return knex.schema.createTable('audit_log', function (table) {
+      table.bigIncrements('id');
+      table.timestamp('at', true).notNullable().defaultTo(knex.fn.now());
+      table.text('actor').notNullable();
+      table.text('action').notNullable();
+      table.text('package').index('audit_log_package_index');
+      table.text('detail');
+    });
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('audit_log')
+  .then(function () {
+    return knex.schema.dropTable('package_transfers');
+  });
+};
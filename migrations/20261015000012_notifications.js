@@ -0,0 +1,15 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('organizations', function (table) {
+    table.text('email');
+    table.boolean('notifications').notNullable().defaultTo(true);
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.table('organizations', function (table) {
+    table.dropColumn('notifications');
+    table.dropColumn('email');
+  });
+};
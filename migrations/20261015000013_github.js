@@ -0,0 +1,19 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.integer('stars').notNullable().defaultTo(0);
+    table.text('license');
+    table.boolean('archived').notNullable().defaultTo(false);
+    table.timestamp('enriched_at', true).index('packages_enriched_at_index');
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.dropColumn('stars');
+    table.dropColumn('license');
+    table.dropColumn('archived');
+    table.dropColumn('enriched_at');
+  });
+};
@@ -0,0 +1,15 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.text('deprecation_message');
+    table.text('deprecation_replacement');
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.dropColumn('deprecation_replacement');
+    table.dropColumn('deprecation_message');
+  });
+};
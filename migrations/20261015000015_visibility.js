@@ -0,0 +1,27 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('packages', function (table) {
+    table.text('visibility').notNullable().defaultTo('public');
+  })
+  .then(function () {
+    return knex.raw("ALTER TABLE packages ADD CONSTRAINT packages_visibility_check CHECK (visibility IN ('public', 'private'))");
+  })
+  .then(function () {
+    return knex.schema.createTable('api_keys', function (table) {
+      table.text('name').primary();
+      table.text('token_hash').notNullable().unique();
+      table.specificType('scopes', 'text[]').notNullable().defaultTo('{}');
+      table.timestamp('created_at', true).notNullable().defaultTo(knex.fn.now());
+    });
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('api_keys')
+  .then(function () {
+    return knex.schema.table('packages', function (table) {
+      table.dropColumn('visibility');
+    });
+  });
+};
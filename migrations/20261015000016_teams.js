@@ -0,0 +1,58 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.raw(
+    'CREATE TABLE organization_members (' +
+    'organization text NOT NULL REFERENCES organizations (name) ON DELETE CASCADE, ' +
+    'name text NOT NULL, ' +
+    'token_hash text NOT NULL UNIQUE, ' +
+    'created_at timestamptz NOT NULL DEFAULT now(), ' +
+    'PRIMARY KEY (organization, name))'
+  )
+  .then(function () {
+    return knex.raw(
+      'CREATE TABLE teams (' +
+      'organization text NOT NULL REFERENCES organizations (name) ON DELETE CASCADE, ' +
+      'name text NOT NULL, ' +
+      'created_at timestamptz NOT NULL DEFAULT now(), ' +
+      'PRIMARY KEY (organization, name))'
+    );
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE TABLE team_members (' +
+      'organization text NOT NULL, ' +
+      'team text NOT NULL, ' +
+      'member text NOT NULL, ' +
+      'PRIMARY KEY (organization, team, member), ' +
+      'FOREIGN KEY (organization, team) REFERENCES teams (organization, name) ON DELETE CASCADE, ' +
+      'FOREIGN KEY (organization, member) REFERENCES organization_members (organization, name) ON DELETE CASCADE)'
+    );
+  })
+  .then(function () {
+    // Grants only apply while the organization owns the package, so they
+    // don't reference packages and survive transfers harmlessly.
+    return knex.raw(
+      'CREATE TABLE team_packages (' +
+      'organization text NOT NULL, ' +
+      'team text NOT NULL, ' +
+      'package text NOT NULL, ' +
+      "permission text NOT NULL CHECK (permission IN ('read', 'maintain')), " +
+      'PRIMARY KEY (organization, team, package), ' +
+      'FOREIGN KEY (organization, team) REFERENCES teams (organization, name) ON DELETE CASCADE)'
+    );
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('team_packages')
+  .then(function () {
+    return knex.schema.dropTable('team_members');
+  })
+  .then(function () {
+    return knex.schema.dropTable('teams');
+  })
+  .then(function () {
+    return knex.schema.dropTable('organization_members');
+  });
+};
@@ -0,0 +1,18 @@
+'use strict';
+
+// Checksums belong to a repository and tag rather than to a package, so
+// they stay valid across renames and are ignored when a package moves.
+exports.up = function (knex, Promise) {
+  return knex.raw(
+    'CREATE TABLE versions (' +
+    'url text NOT NULL, ' +
+    'tag text NOT NULL, ' +
+    'sha256 text NOT NULL, ' +
+    'created_at timestamptz NOT NULL DEFAULT now(), ' +
+    'PRIMARY KEY (url, tag))'
+  );
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('versions');
+};
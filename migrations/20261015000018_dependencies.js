@@ -0,0 +1,20 @@
+'use strict';
+
+// Like checksums, dependencies are read from a repository and belong to
+// its URL; the packages declaring a dependency are found through it.
+exports.up = function (knex, Promise) {
+  return knex.raw(
+    'CREATE TABLE dependencies (' +
+    'url text NOT NULL, ' +
+    'name text NOT NULL, ' +
+    'version_range text NOT NULL, ' +
+    'dev boolean NOT NULL DEFAULT false, ' +
+    'PRIMARY KEY (url, name, dev))'
+  ).then(function () {
+    return knex.raw('CREATE INDEX dependencies_name_index ON dependencies (name)');
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('dependencies');
+};
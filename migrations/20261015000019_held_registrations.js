@@ -0,0 +1,15 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('held_registrations', function (table) {
+    table.text('name').primary();
+    table.text('url').notNullable();
+    table.text('similar_to').notNullable();
+    table.integer('distance').notNullable();
+    table.timestamp('created_at', true).notNullable().defaultTo(knex.fn.now());
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('held_registrations');
+};
@@ -0,0 +1,15 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('deprecated_requests', function (table) {
+    table.date('day').notNullable();
+    table.text('dimension').notNullable();
+    table.text('value').notNullable();
+    table.bigInteger('requests').notNullable().defaultTo(0);
+    table.primary(['day', 'dimension', 'value']);
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('deprecated_requests');
+};
@@ -0,0 +1,29 @@
+'use strict';
+
+// Invalidations name the changed packages too, so CDN keys can be purged
+// for packages that no longer exist.
+exports.up = function (knex, Promise) {
+  return knex.raw(
+    'CREATE OR REPLACE FUNCTION packages_notify_invalidation() RETURNS trigger AS $$ ' +
+    'DECLARE urls text[]; names text[]; BEGIN ' +
+    "IF current_setting('registry.skip_invalidation', true) = 'on' THEN RETURN NULL; END IF; " +
+    "IF TG_OP = 'INSERT' THEN urls := ARRAY[NEW.url]; names := ARRAY[NEW.name]; " +
+    "ELSIF TG_OP = 'DELETE' THEN urls := ARRAY[OLD.url]; names := ARRAY[OLD.name]; " +
+    'ELSE urls := ARRAY[OLD.url, NEW.url]; names := ARRAY[OLD.name, NEW.name]; END IF; ' +
+    "PERFORM pg_notify('registry_invalidations', json_build_object('keys', json_build_array('packages', 'packages_count'), 'packages', names, 'urls', urls)::text); " +
+    'RETURN NULL; END $$ LANGUAGE plpgsql'
+  );
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw(
+    'CREATE OR REPLACE FUNCTION packages_notify_invalidation() RETURNS trigger AS $$ ' +
+    'DECLARE urls text[]; BEGIN ' +
+    "IF current_setting('registry.skip_invalidation', true) = 'on' THEN RETURN NULL; END IF; " +
+    "IF TG_OP = 'INSERT' THEN urls := ARRAY[NEW.url]; " +
+    "ELSIF TG_OP = 'DELETE' THEN urls := ARRAY[OLD.url]; " +
+    'ELSE urls := ARRAY[OLD.url, NEW.url]; END IF; ' +
+    "PERFORM pg_notify('registry_invalidations', json_build_object('keys', json_build_array('packages', 'packages_count'), 'urls', urls)::text); " +
+    'RETURN NULL; END $$ LANGUAGE plpgsql'
+  );
+};
@@ -0,0 +1,65 @@
+'use strict';
+
+// Packages keep the lowercased URL of their repository in normalized_url,
+// unique per tenant, so a repository is registered once. GitHub URLs are
+// reduced to https://github.com/owner/repo there, as lib/normalizeURL.js and
+// the Go server do before storing new ones, so every form of a repository
+// gets the same key; url itself is left as it was registered. Of packages
+// that already share a repository only the oldest gets normalized_url;
+// GET /admin/duplicates lists the others. Restores and mirrors set
+// registry.skip_url_check to copy packages as they are.
+var github = "'^((git|git\\+ssh|ssh|https|http)://([^@/]+@|)(www\\.|)github\\.com(:[0-9]+|)/|git@(www\\.|)github\\.com:)/*'";
+
+exports.up = function (knex, Promise) {
+  return knex.raw(
+    'CREATE FUNCTION registry_normalized_url(url text) RETURNS text AS $$ SELECT lower(CASE ' +
+    'WHEN url ~* (' + github + " || '[^/]+/[^/]+/*$') " +
+    "THEN 'https://github.com/' || regexp_replace(regexp_replace(url, " + github + ", '', 'i'), '(\\.git|)/*$', '') " +
+    'ELSE url END) $$ LANGUAGE sql IMMUTABLE'
+  )
+  .then(function () {
+    return knex.raw('ALTER TABLE packages ADD COLUMN normalized_url text');
+  })
+  .then(function () {
+    return knex.raw(
+      'UPDATE packages SET normalized_url = registry_normalized_url(packages.url) FROM (' +
+      'SELECT id, row_number() OVER (PARTITION BY tenant, registry_normalized_url(url) ORDER BY created_at NULLS LAST, id) AS n FROM packages' +
+      ') ranked WHERE ranked.id = packages.id AND ranked.n = 1'
+    );
+  })
+  .then(function () {
+    return knex.raw('CREATE UNIQUE INDEX packages_normalized_url_unique ON packages (tenant, normalized_url)');
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE FUNCTION packages_normalized_url() RETURNS trigger AS $$ BEGIN ' +
+      "IF TG_OP = 'UPDATE' AND NEW.url IS NOT DISTINCT FROM OLD.url THEN RETURN NEW; END IF; " +
+      'NEW.normalized_url := registry_normalized_url(NEW.url); ' +
+      "IF current_setting('registry.skip_url_check', true) = 'on' AND EXISTS (" +
+      'SELECT 1 FROM packages WHERE tenant = NEW.tenant AND normalized_url = NEW.normalized_url AND id <> NEW.id' +
+      ') THEN NEW.normalized_url := NULL; END IF; ' +
+      'RETURN NEW; END $$ LANGUAGE plpgsql'
+    );
+  })
+  .then(function () {
+    return knex.raw(
+      'CREATE TRIGGER packages_normalized_url BEFORE INSERT OR UPDATE OF url ' +
+      'ON packages FOR EACH ROW EXECUTE PROCEDURE packages_normalized_url()'
+    );
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw('DROP TRIGGER IF EXISTS packages_normalized_url ON packages')
+    .then(function () {
+      return knex.raw('DROP FUNCTION IF EXISTS packages_normalized_url()');
+    })
+    .then(function () {
+      return knex.schema.table('packages', function (table) {
+        table.dropColumn('normalized_url');
+      });
+    })
+    .then(function () {
+      return knex.raw('DROP FUNCTION IF EXISTS registry_normalized_url(text)');
+    });
+};
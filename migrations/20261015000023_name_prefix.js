@@ -0,0 +1,11 @@
+'use strict';
+
+// Serves GET /packages/prefix/{prefix}: a byte-ordered index answers both
+// name LIKE 'prefix%' and ORDER BY name whatever the database collation.
+exports.up = function (knex, Promise) {
+  return knex.raw('CREATE INDEX packages_name_prefix_index ON packages (name COLLATE "C") WHERE tenant = \'\'');
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw('DROP INDEX IF EXISTS packages_name_prefix_index');
+};
@@ -0,0 +1,26 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.table('api_keys', function (table) {
+    table.integer('daily_quota').notNullable().defaultTo(0);
+    table.integer('total_quota').notNullable().defaultTo(0);
+  })
+  .then(function () {
+    return knex.schema.createTable('api_key_publications', function (table) {
+      table.text('key_name').notNullable().references('name').inTable('api_keys').onDelete('CASCADE');
+      table.text('package').notNullable();
+      table.timestamp('created_at', true).notNullable().defaultTo(knex.fn.now());
+      table.index(['key_name', 'created_at']);
+    });
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('api_key_publications')
+  .then(function () {
+    return knex.schema.table('api_keys', function (table) {
+      table.dropColumn('daily_quota');
+      table.dropColumn('total_quota');
+    });
+  });
+};
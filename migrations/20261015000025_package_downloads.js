@@ -0,0 +1,16 @@
+'use strict';
+
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('package_downloads', function (table) {
+    table.text('name').notNullable();
+    table.text('period').notNullable();
+    table.timestamp('start', true).notNullable();
+    table.bigInteger('downloads').notNullable().defaultTo(0);
+    table.primary(['name', 'period', 'start']);
+    table.index(['period', 'start']);
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('package_downloads');
+};
@@ -0,0 +1,65 @@
+'use strict';
+
+// Private packages are left out of the change events: none are sent for
+// them, a package made private is reported as deleted and one made public
+// again as created.
+
+var publicOnly =
+  'CREATE OR REPLACE FUNCTION packages_notify_event() RETURNS trigger AS $$ BEGIN ' +
+  "IF TG_OP = 'DELETE' THEN " +
+  "IF OLD.tenant = '' AND OLD.visibility <> 'private' THEN PERFORM pg_notify('registry_events', json_build_object('type', 'deleted', 'name', OLD.name, 'url', OLD.url)::text); END IF; " +
+  'RETURN NULL; END IF; ' +
+  "IF NEW.tenant <> '' THEN RETURN NULL; END IF; " +
+  "IF TG_OP = 'INSERT' THEN " +
+  "IF NEW.visibility <> 'private' THEN PERFORM pg_notify('registry_events', json_build_object('type', 'created', 'name', NEW.name, 'url', NEW.url)::text); END IF; " +
+  'RETURN NULL; END IF; ' +
+  "IF NEW.visibility = 'private' THEN " +
+  "IF OLD.visibility <> 'private' THEN PERFORM pg_notify('registry_events', json_build_object('type', 'deleted', 'name', OLD.name, 'url', OLD.url)::text); END IF; " +
+  'RETURN NULL; END IF; ' +
+  "IF OLD.visibility = 'private' THEN " +
+  "PERFORM pg_notify('registry_events', json_build_object('type', 'created', 'name', NEW.name, 'url', NEW.url)::text); " +
+  'ELSIF OLD.name <> NEW.name THEN ' +
+  "PERFORM pg_notify('registry_events', json_build_object('type', 'updated', 'name', NEW.name, 'url', NEW.url, 'old_name', OLD.name)::text); " +
+  'ELSE ' +
+  "PERFORM pg_notify('registry_events', json_build_object('type', 'updated', 'name', NEW.name, 'url', NEW.url)::text); " +
+  'END IF; ' +
+  'RETURN NULL; END $$ LANGUAGE plpgsql';
+
+var allPackages =
+  'CREATE OR REPLACE FUNCTION packages_notify_event() RETURNS trigger AS $$ BEGIN ' +
+  "IF TG_OP = 'DELETE' THEN " +
+  "IF OLD.tenant = '' THEN PERFORM pg_notify('registry_events', json_build_object('type', 'deleted', 'name', OLD.name, 'url', OLD.url)::text); END IF; " +
+  'RETURN NULL; END IF; ' +
+  "IF NEW.tenant <> '' THEN RETURN NULL; END IF; " +
+  "IF TG_OP = 'INSERT' THEN " +
+  "PERFORM pg_notify('registry_events', json_build_object('type', 'created', 'name', NEW.name, 'url', NEW.url)::text); " +
+  'ELSIF OLD.name <> NEW.name THEN ' +
+  "PERFORM pg_notify('registry_events', json_build_object('type', 'updated', 'name', NEW.name, 'url', NEW.url, 'old_name', OLD.name)::text); " +
+  'ELSE ' +
+  "PERFORM pg_notify('registry_events', json_build_object('type', 'updated', 'name', NEW.name, 'url', NEW.url)::text); " +
+  'END IF; ' +
+  'RETURN NULL; END $$ LANGUAGE plpgsql';
+
+function createTrigger(knex, columns) {
+  return knex.raw('DROP TRIGGER IF EXISTS packages_notify_event ON packages')
+    .then(function () {
+      return knex.raw(
+        'CREATE TRIGGER packages_notify_event AFTER INSERT OR UPDATE OF ' + columns + ' OR DELETE ' +
+        'ON packages FOR EACH ROW EXECUTE PROCEDURE packages_notify_event()'
+      );
+    });
+}
+
+exports.up = function (knex, Promise) {
+  return knex.raw(publicOnly)
+    .then(function () {
+      return createTrigger(knex, 'name, url, description, keywords, visibility');
+    });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.raw(allPackages)
+    .then(function () {
+      return createTrigger(knex, 'name, url, description, keywords');
+    });
+};
@@ -0,0 +1,15 @@
+'use strict';
+
+// Feature flags switched through the admin API, overriding FEATURE_FLAGS on
+// every instance. Flags that were never switched, or were reset, have no row.
+exports.up = function (knex, Promise) {
+  return knex.schema.createTable('feature_flags', function (table) {
+    table.text('name').primary();
+    table.boolean('enabled').notNullable();
+    table.timestamp('updated_at', true).notNullable().defaultTo(knex.fn.now());
+  });
+};
+
+exports.down = function (knex, Promise) {
+  return knex.schema.dropTable('feature_flags');
+};
@@ -0,0 +1,103 @@
+package registry
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The admin API lives under /admin/ and is enabled by setting ADMIN_TOKEN
+// or OIDC_ISSUER. Requests authenticate with "Authorization: Bearer <token>"
+// or, with OIDC, an admin session, see auth.go.
+
+type adminRoute struct {
+	// op.Path matches exactly, or by the prefix before its first {param}.
+	op     apiOperation
+	handle func(r *http.Request) *http.Response
+}
+
+func (s *Server) adminRoutes() []adminRoute {
+	return []adminRoute{
+		{apiOperation{Method: http.MethodGet, Path: "/admin/", Summary: "Admin dashboard", Auth: true}, s.serveDashboard},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/aliases", Summary: "List aliases", Result: []Alias{}, Auth: true}, s.listAliases},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/aliases", Summary: "Create an alias", Body: Alias{}, Result: Alias{}, Auth: true}, s.createAlias},
+		{apiOperation{Method: http.MethodDelete, Path: "/admin/aliases/{alias}", Summary: "Delete an alias", Auth: true}, s.deleteAlias},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/api-keys", Summary: "List API keys", Result: []APIKey{}, Auth: true}, s.listAPIKeys},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/api-keys", Summary: "Create an API key; its token is only returned once", Body: APIKey{}, Result: createdAPIKey{}, Auth: true}, s.createAPIKey},
+		{apiOperation{Method: http.MethodDelete, Path: "/admin/api-keys/{name}", Summary: "Delete an API key", Auth: true}, s.deleteAPIKey},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/audit-log", Summary: "Audit log, newest first", Query: []string{"package", "limit"}, Result: []AuditEntry{}, Auth: true}, s.listAuditLog},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/cache/gc", Summary: "Evict the cached entries about removed packages now", Result: CacheGCReport{}, Auth: true}, s.runCacheGC},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/cache/invalidate", Summary: "Invalidate cached entries on every instance", Body: invalidation{}, Result: invalidation{}, Auth: true}, s.invalidateCache},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/clients", Summary: "Requests per client version and day", Query: []string{"days"}, Result: []ClientStat{}, Auth: true}, s.listClientStats},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/deprecated-traffic", Summary: "Requests to the deprecated hosts per day by client, referer and package", Query: []string{"days"}, Result: []DeprecatedTrafficDay{}, Auth: true}, s.listDeprecatedTraffic},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/duplicates", Summary: "Repositories registered as several packages", Result: []DuplicateRepository{}, Auth: true}, s.listDuplicates},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/export", Summary: "Export the packages of every tenant as CSV or NDJSON", Query: []string{"format"}, Auth: true}, s.exportPackages},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/flags", Summary: "List feature flags", Result: []FeatureFlag{}, Auth: true}, s.listFeatureFlags},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/flags/{name}", Summary: "Switch a feature flag on this instance", Body: flagSwitch{}, Result: FeatureFlag{}, Auth: true}, s.setFeatureFlag},
+		{apiOperation{Method: http.MethodDelete, Path: "/admin/flags/{name}", Summary: "Return a feature flag to its configured value", Result: FeatureFlag{}, Auth: true}, s.setFeatureFlag},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/import", Summary: "Import packages from CSV or NDJSON, creating and updating them", Query: []string{"format", "dry_run"}, Result: ImportReport{}, Auth: true}, s.importPackages},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/logging", Summary: "Show the log levels and sampling rates", Result: LogSettings{}, Auth: true}, s.getLogSettings},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/logging", Summary: "Change the log levels and sampling rates on this instance", Body: LogSettings{}, Result: LogSettings{}, Auth: true}, s.setLogSettings},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/packages/{name}/url", Summary: "Move a package to another repository", Body: packageURL{}, Result: packageURL{}, Auth: true}, s.setPackageURL},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/read-only", Summary: "Show read-only mode", Result: readOnlyMode{}, Auth: true}, s.getReadOnly},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/read-only", Summary: "Switch read-only mode", Body: readOnlyMode{}, Result: readOnlyMode{}, Auth: true}, s.setReadOnly},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/recordings", Summary: "Recorded requests and responses, newest first", Query: []string{"limit"}, Result: []RecordedExchange{}, Auth: true}, s.listRecordings},
+		{apiOperation{Method: http.MethodDelete, Path: "/admin/recordings", Summary: "Clear the recorded requests", Auth: true}, s.clearRecordings},
+		{apiOperation{Method: http.MethodGet, Path: "/admin/registrations", Summary: "List registrations held because their name is close to a popular package", Result: []HeldRegistration{}, Auth: true}, s.listHeldRegistrations},
+		{apiOperation{Method: http.MethodPost, Path: "/admin/registrations/{name}", Summary: "Approve a held registration", Result: HeldRegistration{}, Auth: true}, s.approveRegistration},
+		{apiOperation{Method: http.MethodDelete, Path: "/admin/registrations/{name}", Summary: "Dismiss a held registration", Auth: true}, s.rejectRegistration},
+	}
+}
+
+func (route adminRoute) matches(r *http.Request) bool {
+	if route.op.Method != r.Method {
+		return false
+	}
+	if i := strings.IndexByte(route.op.Path, '{'); i >= 0 {
+		return strings.HasPrefix(r.URL.Path, route.op.Path[:i])
+	}
+	return r.URL.Path == route.op.Path
+}
+
+func (s *Server) adminOperations() []apiOperation {
+	routes := s.adminRoutes()
+	ops := make([]apiOperation, len(routes))
+	for i, route := range routes {
+		ops[i] = route.op
+	}
+	return ops
+}
+
+func (s *Server) adminHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !strings.HasPrefix(r.URL.Path, "/admin/") {
+		return r, nil
+	}
+	if len(s.auth) == 0 {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+	}
+	if response := s.oidcHandler(r); response != nil {
+		return r, response
+	}
+	if response := s.sessionHandler(r); response != nil {
+		return r, response
+	}
+	if response := dashboardAsset(r); response != nil {
+		return r, response
+	}
+	if !s.isAdmin(r) {
+		if r.Method == http.MethodGet && strings.Contains(r.Header.Get("Accept"), "text/html") {
+			response := goproxy.NewResponse(r, "text/html", http.StatusFound, "")
+			response.Header.Set("Location", "/admin/login")
+			return r, response
+		}
+		return r, goproxy.NewResponse(r, "text/html", http.StatusUnauthorized, "Invalid admin token")
+	}
+
+	for _, route := range s.adminRoutes() {
+		if route.matches(r) {
+			return r, route.handle(r)
+		}
+	}
+	return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+}
@@ -0,0 +1,54 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Alias maps an additional name onto a registered package.
+type Alias struct {
+	Alias   string `json:"alias"`
+	Package string `json:"package"`
+}
+
+func (s *Server) listAliases(r *http.Request) *http.Response {
+	aliases, err := s.store.ListAliases()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return jsonResponse(r, http.StatusOK, aliases)
+}
+
+func (s *Server) createAlias(r *http.Request) *http.Response {
+	var a Alias
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if err := validatePackageName(a.Alias); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid alias. "+err.Error())
+	}
+	switch err := s.store.CreateAlias(a); err {
+	case nil:
+		return jsonResponse(r, http.StatusCreated, a)
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "Alias already exists")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Package not found or alias is a registered package")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) deleteAlias(r *http.Request) *http.Response {
+	switch err := s.store.DeleteAlias(strings.TrimPrefix(r.URL.Path, "/admin/aliases/")); err {
+	case nil:
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Alias not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
@@ -0,0 +1,235 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testAdminToken is the ADMIN_TOKEN of the registries under test.
+const testAdminToken = "test-admin-token"
+
+// testRegistry serves a Server over httptest. Requests are sent for
+// registry.bower.io, so the deprecated host handlers leave them alone.
+type testRegistry struct {
+	server *Server
+	http   *httptest.Server
+}
+
+// newTestRegistry serves store and cache with the configuration of the
+// environment, registering packages natively instead of through the
+// sidecar.
+func newTestRegistry(t *testing.T, store Store, cache Cache) *testRegistry {
+	cfg, err := LoadServerConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.adminToken = testAdminToken
+	disabled := sidecarDisabled
+	sidecarDisabled = true
+
+	s := NewServer(store, cache, cfg)
+	s.listenForInvalidations()
+	r := &testRegistry{server: s, http: httptest.NewServer(s)}
+	t.Cleanup(func() {
+		r.http.Close()
+		sidecarDisabled = disabled
+	})
+	return r
+}
+
+// do sends a request, with form as its body if set, and returns the
+// response with its body read.
+func (r *testRegistry) do(t *testing.T, method, path string, form url.Values, admin bool) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(method, r.http.URL+path, strings.NewReader(form.Encode()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return r.send(t, req, admin)
+}
+
+func (r *testRegistry) send(t *testing.T, req *http.Request, admin bool) (*http.Response, string) {
+	t.Helper()
+	req.Host = "registry.bower.io"
+	if admin {
+		req.Header.Set("Authorization", "Bearer "+testAdminToken)
+	}
+	resp, err := r.http.Client().Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return resp, string(data)
+}
+
+// listed reports whether GET /packages lists name.
+func (r *testRegistry) listed(t *testing.T, name string) bool {
+	t.Helper()
+	resp, body := r.do(t, http.MethodGet, "/packages", nil, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("GET /packages: %d %s", resp.StatusCode, body)
+	}
+	var packages []Package
+	if err := json.Unmarshal([]byte(body), &packages); err != nil {
+		t.Fatalf("GET /packages: %s", err)
+	}
+	for _, p := range packages {
+		if p.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// eventually retries cond for a few seconds, as the package list is
+// refreshed in the background after changes.
+func (r *testRegistry) eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// gitRepository serves an empty bare repository over git's dumb HTTP
+// protocol, for registrations to reach, and returns its URL.
+func gitRepository(t *testing.T) string {
+	dir := t.TempDir()
+	repo := filepath.Join(dir, "repo.git")
+	if git, err := exec.LookPath("git"); err == nil {
+		for _, args := range [][]string{{"init", "-q", "--bare", repo}, {"--git-dir", repo, "update-server-info"}} {
+			if out, err := exec.Command(git, args...).CombinedOutput(); err != nil {
+				t.Fatalf("git %s: %s: %s", args[0], err, out)
+			}
+		}
+	}
+	srv := httptest.NewServer(http.FileServer(http.Dir(dir)))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/repo.git"
+}
+
+// testAPI runs the scenarios every store has to pass on an empty store.
+func testAPI(t *testing.T, store Store, cache Cache) {
+	r := newTestRegistry(t, store, cache)
+	t.Run("Lookup", func(t *testing.T) { testLookup(t, r) })
+	t.Run("List", func(t *testing.T) { testList(t, r) })
+	t.Run("Register", func(t *testing.T) { testRegister(t, r) })
+	t.Run("Invalidation", func(t *testing.T) { testInvalidation(t, r) })
+}
+
+func testLookup(t *testing.T, r *testRegistry) {
+	if err := r.server.store.InsertPackage("lookup-pkg", "https://github.com/bower/lookup-pkg"); err != nil {
+		t.Fatal(err)
+	}
+	resp, body := r.do(t, http.MethodGet, "/packages/lookup-pkg", nil, false)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("lookup: %d %s", resp.StatusCode, body)
+	}
+	var p Package
+	if err := json.Unmarshal([]byte(body), &p); err != nil {
+		t.Fatal(err)
+	}
+	if p.Name != "lookup-pkg" || p.URL != "https://github.com/bower/lookup-pkg" {
+		t.Errorf("lookup returned %+v", p)
+	}
+
+	if resp, body := r.do(t, http.MethodGet, "/packages/missing-pkg", nil, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("lookup of a missing package: %d %s", resp.StatusCode, body)
+	}
+}
+
+func testList(t *testing.T, r *testRegistry) {
+	if err := r.server.store.InsertPackage("list-pkg", "https://github.com/bower/list-pkg"); err != nil {
+		t.Fatal(err)
+	}
+	r.server.packagesChanged()
+	r.eventually(t, "list-pkg is listed", func() bool { return r.listed(t, "list-pkg") })
+}
+
+func testRegister(t *testing.T, r *testRegistry) {
+	repo := gitRepository(t)
+	form := url.Values{"name": {"register-pkg"}, "url": {repo}}
+	if resp, body := r.do(t, http.MethodPost, "/packages", form, false); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("register: %d %s", resp.StatusCode, body)
+	}
+	if resp, body := r.do(t, http.MethodGet, "/packages/register-pkg", nil, false); resp.StatusCode != http.StatusOK || !strings.Contains(body, repo) {
+		t.Errorf("lookup after registering: %d %s", resp.StatusCode, body)
+	}
+	r.eventually(t, "register-pkg is listed", func() bool { return r.listed(t, "register-pkg") })
+
+	for _, c := range []struct {
+		form url.Values
+		code int
+	}{
+		{url.Values{"name": {"register-pkg"}, "url": {repo}}, http.StatusForbidden},
+		{url.Values{"name": {"register-again"}, "url": {repo}}, http.StatusForbidden},
+		{url.Values{"name": {"Bad--Name"}, "url": {repo}}, http.StatusBadRequest},
+		{url.Values{"name": {"top"}, "url": {repo}}, http.StatusBadRequest},
+		{url.Values{"name": {"bad-url"}, "url": {"-oProxyCommand=true"}}, http.StatusBadRequest},
+	} {
+		if resp, body := r.do(t, http.MethodPost, "/packages", c.form, false); resp.StatusCode != c.code {
+			t.Errorf("register %s: got %d %s, want %d", c.form.Encode(), resp.StatusCode, body, c.code)
+		}
+	}
+
+	if resp, body := r.do(t, http.MethodDelete, "/packages/register-pkg", nil, false); resp.StatusCode != http.StatusForbidden {
+		t.Errorf("unregister without a token: %d %s", resp.StatusCode, body)
+	}
+	if resp, body := r.do(t, http.MethodDelete, "/packages/register-pkg", nil, true); resp.StatusCode != http.StatusNoContent {
+		t.Fatalf("unregister: %d %s", resp.StatusCode, body)
+	}
+	if resp, _ := r.do(t, http.MethodGet, "/packages/register-pkg", nil, false); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("lookup after unregistering: %d", resp.StatusCode)
+	}
+	r.eventually(t, "register-pkg is no longer listed", func() bool { return !r.listed(t, "register-pkg") })
+}
+
+func testInvalidation(t *testing.T, r *testRegistry) {
+	r.eventually(t, "the package list is cached", func() bool {
+		_, err := r.server.cache.Get("packages")
+		return r.listed(t, "list-pkg") && err == nil
+	})
+
+	req, err := http.NewRequest(http.MethodPost, r.http.URL+"/admin/cache/invalidate", strings.NewReader(`{"keys":["packages"]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if resp, body := r.send(t, req, true); resp.StatusCode != http.StatusAccepted {
+		t.Fatalf("invalidate: %d %s", resp.StatusCode, body)
+	}
+	// Stores that broadcast apply the invalidation once it comes back.
+	r.eventually(t, "the package list is dropped", func() bool {
+		_, err := r.server.cache.Get("packages")
+		return err != nil
+	})
+	if !r.listed(t, "list-pkg") {
+		t.Error("list-pkg is not listed after the invalidation")
+	}
+}
+
+func TestAPIMemory(t *testing.T) {
+	store, err := openMemory("", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	testAPI(t, store, newMemoryCache())
+}
@@ -0,0 +1,190 @@
+package registry
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /packages/{name}/archive/{version} lets consumers without git download a
+// tagged version of a GitHub repository. It redirects to codeload, or with
+// ARCHIVE_PROXY=true streams the archive through the registry for networks
+// that can't reach GitHub directly, optionally from the artifact cache.
+
+var archiveOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/packages/{name}/archive/{version}", Summary: "Download a version as a tarball or, with format=zip, a zip", Query: []string{"format"}},
+}
+
+// archiveClient has no overall timeout, since archives can be large, but
+// gives up on upstreams that don't answer.
+var archiveClient = &http.Client{
+	Transport: &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: 30 * time.Second,
+	},
+}
+
+func archivePath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/") && strings.Contains(req.URL.Path, "/archive/")
+	}
+}
+
+func (s *Server) serveArchive(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	path := strings.TrimPrefix(r.URL.Path, "/packages/")
+	i := strings.LastIndex(path, "/archive/")
+	name, version := path[:i], path[i+len("/archive/"):]
+	if version == "" || strings.Contains(version, "/") {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+	}
+	format := "tar.gz"
+	switch r.URL.Query().Get("format") {
+	case "", "tar.gz", "tgz":
+	case "zip":
+		format = "zip"
+	default:
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid format, expected tar.gz or zip")
+	}
+
+	pkg, err := s.readPackage(r, name)
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if _, _, ok := parseGitHubURL(pkg.URL); !ok {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Archives are only available for GitHub repositories")
+	}
+	tag, err := findTag(pkg.URL, version)
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Version not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not list repository tags")
+	}
+	archive, _ := githubArchiveURL(pkg.URL, format, tag)
+
+	if !s.config.archiveProxy {
+		response := goproxy.NewResponse(r, "text/html", http.StatusFound, "")
+		response.Header.Set("Location", archive)
+		response.Header.Set("Cache-Control", cacheControl(pkg, int(tagCacheTTL.Seconds())))
+		return r, response
+	}
+	response := s.streamArchive(r, archive, format)
+	if response.StatusCode == http.StatusOK {
+		response.Header.Set("Cache-Control", cacheControl(pkg, int(tagCacheTTL.Seconds())))
+	}
+	return r, response
+}
+
+// findTag returns the tag of version, given as the tag itself, as a
+// version with or without the v prefix, or as "latest".
+func findTag(repoURL, version string) (string, error) {
+	tags, err := repoTags(repoURL)
+	if err != nil {
+		return "", err
+	}
+	for _, tag := range tags {
+		if tag == version {
+			return tag, nil
+		}
+	}
+	versions, err := repoVersions(repoURL)
+	if err != nil {
+		return "", err
+	}
+	if version == "latest" {
+		if v, ok := latestVersion(versions); ok {
+			return v.Tag, nil
+		}
+		return "", ErrNotFound
+	}
+	want, ok := parseVersion(version)
+	if !ok {
+		return "", ErrNotFound
+	}
+	for _, v := range versions {
+		if compareVersions(v, want) == 0 {
+			return v.Tag, nil
+		}
+	}
+	return "", ErrNotFound
+}
+
+// streamArchive passes the archive at url through to the client, keeping
+// only the headers that describe it, and serves it from the artifact cache
+// when there is one.
+func (s *Server) streamArchive(r *http.Request, archive, format string) *http.Response {
+	header := http.Header{}
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(tagCacheTTL.Seconds())))
+	key := artifactKey(archive)
+	if s.artifacts != nil && key != "" {
+		if data := s.artifacts.get(key); data != nil {
+			header.Set("Content-Type", archiveContentTypes[format])
+			header.Set("X-Cache", "HIT")
+			return archiveResponse(r, header, ioutil.NopCloser(bytes.NewReader(data)), int64(len(data)))
+		}
+	}
+
+	upstream, err := archiveClient.Get(archive)
+	if err != nil {
+		archiveLog.Warnf("Could not fetch %s: %s", archive, err)
+		return goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not fetch the archive")
+	}
+	if upstream.StatusCode != http.StatusOK {
+		upstream.Body.Close()
+		archiveLog.Warnf("Could not fetch %s: %s", archive, upstream.Status)
+		return goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not fetch the archive")
+	}
+	metrics.Add("archive_proxied", 1)
+	for _, name := range []string{"Content-Type", "Content-Length", "Content-Disposition", "ETag", "Last-Modified"} {
+		if value := upstream.Header.Get(name); value != "" {
+			header.Set(name, value)
+		}
+	}
+	body := upstream.Body
+	if s.artifacts != nil && key != "" {
+		header.Set("X-Cache", "MISS")
+		cache := s.artifacts
+		body = &cachingBody{ReadCloser: body, limit: cache.maxSize / 10, done: func(data []byte) {
+			cache.put(key, data)
+		}}
+	}
+	return archiveResponse(r, header, body, upstream.ContentLength)
+}
+
+var archiveContentTypes = map[string]string{
+	"tar.gz": "application/x-gzip",
+	"zip":    "application/zip",
+}
+
+// artifactKey turns a codeload URL into owner/repo/format/tag, or "" for
+// names that can't be stored safely.
+func artifactKey(archive string) string {
+	key := strings.TrimPrefix(archive, "https://codeload.github.com/")
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return ""
+		}
+	}
+	return key
+}
+
+func archiveResponse(r *http.Request, header http.Header, body io.ReadCloser, length int64) *http.Response {
+	return &http.Response{
+		Request:       r,
+		StatusCode:    http.StatusOK,
+		Status:        "200 OK",
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		Body:          body,
+		ContentLength: length,
+	}
+}
@@ -0,0 +1,290 @@
+package registry
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Archives streamed with ARCHIVE_PROXY=true can be kept in an artifact
+// cache, in ARTIFACT_CACHE_DIR or in the bucket ARTIFACT_CACHE_BUCKET, so
+// that popular versions are fetched from GitHub once. The least recently
+// used archives are evicted when the cache grows past ARTIFACT_CACHE_SIZE.
+
+type artifactBackend interface {
+	get(key string) ([]byte, error)
+	put(key string, data []byte) error
+	delete(key string) error
+	// list returns what is cached, oldest first.
+	list() ([]artifactEntry, error)
+}
+
+type artifactEntry struct {
+	key  string
+	size int64
+}
+
+// diskArtifacts keeps archives as files below dir.
+type diskArtifacts struct {
+	dir string
+}
+
+func (d diskArtifacts) path(key string) string {
+	return filepath.Join(d.dir, filepath.FromSlash(key))
+}
+
+func (d diskArtifacts) get(key string) ([]byte, error) {
+	return ioutil.ReadFile(d.path(key))
+}
+
+func (d diskArtifacts) put(key string, data []byte) error {
+	path := d.path(key)
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), ".artifact")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func (d diskArtifacts) delete(key string) error {
+	return os.Remove(d.path(key))
+}
+
+func (d diskArtifacts) list() ([]artifactEntry, error) {
+	type file struct {
+		artifactEntry
+		modified time.Time
+	}
+	var files []file
+	err := filepath.Walk(d.dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == d.dir {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() || strings.HasPrefix(info.Name(), ".artifact") {
+			return nil
+		}
+		rel, err := filepath.Rel(d.dir, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, file{artifactEntry{filepath.ToSlash(rel), info.Size()}, info.ModTime()})
+		return nil
+	})
+	sort.Slice(files, func(i, j int) bool { return files[i].modified.Before(files[j].modified) })
+	entries := make([]artifactEntry, len(files))
+	for i, f := range files {
+		entries[i] = f.artifactEntry
+	}
+	return entries, err
+}
+
+// s3Artifacts keeps archives in a bucket below prefix.
+type s3Artifacts struct {
+	client *s3Client
+	prefix string
+}
+
+func (b s3Artifacts) get(key string) ([]byte, error) {
+	return b.client.get(b.prefix + key)
+}
+
+func (b s3Artifacts) put(key string, data []byte) error {
+	return b.client.put(b.prefix+key, data, "application/octet-stream")
+}
+
+func (b s3Artifacts) delete(key string) error {
+	return b.client.delete(b.prefix + key)
+}
+
+func (b s3Artifacts) list() ([]artifactEntry, error) {
+	objects, err := b.client.listObjects(b.prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(objects, func(i, j int) bool { return objects[i].LastModified.Before(objects[j].LastModified) })
+	entries := make([]artifactEntry, len(objects))
+	for i, o := range objects {
+		entries[i] = artifactEntry{strings.TrimPrefix(o.Key, b.prefix), o.Size}
+	}
+	return entries, nil
+}
+
+// artifactCache indexes the backend in memory, most recently used first.
+type artifactCache struct {
+	backend artifactBackend
+	maxSize int64
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	size    int64
+}
+
+// loadArtifactCache reads the ARTIFACT_CACHE_* environment and indexes
+// what is already cached. It returns nil when no cache is configured.
+func loadArtifactCache() (*artifactCache, error) {
+	var backend artifactBackend
+	if dir := getEnv("ARTIFACT_CACHE_DIR", ""); dir != "" {
+		backend = diskArtifacts{dir: dir}
+	} else if bucket := getEnv("ARTIFACT_CACHE_BUCKET", ""); bucket != "" {
+		backend = s3Artifacts{
+			client: newS3Client(
+				getEnv("ARTIFACT_CACHE_ENDPOINT", "https://s3.amazonaws.com"),
+				bucket,
+				getEnv("ARTIFACT_CACHE_REGION", "us-east-1"),
+				getEnv("ARTIFACT_CACHE_ACCESS_KEY_ID", ""),
+				getEnv("ARTIFACT_CACHE_SECRET_ACCESS_KEY", ""),
+			),
+			prefix: getEnv("ARTIFACT_CACHE_PREFIX", "archives/"),
+		}
+	} else {
+		return nil, nil
+	}
+	maxSize, err := strconv.ParseInt(getEnv("ARTIFACT_CACHE_SIZE", "10737418240"), 10, 64)
+	if err != nil || maxSize <= 0 {
+		return nil, fmt.Errorf("Invalid ARTIFACT_CACHE_SIZE, expected a number of bytes")
+	}
+
+	c := &artifactCache{backend: backend, maxSize: maxSize, lru: list.New(), entries: map[string]*list.Element{}}
+	existing, err := backend.list()
+	if err != nil {
+		return nil, fmt.Errorf("Could not list the artifact cache: %s", err)
+	}
+	for _, e := range existing {
+		c.add(e)
+	}
+	c.evict()
+	return c, nil
+}
+
+// get returns a cached archive, or nil.
+func (c *artifactCache) get(key string) []byte {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if ok {
+		c.lru.MoveToFront(el)
+	}
+	c.mu.Unlock()
+	if !ok {
+		metrics.Add("artifact_cache_misses", 1)
+		return nil
+	}
+	data, err := c.backend.get(key)
+	if err != nil {
+		archiveLog.Warnf("Could not read %s from the artifact cache: %s", key, err)
+		c.forget(key)
+		metrics.Add("artifact_cache_misses", 1)
+		return nil
+	}
+	metrics.Add("artifact_cache_hits", 1)
+	return data
+}
+
+// put stores an archive unless it would take more than a tenth of the
+// cache.
+func (c *artifactCache) put(key string, data []byte) {
+	if int64(len(data)) > c.maxSize/10 {
+		return
+	}
+	if err := c.backend.put(key, data); err != nil {
+		archiveLog.Warnf("Could not write %s to the artifact cache: %s", key, err)
+		return
+	}
+	c.mu.Lock()
+	c.add(artifactEntry{key, int64(len(data))})
+	c.mu.Unlock()
+	c.evict()
+}
+
+// add indexes e as the most recently used archive; c.mu must be held once
+// the cache is shared.
+func (c *artifactCache) add(e artifactEntry) {
+	if el, ok := c.entries[e.key]; ok {
+		c.size -= el.Value.(artifactEntry).size
+		c.lru.Remove(el)
+	}
+	c.entries[e.key] = c.lru.PushFront(e)
+	c.size += e.size
+}
+
+func (c *artifactCache) forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.size -= el.Value.(artifactEntry).size
+		c.lru.Remove(el)
+		delete(c.entries, key)
+	}
+}
+
+// evict deletes the least recently used archives until the cache fits.
+func (c *artifactCache) evict() {
+	for {
+		c.mu.Lock()
+		el := c.lru.Back()
+		if el == nil || c.size <= c.maxSize {
+			c.mu.Unlock()
+			return
+		}
+		e := el.Value.(artifactEntry)
+		c.lru.Remove(el)
+		delete(c.entries, e.key)
+		c.size -= e.size
+		c.mu.Unlock()
+
+		if err := c.backend.delete(e.key); err != nil && !os.IsNotExist(err) {
+			archiveLog.Warnf("Could not evict %s from the artifact cache: %s", e.key, err)
+		}
+		metrics.Add("artifact_cache_evictions", 1)
+	}
+}
+
+// cachingBody passes a streamed archive through and stores it once it has
+// been read to the end.
+type cachingBody struct {
+	io.ReadCloser
+	buf   bytes.Buffer
+	limit int64
+	done  func([]byte)
+}
+
+func (b *cachingBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if b.done != nil {
+		if int64(b.buf.Len()+n) > b.limit {
+			b.done = nil
+			b.buf = bytes.Buffer{}
+		} else {
+			b.buf.Write(p[:n])
+		}
+	}
+	if err == io.EOF && b.done != nil {
+		go b.done(b.buf.Bytes())
+		b.done = nil
+	}
+	return n, err
+}
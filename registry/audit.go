@@ -0,0 +1,46 @@
+package registry
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// AuditEntry records who did what to a package. Actors are named by kind,
+// e.g. org:acme.
+type AuditEntry struct {
+	At      time.Time `json:"at"`
+	Actor   string    `json:"actor"`
+	Action  string    `json:"action"`
+	Package string    `json:"package,omitempty"`
+	Detail  string    `json:"detail,omitempty"`
+}
+
+// audit records an action that already happened, so failures are only
+// logged.
+func (s *Server) audit(actor, action, pkg, detail string) {
+	e := AuditEntry{At: time.Now().UTC(), Actor: actor, Action: action, Package: pkg, Detail: detail}
+	if err := s.store.RecordAudit(e); err != nil {
+		authLog.Errorf("Could not record %s of %s in the audit log: %s", action, pkg, err)
+	}
+}
+
+func (s *Server) listAuditLog(r *http.Request) *http.Response {
+	limit := 100
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > 1000 {
+			return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid limit, the maximum is 1000")
+		}
+	}
+	entries, err := s.store.AuditLog(r.URL.Query().Get("package"), limit)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	if entries == nil {
+		entries = []AuditEntry{}
+	}
+	return jsonResponse(r, http.StatusOK, entries)
+}
@@ -0,0 +1,175 @@
+package registry
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Admins authenticate through one or more auth providers: the static
+// ADMIN_TOKEN and, with OIDC_ISSUER set, single sign-on through an OpenID
+// Connect identity provider, see oidc.go. The admin API is disabled when no
+// provider is configured. Browsers sign in to the dashboard at /admin/login
+// and then send a signed session cookie instead; API clients send the
+// token in the Authorization header.
+
+// sessionCookie holds the session of a signed in admin.
+const sessionCookie = "registry_admin"
+
+type authProvider interface {
+	// Authenticate returns the actor r authenticates as, e.g. "admin" or
+	// "admin:alice@example.com", or "" when the provider doesn't know r.
+	Authenticate(r *http.Request) (string, error)
+}
+
+// tokenAuth accepts the static admin token, or a session signed with it
+// at /admin/login; changing the token ends those sessions.
+type tokenAuth string
+
+func (t tokenAuth) Authenticate(r *http.Request) (string, error) {
+	if token := requestToken(r); token != "" {
+		if !t.matches(token) {
+			return "", nil
+		}
+		return "admin", nil
+	}
+	if identity, ok := sessionIdentity(r, string(t)); !ok || identity != "admin" {
+		return "", nil
+	}
+	return "admin", nil
+}
+
+func (t tokenAuth) matches(token string) bool {
+	return subtle.ConstantTimeCompare([]byte(token), []byte(t)) == 1
+}
+
+func newAuthProviders(cfg ServerConfig) []authProvider {
+	var providers []authProvider
+	if cfg.adminToken != "" {
+		providers = append(providers, tokenAuth(cfg.adminToken))
+	}
+	if cfg.oidc != nil {
+		providers = append(providers, newOIDCAuth(*cfg.oidc))
+	}
+	return providers
+}
+
+// adminActor returns the admin r authenticates as, or "". Provider errors,
+// such as an unreachable identity provider, are logged and deny access.
+func (s *Server) adminActor(r *http.Request) string {
+	for _, p := range s.auth {
+		actor, err := p.Authenticate(r)
+		if err != nil {
+			authLog.Errorf("Could not authenticate admin: %s", err)
+			continue
+		}
+		if actor != "" {
+			return actor
+		}
+	}
+	return ""
+}
+
+func (s *Server) isAdmin(r *http.Request) bool {
+	return s.adminActor(r) != ""
+}
+
+// sameOrigin reports whether r was sent by a page of this registry, which
+// is required before a session cookie may change anything.
+func sameOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		origin = r.Header.Get("Referer")
+	}
+	u, err := url.Parse(origin)
+	return err == nil && u.Host != "" && u.Host == r.Host
+}
+
+// newSession returns a cookie value naming identity until the session
+// expires, signed with secret: base64(identity).expiry.signature.
+func newSession(secret, identity string, expires time.Time) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(identity)) + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + signSession(secret, payload)
+}
+
+// parseSession returns the identity of a valid, unexpired session cookie.
+func parseSession(secret, value string) (string, bool) {
+	i := strings.LastIndexByte(value, '.')
+	if i < 0 || !hmac.Equal([]byte(value[i+1:]), []byte(signSession(secret, value[:i]))) {
+		return "", false
+	}
+	parts := strings.SplitN(value[:i], ".", 2)
+	if len(parts) != 2 {
+		return "", false
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", false
+	}
+	identity, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return "", false
+	}
+	return string(identity), true
+}
+
+func signSession(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// sessionIdentity returns the identity of the session cookie of r, signed
+// with secret. Sessions only change things when r comes from a registry
+// page.
+func sessionIdentity(r *http.Request, secret string) (string, bool) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", false
+	}
+	identity, ok := parseSession(secret, cookie.Value)
+	if !ok || r.Method != http.MethodGet && r.Method != http.MethodHead && !sameOrigin(r) {
+		return "", false
+	}
+	return identity, true
+}
+
+// sessionHandler signs browsers in with the admin token and out again. It
+// answers /admin/logout and, unless OIDC does, /admin/login, which need no
+// authentication.
+func (s *Server) sessionHandler(r *http.Request) *http.Response {
+	secure := strings.HasPrefix(s.config.siteURL, "https://")
+	switch {
+	case r.URL.Path == "/admin/logout" && r.Method == http.MethodGet:
+		response := goproxy.NewResponse(r, "text/html", http.StatusFound, "")
+		response.Header.Set("Location", "/")
+		response.Header.Add("Set-Cookie", (&http.Cookie{Name: sessionCookie, Value: "", Path: "/admin/", MaxAge: -1, HttpOnly: true, Secure: secure}).String())
+		return response
+	case r.URL.Path != "/admin/login" || s.config.adminToken == "":
+		return nil
+	case r.Method == http.MethodGet:
+		response := dashboardPage(r, "login.html", "text/html; charset=utf-8")
+		response.Header.Set("Cache-Control", "no-store")
+		return response
+	case r.Method == http.MethodPost:
+		if !sameOrigin(r) || !tokenAuth(s.config.adminToken).matches(r.PostFormValue("token")) {
+			return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Invalid admin token")
+		}
+		expires := time.Now().Add(s.config.sessionTTL)
+		s.audit("admin", "admin.login", "", "")
+		response := goproxy.NewResponse(r, "text/html", http.StatusFound, "")
+		response.Header.Set("Location", "/admin/")
+		response.Header.Add("Set-Cookie", (&http.Cookie{Name: sessionCookie, Value: newSession(s.config.adminToken, "admin", expires), Path: "/admin/", Expires: expires, HttpOnly: true, Secure: secure}).String())
+		return response
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package registry
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /autocomplete?q= answers typeahead in editors and search boxes with the
+// names of the most popular packages starting with q, as a bare JSON array.
+// Names come from a prefix trie in memory that is rebuilt from the store
+// every AUTOCOMPLETE_REFRESH, so lookups never touch the database. Until the
+// first build is done, the store's prefix lookup answers instead. With
+// SEARCH_INDEX_REFRESH set, the search index builds the trie instead.
+
+const (
+	autocompleteResults = 10
+	// autocompleteMaxAge is how long clients and CDNs may keep answers;
+	// a new package shows up within a refresh and this.
+	autocompleteMaxAge = 3600
+)
+
+// trieNode holds, besides its children, the best names under it, so a
+// lookup is a walk down the prefix.
+type trieNode struct {
+	children []trieEdge
+	// top are the ranks of up to autocompleteResults names, best first.
+	top []int32
+}
+
+type trieEdge struct {
+	b    byte
+	node *trieNode
+}
+
+func (n *trieNode) child(b byte, create bool) *trieNode {
+	i := sort.Search(len(n.children), func(i int) bool { return n.children[i].b >= b })
+	if i < len(n.children) && n.children[i].b == b {
+		return n.children[i].node
+	}
+	if !create {
+		return nil
+	}
+	child := &trieNode{}
+	n.children = append(n.children, trieEdge{})
+	copy(n.children[i+1:], n.children[i:])
+	n.children[i] = trieEdge{b, child}
+	return child
+}
+
+// nameTrie indexes names given best first.
+type nameTrie struct {
+	names []string
+	root  trieNode
+}
+
+func newNameTrie(names []string) *nameTrie {
+	t := &nameTrie{names: names}
+	for rank, name := range names {
+		n := &t.root
+		for i := 0; ; i++ {
+			if len(n.top) < autocompleteResults {
+				n.top = append(n.top, int32(rank))
+			}
+			if i == len(name) {
+				break
+			}
+			n = n.child(name[i], true)
+		}
+	}
+	return t
+}
+
+// complete returns the best names starting with prefix.
+func (t *nameTrie) complete(prefix string) []string {
+	n := &t.root
+	for i := 0; i < len(prefix) && n != nil; i++ {
+		n = n.child(prefix[i], false)
+	}
+	names := []string{}
+	if n != nil {
+		for _, rank := range n.top {
+			names = append(names, t.names[rank])
+		}
+	}
+	return names
+}
+
+// autocompleteIndex holds the current trie.
+type autocompleteIndex struct {
+	mu    sync.RWMutex
+	trie  *nameTrie
+	built time.Time
+}
+
+func (a *autocompleteIndex) get() *nameTrie {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.trie
+}
+
+// rebuild reads the public packages of the default registry, most popular
+// first, and swaps in a new trie.
+func (a *autocompleteIndex) rebuild(store Store) error {
+	count, err := store.CountPackages()
+	if err != nil {
+		return err
+	}
+	results, err := store.Search("", int(count)+1)
+	if err != nil {
+		return err
+	}
+	names := make([]string, len(results))
+	for i, r := range results {
+		names[i] = strings.ToLower(r.Name)
+	}
+	trie := newNameTrie(names)
+	a.mu.Lock()
+	a.trie, a.built = trie, time.Now()
+	a.mu.Unlock()
+	return nil
+}
+
+// startAutocomplete builds the trie in the background and then every
+// interval.
+func (s *Server) startAutocomplete() {
+	if s.config.autocompleteRefresh <= 0 && s.config.searchIndexRefresh <= 0 {
+		return
+	}
+	metrics.Set("autocomplete", expvar.Func(func() interface{} {
+		s.autocomplete.mu.RLock()
+		defer s.autocomplete.mu.RUnlock()
+		names := 0
+		if s.autocomplete.trie != nil {
+			names = len(s.autocomplete.trie.names)
+		}
+		return map[string]interface{}{"names": names, "built_at": s.autocomplete.built}
+	}))
+	if s.config.searchIndexRefresh > 0 {
+		// The search index rebuilds the trie along with itself.
+		return
+	}
+	go func() {
+		for {
+			if err := s.autocomplete.rebuild(s.store); err != nil {
+				searchLog.Errorf("Could not rebuild the autocomplete index: %s", err)
+			}
+			time.Sleep(s.config.autocompleteRefresh)
+		}
+	}()
+}
+
+func (s *Server) serveAutocomplete(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	q := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("q")))
+	var names []string
+	if trie := s.autocomplete.get(); trie != nil {
+		names = trie.complete(q)
+	} else if q != "" {
+		packages, err := s.store.PackagesByPrefix(q, autocompleteResults)
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		for _, p := range packages {
+			names = append(names, p.Name)
+		}
+	}
+	if names == nil {
+		names = []string{}
+	}
+	response := jsonResponse(r, http.StatusOK, names)
+	response.Header.Set("Cache-Control", "public, max-age="+strconv.Itoa(autocompleteMaxAge))
+	return r, response
+}
@@ -0,0 +1,232 @@
+package registry
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"strconv"
+	"time"
+)
+
+const backupKeyFormat = "20060102T150405Z"
+
+// PackageRecord is a full row of the packages table as stored in backups.
+// Visibility is public or private; records without it, from backups taken
+// before it was added, keep the settings that follow it of the stored
+// package, see keepSettings.
+type PackageRecord struct {
+	Tenant       string       `json:"tenant,omitempty"`
+	Name         string       `json:"name"`
+	URL          string       `json:"url"`
+	CreatedAt    *time.Time   `json:"created_at"`
+	Hits         *int32       `json:"hits"`
+	Visibility   string       `json:"visibility,omitempty"`
+	Organization string       `json:"organization,omitempty"`
+	CacheTTL     int32        `json:"cache_ttl,omitempty"`
+	Deprecated   *Deprecation `json:"deprecated,omitempty"`
+}
+
+// validVisibility reports whether v is a visibility a record may carry.
+func validVisibility(v string) bool {
+	return v == "" || v == "public" || v == "private"
+}
+
+// keepSettings gives a record without a visibility the settings of old, the
+// stored package of that name, or makes it public when there is none, so
+// restoring an older backup doesn't publish private packages or drop their
+// organization.
+func (r *PackageRecord) keepSettings(old *PackageRecord) {
+	if r.Visibility != "" {
+		return
+	}
+	if old == nil {
+		r.Visibility = "public"
+		return
+	}
+	r.Visibility, r.Organization, r.CacheTTL, r.Deprecated = old.Visibility, old.Organization, old.CacheTTL, old.Deprecated
+}
+
+type backupConfig struct {
+	store     *s3Client
+	prefix    string
+	retention int
+}
+
+// loadBackupConfig reads the BACKUP_* environment. Backups are disabled
+// unless a bucket is configured.
+func loadBackupConfig() (*backupConfig, error) {
+	bucket := getEnv("BACKUP_BUCKET", "")
+	if bucket == "" {
+		return nil, nil
+	}
+	retention, err := strconv.Atoi(getEnv("BACKUP_RETENTION", "30"))
+	if err != nil {
+		return nil, errors.New("invalid BACKUP_RETENTION")
+	}
+	return &backupConfig{
+		store: newS3Client(
+			getEnv("BACKUP_ENDPOINT", "https://s3.amazonaws.com"),
+			bucket,
+			getEnv("BACKUP_REGION", "us-east-1"),
+			getEnv("BACKUP_ACCESS_KEY_ID", ""),
+			getEnv("BACKUP_SECRET_ACCESS_KEY", ""),
+		),
+		prefix:    getEnv("BACKUP_PREFIX", "registry-backups/"),
+		retention: retention,
+	}, nil
+}
+
+func startBackups(cfg *backupConfig, store Store, interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if key, err := cfg.backup(store); err != nil {
+				jobLog.Errorf("Backup error: %s", err)
+			} else {
+				jobLog.Infof("Backup written to %s", key)
+			}
+		}
+	}()
+}
+
+// backup uploads a gzipped JSON snapshot of the packages table and prunes
+// snapshots beyond the retention count. Keys sort chronologically.
+func (cfg *backupConfig) backup(store Store) (string, error) {
+	records, err := store.Snapshot()
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if err := json.NewEncoder(gz).Encode(records); err != nil {
+		return "", err
+	}
+	if err := gz.Close(); err != nil {
+		return "", err
+	}
+
+	key := cfg.prefix + time.Now().UTC().Format(backupKeyFormat) + ".json.gz"
+	if err := cfg.store.put(key, buf.Bytes(), "application/gzip"); err != nil {
+		return "", err
+	}
+
+	if cfg.retention > 0 {
+		keys, err := cfg.store.list(cfg.prefix)
+		if err != nil {
+			return key, err
+		}
+		for len(keys) > cfg.retention {
+			if err := cfg.store.delete(keys[0]); err != nil {
+				return key, err
+			}
+			keys = keys[1:]
+		}
+	}
+	return key, nil
+}
+
+// restore loads a snapshot (the latest one when key is empty) and upserts it
+// into the packages table. With replace, packages missing from the snapshot
+// are deleted as well.
+func (cfg *backupConfig) restore(store Store, key string, replace bool) (int, error) {
+	if key == "" {
+		keys, err := cfg.store.list(cfg.prefix)
+		if err != nil {
+			return 0, err
+		}
+		if len(keys) == 0 {
+			return 0, errors.New("no backups found")
+		}
+		key = keys[len(keys)-1]
+	}
+	jobLog.Infof("Restoring from %s", key)
+
+	data, err := cfg.store.get(key)
+	if err != nil {
+		return 0, err
+	}
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return 0, err
+	}
+	raw, err := ioutil.ReadAll(gz)
+	if err != nil {
+		return 0, err
+	}
+	var records []PackageRecord
+	if err := json.Unmarshal(raw, &records); err != nil {
+		return 0, err
+	}
+	current, err := store.Snapshot()
+	if err != nil {
+		return 0, err
+	}
+	stored := map[string]*PackageRecord{}
+	for i := range current {
+		stored[current[i].Tenant+"/"+current[i].Name] = &current[i]
+	}
+	for i := range records {
+		if !validVisibility(records[i].Visibility) {
+			return 0, fmt.Errorf("invalid visibility %q of %s", records[i].Visibility, records[i].Name)
+		}
+		records[i].keepSettings(stored[records[i].Tenant+"/"+records[i].Name])
+	}
+	return len(records), store.Restore(records, replace)
+}
+
+func runBackup(args []string) {
+	flags := flag.NewFlagSet("backup", flag.ExitOnError)
+	flags.Parse(args)
+
+	cfg := mustBackupConfig()
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatalf("Connection error: %s", err)
+	}
+	defer store.Close()
+
+	key, err := cfg.backup(store)
+	if err != nil {
+		log.Fatalf("Backup failed: %s", err)
+	}
+	log.Printf("Backup written to %s", key)
+}
+
+func runRestore(args []string) {
+	flags := flag.NewFlagSet("restore", flag.ExitOnError)
+	key := flags.String("key", "", "backup object to restore (defaults to the latest)")
+	replace := flags.Bool("replace", false, "delete packages that are not in the backup")
+	flags.Parse(args)
+
+	cfg := mustBackupConfig()
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatalf("Connection error: %s", err)
+	}
+	defer store.Close()
+
+	n, err := cfg.restore(store, *key, *replace)
+	if err != nil {
+		log.Fatalf("Restore failed: %s", err)
+	}
+	if cache, err := ConnectCache(); err == nil {
+		cache.Delete("packages")
+	}
+	log.Printf("Restored %d packages", n)
+}
+
+func mustBackupConfig() *backupConfig {
+	cfg, err := loadBackupConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg == nil {
+		log.Fatal("BACKUP_BUCKET is not set")
+	}
+	return cfg
+}
@@ -0,0 +1,90 @@
+package registry
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /packages/{name}/badge.svg renders a flat, shields.io style badge with
+// the package name and its latest tag, for maintainers to embed in READMEs.
+
+const (
+	badgeRelease    = "#4c1"
+	badgePrerelease = "#dfb317"
+	badgeUnknown    = "#9f9f9f"
+	badgeMissing    = "#e05d44"
+)
+
+const badgeTemplate = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[2]s: %[3]s">` +
+	`<title>%[2]s: %[3]s</title>` +
+	`<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>` +
+	`<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>` +
+	`<g clip-path="url(#r)"><rect width="%[4]d" height="20" fill="#555"/><rect x="%[4]d" width="%[5]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>` +
+	`<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">` +
+	`<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[2]s</text><text x="%[7]d" y="14">%[2]s</text>` +
+	`<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[3]s</text><text x="%[8]d" y="14">%[3]s</text>` +
+	`</g></svg>`
+
+func badgePath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/") && strings.HasSuffix(req.URL.Path, "/badge.svg")
+	}
+}
+
+func (s *Server) serveBadge(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/packages/"), "/badge.svg")
+	pkg, err := s.readPackage(r, name)
+	if err == ErrNotFound {
+		return r, badgeResponse(r, http.StatusNotFound, name, "not found", badgeMissing)
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+
+	value, color := "unknown", badgeUnknown
+	if versions, err := repoVersions(pkg.URL); err == nil {
+		value = "no tags"
+		if v, ok := latestVersion(versions); ok {
+			value, color = "v"+v.String(), badgeRelease
+			if v.Pre != "" {
+				color = badgePrerelease
+			}
+		}
+	}
+	response := badgeResponse(r, http.StatusOK, name, value, color)
+	response.Header.Set("Cache-Control", cacheControl(pkg, int(tagCacheTTL.Seconds())))
+	return r, response
+}
+
+func badgeResponse(r *http.Request, status int, label, value, color string) *http.Response {
+	lw, vw := badgeTextWidth(label)+10, badgeTextWidth(value)+10
+	svg := fmt.Sprintf(badgeTemplate, lw+vw, html.EscapeString(label), html.EscapeString(value),
+		lw, vw, color, lw/2, lw+vw/2)
+	response := goproxy.NewResponse(r, "image/svg+xml", status, svg)
+	response.Header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(tagCacheTTL.Seconds())))
+	return response
+}
+
+// badgeTextWidth estimates the width of text in 11px Verdana, which is close
+// enough without shipping font metrics.
+func badgeTextWidth(text string) int {
+	width := 0.0
+	for _, c := range text {
+		switch {
+		case strings.ContainsRune("il.,:;|!'", c):
+			width += 3.5
+		case strings.ContainsRune("fjrt()[]/-", c):
+			width += 4.5
+		case c == 'm' || c == 'w' || c == 'M' || c == 'W':
+			width += 10
+		case c >= 'A' && c <= 'Z':
+			width += 7.5
+		default:
+			width += 6.5
+		}
+	}
+	return int(width + 0.5)
+}
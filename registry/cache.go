@@ -0,0 +1,222 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/bmizerany/mc"
+)
+
+// Cache is a shared key-value cache. Get fails for missing and expired keys.
+type Cache interface {
+	Get(key string) (string, error)
+	// Set stores value for ttl; zero keeps it until it is evicted.
+	Set(key, value string, ttl time.Duration) error
+	Delete(key string) error
+}
+
+// memcachedCache dials memcached when it is first used and again after
+// the connection breaks, at most every cacheRedialInterval, so the registry
+// starts and keeps serving while memcached is down. Until it is reachable
+// every Get misses.
+type memcachedCache struct {
+	servers            string
+	username, password string
+
+	mu       sync.Mutex
+	conn     *mc.Conn
+	lastDial time.Time
+}
+
+const cacheRedialInterval = 5 * time.Second
+
+var (
+	errCacheMiss        = errors.New("cache miss")
+	errCacheUnavailable = errors.New("cache unavailable")
+)
+
+// ConnectCache dials MEMCACHEDCLOUD_SERVERS and authenticates when
+// credentials are configured. MEMCACHEDCLOUD_SERVERS=memory keeps the cache
+// in process instead. A memcached that can't be reached isn't an error: the
+// cache connects once it can.
+func ConnectCache() (Cache, error) {
+	servers := getEnv("MEMCACHEDCLOUD_SERVERS", "localhost:11211")
+	if servers == "memory" {
+		return newMemoryCache(), nil
+	}
+	c := &memcachedCache{
+		servers:  servers,
+		username: os.Getenv("MEMCACHEDCLOUD_USERNAME"),
+		password: os.Getenv("MEMCACHEDCLOUD_PASSWORD"),
+	}
+	if _, err := c.connection(); err != nil {
+		cacheLog.Warnf("%s, connecting later", err)
+	}
+	return c, nil
+}
+
+// connection returns the open connection, dialing when there is none.
+// Others miss meanwhile rather than wait for the dial.
+func (c *memcachedCache) connection() (*mc.Conn, error) {
+	c.mu.Lock()
+	if c.conn != nil {
+		defer c.mu.Unlock()
+		return c.conn, nil
+	}
+	if time.Since(c.lastDial) < cacheRedialInterval {
+		c.mu.Unlock()
+		return nil, errCacheUnavailable
+	}
+	c.lastDial = time.Now()
+	c.mu.Unlock()
+
+	conn, err := mc.Dial("tcp", c.servers)
+	if err != nil {
+		return nil, fmt.Errorf("Memcached connection error: %s", err)
+	}
+	if c.username != "" && c.password != "" {
+		if err := conn.Auth(c.username, c.password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("Memcached auth error: %s", err)
+		}
+	}
+	c.mu.Lock()
+	c.conn = conn
+	c.mu.Unlock()
+	return conn, nil
+}
+
+// check drops the connection when err broke it. Errors memcached answers
+// with, like a miss, leave it open.
+func (c *memcachedCache) check(conn *mc.Conn, err error) error {
+	if _, ok := err.(net.Error); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
+		c.mu.Lock()
+		if c.conn == conn {
+			c.conn = nil
+			conn.Close()
+		}
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *memcachedCache) Get(key string) (string, error) {
+	conn, err := c.connection()
+	if err != nil {
+		return "", err
+	}
+	val, _, _, err := conn.Get(key)
+	return val, c.check(conn, err)
+}
+
+func (c *memcachedCache) Set(key, value string, ttl time.Duration) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return c.check(conn, conn.Set(key, value, 0, 0, int(ttl.Seconds())))
+}
+
+func (c *memcachedCache) Delete(key string) error {
+	conn, err := c.connection()
+	if err != nil {
+		return err
+	}
+	return c.check(conn, conn.Del(key))
+}
+
+// memoryCache is an in-process Cache. Expired entries are dropped when they
+// are read or overwritten.
+type memoryCache struct {
+	mu      sync.Mutex
+	entries map[string]memoryCacheEntry
+}
+
+type memoryCacheEntry struct {
+	value   string
+	expires time.Time
+}
+
+func newMemoryCache() *memoryCache {
+	return &memoryCache{entries: map[string]memoryCacheEntry{}}
+}
+
+func (c *memoryCache) Get(key string) (string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok {
+		return "", errCacheMiss
+	}
+	if !entry.expires.IsZero() && time.Now().After(entry.expires) {
+		delete(c.entries, key)
+		return "", errCacheMiss
+	}
+	return entry.value, nil
+}
+
+func (c *memoryCache) Set(key, value string, ttl time.Duration) error {
+	entry := memoryCacheEntry{value: value}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	c.mu.Lock()
+	c.entries[key] = entry
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *memoryCache) Delete(key string) error {
+	c.mu.Lock()
+	delete(c.entries, key)
+	c.mu.Unlock()
+	return nil
+}
+
+// Flush drops every entry.
+func (c *memoryCache) Flush() {
+	c.mu.Lock()
+	c.entries = map[string]memoryCacheEntry{}
+	c.mu.Unlock()
+}
+
+// flightGroup runs at most one call per key at a time; callers arriving while
+// it runs wait for and share its result.
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flight
+}
+
+type flight struct {
+	done chan struct{}
+	val  string
+	err  error
+}
+
+func (g *flightGroup) Do(key string, fn func() (string, error)) (string, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = map[string]*flight{}
+	}
+	if f, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return f.val, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.calls[key] = f
+	g.mu.Unlock()
+
+	f.val, f.err = fn()
+	close(f.done)
+
+	g.mu.Lock()
+	delete(g.calls, key)
+	g.mu.Unlock()
+	return f.val, f.err
+}
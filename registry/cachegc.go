@@ -0,0 +1,197 @@
+package registry
+
+import (
+	"expvar"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bmizerany/mc"
+	"github.com/elazarl/goproxy"
+)
+
+// Memcached can't list its keys, so each instance indexes the keys it
+// writes to the shared cache with their class, size and the packages they
+// are about. Every CACHE_GC_INTERVAL (default 1h) the index is scanned:
+// keys about packages that were deleted or renamed since are evicted, and
+// expired ones are dropped from the index. /metrics reports the keys and
+// bytes per class in cache_usage; keys written by other instances or the
+// node process are only counted by them.
+
+// maxIndexedCacheKeys caps the index; keys written while it is full are
+// neither counted nor collected, and expire on their own.
+const maxIndexedCacheKeys = 100000
+
+type indexedCacheKey struct {
+	class    string
+	size     int
+	expires  time.Time
+	packages []string
+}
+
+type cacheKeyIndex struct {
+	mu   sync.Mutex
+	keys map[string]indexedCacheKey
+}
+
+// cacheKeyClass names the class of key: its prefix, or package_list for the
+// package list keys.
+func cacheKeyClass(key string) string {
+	if i := strings.Index(key, ":"); i > 0 {
+		return key[:i]
+	}
+	if strings.HasPrefix(key, "packages") {
+		return "package_list"
+	}
+	return "other"
+}
+
+// add indexes key, holding size bytes for ttl, as being about packages.
+func (ix *cacheKeyIndex) add(key string, size int, ttl time.Duration, packages ...string) {
+	entry := indexedCacheKey{class: cacheKeyClass(key), size: size}
+	if ttl > 0 {
+		entry.expires = time.Now().Add(ttl)
+	}
+	for _, name := range packages {
+		if name != "" {
+			entry.packages = append(entry.packages, name)
+		}
+	}
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	if ix.keys == nil {
+		ix.keys = map[string]indexedCacheKey{}
+	}
+	if _, ok := ix.keys[key]; !ok && len(ix.keys) >= maxIndexedCacheKeys {
+		metrics.Add("cache_keys_unindexed", 1)
+		return
+	}
+	ix.keys[key] = entry
+}
+
+// forget drops keys from the index.
+func (ix *cacheKeyIndex) forget(keys ...string) {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	for _, key := range keys {
+		delete(ix.keys, key)
+	}
+}
+
+// reset empties the index, after the cache was flushed.
+func (ix *cacheKeyIndex) reset() {
+	ix.mu.Lock()
+	ix.keys = nil
+	ix.mu.Unlock()
+}
+
+// snapshot returns the unexpired keys, dropping the expired ones.
+func (ix *cacheKeyIndex) snapshot(now time.Time) map[string]indexedCacheKey {
+	ix.mu.Lock()
+	defer ix.mu.Unlock()
+	keys := make(map[string]indexedCacheKey, len(ix.keys))
+	for key, entry := range ix.keys {
+		if !entry.expires.IsZero() && now.After(entry.expires) {
+			delete(ix.keys, key)
+			continue
+		}
+		keys[key] = entry
+	}
+	return keys
+}
+
+// CacheClassUsage is what the indexed keys of a class hold.
+type CacheClassUsage struct {
+	Keys  int `json:"keys"`
+	Bytes int `json:"bytes"`
+}
+
+func (ix *cacheKeyIndex) usage() map[string]CacheClassUsage {
+	usage := map[string]CacheClassUsage{}
+	for _, entry := range ix.snapshot(time.Now()) {
+		u := usage[entry.class]
+		u.Keys++
+		u.Bytes += entry.size
+		usage[entry.class] = u
+	}
+	return usage
+}
+
+func (ix *cacheKeyIndex) publish() {
+	metrics.Set("cache_usage", expvar.Func(func() interface{} { return ix.usage() }))
+}
+
+// CacheGCReport is the outcome of a garbage collection.
+type CacheGCReport struct {
+	Scanned  int      `json:"scanned"`
+	Evicted  int      `json:"evicted"`
+	Orphaned []string `json:"orphaned,omitempty"`
+}
+
+// collectCacheGarbage evicts the indexed keys about packages that no longer
+// exist.
+func (s *Server) collectCacheGarbage() (CacheGCReport, error) {
+	keys := s.cacheKeys.snapshot(time.Now())
+	report := CacheGCReport{Scanned: len(keys)}
+	exists := map[string]bool{}
+	for key, entry := range keys {
+		orphaned := false
+		for _, name := range entry.packages {
+			found, checked := exists[name]
+			if !checked {
+				_, err := s.store.GetPackage(name)
+				if err != nil && err != ErrNotFound {
+					return report, err
+				}
+				found = err == nil
+				exists[name] = found
+				if !found {
+					report.Orphaned = append(report.Orphaned, name)
+				}
+			}
+			if !found {
+				orphaned = true
+			}
+		}
+		if !orphaned {
+			continue
+		}
+		if err := s.cache.Delete(key); err != nil && err != errCacheMiss && err != mc.ErrNotFound {
+			cacheLog.Warnf("Could not evict cache key %s: %s", key, err)
+			continue
+		}
+		s.cacheKeys.forget(key)
+		report.Evicted++
+	}
+	metrics.Add("cache_gc_evicted", int64(report.Evicted))
+	return report, nil
+}
+
+// startCacheGC collects cache garbage every CACHE_GC_INTERVAL.
+func (s *Server) startCacheGC() {
+	s.cacheKeys.publish()
+	if s.config.cacheGCInterval <= 0 {
+		return
+	}
+	go func() {
+		for range time.Tick(s.config.cacheGCInterval) {
+			report, err := s.collectCacheGarbage()
+			if err != nil {
+				cacheLog.Errorf("Cache garbage collection error: %s", err)
+				continue
+			}
+			if report.Evicted > 0 {
+				cacheLog.Infof("Evicted %d cache keys about %d removed packages", report.Evicted, len(report.Orphaned))
+			}
+		}
+	}()
+}
+
+func (s *Server) runCacheGC(r *http.Request) *http.Response {
+	report, err := s.collectCacheGarbage()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	return jsonResponse(r, http.StatusOK, report)
+}
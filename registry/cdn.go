@@ -0,0 +1,286 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With a CDN in front, package responses carry a Surrogate-Key header:
+// "packages" for the list, search and prefix lookups, "package-<name>" for the routes of a
+// package. Whenever caches are invalidated, the matching keys are purged
+// from the CDN of CDN_PURGE: fastly purges the keys, cloudfront, which has
+// no keys, invalidates the paths they stand for. Keys are collected for a
+// second and purged together. Every instance hears of every invalidation,
+// so each purges; purges are idempotent.
+
+const (
+	cdnPurgeDelay = time.Second
+	// fastlyMaxKeys is the most keys Fastly purges in one request.
+	fastlyMaxKeys = 256
+)
+
+type cdnPurger interface {
+	// Purge drops keys from the CDN; the key "*" drops everything.
+	Purge(keys []string) error
+}
+
+func loadCDNPurger() (cdnPurger, error) {
+	client := &http.Client{Timeout: 30 * time.Second}
+	switch provider := getEnv("CDN_PURGE", ""); provider {
+	case "":
+		return nil, nil
+	case "fastly":
+		p := fastlyPurger{
+			token:   getEnv("FASTLY_API_TOKEN", ""),
+			service: getEnv("FASTLY_SERVICE_ID", ""),
+			soft:    getEnv("FASTLY_SOFT_PURGE", "") == "true",
+			client:  client,
+		}
+		if p.token == "" || p.service == "" {
+			return nil, fmt.Errorf("CDN_PURGE=fastly needs FASTLY_API_TOKEN and FASTLY_SERVICE_ID")
+		}
+		return p, nil
+	case "cloudfront":
+		p := cloudFrontPurger{
+			distribution: getEnv("CLOUDFRONT_DISTRIBUTION_ID", ""),
+			accessKey:    getEnv("CLOUDFRONT_ACCESS_KEY_ID", ""),
+			secretKey:    getEnv("CLOUDFRONT_SECRET_ACCESS_KEY", ""),
+			client:       client,
+		}
+		if p.distribution == "" || p.accessKey == "" || p.secretKey == "" {
+			return nil, fmt.Errorf("CDN_PURGE=cloudfront needs CLOUDFRONT_DISTRIBUTION_ID, CLOUDFRONT_ACCESS_KEY_ID and CLOUDFRONT_SECRET_ACCESS_KEY")
+		}
+		return p, nil
+	default:
+		return nil, fmt.Errorf("Invalid CDN_PURGE: %s", provider)
+	}
+}
+
+// surrogateKeys returns the keys of the response to a path, if any.
+func surrogateKeys(path string) string {
+	if path == "/packages" || strings.HasPrefix(path, "/packages/search/") || strings.HasPrefix(path, "/packages/prefix/") {
+		return "packages"
+	}
+	if !strings.HasPrefix(path, "/packages/") {
+		return ""
+	}
+	segments := strings.SplitN(strings.TrimPrefix(path, "/packages/"), "/", 3)
+	name := segments[0]
+	if strings.HasPrefix(name, "@") && len(segments) > 1 {
+		name += "/" + segments[1]
+	}
+	if validatePackageName(name) != nil && validateScopedName(name) != nil {
+		return ""
+	}
+	return "package-" + name
+}
+
+// addSurrogateKeys tags the package responses of Go handlers and the
+// sidecar alike.
+func addSurrogateKeys(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys := surrogateKeys(r.URL.Path)
+		if keys == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, before: func(h http.Header) {
+			h.Set("Surrogate-Key", keys)
+		}}, r)
+	})
+}
+
+// purgeKeys returns the surrogate keys an invalidation drops. Invalidations
+// from Go handlers only name repositories, which are looked up.
+func (s *Server) purgeKeys(inv invalidation) []string {
+	if inv.all() {
+		return []string{"*"}
+	}
+	var keys []string
+	for _, k := range inv.Keys {
+		if k == "packages" {
+			keys = append(keys, "packages")
+		}
+	}
+	for _, name := range inv.Packages {
+		keys = append(keys, "package-"+name)
+	}
+	if len(inv.Packages) == 0 {
+		for _, url := range inv.URLs {
+			if p, err := s.store.PackageByURL(url); err == nil {
+				keys = append(keys, "package-"+p.Name)
+			}
+		}
+	}
+	return keys
+}
+
+// purgeQueue collects keys until the next purge.
+type purgeQueue struct {
+	mu      sync.Mutex
+	pending map[string]bool
+}
+
+func (q *purgeQueue) add(keys []string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending == nil {
+		q.pending = map[string]bool{}
+	}
+	for _, k := range keys {
+		q.pending[k] = true
+	}
+}
+
+func (q *purgeQueue) take() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.pending["*"] {
+		q.pending = nil
+		return []string{"*"}
+	}
+	keys := make([]string, 0, len(q.pending))
+	for k := range q.pending {
+		keys = append(keys, k)
+	}
+	q.pending = nil
+	sort.Strings(keys)
+	return keys
+}
+
+// startCDNPurges purges the collected keys every cdnPurgeDelay.
+func (s *Server) startCDNPurges() {
+	if s.config.cdnPurger == nil {
+		return
+	}
+	go func() {
+		for range time.Tick(cdnPurgeDelay) {
+			keys := s.purges.take()
+			if len(keys) == 0 {
+				continue
+			}
+			if err := s.config.cdnPurger.Purge(keys); err != nil {
+				cacheLog.Errorf("Could not purge %d CDN keys: %s", len(keys), err)
+				metrics.Add("cdn_purge_errors", 1)
+				continue
+			}
+			metrics.Add("cdn_purged_keys", int64(len(keys)))
+		}
+	}()
+}
+
+// fastlyPurger purges surrogate keys of a Fastly service.
+type fastlyPurger struct {
+	token   string
+	service string
+	// soft marks content stale instead of dropping it.
+	soft   bool
+	client *http.Client
+}
+
+func (f fastlyPurger) Purge(keys []string) error {
+	if len(keys) == 1 && keys[0] == "*" {
+		return f.post("/purge_all", "")
+	}
+	for start := 0; start < len(keys); start += fastlyMaxKeys {
+		end := start + fastlyMaxKeys
+		if end > len(keys) {
+			end = len(keys)
+		}
+		if err := f.post("/purge", strings.Join(keys[start:end], " ")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f fastlyPurger) post(path, keys string) error {
+	req, err := http.NewRequest(http.MethodPost, "https://api.fastly.com/service/"+f.service+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Fastly-Key", f.token)
+	req.Header.Set("Accept", "application/json")
+	if keys != "" {
+		req.Header.Set("Surrogate-Key", keys)
+	}
+	if f.soft {
+		req.Header.Set("Fastly-Soft-Purge", "1")
+	}
+	return doPurge(f.client, req, "Fastly")
+}
+
+// cloudFrontPurger invalidates the paths of the keys in a CloudFront
+// distribution.
+type cloudFrontPurger struct {
+	distribution string
+	accessKey    string
+	secretKey    string
+	client       *http.Client
+}
+
+type cloudFrontInvalidation struct {
+	XMLName xml.Name `xml:"http://cloudfront.amazonaws.com/doc/2020-05-31/ InvalidationBatch"`
+	Paths   struct {
+		Quantity int      `xml:"Quantity"`
+		Items    []string `xml:"Items>Path"`
+	} `xml:"Paths"`
+	CallerReference string `xml:"CallerReference"`
+}
+
+// cloudFrontPaths turns keys into the paths of their responses.
+func cloudFrontPaths(keys []string) []string {
+	var paths []string
+	for _, k := range keys {
+		switch {
+		case k == "*":
+			return []string{"/*"}
+		case k == "packages":
+			paths = append(paths, "/packages", "/packages/search/*", "/packages/prefix/*")
+		case strings.HasPrefix(k, "package-"):
+			name := strings.TrimPrefix(k, "package-")
+			paths = append(paths, "/packages/"+name, "/packages/"+name+"/*")
+		}
+	}
+	return paths
+}
+
+func (c cloudFrontPurger) Purge(keys []string) error {
+	var batch cloudFrontInvalidation
+	batch.Paths.Items = cloudFrontPaths(keys)
+	batch.Paths.Quantity = len(batch.Paths.Items)
+	batch.CallerReference = "registry-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	body, err := xml.Marshal(batch)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://cloudfront.amazonaws.com/2020-05-31/distribution/"+c.distribution+"/invalidation", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/xml")
+	// CloudFront is a global service signed in us-east-1.
+	signV4(req, body, time.Now().UTC(), "us-east-1", "cloudfront", c.accessKey, c.secretKey)
+	return doPurge(c.client, req, "CloudFront")
+}
+
+func doPurge(client *http.Client, req *http.Request, cdn string) error {
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("%s returned %s: %s", cdn, resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	statusOK     = "ok"
+	statusBroken = "broken"
+
+	// A package is reported as broken after this many consecutive failed checks.
+	brokenThreshold = 3
+
+	checkBatchSize  = 50
+	checkWorkers    = 8
+	checkTimeout    = 30 * time.Second
+	maxCheckBackoff = 30 * 24 * time.Hour
+)
+
+// startURLChecker periodically probes the repository URL of every package
+// that is due for a check. A failing repository is retried with exponential
+// backoff starting at base, so dead URLs don't get hammered every interval.
+// The owners of packages that turn broken are emailed.
+func startURLChecker(store Store, mail *ownerMail, interval, base time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := checkDueURLs(store, mail, interval, base); err != nil {
+				jobLog.Errorf("URL check error: %s", err)
+			}
+		}
+	}()
+}
+
+// checkDueURLs checks every package that is due, checkBatchSize at a time
+// by checkWorkers in parallel, so the whole registry is checked each
+// interval however many packages it has. It stops when a batch has only
+// packages it already checked, e.g. ones whose URL changed meanwhile.
+func checkDueURLs(store Store, mail *ownerMail, interval, base time.Duration) error {
+	checked := map[string]bool{}
+	for {
+		due, err := store.DueURLChecks(checkBatchSize)
+		if err != nil {
+			return err
+		}
+		var batch []Package
+		for _, p := range due {
+			if !checked[p.Name+" "+p.URL] {
+				checked[p.Name+" "+p.URL] = true
+				batch = append(batch, p)
+			}
+		}
+		if len(batch) == 0 {
+			return nil
+		}
+		if err := checkBatch(store, mail, batch, interval, base); err != nil {
+			return err
+		}
+		if len(due) < checkBatchSize {
+			return nil
+		}
+	}
+}
+
+func checkBatch(store Store, mail *ownerMail, batch []Package, interval, base time.Duration) error {
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	work := make(chan Package)
+	for i := 0; i < checkWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for p := range work {
+				if err := checkPackageURL(store, mail, p, interval, base); err != nil {
+					once.Do(func() { firstErr = err })
+				}
+			}
+		}()
+	}
+	for _, p := range batch {
+		work <- p
+	}
+	close(work)
+	wg.Wait()
+	return firstErr
+}
+
+func checkPackageURL(store Store, mail *ownerMail, p Package, interval, base time.Duration) error {
+	checkErr := checkURL(p.URL)
+	if checkErr == nil {
+		return store.RecordURLSuccess(p, interval)
+	}
+	jobLog.Infof("URL check failed for %s (%s): %s", p.Name, p.URL, checkErr)
+	broken, err := store.RecordURLFailure(p, brokenThreshold, base, maxCheckBackoff)
+	if err != nil {
+		return err
+	}
+	if broken {
+		if owner, err := store.PackageOrganization(p.Name); err == nil {
+			mail.notify(owner, "package_broken", mailData{Package: p, Error: checkErr.Error()})
+		}
+	}
+	return nil
+}
+
+// repositorySchemes are the URL schemes of repositories git is asked to
+// reach. Others, like file:// or ext::, would let a client make the
+// registry read local paths or run commands.
+var repositorySchemes = []string{"https://", "http://", "git://", "ssh://"}
+
+// scpLikeURL matches the user@host:path form of ssh URLs, e.g.
+// git@github.com:owner/repo.git.
+var scpLikeURL = regexp.MustCompile(`^[A-Za-z0-9._-]+@[A-Za-z0-9.-]+:[^/-]`)
+
+// validateRepositoryURL accepts the URLs of network repositories. It must
+// pass before a URL from a request reaches git.
+func validateRepositoryURL(url string) error {
+	if strings.HasPrefix(url, "-") {
+		return errors.New("URL must not start with -")
+	}
+	if strings.ContainsAny(url, " \t\r\n") {
+		return errors.New("URL must not contain whitespace")
+	}
+	lower := strings.ToLower(url)
+	for _, scheme := range repositorySchemes {
+		if strings.HasPrefix(lower, scheme) && len(url) > len(scheme) {
+			return nil
+		}
+	}
+	if scpLikeURL.MatchString(url) {
+		return nil
+	}
+	return errors.New("URL must be https://, http://, git://, ssh:// or user@host:path")
+}
+
+// checkURL uses git ls-remote when git is available and falls back to an
+// HTTP HEAD request for http(s) URLs otherwise. URLs failing
+// validateRepositoryURL are rejected without running either.
+func checkURL(url string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+
+	if err := validateRepositoryURL(url); err != nil {
+		return err
+	}
+	if git, err := exec.LookPath("git"); err == nil {
+		cmd := exec.CommandContext(ctx, git, "ls-remote", "--heads", "--", url)
+		cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0", "GIT_ALLOW_PROTOCOL=https:http:git:ssh")
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("git ls-remote: %s: %s", err, strings.TrimSpace(string(out)))
+		}
+		return nil
+	}
+
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return errors.New("git is not installed and URL is not http(s)")
+	}
+	req, err := http.NewRequest(http.MethodHead, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 400 {
+		return fmt.Errorf("HEAD returned %s", resp.Status)
+	}
+	return nil
+}
+
+type BrokenPackage struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	Failures  int32     `json:"failures"`
+	CheckedAt time.Time `json:"checked_at"`
+}
+
+func (s *Server) listBrokenPackages(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	broken, err := s.store.BrokenPackages()
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return r, jsonResponse(r, http.StatusOK, broken)
+}
@@ -0,0 +1,118 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The GitHub enrichment job also downloads the tarball of every tagged
+// version once and records its SHA-256 sum, so clients can check that the
+// archive they download is the one the registry first saw.
+// /packages/{name}/versions lists the versions with their sums.
+
+// checksumBatchSize caps the tarballs downloaded per package and round;
+// the rest are summed the next time the package is enriched.
+const checksumBatchSize = 20
+
+// VersionChecksum is a tagged version and, once the enrichment job summed
+// it, the SHA-256 of its tarball.
+type VersionChecksum struct {
+	Version string `json:"version"`
+	Tag     string `json:"tag"`
+	Tarball string `json:"tarball,omitempty"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// recordChecksums sums the tarballs of the newest versions of p that have
+// no sum yet.
+func (e *githubEnricher) recordChecksums(p Package) error {
+	versions, err := repoVersions(p.URL)
+	if err != nil {
+		return err
+	}
+	sums, err := e.store.VersionChecksums(p.URL)
+	if err != nil {
+		return err
+	}
+	summed := 0
+	for i := len(versions) - 1; i >= 0 && summed < checksumBatchSize; i-- {
+		tag := versions[i].Tag
+		if _, ok := sums[tag]; ok {
+			continue
+		}
+		tarball, ok := githubArchiveURL(p.URL, "tar.gz", tag)
+		if !ok {
+			return nil
+		}
+		sum, err := tarballChecksum(tarball)
+		if err != nil {
+			archiveLog.Warnf("Could not sum %s %s: %s", p.Name, tag, err)
+			metrics.Add("checksum_errors", 1)
+			continue
+		}
+		if err := e.store.RecordChecksum(p.URL, tag, sum); err != nil {
+			return err
+		}
+		metrics.Add("checksums_recorded", 1)
+		summed++
+	}
+	return nil
+}
+
+func tarballChecksum(tarball string) (string, error) {
+	resp, err := archiveClient.Get(tarball)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, resp.Body); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func versionsPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/") && strings.HasSuffix(strings.TrimPrefix(req.URL.Path, "/packages/"), "/versions")
+	}
+}
+
+// listVersions serves the versions of a package, newest first, with the
+// sums recorded so far.
+func (s *Server) listVersions(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/packages/"), "/versions")
+	pkg, err := s.readPackage(r, name)
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	versions, err := repoVersions(pkg.URL)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not list repository tags")
+	}
+	sums, err := s.store.VersionChecksums(pkg.URL)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+
+	list := make([]VersionChecksum, 0, len(versions))
+	for i := len(versions) - 1; i >= 0; i-- {
+		v := versions[i]
+		tarball, _ := githubArchiveURL(pkg.URL, "tar.gz", v.Tag)
+		list = append(list, VersionChecksum{Version: v.String(), Tag: v.Tag, Tarball: tarball, SHA256: sums[v.Tag]})
+	}
+	response := jsonResponse(r, http.StatusOK, list)
+	response.Header.Set("Cache-Control", cacheControl(pkg, int(tagCacheTTL.Seconds())))
+	return r, response
+}
@@ -0,0 +1,224 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ClientStat counts the requests made by one client version on one day.
+type ClientStat struct {
+	Day      time.Time `json:"day"`
+	Client   string    `json:"client"`
+	Version  string    `json:"version"`
+	Requests int64     `json:"requests"`
+}
+
+// maxClientKeys bounds the distinct clients counted between two flushes, so
+// made-up User-Agents can't grow the counts without limit.
+const maxClientKeys = 1000
+
+// userAgentProduct matches the first product token of a User-Agent. Bower
+// sends either "bower/1.8.8 (...)" or, in old releases, "node/v0.10.26 darwin x64".
+var userAgentProduct = regexp.MustCompile(`^([A-Za-z][A-Za-z0-9._-]{0,31})/v?([0-9][0-9A-Za-z.+-]{0,31})`)
+
+var clientName = regexp.MustCompile(`^[a-z][a-z0-9._-]*$`)
+
+// parseUserAgent returns the lowercased client name and its version, or
+// "unknown" when the User-Agent has no product token.
+func parseUserAgent(ua string) (client, version string) {
+	m := userAgentProduct.FindStringSubmatch(strings.TrimSpace(ua))
+	if m == nil {
+		return "unknown", ""
+	}
+	return strings.ToLower(m[1]), m[2]
+}
+
+type clientKey struct {
+	client, version string
+}
+
+type clientCounter struct {
+	mu     sync.Mutex
+	counts map[clientKey]int64
+}
+
+func (c *clientCounter) add(client, version string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[clientKey]int64{}
+	}
+	key := clientKey{client, version}
+	if _, ok := c.counts[key]; !ok && len(c.counts) >= maxClientKeys {
+		key = clientKey{"other", ""}
+	}
+	c.counts[key]++
+}
+
+// take returns the counts collected so far and resets them.
+func (c *clientCounter) take(day time.Time) []ClientStat {
+	c.mu.Lock()
+	counts := c.counts
+	c.counts = nil
+	c.mu.Unlock()
+
+	stats := make([]ClientStat, 0, len(counts))
+	for k, n := range counts {
+		stats = append(stats, ClientStat{Day: day, Client: k.client, Version: k.version, Requests: n})
+	}
+	return stats
+}
+
+// countClient records the client of every request that gets past the health
+// and metrics endpoints. It never answers the request itself.
+func (s *Server) countClient(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	s.clients.add(parseUserAgent(r.UserAgent()))
+	return r, nil
+}
+
+// startClientStats adds the counted requests to the client_stats table
+// every interval.
+func (s *Server) startClientStats(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			stats := s.clients.take(time.Now().UTC().Truncate(24 * time.Hour))
+			if len(stats) == 0 {
+				continue
+			}
+			if err := s.store.RecordClientRequests(stats); err != nil {
+				jobLog.Errorf("Could not record client statistics: %s", err)
+			}
+		}
+	}()
+}
+
+func (s *Server) listClientStats(r *http.Request) *http.Response {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	stats, err := s.store.ClientStats(since)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if stats == nil {
+		stats = []ClientStat{}
+	}
+	return jsonResponse(r, http.StatusOK, stats)
+}
+
+// clientRule selects a client and, optionally, a range of its versions.
+type clientRule struct {
+	client      string
+	constraints []versionConstraint
+}
+
+type versionConstraint struct {
+	op      string
+	version Version
+}
+
+func (c versionConstraint) allows(v Version) bool {
+	cmp := compareVersions(v, c.version)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return cmp == 0
+}
+
+// parseClientRules parses rules such as "node, bower<1.8.0" or
+// "bower>=1.3 <1.8". A version missing minor or patch numbers is padded
+// with zeros.
+func parseClientRules(s string) ([]clientRule, error) {
+	var rules []clientRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		i := strings.IndexAny(item, "<>=")
+		if i < 0 {
+			i = len(item)
+		}
+		rule := clientRule{client: strings.ToLower(strings.TrimSpace(item[:i]))}
+		if !clientName.MatchString(rule.client) {
+			return nil, fmt.Errorf("invalid client rule %q", item)
+		}
+		for _, field := range strings.Fields(item[i:]) {
+			op := field[:len(field)-len(strings.TrimLeft(field, "<>="))]
+			switch op {
+			case "<", "<=", ">", ">=", "=":
+			default:
+				return nil, fmt.Errorf("invalid client rule %q", item)
+			}
+			v, ok := parseLooseVersion(field[len(op):])
+			if !ok {
+				return nil, fmt.Errorf("invalid client rule %q", item)
+			}
+			rule.constraints = append(rule.constraints, versionConstraint{op, v})
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseLooseVersion(s string) (Version, bool) {
+	s = strings.TrimLeft(s, "v")
+	core, rest := s, ""
+	if i := strings.IndexAny(s, "-+"); i >= 0 {
+		core, rest = s[:i], s[i:]
+	}
+	for strings.Count(core, ".") < 2 {
+		core += ".0"
+	}
+	return parseVersion(core + rest)
+}
+
+func (rule clientRule) matches(client, version string) bool {
+	if rule.client != client {
+		return false
+	}
+	if len(rule.constraints) == 0 {
+		return true
+	}
+	v, ok := parseLooseVersion(version)
+	if !ok {
+		return false
+	}
+	for _, c := range rule.constraints {
+		if !c.allows(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// matchesClient reports whether the request's User-Agent is selected by any
+// of rules. Without rules every client is selected.
+func matchesClient(rules []clientRule, r *http.Request) bool {
+	if len(rules) == 0 {
+		return true
+	}
+	client, version := parseUserAgent(r.UserAgent())
+	for _, rule := range rules {
+		if rule.matches(client, version) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,51 @@
+package registry
+
+import (
+	"errors"
+	"sync"
+)
+
+// errLookupAborted is what waiting lookups get when the call they share
+// panics.
+var errLookupAborted = errors.New("lookup aborted")
+
+// lookupGroup coalesces concurrent lookups of the same package: while one
+// is in flight, others for the name wait for its result instead of
+// querying the database too. Bursts of identical lookups, e.g. after a CDN
+// purge, then cost one query.
+type lookupGroup struct {
+	mu    sync.Mutex
+	calls map[string]*lookupCall
+}
+
+type lookupCall struct {
+	done chan struct{}
+	pkg  Package
+	err  error
+}
+
+// do returns fn's result, calling it only when no call for name is in
+// flight. The second result tells whether the call was shared.
+func (g *lookupGroup) do(name string, fn func() (Package, error)) (Package, error, bool) {
+	g.mu.Lock()
+	if call, ok := g.calls[name]; ok {
+		g.mu.Unlock()
+		<-call.done
+		return call.pkg, call.err, true
+	}
+	if g.calls == nil {
+		g.calls = map[string]*lookupCall{}
+	}
+	call := &lookupCall{done: make(chan struct{}), err: errLookupAborted}
+	g.calls[name] = call
+	g.mu.Unlock()
+
+	defer func() {
+		g.mu.Lock()
+		delete(g.calls, name)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+	call.pkg, call.err = fn()
+	return call.pkg, call.err, false
+}
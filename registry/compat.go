@@ -0,0 +1,95 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Package lookups come in two formats. The classic one is the {name, url}
+// object Bower clients expect; the extended one adds the package metadata.
+// Clients ask for the extended format with
+//
+//	Accept: application/vnd.registry.v2+json
+//
+// and RESPONSE_FORMAT=extended makes it the default for everyone else.
+// Extended fields are snake_case unless RESPONSE_FIELD_CASE=camel.
+
+const mediaTypeV2 = "application/vnd.registry.v2+json"
+
+type responseFormat struct {
+	extendedDefault bool
+	camelCase       bool
+}
+
+func loadResponseFormat() responseFormat {
+	return responseFormat{
+		extendedDefault: getEnv("RESPONSE_FORMAT", "classic") == "extended",
+		camelCase:       getEnv("RESPONSE_FIELD_CASE", "snake") == "camel",
+	}
+}
+
+// extended reports whether a request gets the extended format. An explicit
+// application/json keeps the classic format even when extended is the
+// default.
+func (f responseFormat) extended(r *http.Request) bool {
+	accept := r.Header.Get("Accept")
+	if strings.Contains(accept, mediaTypeV2) {
+		return true
+	}
+	return f.extendedDefault && !strings.Contains(accept, "application/json")
+}
+
+func (f responseFormat) field(snake string) string {
+	if !f.camelCase {
+		return snake
+	}
+	parts := strings.Split(snake, "_")
+	for i := 1; i < len(parts); i++ {
+		parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+	}
+	return strings.Join(parts, "")
+}
+
+// marshalExtended encodes a package in the extended format. canonicalName
+// is set for lookups through an alias.
+func (f responseFormat) marshalExtended(d PackageDetails, name, canonicalName string) ([]byte, error) {
+	return json.Marshal(f.extendedDocument(d, name, canonicalName))
+}
+
+func (f responseFormat) extendedDocument(d PackageDetails, name, canonicalName string) map[string]interface{} {
+	keywords := d.Keywords
+	if keywords == nil {
+		keywords = []string{}
+	}
+	doc := map[string]interface{}{
+		f.field("name"):        name,
+		f.field("url"):         d.URL,
+		f.field("description"): d.Description,
+		f.field("keywords"):    keywords,
+		f.field("hits"):        d.Hits,
+		f.field("status"):      d.Status,
+		f.field("stars"):       d.Stars,
+		f.field("archived"):    d.Archived,
+	}
+	if d.Deprecated != nil {
+		doc[f.field("deprecated")] = d.Deprecated
+	} else {
+		doc[f.field("deprecated")] = nil
+	}
+	if d.License != "" {
+		doc[f.field("license")] = d.License
+	} else {
+		doc[f.field("license")] = nil
+	}
+	if d.CreatedAt != nil {
+		doc[f.field("created_at")] = d.CreatedAt.UTC().Format(time.RFC3339)
+	} else {
+		doc[f.field("created_at")] = nil
+	}
+	if canonicalName != "" {
+		doc[f.field("canonical_name")] = canonicalName
+	}
+	return doc
+}
@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The Composer facade exposes every package as {vendor}/{name} using
+// lazy provider loading (Composer 1) and metadata-url (Composer 2), so no
+// repository tags have to be listed until a package is actually requested.
+
+type composerSource struct {
+	Type      string `json:"type"`
+	URL       string `json:"url"`
+	Reference string `json:"reference"`
+}
+
+type composerVersion struct {
+	Name    string          `json:"name"`
+	Version string          `json:"version"`
+	Source  composerSource  `json:"source"`
+	Dist    *composerSource `json:"dist,omitempty"`
+}
+
+func (s *Server) composerRoot(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	data, err := json.Marshal(map[string]interface{}{
+		"packages":                   []string{},
+		"providers-lazy-url":         "/p/%package%.json",
+		"metadata-url":               "/p2/%package%.json",
+		"available-package-patterns": []string{s.config.composerVendor + "/*"},
+	})
+	if err != nil {
+		return r, goproxy.NewResponse(r, "application/json", http.StatusInternalServerError, `{"error":"Internal server error"}`)
+	}
+	response := goproxy.NewResponse(r, "application/json", http.StatusOK, string(data))
+	response.Header.Add("Cache-Control", "public, max-age=604800")
+	return r, response
+}
+
+// composerPackage serves both /p/{vendor}/{name}.json, where versions are
+// keyed by version string, and /p2/{vendor}/{name}.json, where they are a list.
+func (s *Server) composerPackage(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	notFound := goproxy.NewResponse(r, "application/json", http.StatusNotFound, `{"error":"Not found"}`)
+
+	v2 := strings.HasPrefix(r.URL.Path, "/p2/")
+	fullName := strings.TrimSuffix(strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/p2/"), "/p/"), ".json")
+	dev := v2 && strings.HasSuffix(fullName, "~dev")
+	fullName = strings.TrimSuffix(fullName, "~dev")
+	if !strings.HasPrefix(fullName, s.config.composerVendor+"/") {
+		return r, notFound
+	}
+	// Composer 2 requests dev versions from {name}~dev.json; tags are all we have.
+	if dev {
+		data, _ := json.Marshal(map[string]interface{}{"packages": map[string][]composerVersion{fullName: {}}})
+		return r, goproxy.NewResponse(r, "application/json", http.StatusOK, string(data))
+	}
+	packageName := strings.TrimPrefix(fullName, s.config.composerVendor+"/")
+
+	p, err := s.store.GetPackage(packageName)
+	if err == nil {
+		err = s.checkVisible(r, p)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			return r, notFound
+		}
+		return r, goproxy.NewResponse(r, "application/json", http.StatusInternalServerError, `{"error":"Internal server error"}`)
+	}
+
+	url := p.URL
+	versions, err := repoVersions(url)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "application/json", http.StatusBadGateway, `{"error":"Could not list repository tags"}`)
+	}
+
+	list := []composerVersion{}
+	byVersion := map[string]composerVersion{}
+	for _, v := range versions {
+		cv := composerVersion{
+			Name:    fullName,
+			Version: v.String(),
+			Source:  composerSource{Type: "git", URL: url, Reference: v.Tag},
+		}
+		if zip, ok := githubArchiveURL(url, "zip", v.Tag); ok {
+			cv.Dist = &composerSource{Type: "zip", URL: zip, Reference: v.Tag}
+		}
+		list = append(list, cv)
+		byVersion[cv.Version] = cv
+	}
+
+	var doc interface{} = map[string]interface{}{"packages": map[string]interface{}{fullName: byVersion}}
+	if v2 {
+		doc = map[string]interface{}{"packages": map[string]interface{}{fullName: list}}
+	}
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "application/json", http.StatusInternalServerError, `{"error":"Internal server error"}`)
+	}
+	response := goproxy.NewResponse(r, "application/json", http.StatusOK, string(data))
+	response.Header.Add("Cache-Control", cacheControl(p, 600))
+	return r, response
+}
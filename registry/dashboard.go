@@ -0,0 +1,85 @@
+package registry
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /admin/ is a small dashboard for admins on top of the admin API: package
+// search with URL editing, the moderation queue of broken packages and held
+// registrations, the audit log, cache flushing and live metrics. Its files
+// live in dashboard/ and are built into the binary. Browsers sign in at
+// /admin/login, through OIDC or with the admin token, and the script's
+// requests carry the session cookie they get.
+
+//go:embed dashboard
+var dashboardFiles embed.FS
+
+// dashboardPage returns a response with the file name of dashboard/.
+func dashboardPage(r *http.Request, name, contentType string) *http.Response {
+	data, err := dashboardFiles.ReadFile("dashboard/" + name)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return goproxy.NewResponse(r, contentType, http.StatusOK, string(data))
+}
+
+// dashboardAsset serves the script of the dashboard, which holds no secrets
+// and is loaded without credentials.
+func dashboardAsset(r *http.Request) *http.Response {
+	if r.Method != http.MethodGet || r.URL.Path != "/admin/dashboard.js" {
+		return nil
+	}
+	response := dashboardPage(r, "dashboard.js", "application/javascript; charset=utf-8")
+	response.Header.Set("Cache-Control", "public, max-age=300")
+	return response
+}
+
+func (s *Server) serveDashboard(r *http.Request) *http.Response {
+	response := dashboardPage(r, "index.html", "text/html; charset=utf-8")
+	response.Header.Set("Cache-Control", "no-store")
+	return response
+}
+
+type packageURL struct {
+	URL string `json:"url"`
+}
+
+func (s *Server) setPackageURL(r *http.Request) *http.Response {
+	path := strings.TrimPrefix(r.URL.Path, "/admin/packages/")
+	if !strings.HasSuffix(path, "/url") {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+	}
+	name := strings.TrimSuffix(path, "/url")
+	var u packageURL
+	if err := json.NewDecoder(r.Body).Decode(&u); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	u.URL = normalizeURL(u.URL)
+	if err := validateRepositoryURL(u.URL); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL. "+err.Error())
+	}
+	if err := checkURL(u.URL); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL")
+	}
+	old, err := s.store.GetPackage(name)
+	if err == nil {
+		err = s.store.SetPackageURL(name, u.URL)
+	}
+	switch err {
+	case nil:
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	case ErrURLTaken:
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "Repository already registered as another package")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.audit(s.adminActor(r), "package.url_changed", name, old.URL+" -> "+u.URL)
+	s.packagesChanged(old.URL, u.URL)
+	return jsonResponse(r, http.StatusOK, u)
+}
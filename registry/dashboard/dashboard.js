@@ -0,0 +1,133 @@
+(function () {
+  'use strict';
+
+  // Requests carry the session cookie set at sign-in.
+  function api(method, path, body) {
+    var init = {method: method, headers: {'Accept': 'application/json'}, credentials: 'same-origin'};
+    if (body !== undefined) init.body = JSON.stringify(body);
+    return fetch(path, init).then(function (res) {
+      if (!res.ok) return res.text().then(function (text) { throw new Error(res.status + ' ' + text); });
+      return res.status === 204 ? null : res.json();
+    });
+  }
+
+  function status(text) {
+    document.getElementById('status').textContent = text;
+  }
+
+  function fail(err) {
+    status(err.message);
+  }
+
+  function row(cells) {
+    var tr = document.createElement('tr');
+    cells.forEach(function (cell) {
+      var td = document.createElement('td');
+      if (cell instanceof Node) td.appendChild(cell); else td.textContent = cell == null ? '' : cell;
+      tr.appendChild(td);
+    });
+    return tr;
+  }
+
+  function fill(id, rows, empty) {
+    var table = document.getElementById(id);
+    table.textContent = '';
+    rows.forEach(function (r) { table.appendChild(r); });
+    if (!rows.length) table.appendChild(row([empty]));
+  }
+
+  function editButton(pkg, done) {
+    var button = document.createElement('button');
+    button.textContent = 'Edit URL';
+    button.onclick = function () {
+      var url = prompt('New repository URL of ' + pkg.name, pkg.url);
+      if (!url || url === pkg.url) return;
+      api('POST', '/admin/packages/' + encodeURIComponent(pkg.name) + '/url', {url: url}).then(function () {
+        status('Moved ' + pkg.name + ' to ' + url);
+        done();
+        loadAudit();
+      }, fail);
+    };
+    return button;
+  }
+
+  function search() {
+    var q = document.querySelector('#search input').value.trim();
+    if (!q) return;
+    api('GET', '/packages/search/' + encodeURIComponent(q)).then(function (results) {
+      fill('results', results.map(function (p) {
+        return row([p.name, p.url, editButton(p, search)]);
+      }), 'No packages found.');
+    }, fail);
+  }
+
+  function loadBroken() {
+    api('GET', '/packages/broken').then(function (broken) {
+      fill('broken', broken.map(function (p) {
+        return row([p.name, p.url, p.failures + ' failed checks', editButton(p, loadBroken)]);
+      }), 'Nothing to review.');
+    }, fail);
+  }
+
+  function decide(h, method, verb) {
+    var button = document.createElement('button');
+    button.textContent = verb;
+    button.onclick = function () {
+      api(method, '/admin/registrations/' + encodeURIComponent(h.name)).then(function () {
+        status(verb + 'd ' + h.name);
+        loadHeld();
+        loadAudit();
+      }, fail);
+    };
+    return button;
+  }
+
+  function loadHeld() {
+    api('GET', '/admin/registrations').then(function (held) {
+      fill('held', held.map(function (h) {
+        return row([h.name, h.url, 'similar to ' + h.similar_to, decide(h, 'POST', 'Approve'), decide(h, 'DELETE', 'Dismiss')]);
+      }), 'Nothing to review.');
+    }, fail);
+  }
+
+  function loadAudit() {
+    api('GET', '/admin/audit-log?limit=50').then(function (entries) {
+      fill('audit', entries.map(function (e) {
+        return row([new Date(e.at).toLocaleString(), e.actor, e.action, e.package, e.detail]);
+      }), 'No entries.');
+    }, fail);
+  }
+
+  function loadMetrics() {
+    api('GET', '/metrics').then(function (vars) {
+      var counters = vars.registry || {};
+      var rows = Object.keys(counters).sort().filter(function (name) {
+        return typeof counters[name] === 'number';
+      }).map(function (name) {
+        return row([name, counters[name]]);
+      });
+      if (vars.memstats) {
+        rows.push(row(['heap_alloc_bytes', vars.memstats.HeapAlloc]));
+        rows.push(row(['gc_runs', vars.memstats.NumGC]));
+      }
+      fill('metrics', rows, 'No metrics yet.');
+    }, fail);
+  }
+
+  document.getElementById('search').onsubmit = function (e) {
+    e.preventDefault();
+    search();
+  };
+  document.getElementById('flush').onclick = function () {
+    if (!confirm('Flush the caches of every instance?')) return;
+    api('POST', '/admin/cache/invalidate', {keys: ['*'], packages: ['*']}).then(function () {
+      status('Caches flushed');
+    }, fail);
+  };
+
+  loadBroken();
+  loadHeld();
+  loadAudit();
+  loadMetrics();
+  setInterval(loadMetrics, 5000);
+})();
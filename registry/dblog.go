@@ -0,0 +1,65 @@
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// queryLogger receives pgx's per-query log events. It logs queries slower
+// than threshold and counts slow and timed out statements. Parameters are
+// redacted, since lookups carry user input.
+type queryLogger struct {
+	threshold time.Duration
+	slow      *expvar.Int
+	timeouts  *expvar.Int
+}
+
+func newQueryLogger(threshold time.Duration) *queryLogger {
+	l := &queryLogger{threshold: threshold, slow: new(expvar.Int), timeouts: new(expvar.Int)}
+	metrics.Set("db_slow_queries", l.slow)
+	metrics.Set("db_statement_timeouts", l.timeouts)
+	return l
+}
+
+func (l *queryLogger) Log(level pgx.LogLevel, msg string, data map[string]interface{}) {
+	if msg != "Query" && msg != "Exec" {
+		if level <= pgx.LogLevelError {
+			dbLog.Errorf("Database %s: %v", msg, data["err"])
+		}
+		return
+	}
+
+	if err, ok := data["err"].(pgx.PgError); ok && err.Code == "57014" {
+		l.timeouts.Add(1)
+		dbLog.Warnf("Statement timeout: %v args=%s", data["sql"], redactArgs(data["args"]))
+		return
+	}
+	if d, ok := data["time"].(time.Duration); ok && d >= l.threshold {
+		l.slow.Add(1)
+		dbLog.Warnf("Slow query (%s): %v args=%s", d, data["sql"], redactArgs(data["args"]))
+	}
+}
+
+// redactArgs keeps the shape of query parameters but not their content.
+func redactArgs(args interface{}) string {
+	list, ok := args.([]interface{})
+	if !ok {
+		return "[]"
+	}
+	redacted := make([]string, len(list))
+	for i, a := range list {
+		switch v := a.(type) {
+		case string:
+			redacted[i] = fmt.Sprintf("<string len=%d>", len(v))
+		case nil:
+			redacted[i] = "NULL"
+		default:
+			redacted[i] = fmt.Sprintf("<%T>", v)
+		}
+	}
+	return "[" + strings.Join(redacted, " ") + "]"
+}
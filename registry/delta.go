@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// GET /packages?since= serves the packages changed since a point in time,
+// and tombstones of the packages deleted since, so mirrors can stay in
+// sync without downloading the whole list. since is an RFC 3339 time, Unix
+// seconds, or the cursor of the previous response; 0 syncs everything.
+//
+// Changes are stamped when they are written but only become visible when
+// their transaction commits, so a cursor at the end of the changes points
+// deltaOverlap back in time. Clients see some changes twice and have to
+// apply them idempotently.
+
+const deltaOverlap = time.Minute
+
+const (
+	defaultDeltaLimit = 1000
+	maxDeltaLimit     = 10000
+)
+
+// PackageChange is a package of the default registry that was created,
+// changed or, when Deleted is set, removed at At.
+type PackageChange struct {
+	Name    string
+	URL     string
+	At      time.Time
+	Deleted bool
+}
+
+// before and after compare a change to the position (at, name) in the
+// order changes are synced in.
+func (c PackageChange) before(at time.Time, name string) bool {
+	return c.At.Before(at) || c.At.Equal(at) && c.Name < name
+}
+
+func (c PackageChange) after(at time.Time, name string) bool {
+	return c.At.After(at) || c.At.Equal(at) && c.Name > name
+}
+
+type changedPackage struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type deletedPackage struct {
+	Name      string    `json:"name"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type packageChanges struct {
+	Packages []changedPackage `json:"packages"`
+	Deleted  []deletedPackage `json:"deleted"`
+	// Cursor is the since of the next request; More is set when it should
+	// be made right away.
+	Cursor string `json:"cursor"`
+	More   bool   `json:"more"`
+}
+
+// deltaCursor is a position in the order of changes. Cursors are opaque to
+// clients.
+type deltaCursor struct {
+	at   time.Time
+	name string
+}
+
+func (c deltaCursor) String() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.FormatInt(c.at.UnixNano(), 10) + ":" + c.name))
+}
+
+func parseSince(since string) (deltaCursor, error) {
+	if t, err := time.Parse(time.RFC3339, since); err == nil {
+		return deltaCursor{at: t}, nil
+	}
+	if secs, err := strconv.ParseInt(since, 10, 64); err == nil {
+		return deltaCursor{at: time.Unix(secs, 0)}, nil
+	}
+	raw, err := base64.RawURLEncoding.DecodeString(since)
+	if err != nil {
+		return deltaCursor{}, errors.New("invalid since")
+	}
+	parts := strings.SplitN(string(raw), ":", 2)
+	nanos, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil || len(parts) != 2 {
+		return deltaCursor{}, errors.New("invalid since")
+	}
+	return deltaCursor{at: time.Unix(0, nanos), name: parts[1]}, nil
+}
+
+func (s *Server) listPackageChanges(r *http.Request) *http.Response {
+	cursor, err := parseSince(r.URL.Query().Get("since"))
+	if err != nil {
+		return jsonResponse(r, http.StatusBadRequest, map[string]string{"error": "Invalid since, expected a time or a cursor"})
+	}
+	limit := defaultDeltaLimit
+	if l := r.URL.Query().Get("limit"); l != "" {
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 || limit > maxDeltaLimit {
+			return jsonResponse(r, http.StatusBadRequest, map[string]string{"error": "Invalid limit, the maximum is " + strconv.Itoa(maxDeltaLimit)})
+		}
+	}
+
+	start := time.Now()
+	changes, err := s.store.PackageChanges(cursor.at, cursor.name, limit+1)
+	if err != nil {
+		return jsonResponse(r, http.StatusInternalServerError, map[string]string{"error": "Internal server error"})
+	}
+
+	result := packageChanges{Packages: []changedPackage{}, Deleted: []deletedPackage{}}
+	if len(changes) > limit {
+		changes, result.More = changes[:limit], true
+	}
+	for _, c := range changes {
+		if c.Deleted {
+			result.Deleted = append(result.Deleted, deletedPackage{Name: c.Name, DeletedAt: c.At.UTC()})
+		} else {
+			result.Packages = append(result.Packages, changedPackage{Name: c.Name, URL: c.URL, UpdatedAt: c.At.UTC()})
+		}
+	}
+
+	next := deltaCursor{at: start.Add(-deltaOverlap)}
+	if result.More {
+		last := changes[len(changes)-1]
+		next = deltaCursor{at: last.At, name: last.Name}
+	} else if next.at.Before(cursor.at) {
+		// Polling more often than deltaOverlap must not move backwards.
+		next = cursor
+	}
+	result.Cursor = next.String()
+
+	response := jsonResponse(r, http.StatusOK, result)
+	response.Header.Set("Cache-Control", "no-cache")
+	return response
+}
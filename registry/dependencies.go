@@ -0,0 +1,160 @@
+package registry
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The GitHub enrichment job also reads the bower.json on the default branch
+// of each repository and keeps the dependencies it declares.
+// /packages/{name}/dependencies lists them and /packages/{name}/dependents
+// answers the reverse question, which packages depend on a given one, so
+// maintainers can tell who a breaking change affects. Dependents are paginated
+// like /v2/packages, with the links in a Link header since the body is a
+// plain list.
+
+// dependencyCacheTTL is short next to the enrichment interval, which is
+// when dependencies change.
+const dependencyCacheTTL = time.Hour
+
+// maxManifestSize caps the bower.json read from a repository.
+const maxManifestSize = 1 << 20
+
+const (
+	dependentsDefaultPerPage = 100
+	dependentsMaxPerPage     = 1000
+)
+
+// Dependency is a package declared in a bower.json, with the range or
+// endpoint it was declared with.
+type Dependency struct {
+	Name  string `json:"name"`
+	Range string `json:"range"`
+	Dev   bool   `json:"dev,omitempty"`
+}
+
+type bowerManifest struct {
+	Dependencies    map[string]string `json:"dependencies"`
+	DevDependencies map[string]string `json:"devDependencies"`
+}
+
+// fetchDependencies returns the dependencies declared in the bower.json of
+// owner/repo, none when it has no bower.json.
+func (e *githubEnricher) fetchDependencies(owner, repo string) ([]Dependency, error) {
+	resp, err := e.get("/repos/"+owner+"/"+repo+"/contents/bower.json", "application/vnd.github.raw")
+	if err != nil {
+		return nil, err
+	}
+	deps := []Dependency{}
+	if resp == nil {
+		return deps, nil
+	}
+	defer resp.Body.Close()
+
+	var m bowerManifest
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxManifestSize)).Decode(&m); err != nil {
+		return nil, err
+	}
+	for name, r := range m.Dependencies {
+		deps = append(deps, Dependency{Name: name, Range: r})
+	}
+	for name, r := range m.DevDependencies {
+		deps = append(deps, Dependency{Name: name, Range: r, Dev: true})
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].Name != deps[j].Name {
+			return deps[i].Name < deps[j].Name
+		}
+		return !deps[i].Dev && deps[j].Dev
+	})
+	return deps, nil
+}
+
+var dependencyOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/packages/{name}/dependencies", Summary: "List the dependencies declared in the bower.json of a package", Result: []Dependency{}},
+	{Method: http.MethodGet, Path: "/packages/{name}/dependents", Summary: "List the packages that declare a dependency on a package", Query: []string{"page", "per_page"}, Result: []Dependency{}},
+}
+
+func dependenciesPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		path := strings.TrimPrefix(req.URL.Path, "/packages/")
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/") &&
+			(strings.HasSuffix(path, "/dependencies") || strings.HasSuffix(path, "/dependents"))
+	}
+}
+
+func (s *Server) dependenciesHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	path := strings.TrimPrefix(r.URL.Path, "/packages/")
+	if strings.HasSuffix(path, "/dependents") {
+		return r, s.listDependents(r, strings.TrimSuffix(path, "/dependents"))
+	}
+	return r, s.listDependencies(r, strings.TrimSuffix(path, "/dependencies"))
+}
+
+func (s *Server) listDependencies(r *http.Request, name string) *http.Response {
+	pkg, err := s.readPackage(r, name)
+	if err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	deps, err := s.store.Dependencies(pkg.URL)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	response := jsonResponse(r, http.StatusOK, deps)
+	response.Header.Set("Cache-Control", cacheControl(pkg, int(dependencyCacheTTL.Seconds())))
+	return response
+}
+
+// listDependents serves the public packages depending on a package. The
+// package itself needn't be registered, since bower.json may name
+// dependencies the registry doesn't know.
+func (s *Server) listDependents(r *http.Request, name string) *http.Response {
+	page, ok := queryInt(r, "page", 1)
+	if !ok {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid page")
+	}
+	perPage, ok := queryInt(r, "per_page", dependentsDefaultPerPage)
+	if !ok || perPage > dependentsMaxPerPage {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid per_page, the maximum is "+strconv.Itoa(dependentsMaxPerPage))
+	}
+
+	pkg, err := s.readPackage(r, name)
+	if err == nil && pkg.CanonicalName != "" {
+		name = pkg.CanonicalName
+	} else if err != nil && err != ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	// One more than asked tells whether there is a next page.
+	dependents, err := s.store.Dependents(name, (page-1)*perPage, perPage+1)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	next := len(dependents) > perPage
+	if next {
+		dependents = dependents[:perPage]
+	}
+
+	pageURL := func(n int) string {
+		return r.URL.Path + "?page=" + strconv.Itoa(n) + "&per_page=" + strconv.Itoa(perPage)
+	}
+	links := []string{"<" + pageURL(1) + `>; rel="first"`}
+	if page > 1 {
+		links = append(links, "<"+pageURL(page-1)+`>; rel="prev"`)
+	}
+	if next {
+		links = append(links, "<"+pageURL(page+1)+`>; rel="next"`)
+	}
+	response := jsonResponse(r, http.StatusOK, dependents)
+	response.Header.Set("Link", strings.Join(links, ", "))
+	response.Header.Set("Cache-Control", cacheControl(pkg, int(dependencyCacheTTL.Seconds())))
+	return response
+}
@@ -0,0 +1,120 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Packages can be marked deprecated by an admin or, for packages owned by
+// an organization, by its members. Lookups then carry the deprecation and a
+// Warning header, and search ranks the package lower.
+
+// Deprecation explains why a package shouldn't be used any more.
+type Deprecation struct {
+	Message     string `json:"message"`
+	Replacement string `json:"replacement,omitempty"`
+}
+
+// warning formats the deprecation as a Warning header (RFC 7234).
+func (d Deprecation) warning(name string) string {
+	text := name + " is deprecated: " + d.Message
+	if d.Replacement != "" {
+		text += " Use " + d.Replacement + " instead."
+	}
+	return "299 - " + strconv.Quote(text)
+}
+
+var deprecateOperations = []apiOperation{
+	{Method: http.MethodPost, Path: "/packages/{name}/deprecation", Summary: "Deprecate a package", Body: Deprecation{}, Result: Deprecation{}, Auth: true},
+	{Method: http.MethodDelete, Path: "/packages/{name}/deprecation", Summary: "Undo the deprecation of a package", Auth: true},
+}
+
+func deprecationPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return strings.HasPrefix(req.URL.Path, "/packages/") && strings.HasSuffix(req.URL.Path, "/deprecation")
+	}
+}
+
+func (s *Server) deprecationHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusMethodNotAllowed, "Method not allowed")
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/packages/"), "/deprecation")
+	actor, err := s.packageMaintainer(r, name)
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if actor == "" {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Only admins, the owning organization and its maintainers can deprecate a package")
+	}
+
+	if r.Method == http.MethodDelete {
+		if err := s.store.SetDeprecation(name, nil); err == ErrNotFound {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+		} else if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		s.audit(actor, "package.undeprecated", name, "")
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	}
+
+	var d Deprecation
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	d.Message, d.Replacement = strings.TrimSpace(d.Message), strings.TrimSpace(d.Replacement)
+	if d.Message == "" {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "A message is required")
+	}
+	if d.Replacement != "" {
+		if d.Replacement == name {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "A package can't replace itself")
+		}
+		if _, err := s.lookupPackage(d.Replacement); err == ErrNotFound {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "The replacement is not registered")
+		} else if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+	}
+	if err := s.store.SetDeprecation(name, &d); err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.audit(actor, "package.deprecated", name, d.Message)
+	return r, jsonResponse(r, http.StatusOK, d)
+}
+
+// packageMaintainer returns who may change a package on behalf of r:
+// the admin, "org:<name>" for the owning organization, "org:<name>/<member>"
+// for members of its teams that maintain the package, or "".
+func (s *Server) packageMaintainer(r *http.Request, name string) (string, error) {
+	owner, err := s.store.PackageOrganization(name)
+	if err != nil {
+		return "", err
+	}
+	if actor := s.adminActor(r); actor != "" {
+		return actor, nil
+	}
+	if owner == "" {
+		return "", nil
+	}
+	owns, err := s.isOrgMember(r, owner)
+	if err != nil {
+		return "", err
+	}
+	if owns {
+		return "org:" + owner, nil
+	}
+	member, permission, err := s.memberPermission(r, owner, name)
+	if err != nil || permission != permissionMaintain {
+		return "", err
+	}
+	return "org:" + owner + "/" + member, nil
+}
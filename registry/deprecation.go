@@ -0,0 +1,262 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const defaultDeprecationMessage = "This bower version is deprecated. Please update it: npm update -g bower"
+
+// deprecationConfig shapes the fake search results old clients get instead
+// of real ones. Messages are templates over deprecationData; localized
+// variants come from DEPRECATION_MESSAGE_{LANG}, e.g. DEPRECATION_MESSAGE_PT_BR.
+type deprecationConfig struct {
+	packageName string
+	results     int
+	messages    map[string]*template.Template
+	// redirectPercent is the share of clients, by IP, that get redirected.
+	redirectPercent uint32
+	// probeURL, when set, is checked before redirecting; see upstreamProbe.
+	probeURL      string
+	probeTimeout  time.Duration
+	probeRetries  int
+	probeInterval time.Duration
+}
+
+type deprecationData struct {
+	Query   string
+	Host    string
+	Client  string
+	Version string
+}
+
+func loadDeprecationConfig() (deprecationConfig, error) {
+	cfg := deprecationConfig{
+		packageName: getEnv("DEPRECATION_PACKAGE", "deprecated"),
+		messages:    map[string]*template.Template{},
+	}
+	var err error
+	if cfg.results, err = strconv.Atoi(getEnv("DEPRECATION_RESULTS", "1")); err != nil || cfg.results < 1 {
+		return cfg, fmt.Errorf("Invalid DEPRECATION_RESULTS: %s", getEnv("DEPRECATION_RESULTS", ""))
+	}
+
+	percent, err := strconv.ParseUint(getEnv("DEPRECATION_REDIRECT_PERCENT", "100"), 10, 32)
+	if err != nil || percent > 100 {
+		return cfg, fmt.Errorf("Invalid DEPRECATION_REDIRECT_PERCENT: %s", getEnv("DEPRECATION_REDIRECT_PERCENT", ""))
+	}
+	cfg.redirectPercent = uint32(percent)
+
+	cfg.probeURL = getEnv("DEPRECATION_PROBE_URL", "")
+	if cfg.probeTimeout, err = time.ParseDuration(getEnv("DEPRECATION_PROBE_TIMEOUT", "2s")); err != nil {
+		return cfg, fmt.Errorf("Invalid DEPRECATION_PROBE_TIMEOUT: %s", err)
+	}
+	if cfg.probeRetries, err = strconv.Atoi(getEnv("DEPRECATION_PROBE_RETRIES", "2")); err != nil || cfg.probeRetries < 0 {
+		return cfg, fmt.Errorf("Invalid DEPRECATION_PROBE_RETRIES: %s", getEnv("DEPRECATION_PROBE_RETRIES", ""))
+	}
+	if cfg.probeInterval, err = time.ParseDuration(getEnv("DEPRECATION_PROBE_INTERVAL", "30s")); err != nil {
+		return cfg, fmt.Errorf("Invalid DEPRECATION_PROBE_INTERVAL: %s", err)
+	}
+
+	sources := map[string]string{"": getEnv("DEPRECATION_MESSAGE", defaultDeprecationMessage)}
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "DEPRECATION_MESSAGE_") {
+			continue
+		}
+		parts := strings.SplitN(strings.TrimPrefix(kv, "DEPRECATION_MESSAGE_"), "=", 2)
+		lang := strings.ToLower(strings.Replace(parts[0], "_", "-", -1))
+		sources[lang] = parts[1]
+	}
+	for lang, text := range sources {
+		t, err := template.New(lang).Parse(text)
+		if err != nil {
+			return cfg, fmt.Errorf("Invalid deprecation message %q: %s", lang, err)
+		}
+		cfg.messages[lang] = t
+	}
+	return cfg, nil
+}
+
+// message picks the variant for the preferred language of Accept-Language,
+// falling back from "pt-br" to "pt" and finally to DEPRECATION_MESSAGE.
+func (cfg deprecationConfig) message(acceptLanguage string) *template.Template {
+	for _, lang := range acceptedLanguages(acceptLanguage) {
+		if t, ok := cfg.messages[lang]; ok {
+			return t
+		}
+		if i := strings.IndexByte(lang, '-'); i > 0 {
+			if t, ok := cfg.messages[lang[:i]]; ok {
+				return t
+			}
+		}
+	}
+	return cfg.messages[""]
+}
+
+// acceptedLanguages returns the languages of an Accept-Language header,
+// lowercased and ordered by quality.
+func acceptedLanguages(header string) []string {
+	type weighted struct {
+		lang string
+		q    float64
+	}
+	var langs []weighted
+	for _, part := range strings.Split(header, ",") {
+		fields := strings.Split(part, ";")
+		lang := strings.ToLower(strings.TrimSpace(fields[0]))
+		if lang == "" || lang == "*" {
+			continue
+		}
+		q := 1.0
+		for _, f := range fields[1:] {
+			if f = strings.TrimSpace(f); strings.HasPrefix(f, "q=") {
+				if v, err := strconv.ParseFloat(f[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			langs = append(langs, weighted{lang, q})
+		}
+	}
+	sort.SliceStable(langs, func(i, j int) bool { return langs[i].q > langs[j].q })
+	list := make([]string, len(langs))
+	for i, l := range langs {
+		list[i] = l.lang
+	}
+	return list
+}
+
+// redirects reports whether the redirect applies to a client. Clients are
+// bucketed by a hash of their IP, so a client is either always or never
+// redirected while the percentage is raised step by step.
+func (cfg deprecationConfig) redirects(clientIP string) bool {
+	if cfg.redirectPercent >= 100 {
+		return true
+	}
+	h := fnv.New32a()
+	h.Write([]byte(clientIP))
+	return h.Sum32()%100 < cfg.redirectPercent
+}
+
+// upstreamProbe caches whether registry.bower.io answers, so clients are
+// only redirected to a registry that is up. While it is down they are served
+// from local data instead.
+type upstreamProbe struct {
+	mu      sync.Mutex
+	up      bool
+	checked time.Time
+}
+
+// healthy probes cfg.probeURL at most once per probeInterval, retrying
+// failed attempts probeRetries times. Requests arriving during a probe
+// wait for its result.
+func (p *upstreamProbe) healthy(cfg deprecationConfig) bool {
+	if cfg.probeURL == "" {
+		return true
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.checked.IsZero() && time.Since(p.checked) < cfg.probeInterval {
+		return p.up
+	}
+	client := &http.Client{Timeout: cfg.probeTimeout}
+	var err error
+	for attempt := 0; attempt <= cfg.probeRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * 100 * time.Millisecond)
+		}
+		var resp *http.Response
+		if resp, err = client.Get(cfg.probeURL); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode/100 != 2 {
+				err = fmt.Errorf("status %s", resp.Status)
+			}
+		}
+		if err == nil {
+			break
+		}
+	}
+	if up := err == nil; up != p.up || p.checked.IsZero() {
+		if up {
+			serverLog.Infof("Upstream %s is up, redirecting deprecated hosts", cfg.probeURL)
+		} else {
+			serverLog.Warnf("Upstream %s is down, serving deprecated hosts locally: %s", cfg.probeURL, err)
+		}
+		p.up = up
+	}
+	p.checked = time.Now()
+	return p.up
+}
+
+// deprecationResults renders the fake search results for a request.
+func (s *Server) deprecationResults(r *http.Request) (string, error) {
+	client, version := parseUserAgent(r.UserAgent())
+	data := deprecationData{
+		Query:   strings.TrimPrefix(r.URL.Path, "/packages/search/"),
+		Host:    r.Host,
+		Client:  client,
+		Version: version,
+	}
+	var msg bytes.Buffer
+	if err := s.config.deprecation.message(r.Header.Get("Accept-Language")).Execute(&msg, data); err != nil {
+		return "", err
+	}
+	results := make([]Package, s.config.deprecation.results)
+	for i := range results {
+		results[i] = Package{Name: s.config.deprecation.packageName, URL: msg.String()}
+	}
+	out, err := json.Marshal(results)
+	return string(out), err
+}
+
+// deprecatedHostHandler sends old clients that still use another hostname to
+// registry.bower.io. DEPRECATED_CLIENTS can narrow it down to some clients
+// and DEPRECATION_REDIRECT_PERCENT roll the redirect out gradually; clients
+// left out, or all of them while DEPRECATION_PROBE_URL fails, are served as
+// usual.
+func (s *Server) deprecatedHostHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	host := normalizeHost(r.Host)
+	if r.Method == "GET" && host != "registry.bower.io" && host != "components.bower.io" && matchesClient(s.config.deprecatedClients, r) {
+		s.countDeprecatedRequest(r)
+		if strings.HasPrefix(r.URL.Path, "/packages/search/") && s.flags.on("deprecation_stub") {
+			body, err := s.deprecationResults(r)
+			if err != nil {
+				return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+			}
+			response := goproxy.NewResponse(r, "application/json", http.StatusOK, body)
+			response.Header.Set("Vary", "Accept-Language")
+			return r, response
+		}
+		if !s.config.deprecation.redirects(s.clientIP(r)) {
+			return r, nil
+		}
+		if !s.upstream.healthy(s.config.deprecation) {
+			metrics.Add("deprecation_upstream_down", 1)
+			return r, nil
+		}
+		if s.flags.on("redirect_delay") {
+			time.Sleep(10 * time.Second)
+		}
+		response := goproxy.NewResponse(r, "application/json", http.StatusPermanentRedirect, "")
+		target := "https://registry.bower.io" + r.URL.Path
+		if len(r.URL.RawQuery) > 0 {
+			target += "?" + r.URL.RawQuery
+		}
+		response.Header.Set("Location", target)
+		return r, response
+	}
+
+	return r, nil
+}
@@ -0,0 +1,66 @@
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+)
+
+// The runtime profiles of net/http/pprof and the expvar variables are
+// served on DIAGNOSTICS_ADDR, apart from the registry port, so profiles can
+// be taken from production without exposing them:
+//
+//	go tool pprof http://localhost:6060/debug/pprof/goroutine
+//
+// Only loopback addresses are accepted; reach the port through SSH or
+// kubectl port-forward.
+
+const defaultDiagnosticsAddr = "127.0.0.1:6060"
+
+// diagnosticsAddr returns the address of the diagnostics port, empty when
+// it is turned off with DIAGNOSTICS_ADDR=none.
+func diagnosticsAddr() (string, error) {
+	addr := getEnv("DIAGNOSTICS_ADDR", defaultDiagnosticsAddr)
+	if addr == "none" {
+		return "", nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return "", fmt.Errorf("Invalid DIAGNOSTICS_ADDR: %s", err)
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return "", fmt.Errorf("Invalid DIAGNOSTICS_ADDR: %s is not a loopback address", addr)
+	}
+	return addr, nil
+}
+
+func diagnosticsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// startDiagnostics serves the diagnostics port in the background. The port
+// is bound before returning, so a taken port stops the startup.
+func startDiagnostics() error {
+	addr, err := diagnosticsAddr()
+	if err != nil || addr == "" {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("Could not listen on DIAGNOSTICS_ADDR: %s", err)
+	}
+	serverLog.Infof("Serving diagnostics at %s", l.Addr())
+	go func() {
+		serverLog.Errorf("Diagnostics server stopped: %s", http.Serve(l, diagnosticsHandler()))
+	}()
+	return nil
+}
@@ -0,0 +1,256 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Lookups of a package, what `bower install` makes for each dependency, are
+// counted as its downloads per hour and added to the store every minute.
+// Every hour the counts are compacted: hours older than
+// DOWNLOAD_STATS_HOURS (default 168) are added up into days, days older
+// than DOWNLOAD_STATS_DAYS (default 90) into months, and months older than
+// DOWNLOAD_STATS_MONTHS (default 0, never) are deleted. The series of a
+// package is served at /packages/{name}/downloads for trend graphs.
+
+// downloadIntervals are the bucket sizes, finest first.
+var downloadIntervals = []string{"hour", "day", "month"}
+
+// maxDownloadPoints caps the buckets of a series.
+const maxDownloadPoints = 1000
+
+// DownloadBucket counts the downloads of a package in an interval.
+type DownloadBucket struct {
+	Interval  string    `json:"-"`
+	Start     time.Time `json:"start"`
+	Downloads int64     `json:"downloads"`
+}
+
+// DownloadSeries is the downloads of a package per interval.
+type DownloadSeries struct {
+	Name     string           `json:"name"`
+	Interval string           `json:"interval"`
+	Total    int64            `json:"total"`
+	Buckets  []DownloadBucket `json:"buckets"`
+}
+
+// truncateToInterval returns the start of the interval containing t, in
+// UTC.
+func truncateToInterval(t time.Time, interval string) time.Time {
+	t = t.UTC()
+	switch interval {
+	case "hour":
+		return t.Truncate(time.Hour)
+	case "day":
+		return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	default:
+		return time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+	}
+}
+
+// nextInterval returns the start of the interval after the one starting at
+// t.
+func nextInterval(t time.Time, interval string) time.Time {
+	switch interval {
+	case "hour":
+		return t.Add(time.Hour)
+	case "day":
+		return t.AddDate(0, 0, 1)
+	default:
+		return t.AddDate(0, 1, 0)
+	}
+}
+
+// intervalRank orders the intervals from finest to coarsest, -1 for unknown
+// ones.
+func intervalRank(interval string) int {
+	for i, name := range downloadIntervals {
+		if name == interval {
+			return i
+		}
+	}
+	return -1
+}
+
+type downloadCounter struct {
+	mu     sync.Mutex
+	hour   time.Time
+	counts map[string]int64
+}
+
+func (c *downloadCounter) add(name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.counts == nil {
+		c.counts = map[string]int64{}
+	}
+	c.counts[name]++
+}
+
+// take returns the counts collected since the last call and resets them.
+// Counts collected before an hour ended are taken as of that hour.
+func (c *downloadCounter) take(now time.Time) (time.Time, map[string]int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	hour, counts := c.hour, c.counts
+	c.hour, c.counts = now.UTC().Truncate(time.Hour), nil
+	if hour.IsZero() {
+		hour = c.hour
+	}
+	return hour, counts
+}
+
+// startDownloadStats adds the counted downloads to the store every
+// interval and compacts the buckets every hour.
+func (s *Server) startDownloadStats(interval time.Duration) {
+	s.downloads.take(time.Now())
+	go func() {
+		var compacted time.Time
+		for now := range time.Tick(interval) {
+			if hour, counts := s.downloads.take(now); len(counts) > 0 {
+				if err := s.store.RecordDownloads(hour, counts); err != nil {
+					jobLog.Errorf("Could not record downloads: %s", err)
+				}
+			}
+			if now.Sub(compacted) < time.Hour {
+				continue
+			}
+			compacted = now
+			if err := s.compactDownloads(now); err != nil {
+				jobLog.Errorf("Could not compact download statistics: %s", err)
+			}
+		}
+	}()
+}
+
+// downloadRetention returns when the buckets of interval kept at now
+// start: older ones have been compacted into the next interval.
+func (s *Server) downloadRetention(interval string, now time.Time) time.Time {
+	switch interval {
+	case "hour":
+		return truncateToInterval(now.Add(-time.Duration(s.config.downloadStatsHours)*time.Hour), "day")
+	case "day":
+		return truncateToInterval(now.AddDate(0, 0, -s.config.downloadStatsDays), "month")
+	}
+	if s.config.downloadStatsMonths == 0 {
+		return time.Time{}
+	}
+	return truncateToInterval(now.AddDate(0, -s.config.downloadStatsMonths, 0), "month")
+}
+
+func (s *Server) compactDownloads(now time.Time) error {
+	for i, interval := range downloadIntervals {
+		before := s.downloadRetention(interval, now)
+		if before.IsZero() {
+			continue
+		}
+		into := ""
+		if i+1 < len(downloadIntervals) {
+			into = downloadIntervals[i+1]
+		}
+		n, err := s.store.CompactDownloads(interval, into, before)
+		if err != nil {
+			return err
+		}
+		metrics.Add("download_buckets_compacted", int64(n))
+	}
+	return nil
+}
+
+func downloadsPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/") && strings.HasSuffix(req.URL.Path, "/downloads")
+	}
+}
+
+// parseDownloadTime accepts RFC 3339 times and dates.
+func parseDownloadTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// listDownloads serves the downloads of a package per interval (hour, day
+// or month, default day) from from to to, by default the last 30 buckets.
+// Buckets already compacted into a coarser interval are left out, so the
+// series starts where its interval is still kept.
+func (s *Server) listDownloads(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/packages/"), "/downloads")
+	query := r.URL.Query()
+	interval := query.Get("interval")
+	if interval == "" {
+		interval = "day"
+	}
+	rank := intervalRank(interval)
+	if rank < 0 {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "interval must be hour, day or month")
+	}
+
+	now := time.Now()
+	until := nextInterval(truncateToInterval(now, interval), interval)
+	since := until
+	for i := 0; i < 30; i++ {
+		since = truncateToInterval(since.Add(-time.Nanosecond), interval)
+	}
+	for param, t := range map[string]*time.Time{"from": &since, "to": &until} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		parsed, err := parseDownloadTime(value)
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, fmt.Sprintf("Invalid %s, use a date or an RFC 3339 time", param))
+		}
+		*t = truncateToInterval(parsed, interval)
+		if param == "to" {
+			*t = nextInterval(*t, interval)
+		}
+	}
+	if kept := s.downloadRetention(interval, now); since.Before(kept) {
+		since = truncateToInterval(kept, interval)
+	}
+
+	pkg, err := s.readPackage(r, name)
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	canonical := pkg.Name
+	if pkg.CanonicalName != "" {
+		canonical = pkg.CanonicalName
+	}
+
+	series := DownloadSeries{Name: canonical, Interval: interval, Buckets: []DownloadBucket{}}
+	index := map[int64]int{}
+	for t := since; t.Before(until); t = nextInterval(t, interval) {
+		if len(series.Buckets) == maxDownloadPoints {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, fmt.Sprintf("At most %d buckets, narrow from and to", maxDownloadPoints))
+		}
+		index[t.Unix()] = len(series.Buckets)
+		series.Buckets = append(series.Buckets, DownloadBucket{Start: t})
+	}
+	buckets, err := s.store.Downloads(canonical, since, until)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	for _, b := range buckets {
+		if intervalRank(b.Interval) > rank {
+			continue
+		}
+		if i, ok := index[truncateToInterval(b.Start, interval).Unix()]; ok {
+			series.Buckets[i].Downloads += b.Downloads
+			series.Total += b.Downloads
+		}
+	}
+
+	response := jsonResponse(r, http.StatusOK, series)
+	response.Header.Set("Cache-Control", cacheControl(pkg, 300))
+	return r, response
+}
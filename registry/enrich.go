@@ -0,0 +1,189 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// With GITHUB_TOKEN set, packages hosted on GitHub are enriched in the
+// background with the description, star count, license and archived flag of
+// their repository, the dependencies declared in its bower.json, see
+// dependencies.go, and the checksums of their versions, see checksums.go.
+// Package pages and the extended format show them, and search ranks popular
+// repositories up and archived ones down.
+
+const enrichBatchSize = 100
+
+// RepoMetadata is what the GitHub API tells about a repository.
+type RepoMetadata struct {
+	Description string
+	Stars       int
+	License     string
+	Archived    bool
+}
+
+type githubEnricher struct {
+	store  Store
+	api    string
+	token  string
+	maxAge time.Duration
+	client *http.Client
+}
+
+type githubRepo struct {
+	Description string `json:"description"`
+	Stars       int    `json:"stargazers_count"`
+	Archived    bool   `json:"archived"`
+	License     *struct {
+		SPDXID string `json:"spdx_id"`
+	} `json:"license"`
+}
+
+// errGitHubRateLimited stops a batch until the rate limit resets.
+type errGitHubRateLimited time.Time
+
+func (e errGitHubRateLimited) Error() string {
+	return "GitHub rate limit exceeded until " + time.Time(e).Format(time.RFC3339)
+}
+
+// startGitHubEnricher enriches the packages due every interval, each one at
+// most once per GITHUB_ENRICH_MAX_AGE. It does nothing without GITHUB_TOKEN.
+func startGitHubEnricher(store Store) error {
+	token := getEnv("GITHUB_TOKEN", "")
+	if token == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(getEnv("GITHUB_ENRICH_INTERVAL", "10m"))
+	if err != nil {
+		return fmt.Errorf("Invalid GITHUB_ENRICH_INTERVAL: %s", err)
+	}
+	maxAge, err := time.ParseDuration(getEnv("GITHUB_ENRICH_MAX_AGE", "24h"))
+	if err != nil {
+		return fmt.Errorf("Invalid GITHUB_ENRICH_MAX_AGE: %s", err)
+	}
+	e := &githubEnricher{
+		store:  store,
+		api:    getEnv("GITHUB_API_URL", "https://api.github.com"),
+		token:  token,
+		maxAge: maxAge,
+		client: &http.Client{Timeout: 10 * time.Second},
+	}
+	go func() {
+		var pausedUntil time.Time
+		for range time.Tick(interval) {
+			if time.Now().Before(pausedUntil) {
+				continue
+			}
+			if err := e.enrichDue(); err != nil {
+				if limited, ok := err.(errGitHubRateLimited); ok {
+					pausedUntil = time.Time(limited)
+				}
+				jobLog.Errorf("GitHub enrichment error: %s", err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (e *githubEnricher) enrichDue() error {
+	due, err := e.store.DueEnrichments(time.Now().Add(-e.maxAge), enrichBatchSize)
+	if err != nil {
+		return err
+	}
+	for _, p := range due {
+		owner, repo, ok := parseGitHubURL(p.URL)
+		if !ok {
+			// Matched by the store's rough URL filter only; don't ask again.
+			if err := e.store.RecordEnrichment(p, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		m, err := e.fetch(owner, repo)
+		if _, limited := err.(errGitHubRateLimited); limited {
+			return err
+		} else if err != nil {
+			jobLog.Warnf("Could not enrich %s from GitHub: %s", p.Name, err)
+			metrics.Add("github_enrich_errors", 1)
+		}
+		var deps []Dependency
+		if m != nil {
+			deps, err = e.fetchDependencies(owner, repo)
+			if _, limited := err.(errGitHubRateLimited); limited {
+				return err
+			} else if err != nil {
+				jobLog.Warnf("Could not read the bower.json of %s: %s", p.Name, err)
+				metrics.Add("github_enrich_errors", 1)
+			}
+		}
+		if err := e.store.RecordEnrichment(p, m); err != nil {
+			return err
+		}
+		if m != nil {
+			metrics.Add("github_enriched", 1)
+			if deps != nil {
+				if err := e.store.RecordDependencies(p.URL, deps); err != nil {
+					return err
+				}
+			}
+			if err := e.recordChecksums(p); err != nil {
+				jobLog.Errorf("Could not record the checksums of %s: %s", p.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// get requests path from the GitHub API. It returns a nil response when
+// the resource doesn't exist or can't be read; the caller closes the body
+// of any other.
+func (e *githubEnricher) get(path, accept string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, e.api+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	req.Header.Set("Authorization", "token "+e.token)
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case resp.StatusCode == http.StatusOK:
+		return resp, nil
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusUnavailableForLegalReasons:
+		resp.Body.Close()
+		return nil, nil
+	case resp.Header.Get("X-RateLimit-Remaining") == "0":
+		resp.Body.Close()
+		reset, _ := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+		return nil, errGitHubRateLimited(time.Unix(reset, 0))
+	default:
+		resp.Body.Close()
+		return nil, fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+}
+
+// fetch returns the metadata of owner/repo, or nil when the repository
+// doesn't exist or can't be read.
+func (e *githubEnricher) fetch(owner, repo string) (*RepoMetadata, error) {
+	resp, err := e.get("/repos/"+owner+"/"+repo, "application/vnd.github+json")
+	if resp == nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var r githubRepo
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return nil, err
+	}
+	m := &RepoMetadata{Description: r.Description, Stars: r.Stars, Archived: r.Archived}
+	if r.License != nil && r.License.SPDXID != "NOASSERTION" {
+		m.License = r.License.SPDXID
+	}
+	return m, nil
+}
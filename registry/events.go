@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /events streams the changes of the default registry's packages as
+// Server-Sent Events. A trigger on the packages table sends every change of a
+// public package to the registry_events channel, so the feed covers changes
+// made by this app, the node app or by hand, on any instance. A package made
+// private is reported as deleted. Events are not replayed: a
+// client that reconnects may have missed some and should resync.
+
+const eventsChannel = "registry_events"
+
+// eventKeepAlive is the interval of the comments that keep idle
+// connections from being closed by proxies.
+const eventKeepAlive = 30 * time.Second
+
+// registryEvent is the payload sent by the packages trigger. Type is
+// created, updated or deleted; OldName is set when a package was renamed.
+type registryEvent struct {
+	Type    string `json:"type"`
+	Name    string `json:"name"`
+	URL     string `json:"url"`
+	OldName string `json:"old_name,omitempty"`
+}
+
+// eventHub fans events out to the connected clients. A client that falls
+// behind by more than its buffer is disconnected rather than slowing down
+// everyone else.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[chan registryEvent]bool
+}
+
+func (h *eventHub) subscribe() chan registryEvent {
+	ch := make(chan registryEvent, 64)
+	h.mu.Lock()
+	if h.subscribers == nil {
+		h.subscribers = map[chan registryEvent]bool{}
+	}
+	h.subscribers[ch] = true
+	h.mu.Unlock()
+	metrics.Add("events_clients", 1)
+	return ch
+}
+
+func (h *eventHub) unsubscribe(ch chan registryEvent) {
+	h.mu.Lock()
+	if h.subscribers[ch] {
+		delete(h.subscribers, ch)
+		close(ch)
+	}
+	h.mu.Unlock()
+	metrics.Add("events_clients", -1)
+}
+
+func (h *eventHub) publish(e registryEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for ch := range h.subscribers {
+		select {
+		case ch <- e:
+		default:
+			delete(h.subscribers, ch)
+			close(ch)
+			metrics.Add("events_dropped_clients", 1)
+		}
+	}
+}
+
+// listenForEvents feeds the hub from the store. Stores that can't
+// broadcast have no events.
+func (s *Server) listenForEvents() {
+	n, ok := s.store.(notifier)
+	if !ok {
+		return
+	}
+	n.Listen(eventsChannel, func(payload string) {
+		var e registryEvent
+		if err := json.Unmarshal([]byte(payload), &e); err != nil {
+			serverLog.Warnf("Invalid registry event %q: %s", payload, err)
+			return
+		}
+		// The trigger leaves private packages out, but a package may have
+		// been made private since the change.
+		if e.Type != "deleted" {
+			if p, err := s.store.GetPackage(e.Name); err != nil || p.Private {
+				return
+			}
+		}
+		s.events.publish(e)
+	})
+}
+
+func (s *Server) streamEvents(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if _, ok := s.store.(notifier); !ok {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotImplemented, "Events need the Postgres store")
+	}
+
+	ch := s.events.subscribe()
+	body, w := io.Pipe()
+	go func() {
+		defer s.events.unsubscribe(ch)
+		// Flushed at once, so clients see the stream open.
+		_, err := io.WriteString(w, "retry: 5000\n\n")
+		tick := time.NewTicker(eventKeepAlive)
+		defer tick.Stop()
+		for err == nil {
+			select {
+			case e, ok := <-ch:
+				if !ok {
+					// Dropped by the hub; the client reconnects.
+					w.Close()
+					return
+				}
+				data, _ := json.Marshal(e)
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			case <-tick.C:
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+			case <-r.Context().Done():
+				err = r.Context().Err()
+			}
+		}
+		w.CloseWithError(err)
+	}()
+
+	response := goproxy.NewResponse(r, "text/event-stream", http.StatusOK, "")
+	response.Body = body
+	response.ContentLength = -1
+	response.Header.Set("Cache-Control", "no-cache")
+	response.Header.Set("X-Accel-Buffering", "no")
+	return r, response
+}
+
+// flushEventStreams flushes every write of text/event-stream responses, which
+// would otherwise sit in the response buffer.
+func flushEventStreams(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if f, ok := w.(http.Flusher); ok {
+			w = &eventStreamWriter{ResponseWriter: w, flusher: f}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type eventStreamWriter struct {
+	http.ResponseWriter
+	flusher http.Flusher
+	stream  bool
+}
+
+func (w *eventStreamWriter) WriteHeader(status int) {
+	w.stream = w.Header().Get("Content-Type") == "text/event-stream"
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *eventStreamWriter) Write(p []byte) (int, error) {
+	n, err := w.ResponseWriter.Write(p)
+	if w.stream {
+		w.flusher.Flush()
+	}
+	return n, err
+}
@@ -0,0 +1,67 @@
+package registry
+
+import (
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// runExport writes the registry as static files laid out like the HTTP API:
+// packages.json holds the index and packages/{name} each package, so the
+// directory can be uploaded to a bucket as a read-only mirror.
+func runExport(args []string) {
+	flags := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := flags.String("dir", "export", "directory to write the registry to")
+	flags.Parse(args)
+
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatalf("Connection error: %s", err)
+	}
+	defer store.Close()
+
+	packages, err := store.ListPackages()
+	if err != nil {
+		log.Fatalf("Could not list packages: %s", err)
+	}
+	if err := exportPackages(*dir, packages); err != nil {
+		log.Fatalf("Export failed: %s", err)
+	}
+	log.Printf("Exported %d packages to %s", len(packages), *dir)
+}
+
+func exportPackages(dir string, packages []Package) error {
+	if err := os.MkdirAll(filepath.Join(dir, "packages"), 0755); err != nil {
+		return err
+	}
+
+	if packages == nil {
+		packages = []Package{}
+	}
+	index, err := json.Marshal(packages)
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "packages.json"), index, 0644); err != nil {
+		return err
+	}
+
+	for _, p := range packages {
+		if p.Name == "" || p.Name == "." || p.Name == ".." || strings.ContainsAny(p.Name, `/\`) {
+			log.Printf("Skipping package with unsafe name %q", p.Name)
+			continue
+		}
+		data, err := json.Marshal(p)
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(filepath.Join(dir, "packages", p.Name), data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,130 @@
+package registry
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With READ_FALLBACK_REFRESH set, lookups survive a database outage: every
+// interval a snapshot of the public packages is kept in memory, and when
+// the store fails a lookup, the package is served from it. Before the first
+// snapshot the package list in the shared cache stands in. Only packages
+// found in neither get 503, so an outage degrades the registry instead of
+// taking it down.
+
+const (
+	// fallbackMaxAge keeps answers from the snapshot, which may be stale,
+	// out of caches for long.
+	fallbackMaxAge = 60
+	// fallbackRetryAfter is the Retry-After of lookups that found nothing.
+	fallbackRetryAfter = 30
+)
+
+var (
+	fallbackHits   = new(expvar.Int)
+	fallbackMisses = new(expvar.Int)
+)
+
+// fallbackSnapshot is the last list of public packages read from the store.
+type fallbackSnapshot struct {
+	mu       sync.RWMutex
+	packages map[string]Package
+	taken    time.Time
+}
+
+func (f *fallbackSnapshot) set(packages []Package, taken time.Time) {
+	byName := make(map[string]Package, len(packages))
+	for _, p := range packages {
+		byName[p.Name] = Package{Name: p.Name, URL: p.URL}
+	}
+	f.mu.Lock()
+	f.packages, f.taken = byName, taken
+	f.mu.Unlock()
+}
+
+// lookup returns the package with name; loaded reports whether there is a
+// snapshot at all.
+func (f *fallbackSnapshot) lookup(name string) (pkg Package, found, loaded bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	pkg, found = f.packages[name]
+	return pkg, found, f.packages != nil
+}
+
+// cachedPackageList reads the package list in the shared cache, which the
+// sidecar and refreshPackageList keep.
+func cachedPackageList(cache Cache) ([]Package, error) {
+	val, err := cache.Get("packages_stale")
+	if err != nil {
+		if val, err = cache.Get("packages"); err != nil {
+			return nil, err
+		}
+	}
+	var packages []Package
+	if err := json.Unmarshal([]byte(val), &packages); err != nil {
+		return nil, fmt.Errorf("could not read the cached package list: %s", err)
+	}
+	return packages, nil
+}
+
+// loadCachedList fills an empty snapshot from the cached package list.
+func (s *Server) loadCachedList() {
+	packages, err := cachedPackageList(s.cache)
+	if err != nil {
+		return
+	}
+	// A zero time marks the snapshot as taken from the cache.
+	s.fallback.set(packages, time.Time{})
+}
+
+// startReadFallback takes a snapshot now and then every interval.
+func (s *Server) startReadFallback() {
+	if s.config.readFallbackRefresh <= 0 {
+		return
+	}
+	metrics.Set("read_fallback_hits", fallbackHits)
+	metrics.Set("read_fallback_misses", fallbackMisses)
+	metrics.Set("read_fallback", expvar.Func(func() interface{} {
+		s.fallback.mu.RLock()
+		defer s.fallback.mu.RUnlock()
+		return map[string]interface{}{"packages": len(s.fallback.packages), "taken_at": s.fallback.taken}
+	}))
+	go func() {
+		for {
+			packages, err := s.store.ListPackages()
+			if err != nil {
+				jobLog.Errorf("Could not take the fallback snapshot: %s", err)
+			} else {
+				s.fallback.set(packages, time.Now())
+			}
+			time.Sleep(s.config.readFallbackRefresh)
+		}
+	}()
+}
+
+// fallbackLookup answers a lookup of name the store failed.
+func (s *Server) fallbackLookup(r *http.Request, name string) *http.Response {
+	pkg, found, loaded := s.fallback.lookup(name)
+	if !loaded {
+		s.loadCachedList()
+		pkg, found, _ = s.fallback.lookup(name)
+	}
+	if !found {
+		fallbackMisses.Add(1)
+		response := goproxy.NewResponse(r, "text/html", http.StatusServiceUnavailable, "Registry temporarily unavailable")
+		response.Header.Set("Retry-After", strconv.Itoa(fallbackRetryAfter))
+		return response
+	}
+	fallbackHits.Add(1)
+	response := jsonResponse(r, http.StatusOK, pkg)
+	response.Header.Set("Cache-Control", cacheControl(pkg, fallbackMaxAge))
+	response.Header.Set("Warning", `111 - "Database unavailable, response may be stale"`)
+	return response
+}
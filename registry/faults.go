@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// With FAULT_TOKEN set, requests carrying it in X-Fault-Token can ask for
+// faults in X-Fault, to check client retries and alerting against a real
+// instance without touching its data. X-Fault is a comma-separated list of
+//
+//	error=0.3      fail that share of the requests
+//	status=502     with this status instead of 503
+//	latency=500ms  delay the response
+//	jitter=1s      by up to this much more
+//	cache=drop     miss the shared cache and discard writes to it
+//
+// Faulted responses carry X-Fault-Injected. Requests without the token are
+// served as usual, whatever their X-Fault says.
+
+type faultSpec struct {
+	errorRate float64
+	status    int
+	latency   time.Duration
+	jitter    time.Duration
+	dropCache bool
+}
+
+func parseFaultSpec(value string) (faultSpec, error) {
+	spec := faultSpec{status: http.StatusServiceUnavailable}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return spec, fmt.Errorf("%q is not key=value", item)
+		}
+		var err error
+		switch key, val := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1]); key {
+		case "error":
+			if spec.errorRate, err = strconv.ParseFloat(val, 64); err != nil || spec.errorRate < 0 || spec.errorRate > 1 {
+				return spec, fmt.Errorf("error must be between 0 and 1")
+			}
+		case "status":
+			if spec.status, err = strconv.Atoi(val); err != nil || spec.status < 400 || spec.status > 599 {
+				return spec, fmt.Errorf("status must be between 400 and 599")
+			}
+		case "latency":
+			if spec.latency, err = time.ParseDuration(val); err != nil || spec.latency < 0 {
+				return spec, fmt.Errorf("invalid latency %q", val)
+			}
+		case "jitter":
+			if spec.jitter, err = time.ParseDuration(val); err != nil || spec.jitter < 0 {
+				return spec, fmt.Errorf("invalid jitter %q", val)
+			}
+		case "cache":
+			if val != "drop" {
+				return spec, fmt.Errorf("cache must be drop")
+			}
+			spec.dropCache = true
+		default:
+			return spec, fmt.Errorf("unknown fault %q", key)
+		}
+	}
+	return spec, nil
+}
+
+// maxFaultDelay caps injected delays, so a typo can't hold connections for
+// hours.
+const maxFaultDelay = time.Minute
+
+type dropCacheKey struct{}
+
+// injectFaults applies the faults requests with token ask for.
+func injectFaults(next http.Handler, token string) http.Handler {
+	if token == "" {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		value := r.Header.Get("X-Fault")
+		given := r.Header.Get("X-Fault-Token")
+		r.Header.Del("X-Fault")
+		r.Header.Del("X-Fault-Token")
+		if value == "" || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		spec, err := parseFaultSpec(value)
+		if err != nil {
+			http.Error(w, "Invalid X-Fault: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("X-Fault-Injected", value)
+		metrics.Add("faults_injected", 1)
+
+		delay := spec.latency
+		if spec.jitter > 0 {
+			delay += time.Duration(rand.Int63n(int64(spec.jitter)))
+		}
+		if delay > maxFaultDelay {
+			delay = maxFaultDelay
+		}
+		if delay > 0 {
+			select {
+			case <-time.After(delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+		if spec.errorRate > 0 && rand.Float64() < spec.errorRate {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "Injected fault", spec.status)
+			return
+		}
+		if spec.dropCache {
+			r = r.WithContext(context.WithValue(r.Context(), dropCacheKey{}, true))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// cacheFor returns the cache to use for r: the shared one, or one that
+// always misses when r asked for cache=drop.
+func (s *Server) cacheFor(r *http.Request) Cache {
+	if drop, _ := r.Context().Value(dropCacheKey{}).(bool); drop {
+		return droppedCache{}
+	}
+	return s.cache
+}
+
+// droppedCache is a cache that is down.
+type droppedCache struct{}
+
+func (droppedCache) Get(key string) (string, error)                 { return "", errCacheUnavailable }
+func (droppedCache) Set(key, value string, ttl time.Duration) error { return nil }
+func (droppedCache) Delete(key string) error                        { return nil }
@@ -0,0 +1,153 @@
+package registry
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /feed.xml is an Atom feed of the feedSize packages registered or changed
+// last, for people who follow the ecosystem in a feed reader. Each package
+// is one entry, whose updated time moves when the package changes, so
+// readers show it again. The feed is cached in the shared cache for feedTTL
+// and dropped with the package list whenever packages change.
+
+const (
+	feedSize = 50
+	feedTTL  = 10 * time.Minute
+)
+
+const atomNamespace = "http://www.w3.org/2005/Atom"
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomPerson struct {
+	Name string `xml:"name"`
+}
+
+type atomCategory struct {
+	Term string `xml:"term,attr"`
+}
+
+type atomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type atomEntry struct {
+	ID         string         `xml:"id"`
+	Title      string         `xml:"title"`
+	Updated    string         `xml:"updated"`
+	Published  string         `xml:"published,omitempty"`
+	Links      []atomLink     `xml:"link"`
+	Summary    string         `xml:"summary,omitempty"`
+	Content    atomText       `xml:"content"`
+	Categories []atomCategory `xml:"category"`
+}
+
+type atomFeed struct {
+	XMLName xml.Name    `xml:"feed"`
+	Xmlns   string      `xml:"xmlns,attr"`
+	ID      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  atomPerson  `xml:"author"`
+	Links   []atomLink  `xml:"link"`
+	Entries []atomEntry `xml:"entry"`
+}
+
+func atomTime(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
+
+// feedEntry describes p as registered when it hasn't changed since, and as
+// updated otherwise.
+func (s *Server) feedEntry(p PackageDetails) atomEntry {
+	link := s.config.siteURL + "/packages/" + p.Name
+	entry := atomEntry{
+		ID:      link,
+		Title:   p.Name + " updated",
+		Updated: atomTime(*p.UpdatedAt),
+		Links:   []atomLink{{Href: link}, {Rel: "related", Href: p.URL}},
+		Summary: p.Description,
+	}
+	if p.CreatedAt != nil {
+		entry.Published = atomTime(*p.CreatedAt)
+		if p.UpdatedAt.Sub(*p.CreatedAt) < time.Minute {
+			entry.Title = p.Name + " registered"
+		}
+	}
+	content := []string{"Repository: " + p.URL}
+	if p.License != "" {
+		content = append(content, "License: "+p.License)
+	}
+	if len(p.Keywords) > 0 {
+		content = append(content, "Keywords: "+strings.Join(p.Keywords, ", "))
+	}
+	if p.Deprecated != nil {
+		deprecated := "Deprecated: " + p.Deprecated.Message
+		if p.Deprecated.Replacement != "" {
+			deprecated += ", use " + p.Deprecated.Replacement
+		}
+		content = append(content, deprecated)
+	}
+	if p.Archived {
+		content = append(content, "The repository is archived.")
+	}
+	entry.Content = atomText{Type: "text", Body: strings.Join(content, "\n")}
+	for _, keyword := range p.Keywords {
+		entry.Categories = append(entry.Categories, atomCategory{Term: keyword})
+	}
+	return entry
+}
+
+// refreshFeed renders the feed from the store and caches it.
+func (s *Server) refreshFeed() (string, error) {
+	packages, err := s.store.RecentPackageDetails(feedSize)
+	if err != nil {
+		return "", err
+	}
+	feed := atomFeed{
+		Xmlns:  atomNamespace,
+		ID:     s.config.siteURL + "/feed.xml",
+		Title:  "New and updated Bower packages",
+		Author: atomPerson{Name: "Bower registry"},
+		Links:  []atomLink{{Rel: "self", Href: s.config.siteURL + "/feed.xml"}, {Href: s.config.siteURL + "/"}},
+		// An empty feed was last updated when it was rendered.
+		Updated: atomTime(time.Now()),
+	}
+	for _, p := range packages {
+		feed.Entries = append(feed.Entries, s.feedEntry(p))
+	}
+	if len(feed.Entries) > 0 {
+		feed.Updated = feed.Entries[0].Updated
+	}
+	data, err := xml.Marshal(feed)
+	if err != nil {
+		return "", err
+	}
+	val := xml.Header + string(data)
+	if s.cache.Set("packages_feed", val, feedTTL) == nil {
+		s.cacheKeys.add("packages_feed", len(val), feedTTL)
+	}
+	return val, nil
+}
+
+func (s *Server) serveFeed(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	val, err := s.cacheFor(r).Get("packages_feed")
+	if err != nil {
+		if val, err = s.refresh.Do("packages_feed", s.refreshFeed); err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+	}
+	response := goproxy.NewResponse(r, "application/atom+xml", http.StatusOK, val)
+	response.Header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(feedTTL/time.Second)))
+	return r, response
+}
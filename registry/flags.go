@@ -0,0 +1,228 @@
+package registry
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Feature flags switch behaviours and endpoints on and off without a
+// deploy. FEATURE_FLAGS overrides their defaults, e.g.
+// FEATURE_FLAGS=graphql=false,redirect_delay=false, and the admin API
+// switches them at runtime. Switches are kept in the store, override
+// FEATURE_FLAGS on every instance and survive restarts; instances reload
+// them when one is broadcast, and every minute in case they missed it.
+
+// featureFlagDefaults lists the known flags with their defaults.
+var featureFlagDefaults = []FeatureFlag{
+	{Name: "api_v2", Default: true, Description: "Serve API v2 under /v2/"},
+	{Name: "autocomplete", Default: true, Description: "Serve /autocomplete"},
+	{Name: "deprecation_stub", Default: true, Description: "Answer searches on deprecated hosts with the deprecation message instead of redirecting them"},
+	{Name: "events", Default: true, Description: "Stream change events at /events"},
+	{Name: "graphql", Default: true, Description: "Serve /graphql"},
+	{Name: "native_search", Default: true, Description: "Search in the registry when NATIVE_SEARCH or SEARCH_INDEX_REFRESH is set, rather than in the node process"},
+	{Name: "redirect_delay", Default: true, Description: "Wait 10 seconds before redirecting deprecated hosts"},
+}
+
+// FeatureFlag is the state of a flag.
+type FeatureFlag struct {
+	Name        string `json:"name"`
+	Enabled     bool   `json:"enabled"`
+	Default     bool   `json:"default"`
+	Description string `json:"description"`
+}
+
+// parseFeatureFlags reads FEATURE_FLAGS, a comma-separated list of
+// name=true or name=false.
+func parseFeatureFlags(value string) (map[string]bool, error) {
+	known := map[string]bool{}
+	for _, f := range featureFlagDefaults {
+		known[f.Name] = true
+	}
+	overrides := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		name := strings.TrimSpace(kv[0])
+		if !known[name] {
+			return nil, fmt.Errorf("unknown flag %q", name)
+		}
+		if len(kv) != 2 || (kv[1] != "true" && kv[1] != "false") {
+			return nil, fmt.Errorf("%s must be true or false", name)
+		}
+		overrides[name] = kv[1] == "true"
+	}
+	return overrides, nil
+}
+
+type featureFlags struct {
+	mu sync.RWMutex
+	// configured holds the values FEATURE_FLAGS gives, enabled the current
+	// ones.
+	configured map[string]bool
+	enabled    map[string]bool
+}
+
+func newFeatureFlags(overrides map[string]bool) *featureFlags {
+	f := &featureFlags{configured: map[string]bool{}, enabled: map[string]bool{}}
+	for _, flag := range featureFlagDefaults {
+		value := flag.Default
+		if v, ok := overrides[flag.Name]; ok {
+			value = v
+		}
+		f.configured[flag.Name] = value
+		f.enabled[flag.Name] = value
+	}
+	return f
+}
+
+// on reports whether the flag name is enabled.
+func (f *featureFlags) on(name string) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	enabled, ok := f.enabled[name]
+	if !ok {
+		panic("unknown feature flag " + name)
+	}
+	return enabled
+}
+
+func (f *featureFlags) get(name string) (FeatureFlag, bool) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for _, flag := range featureFlagDefaults {
+		if flag.Name == name {
+			flag.Enabled = f.enabled[name]
+			return flag, true
+		}
+	}
+	return FeatureFlag{}, false
+}
+
+func (f *featureFlags) list() []FeatureFlag {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	flags := make([]FeatureFlag, len(featureFlagDefaults))
+	for i, flag := range featureFlagDefaults {
+		flag.Enabled = f.enabled[flag.Name]
+		flags[i] = flag
+	}
+	return flags
+}
+
+// load applies the switches kept in the store over the configured values.
+// Switches of flags this version doesn't know are ignored.
+func (f *featureFlags) load(switched map[string]bool) {
+	enabled := map[string]bool{}
+	for name, value := range f.configured {
+		if v, ok := switched[name]; ok {
+			value = v
+		}
+		enabled[name] = value
+	}
+	f.mu.Lock()
+	f.enabled = enabled
+	f.mu.Unlock()
+}
+
+func (f *featureFlags) publish() {
+	metrics.Set("feature_flags", expvar.Func(func() interface{} {
+		f.mu.RLock()
+		defer f.mu.RUnlock()
+		var off []string
+		for name, enabled := range f.enabled {
+			if !enabled {
+				off = append(off, name)
+			}
+		}
+		sort.Strings(off)
+		return map[string]interface{}{"off": off}
+	}))
+}
+
+func (s *Server) loadFeatureFlags() error {
+	switched, err := s.store.FeatureFlags()
+	if err != nil {
+		return err
+	}
+	s.flags.load(switched)
+	return nil
+}
+
+// startFeatureFlagRefresh reloads the switches periodically, for instances
+// that missed a broadcast or share a store that can't send them.
+func (s *Server) startFeatureFlagRefresh(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.loadFeatureFlags(); err != nil {
+				jobLog.Errorf("Feature flag refresh error: %s", err)
+			}
+		}
+	}()
+}
+
+// flagged serves h while the flag name is on and 404 otherwise.
+func (s *Server) flagged(name string, h goproxy.FuncReqHandler) goproxy.FuncReqHandler {
+	return func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		if !s.flags.on(name) {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+		}
+		return h(r, ctx)
+	}
+}
+
+type flagSwitch struct {
+	Enabled bool `json:"enabled"`
+}
+
+func (s *Server) listFeatureFlags(r *http.Request) *http.Response {
+	return jsonResponse(r, http.StatusOK, s.flags.list())
+}
+
+// setFeatureFlag switches a flag on POST and returns it to its configured
+// value on DELETE.
+func (s *Server) setFeatureFlag(r *http.Request) *http.Response {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/flags/")
+	if _, ok := s.flags.get(name); !ok {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Unknown flag")
+	}
+	var req flagSwitch
+	reset := r.Method == http.MethodDelete
+	if !reset {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+		}
+	}
+	var err error
+	if reset {
+		err = s.store.ResetFeatureFlag(name)
+	} else {
+		err = s.store.SetFeatureFlag(name, req.Enabled)
+	}
+	if err == nil {
+		err = s.loadFeatureFlags()
+	}
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	if err := s.invalidate(invalidation{FeatureFlags: true}); err != nil {
+		serverLog.Warnf("Could not broadcast feature flag %s: %s", name, err)
+	}
+	flag, _ := s.flags.get(name)
+	state := "off"
+	if flag.Enabled {
+		state = "on"
+	}
+	s.audit(s.adminActor(r), "flag.changed", "", name+" "+state)
+	return jsonResponse(r, http.StatusOK, flag)
+}
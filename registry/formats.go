@@ -0,0 +1,363 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Read endpoints answer in YAML or MessagePack instead of JSON when Accept
+// prefers application/x-yaml or application/msgpack (and their aliases) to
+// application/json. The JSON a handler or the sidecar produced is converted
+// as is, so the fields and their order are the same in every format.
+// Converted responses drop the X-Registry-Signature header, which signs the
+// JSON body.
+
+const (
+	mediaTypeYAML    = "application/x-yaml"
+	mediaTypeMsgpack = "application/msgpack"
+)
+
+// responseMediaTypes maps the accepted media types to the format served.
+var responseMediaTypes = map[string]string{
+	"application/json":          "application/json",
+	"application/x-yaml":        mediaTypeYAML,
+	"application/yaml":          mediaTypeYAML,
+	"text/yaml":                 mediaTypeYAML,
+	"text/x-yaml":               mediaTypeYAML,
+	"application/msgpack":       mediaTypeMsgpack,
+	"application/x-msgpack":     mediaTypeMsgpack,
+	"application/vnd.msgpack":   mediaTypeMsgpack,
+	"application/x-messagepack": mediaTypeMsgpack,
+}
+
+// preferredFormat returns the format of responseMediaTypes that accept
+// rates highest, the first listed among equals, or "" for none.
+func preferredFormat(accept string) string {
+	format, best := "", 0.0
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		mediaType, ok := responseMediaTypes[strings.ToLower(strings.TrimSpace(params[0]))]
+		if !ok {
+			continue
+		}
+		q := 1.0
+		for _, param := range params[1:] {
+			if kv := strings.SplitN(strings.TrimSpace(param), "=", 2); len(kv) == 2 && kv[0] == "q" {
+				q, _ = strconv.ParseFloat(kv[1], 64)
+			}
+		}
+		if q > best {
+			format, best = mediaType, q
+		}
+	}
+	return format
+}
+
+// negotiateFormat converts JSON responses to GET and HEAD requests into the
+// format Accept prefers.
+func negotiateFormat(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || ctx.Req == nil || ctx.Req.Method != http.MethodGet && ctx.Req.Method != http.MethodHead {
+		return resp
+	}
+	mediaType := strings.TrimSpace(strings.Split(resp.Header.Get("Content-Type"), ";")[0])
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") || resp.Header.Get("Content-Encoding") != "" {
+		return resp
+	}
+	// Caches in front must not serve one format for another.
+	if !varies(resp.Header, "Accept") {
+		resp.Header.Add("Vary", "Accept")
+	}
+	format := preferredFormat(ctx.Req.Header.Get("Accept"))
+	if format == "" || format == "application/json" {
+		return resp
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return goproxy.NewResponse(ctx.Req, "text/html", http.StatusBadGateway, "Bad gateway")
+	}
+	if len(bytes.TrimSpace(data)) == 0 {
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return resp
+	}
+	v, err := decodeOrdered(json.NewDecoder(bytes.NewReader(data)))
+	if err != nil {
+		serverLog.Warnf("Could not convert %s to %s: %s", ctx.Req.URL.Path, format, err)
+		resp.Body = ioutil.NopCloser(bytes.NewReader(data))
+		return resp
+	}
+	var buf bytes.Buffer
+	if format == mediaTypeYAML {
+		writeYAML(&buf, v, 0)
+	} else {
+		writeMsgpack(&buf, v)
+	}
+	resp.Header.Set("Content-Type", format)
+	resp.Header.Del("Content-Length")
+	resp.Header.Del(signatureHeader)
+	resp.ContentLength = int64(buf.Len())
+	resp.Body = ioutil.NopCloser(&buf)
+	metrics.Add("responses_converted", 1)
+	return resp
+}
+
+// varies reports whether the Vary header of h lists field.
+func varies(h http.Header, field string) bool {
+	for _, value := range h["Vary"] {
+		for _, f := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(f), field) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// orderedObject is a JSON object with its members in document order.
+type orderedObject []orderedMember
+
+type orderedMember struct {
+	key   string
+	value interface{}
+}
+
+// decodeOrdered reads the next JSON value: an orderedObject, a slice,
+// a string, a json.Number, a bool or nil.
+func decodeOrdered(dec *json.Decoder) (interface{}, error) {
+	dec.UseNumber()
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	switch tok {
+	case json.Delim('{'):
+		obj := orderedObject{}
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			obj = append(obj, orderedMember{key.(string), value})
+		}
+		_, err = dec.Token()
+		return obj, err
+	case json.Delim('['):
+		list := []interface{}{}
+		for dec.More() {
+			value, err := decodeOrdered(dec)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		_, err = dec.Token()
+		return list, err
+	}
+	return tok, nil
+}
+
+// yamlPlain matches the strings YAML reads back as the same string without
+// quotes.
+var yamlPlain = regexp.MustCompile(`^[A-Za-z_/.(][A-Za-z0-9_ /.()@+=$^-]*$`)
+
+// yamlReserved are plain scalars YAML 1.1 readers take for other types.
+var yamlReserved = map[string]bool{
+	"y": true, "n": true, "yes": true, "no": true, "on": true, "off": true,
+	"true": true, "false": true, "null": true, ".inf": true, ".nan": true,
+}
+
+func yamlString(s string) string {
+	if yamlPlain.MatchString(s) && !strings.HasSuffix(s, " ") && !yamlReserved[strings.ToLower(s)] {
+		return s
+	}
+	// Go's escapes are a subset of those of YAML's double-quoted style.
+	return strconv.Quote(s)
+}
+
+// yamlNumber writes exponents as 1.0e+9, which YAML 1.1 readers need to
+// take them for numbers.
+func yamlNumber(n string) string {
+	i := strings.IndexAny(n, "eE")
+	if i < 0 {
+		return n
+	}
+	mantissa, exponent := n[:i], n[i+1:]
+	if !strings.Contains(mantissa, ".") {
+		mantissa += ".0"
+	}
+	if !strings.HasPrefix(exponent, "+") && !strings.HasPrefix(exponent, "-") {
+		exponent = "+" + exponent
+	}
+	return mantissa + "e" + exponent
+}
+
+func yamlScalar(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return strconv.FormatBool(v)
+	case json.Number:
+		return yamlNumber(v.String())
+	case string:
+		return yamlString(v)
+	case orderedObject:
+		return "{}"
+	}
+	return "[]"
+}
+
+// yamlBlock reports whether v is written as an indented block.
+func yamlBlock(v interface{}) bool {
+	switch v := v.(type) {
+	case orderedObject:
+		return len(v) > 0
+	case []interface{}:
+		return len(v) > 0
+	}
+	return false
+}
+
+// writeYAML writes v in block style, nested blocks indented by two spaces
+// more than indent.
+func writeYAML(w io.Writer, v interface{}, indent int) {
+	pad := strings.Repeat("  ", indent)
+	switch v := v.(type) {
+	case orderedObject:
+		if len(v) == 0 {
+			break
+		}
+		for _, m := range v {
+			io.WriteString(w, pad+yamlString(m.key)+":")
+			if yamlBlock(m.value) {
+				io.WriteString(w, "\n")
+				writeYAML(w, m.value, indent+1)
+			} else {
+				io.WriteString(w, " "+yamlScalar(m.value)+"\n")
+			}
+		}
+		return
+	case []interface{}:
+		if len(v) == 0 {
+			break
+		}
+		for _, item := range v {
+			if !yamlBlock(item) {
+				io.WriteString(w, pad+"- "+yamlScalar(item)+"\n")
+				continue
+			}
+			// The first line of a nested block goes after the dash.
+			var buf bytes.Buffer
+			writeYAML(&buf, item, indent+1)
+			io.WriteString(w, pad+"- "+strings.TrimPrefix(buf.String(), pad+"  "))
+		}
+		return
+	}
+	io.WriteString(w, pad+yamlScalar(v)+"\n")
+}
+
+// writeMsgpack writes v in the smallest MessagePack encoding: numbers
+// without a fraction or exponent as integers, others as float 64.
+func writeMsgpack(w *bytes.Buffer, v interface{}) {
+	switch v := v.(type) {
+	case nil:
+		w.WriteByte(0xc0)
+	case bool:
+		if v {
+			w.WriteByte(0xc3)
+		} else {
+			w.WriteByte(0xc2)
+		}
+	case json.Number:
+		if n, err := strconv.ParseInt(v.String(), 10, 64); err == nil {
+			writeMsgpackInt(w, n)
+		} else if n, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			w.WriteByte(0xcf)
+			binary.Write(w, binary.BigEndian, n)
+		} else {
+			f, _ := v.Float64()
+			w.WriteByte(0xcb)
+			binary.Write(w, binary.BigEndian, math.Float64bits(f))
+		}
+	case string:
+		writeMsgpackHeader(w, len(v), 0xa0, 32, 0xd9, 0xda)
+		w.WriteString(v)
+	case []interface{}:
+		writeMsgpackHeader(w, len(v), 0x90, 16, 0, 0xdc)
+		for _, item := range v {
+			writeMsgpack(w, item)
+		}
+	case orderedObject:
+		writeMsgpackHeader(w, len(v), 0x80, 16, 0, 0xde)
+		for _, m := range v {
+			writeMsgpack(w, m.key)
+			writeMsgpack(w, m.value)
+		}
+	}
+}
+
+// writeMsgpackHeader writes the type and length of a string, array or map:
+// fix holding the length below fixMax, else code8 (strings only, 0 for
+// none), code16 or the code after it with the length in 8, 16 or 32 bits.
+func writeMsgpackHeader(w *bytes.Buffer, n int, fix byte, fixMax int, code8, code16 byte) {
+	switch {
+	case n < fixMax:
+		w.WriteByte(fix | byte(n))
+	case code8 != 0 && n <= math.MaxUint8:
+		w.WriteByte(code8)
+		w.WriteByte(byte(n))
+	case n <= math.MaxUint16:
+		w.WriteByte(code16)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	default:
+		w.WriteByte(code16 + 1)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	}
+}
+
+func writeMsgpackInt(w *bytes.Buffer, n int64) {
+	switch {
+	case n >= 0 && n <= math.MaxInt8:
+		w.WriteByte(byte(n))
+	case n >= -32 && n < 0:
+		w.WriteByte(byte(int8(n)))
+	case n >= 0 && n <= math.MaxUint8:
+		w.WriteByte(0xcc)
+		w.WriteByte(byte(n))
+	case n >= 0 && n <= math.MaxUint16:
+		w.WriteByte(0xcd)
+		binary.Write(w, binary.BigEndian, uint16(n))
+	case n >= 0 && n <= math.MaxUint32:
+		w.WriteByte(0xce)
+		binary.Write(w, binary.BigEndian, uint32(n))
+	case n >= 0:
+		w.WriteByte(0xcf)
+		binary.Write(w, binary.BigEndian, uint64(n))
+	case n >= math.MinInt8:
+		w.WriteByte(0xd0)
+		w.WriteByte(byte(int8(n)))
+	case n >= math.MinInt16:
+		w.WriteByte(0xd1)
+		binary.Write(w, binary.BigEndian, int16(n))
+	case n >= math.MinInt32:
+		w.WriteByte(0xd2)
+		binary.Write(w, binary.BigEndian, int32(n))
+	default:
+		w.WriteByte(0xd3)
+		binary.Write(w, binary.BigEndian, n)
+	}
+}
@@ -0,0 +1,628 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /graphql answers queries over packages, their versions and owners and the
+// registry stats in one request. The schema is fixed and resolved by hand:
+//
+//	type Query {
+//	  package(name: String!): Package
+//	  packages(first: Int = 20, after: String, status: String, owner: String,
+//	           keyword: String, nameContains: String): PackageConnection!
+//	  stats: Stats!
+//	}
+//	type PackageConnection { totalCount: Int! nodes: [Package!]! pageInfo: PageInfo! }
+//	type PageInfo { hasNextPage: Boolean! endCursor: String }
+//	type Package {
+//	  name: String! url: String! description: String! keywords: [String!]!
+//	  hits: Int! status: String! createdAt: String canonicalName: String
+//	  stars: Int! license: String archived: Boolean! deprecated: Deprecation
+//	  owner: Owner versions(first: Int): [Version!]! latestVersion: Version
+//	}
+//	type Owner { login: String! url: String! }
+//	type Deprecation { message: String! replacement: String }
+//	type Version { version: String! tag: String! prerelease: Boolean! }
+//	type Stats { packageCount: Int! brokenPackageCount: Int! clients(days: Int = 7): [ClientStat!]! }
+//	type ClientStat { day: String! client: String! version: String! requests: Int! }
+//
+// Filtering packages scans the whole table, so filtered counts cost as much
+// as the unfiltered list.
+
+const (
+	gqlDefaultFirst = 20
+	gqlMaxFirst     = 100
+)
+
+func graphqlPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return (req.Method == http.MethodGet || req.Method == http.MethodPost) && req.URL.Path == "/graphql"
+	}
+}
+
+var graphqlOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/graphql", Summary: "Run a GraphQL query", Query: []string{"query", "variables", "operationName"}},
+	{Method: http.MethodPost, Path: "/graphql", Summary: "Run a GraphQL query", Body: graphqlRequest{}},
+}
+
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	Variables     map[string]interface{} `json:"variables"`
+	OperationName string                 `json:"operationName"`
+}
+
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+func graphqlErrorResponse(r *http.Request, status int, msg string) *http.Response {
+	return jsonResponse(r, status, map[string]interface{}{"errors": []gqlError{{Message: msg}}})
+}
+
+func (s *Server) graphqlHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	var req graphqlRequest
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return r, graphqlErrorResponse(r, http.StatusBadRequest, "Invalid JSON")
+		}
+	} else {
+		q := r.URL.Query()
+		req.Query, req.OperationName = q.Get("query"), q.Get("operationName")
+		if v := q.Get("variables"); v != "" {
+			if err := json.Unmarshal([]byte(v), &req.Variables); err != nil {
+				return r, graphqlErrorResponse(r, http.StatusBadRequest, "Invalid variables")
+			}
+		}
+	}
+
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		return r, graphqlErrorResponse(r, http.StatusBadRequest, "Syntax error: "+err.Error())
+	}
+	var op *gqlOperation
+	for _, o := range doc.operations {
+		if o.name == req.OperationName || req.OperationName == "" && len(doc.operations) == 1 {
+			op = o
+		}
+	}
+	if op == nil {
+		return r, graphqlErrorResponse(r, http.StatusBadRequest, "Unknown operation")
+	}
+
+	e := &gqlExecutor{fragments: doc.fragments, vars: map[string]interface{}{}}
+	for k, v := range op.defaults {
+		e.vars[k] = v
+	}
+	for k, v := range req.Variables {
+		e.vars[k] = v
+	}
+	result := map[string]interface{}{"data": e.object(s.gqlQuery(r), op.selection, nil)}
+	if len(e.errors) > 0 {
+		result["errors"] = e.errors
+	}
+	return r, jsonResponse(r, http.StatusOK, result)
+}
+
+// gqlObject is a value with fields, resolved on demand.
+type gqlObject struct {
+	typename string
+	resolve  func(field string, args gqlArgs) (interface{}, error)
+}
+
+var (
+	errUnknownField = errors.New("unknown field")
+	errStoreFailed  = errors.New("internal server error")
+)
+
+type gqlExecutor struct {
+	fragments map[string][]gqlSelection
+	vars      map[string]interface{}
+	errors    []gqlError
+}
+
+// gqlMap is a JSON object keeping the order of the selection.
+type gqlMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m *gqlMap) MarshalJSON() ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, k := range m.keys {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		key, _ := json.Marshal(k)
+		value, err := json.Marshal(m.values[k])
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func (e *gqlExecutor) fail(path []interface{}, format string, args ...interface{}) {
+	e.errors = append(e.errors, gqlError{Message: fmt.Sprintf(format, args...), Path: append([]interface{}(nil), path...)})
+}
+
+// collect flattens fragments into the fields of a selection set, merging
+// the sub-selections of fields requested twice under the same key.
+func (e *gqlExecutor) collect(sel []gqlSelection, fields []*gqlField, visited map[string]bool) []*gqlField {
+	for _, s := range sel {
+		switch s := s.(type) {
+		case *gqlField:
+			if !e.included(s.directives) {
+				continue
+			}
+			merged := false
+			for i, f := range fields {
+				if f.key() == s.key() {
+					both := *f
+					both.selection = append(append([]gqlSelection(nil), f.selection...), s.selection...)
+					fields[i], merged = &both, true
+					break
+				}
+			}
+			if !merged {
+				fields = append(fields, s)
+			}
+		case gqlSpread:
+			if !e.included(s.directives) || visited[s.name] {
+				continue
+			}
+			visited[s.name] = true
+			fields = e.collect(e.fragments[s.name], fields, visited)
+		case gqlInline:
+			if e.included(s.directives) {
+				fields = e.collect(s.selection, fields, visited)
+			}
+		}
+	}
+	return fields
+}
+
+func (e *gqlExecutor) included(directives []gqlDirective) bool {
+	for _, d := range directives {
+		cond, _ := e.value(d.args["if"]).(bool)
+		if d.name == "skip" && cond || d.name == "include" && !cond {
+			return false
+		}
+	}
+	return true
+}
+
+// value substitutes the variables in an argument value.
+func (e *gqlExecutor) value(v interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlVariable:
+		return e.vars[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.value(item)
+		}
+		return list
+	case map[string]interface{}:
+		obj := map[string]interface{}{}
+		for k, item := range v {
+			obj[k] = e.value(item)
+		}
+		return obj
+	}
+	return v
+}
+
+func (e *gqlExecutor) object(obj gqlObject, sel []gqlSelection, path []interface{}) *gqlMap {
+	out := &gqlMap{values: map[string]interface{}{}}
+	for _, f := range e.collect(sel, nil, map[string]bool{}) {
+		key := f.key()
+		out.keys = append(out.keys, key)
+		fieldPath := append(path[:len(path):len(path)], key)
+		if f.name == "__typename" {
+			out.values[key] = obj.typename
+			continue
+		}
+		args := gqlArgs{}
+		for k, v := range f.args {
+			args[k] = e.value(v)
+		}
+		v, err := obj.resolve(f.name, args)
+		if err == errUnknownField {
+			e.fail(fieldPath, "Cannot query field %q on type %q", f.name, obj.typename)
+			continue
+		} else if err != nil {
+			e.fail(fieldPath, "%s", err)
+			continue
+		}
+		out.values[key] = e.complete(v, f, fieldPath)
+	}
+	return out
+}
+
+func (e *gqlExecutor) complete(v interface{}, f *gqlField, path []interface{}) interface{} {
+	switch v := v.(type) {
+	case gqlObject:
+		if f.selection == nil {
+			e.fail(path, "Field %q of type %q must have a selection of subfields", f.name, v.typename)
+			return nil
+		}
+		return e.object(v, f.selection, path)
+	case []gqlObject:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = e.complete(item, f, append(path[:len(path):len(path)], i))
+		}
+		return list
+	}
+	if f.selection != nil && v != nil {
+		e.fail(path, "Field %q is a scalar and can't have a selection", f.name)
+		return nil
+	}
+	return v
+}
+
+type gqlArgs map[string]interface{}
+
+// int reads an integer argument. Variables come from JSON as float64.
+func (a gqlArgs) int(name string, def int) (int, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return def, nil
+	case int:
+		return v, nil
+	case float64:
+		if v == float64(int(v)) {
+			return int(v), nil
+		}
+	}
+	return 0, fmt.Errorf("argument %q must be an integer", name)
+}
+
+func (a gqlArgs) string(name string) (string, error) {
+	switch v := a[name].(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	}
+	return "", fmt.Errorf("argument %q must be a string", name)
+}
+
+func (s *Server) gqlQuery(r *http.Request) gqlObject {
+	return gqlObject{typename: "Query", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "package":
+			name, err := args.string("name")
+			if err != nil || name == "" {
+				return nil, errors.New(`argument "name" is required`)
+			}
+			return s.gqlPackageByName(r, name)
+		case "packages":
+			return s.gqlPackages(args)
+		case "stats":
+			return s.gqlStats(), nil
+		}
+		return nil, errUnknownField
+	}}
+}
+
+func (s *Server) gqlPackageByName(r *http.Request, name string) (interface{}, error) {
+	pkg, err := s.readPackage(r, name)
+	if err == ErrNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, errStoreFailed
+	}
+	canonical := pkg.Name
+	if pkg.CanonicalName != "" {
+		canonical = pkg.CanonicalName
+	}
+	details, err := s.store.PackageDetails(canonical)
+	if err != nil {
+		return nil, errStoreFailed
+	}
+	return gqlPackage(details, pkg.Name, pkg.CanonicalName), nil
+}
+
+func (s *Server) gqlPackages(args gqlArgs) (interface{}, error) {
+	first, err := args.int("first", gqlDefaultFirst)
+	if err != nil {
+		return nil, err
+	}
+	if first < 1 || first > gqlMaxFirst {
+		return nil, fmt.Errorf(`argument "first" must be between 1 and %d`, gqlMaxFirst)
+	}
+	offset := 0
+	if after, err := args.string("after"); err != nil {
+		return nil, err
+	} else if after != "" {
+		if offset = decodeCursor(after); offset < 0 {
+			return nil, errors.New("invalid cursor")
+		}
+	}
+	var filters [4]string
+	for i, name := range []string{"status", "owner", "keyword", "nameContains"} {
+		if filters[i], err = args.string(name); err != nil {
+			return nil, err
+		}
+	}
+	status, owner, keyword, nameContains := filters[0], filters[1], filters[2], strings.ToLower(filters[3])
+
+	var total int64
+	var nodes []PackageDetails
+	if status == "" && owner == "" && keyword == "" && nameContains == "" {
+		if total, err = s.store.CountPackages(); err != nil {
+			return nil, errStoreFailed
+		}
+		if nodes, err = s.store.ListPackageDetails(offset, first); err != nil {
+			return nil, errStoreFailed
+		}
+	} else {
+		const batch = 1000
+		for start := 0; ; start += batch {
+			list, err := s.store.ListPackageDetails(start, batch)
+			if err != nil {
+				return nil, errStoreFailed
+			}
+			for _, d := range list {
+				if status != "" && d.Status != status ||
+					nameContains != "" && !strings.Contains(strings.ToLower(d.Name), nameContains) ||
+					keyword != "" && !containsString(d.Keywords, keyword) {
+					continue
+				}
+				if owner != "" {
+					login, _, ok := parseGitHubURL(d.URL)
+					if !ok || !strings.EqualFold(login, owner) {
+						continue
+					}
+				}
+				if total >= int64(offset) && len(nodes) < first {
+					nodes = append(nodes, d)
+				}
+				total++
+			}
+			if len(list) < batch {
+				break
+			}
+		}
+	}
+
+	packages := make([]gqlObject, len(nodes))
+	for i, d := range nodes {
+		packages[i] = gqlPackage(d, d.Name, "")
+	}
+	end := offset + len(nodes)
+	pageInfo := gqlObject{typename: "PageInfo", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "hasNextPage":
+			return int64(end) < total, nil
+		case "endCursor":
+			if len(nodes) == 0 {
+				return nil, nil
+			}
+			return encodeCursor(end), nil
+		}
+		return nil, errUnknownField
+	}}
+	return gqlObject{typename: "PackageConnection", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "totalCount":
+			return total, nil
+		case "nodes":
+			return packages, nil
+		case "pageInfo":
+			return pageInfo, nil
+		}
+		return nil, errUnknownField
+	}}, nil
+}
+
+// Cursors are opaque to clients but just encode the offset of the next
+// package.
+func encodeCursor(offset int) string {
+	return base64.StdEncoding.EncodeToString([]byte("offset:" + strconv.Itoa(offset)))
+}
+
+// decodeCursor returns -1 for an invalid cursor.
+func decodeCursor(cursor string) int {
+	raw, err := base64.StdEncoding.DecodeString(cursor)
+	if err != nil || !bytes.HasPrefix(raw, []byte("offset:")) {
+		return -1
+	}
+	offset, err := strconv.Atoi(string(raw[len("offset:"):]))
+	if err != nil || offset < 0 {
+		return -1
+	}
+	return offset
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func gqlPackage(d PackageDetails, name, canonicalName string) gqlObject {
+	return gqlObject{typename: "Package", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "name":
+			return name, nil
+		case "url":
+			return d.URL, nil
+		case "description":
+			return d.Description, nil
+		case "keywords":
+			if d.Keywords == nil {
+				return []string{}, nil
+			}
+			return d.Keywords, nil
+		case "hits":
+			return d.Hits, nil
+		case "status":
+			return d.Status, nil
+		case "stars":
+			return d.Stars, nil
+		case "license":
+			if d.License == "" {
+				return nil, nil
+			}
+			return d.License, nil
+		case "archived":
+			return d.Archived, nil
+		case "deprecated":
+			if d.Deprecated == nil {
+				return nil, nil
+			}
+			return gqlDeprecation(*d.Deprecated), nil
+		case "createdAt":
+			if d.CreatedAt == nil {
+				return nil, nil
+			}
+			return d.CreatedAt.UTC().Format(time.RFC3339), nil
+		case "canonicalName":
+			if canonicalName == "" {
+				return nil, nil
+			}
+			return canonicalName, nil
+		case "owner":
+			login, _, ok := parseGitHubURL(d.URL)
+			if !ok {
+				return nil, nil
+			}
+			return gqlOwner(login), nil
+		case "versions", "latestVersion":
+			versions, err := repoVersions(d.URL)
+			if err != nil {
+				return nil, errors.New("could not list repository tags")
+			}
+			if field == "latestVersion" {
+				if v, ok := latestVersion(versions); ok {
+					return gqlVersion(v), nil
+				}
+				return nil, nil
+			}
+			first, err := args.int("first", len(versions))
+			if err != nil {
+				return nil, err
+			}
+			// Newest first, so first: 5 gets the latest releases.
+			list := []gqlObject{}
+			for i := len(versions) - 1; i >= 0 && len(list) < first; i-- {
+				list = append(list, gqlVersion(versions[i]))
+			}
+			return list, nil
+		}
+		return nil, errUnknownField
+	}}
+}
+
+func gqlOwner(login string) gqlObject {
+	return gqlObject{typename: "Owner", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "login":
+			return login, nil
+		case "url":
+			return "https://github.com/" + login, nil
+		}
+		return nil, errUnknownField
+	}}
+}
+
+func gqlDeprecation(d Deprecation) gqlObject {
+	return gqlObject{typename: "Deprecation", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "message":
+			return d.Message, nil
+		case "replacement":
+			if d.Replacement == "" {
+				return nil, nil
+			}
+			return d.Replacement, nil
+		}
+		return nil, errUnknownField
+	}}
+}
+
+func gqlVersion(v Version) gqlObject {
+	return gqlObject{typename: "Version", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "version":
+			return v.String(), nil
+		case "tag":
+			return v.Tag, nil
+		case "prerelease":
+			return v.Pre != "", nil
+		}
+		return nil, errUnknownField
+	}}
+}
+
+func (s *Server) gqlStats() gqlObject {
+	return gqlObject{typename: "Stats", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "packageCount":
+			n, err := s.store.CountPackages()
+			if err != nil {
+				return nil, errStoreFailed
+			}
+			return n, nil
+		case "brokenPackageCount":
+			broken, err := s.store.BrokenPackages()
+			if err != nil {
+				return nil, errStoreFailed
+			}
+			return len(broken), nil
+		case "clients":
+			days, err := args.int("days", 7)
+			if err != nil {
+				return nil, err
+			}
+			stats, err := s.store.ClientStats(time.Now().UTC().AddDate(0, 0, -days))
+			if err != nil {
+				return nil, errStoreFailed
+			}
+			list := []gqlObject{}
+			for _, c := range stats {
+				list = append(list, gqlClientStat(c))
+			}
+			return list, nil
+		}
+		return nil, errUnknownField
+	}}
+}
+
+func gqlClientStat(c ClientStat) gqlObject {
+	return gqlObject{typename: "ClientStat", resolve: func(field string, args gqlArgs) (interface{}, error) {
+		switch field {
+		case "day":
+			return c.Day.Format("2006-01-02"), nil
+		case "client":
+			return c.Client, nil
+		case "version":
+			return c.Version, nil
+		case "requests":
+			return c.Requests, nil
+		}
+		return nil, errUnknownField
+	}}
+}
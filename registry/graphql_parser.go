@@ -0,0 +1,458 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// A parser for the query subset of GraphQL: operations with variables,
+// aliases, arguments, fragments and the @skip/@include directives.
+// Mutations, subscriptions and block strings are rejected.
+
+type gqlDocument struct {
+	operations []*gqlOperation
+	fragments  map[string][]gqlSelection
+}
+
+type gqlOperation struct {
+	name      string
+	defaults  map[string]interface{}
+	selection []gqlSelection
+}
+
+// gqlSelection is a *gqlField, gqlSpread or gqlInline.
+type gqlSelection interface{}
+
+type gqlDirective struct {
+	name string
+	args map[string]interface{}
+}
+
+type gqlField struct {
+	alias, name string
+	args        map[string]interface{}
+	directives  []gqlDirective
+	selection   []gqlSelection
+}
+
+func (f *gqlField) key() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+type gqlSpread struct {
+	name       string
+	directives []gqlDirective
+}
+
+type gqlInline struct {
+	directives []gqlDirective
+	selection  []gqlSelection
+}
+
+// gqlVariable is a $name reference in an argument value.
+type gqlVariable string
+
+type gqlToken struct {
+	kind byte // 'p'unctuator, 'n'ame, 's'tring, 'i'nt, 'f'loat, 0 at the end
+	val  string
+	pos  int
+}
+
+func gqlLex(src string) ([]gqlToken, error) {
+	var tokens []gqlToken
+	for i := 0; i < len(src); {
+		c := src[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == ',':
+			i++
+		case c == '#':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case strings.HasPrefix(src[i:], "..."):
+			tokens = append(tokens, gqlToken{'p', "...", i})
+			i += 3
+		case strings.IndexByte("!$():=@[]{}", c) >= 0:
+			tokens = append(tokens, gqlToken{'p', string(c), i})
+			i++
+		case c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+			j := i + 1
+			for j < len(src) && (src[j] == '_' || src[j] >= 'a' && src[j] <= 'z' || src[j] >= 'A' && src[j] <= 'Z' || src[j] >= '0' && src[j] <= '9') {
+				j++
+			}
+			tokens = append(tokens, gqlToken{'n', src[i:j], i})
+			i = j
+		case c == '-' || c >= '0' && c <= '9':
+			j, kind := i+1, byte('i')
+			for j < len(src) && strings.IndexByte("0123456789.eE+-", src[j]) >= 0 {
+				if strings.IndexByte(".eE", src[j]) >= 0 {
+					kind = 'f'
+				}
+				j++
+			}
+			tokens = append(tokens, gqlToken{kind, src[i:j], i})
+			i = j
+		case c == '"':
+			if strings.HasPrefix(src[i:], `"""`) {
+				return nil, fmt.Errorf("block strings are not supported (at %d)", i)
+			}
+			j := i + 1
+			for j < len(src) && src[j] != '"' && src[j] != '\n' {
+				if src[j] == '\\' {
+					j++
+				}
+				j++
+			}
+			if j >= len(src) || src[j] != '"' {
+				return nil, fmt.Errorf("unterminated string (at %d)", i)
+			}
+			// GraphQL string escapes are those of JSON.
+			var s string
+			if err := json.Unmarshal([]byte(src[i:j+1]), &s); err != nil {
+				return nil, fmt.Errorf("invalid string (at %d)", i)
+			}
+			tokens = append(tokens, gqlToken{'s', s, i})
+			i = j + 1
+		default:
+			return nil, fmt.Errorf("unexpected character %q (at %d)", c, i)
+		}
+	}
+	return append(tokens, gqlToken{pos: len(src)}), nil
+}
+
+type gqlParser struct {
+	tokens []gqlToken
+	pos    int
+}
+
+func parseGraphQL(src string) (*gqlDocument, error) {
+	tokens, err := gqlLex(src)
+	if err != nil {
+		return nil, err
+	}
+	p := &gqlParser{tokens: tokens}
+	doc := &gqlDocument{fragments: map[string][]gqlSelection{}}
+	for p.peek().kind != 0 {
+		t := p.peek()
+		switch {
+		case t.kind == 'p' && t.val == "{":
+			sel, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, &gqlOperation{selection: sel})
+		case t.kind == 'n' && t.val == "query":
+			op, err := p.operation()
+			if err != nil {
+				return nil, err
+			}
+			doc.operations = append(doc.operations, op)
+		case t.kind == 'n' && t.val == "fragment":
+			p.next()
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.keyword("on"); err != nil {
+				return nil, err
+			}
+			if _, err := p.name(); err != nil {
+				return nil, err
+			}
+			if _, err := p.directives(); err != nil {
+				return nil, err
+			}
+			if doc.fragments[name], err = p.selectionSet(); err != nil {
+				return nil, err
+			}
+		case t.kind == 'n' && (t.val == "mutation" || t.val == "subscription"):
+			return nil, fmt.Errorf("only queries are supported, not %ss", t.val)
+		default:
+			return nil, p.unexpected()
+		}
+	}
+	if len(doc.operations) == 0 {
+		return nil, fmt.Errorf("no operation given")
+	}
+	return doc, nil
+}
+
+func (p *gqlParser) peek() gqlToken { return p.tokens[p.pos] }
+
+func (p *gqlParser) next() gqlToken {
+	t := p.tokens[p.pos]
+	if t.kind != 0 {
+		p.pos++
+	}
+	return t
+}
+
+func (p *gqlParser) unexpected() error {
+	t := p.peek()
+	if t.kind == 0 {
+		return fmt.Errorf("unexpected end of query")
+	}
+	return fmt.Errorf("unexpected %q (at %d)", t.val, t.pos)
+}
+
+// punct consumes the punctuator val if it is next.
+func (p *gqlParser) punct(val string) bool {
+	if t := p.peek(); t.kind == 'p' && t.val == val {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *gqlParser) expect(val string) error {
+	if !p.punct(val) {
+		return p.unexpected()
+	}
+	return nil
+}
+
+func (p *gqlParser) keyword(val string) error {
+	if t := p.peek(); t.kind == 'n' && t.val == val {
+		p.pos++
+		return nil
+	}
+	return p.unexpected()
+}
+
+func (p *gqlParser) name() (string, error) {
+	if t := p.peek(); t.kind == 'n' {
+		p.pos++
+		return t.val, nil
+	}
+	return "", p.unexpected()
+}
+
+func (p *gqlParser) operation() (*gqlOperation, error) {
+	p.next() // query
+	op := &gqlOperation{defaults: map[string]interface{}{}}
+	if p.peek().kind == 'n' {
+		op.name, _ = p.name()
+	}
+	if p.punct("(") {
+		for !p.punct(")") {
+			if err := p.expect("$"); err != nil {
+				return nil, err
+			}
+			name, err := p.name()
+			if err != nil {
+				return nil, err
+			}
+			if err := p.expect(":"); err != nil {
+				return nil, err
+			}
+			if err := p.skipType(); err != nil {
+				return nil, err
+			}
+			if p.punct("=") {
+				if op.defaults[name], err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if _, err := p.directives(); err != nil {
+		return nil, err
+	}
+	var err error
+	op.selection, err = p.selectionSet()
+	return op, err
+}
+
+// skipType consumes a variable type. Arguments are checked by the
+// resolvers, so the declared types are not needed.
+func (p *gqlParser) skipType() error {
+	if p.punct("[") {
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if _, err := p.name(); err != nil {
+		return err
+	}
+	p.punct("!")
+	return nil
+}
+
+func (p *gqlParser) selectionSet() ([]gqlSelection, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var sel []gqlSelection
+	for !p.punct("}") {
+		if p.punct("...") {
+			if t := p.peek(); t.kind == 'n' && t.val != "on" {
+				p.next()
+				directives, err := p.directives()
+				if err != nil {
+					return nil, err
+				}
+				sel = append(sel, gqlSpread{name: t.val, directives: directives})
+				continue
+			}
+			if p.keyword("on") == nil {
+				if _, err := p.name(); err != nil {
+					return nil, err
+				}
+			}
+			directives, err := p.directives()
+			if err != nil {
+				return nil, err
+			}
+			inner, err := p.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+			sel = append(sel, gqlInline{directives: directives, selection: inner})
+			continue
+		}
+		f, err := p.field()
+		if err != nil {
+			return nil, err
+		}
+		sel = append(sel, f)
+	}
+	if len(sel) == 0 {
+		return nil, fmt.Errorf("empty selection set")
+	}
+	return sel, nil
+}
+
+func (p *gqlParser) field() (*gqlField, error) {
+	name, err := p.name()
+	if err != nil {
+		return nil, err
+	}
+	f := &gqlField{name: name}
+	if p.punct(":") {
+		f.alias = name
+		if f.name, err = p.name(); err != nil {
+			return nil, err
+		}
+	}
+	if f.args, err = p.arguments(); err != nil {
+		return nil, err
+	}
+	if f.directives, err = p.directives(); err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind == 'p' && t.val == "{" {
+		if f.selection, err = p.selectionSet(); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+func (p *gqlParser) arguments() (map[string]interface{}, error) {
+	args := map[string]interface{}{}
+	if !p.punct("(") {
+		return args, nil
+	}
+	for !p.punct(")") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[name], err = p.value(); err != nil {
+			return nil, err
+		}
+	}
+	return args, nil
+}
+
+func (p *gqlParser) directives() ([]gqlDirective, error) {
+	var directives []gqlDirective
+	for p.punct("@") {
+		name, err := p.name()
+		if err != nil {
+			return nil, err
+		}
+		args, err := p.arguments()
+		if err != nil {
+			return nil, err
+		}
+		directives = append(directives, gqlDirective{name: name, args: args})
+	}
+	return directives, nil
+}
+
+// value parses an argument value. Enum values are returned as strings.
+func (p *gqlParser) value() (interface{}, error) {
+	t := p.next()
+	switch t.kind {
+	case 's':
+		return t.val, nil
+	case 'i':
+		n, err := strconv.Atoi(t.val)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q (at %d)", t.val, t.pos)
+		}
+		return n, nil
+	case 'f':
+		n, err := strconv.ParseFloat(t.val, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid number %q (at %d)", t.val, t.pos)
+		}
+		return n, nil
+	case 'n':
+		switch t.val {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		return t.val, nil
+	case 'p':
+		switch t.val {
+		case "$":
+			name, err := p.name()
+			return gqlVariable(name), err
+		case "[":
+			list := []interface{}{}
+			for !p.punct("]") {
+				v, err := p.value()
+				if err != nil {
+					return nil, err
+				}
+				list = append(list, v)
+			}
+			return list, nil
+		case "{":
+			obj := map[string]interface{}{}
+			for !p.punct("}") {
+				name, err := p.name()
+				if err != nil {
+					return nil, err
+				}
+				if err := p.expect(":"); err != nil {
+					return nil, err
+				}
+				if obj[name], err = p.value(); err != nil {
+					return nil, err
+				}
+			}
+			return obj, nil
+		}
+	}
+	if t.kind != 0 {
+		p.pos--
+	}
+	return nil, p.unexpected()
+}
@@ -0,0 +1,105 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// RESPONSE_HEADERS_FILE adds headers to responses without code changes,
+// e.g. Surrogate-Key for a CDN. It is a JSON object from route names, as in
+// /debug/slo, or "*" for every response, to the headers to set:
+//
+//	{
+//	  "GET /packages/{name}": {"Surrogate-Key": "package-{{.name}}"},
+//	  "*": {"X-Served-By": "eu-1"}
+//	}
+//
+// Values are templates over the path parameters of the route and method,
+// host and path. They replace headers set by the handlers; an empty value
+// removes the header.
+
+type headerRules map[string]map[string]*template.Template
+
+func loadHeaderRules() (headerRules, error) {
+	path := getEnv("RESPONSE_HEADERS_FILE", "")
+	if path == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid RESPONSE_HEADERS_FILE: %s", err)
+	}
+	var raw map[string]map[string]string
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("Invalid RESPONSE_HEADERS_FILE: %s", err)
+	}
+	rules := headerRules{}
+	for route, headers := range raw {
+		rules[route] = map[string]*template.Template{}
+		for name, value := range headers {
+			t, err := template.New(name).Option("missingkey=zero").Parse(value)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid RESPONSE_HEADERS_FILE: %s of %s: %s", name, route, err)
+			}
+			rules[route][http.CanonicalHeaderKey(name)] = t
+		}
+	}
+	return rules, nil
+}
+
+// check logs the routes of rules that match no request.
+func (rules headerRules) check(routes routeMatcher) {
+	known := map[string]bool{"*": true, "other": true}
+	for _, p := range routes {
+		known[p.name] = true
+	}
+	for route := range rules {
+		if !known[route] {
+			serverLog.Warnf("RESPONSE_HEADERS_FILE: unknown route %q", route)
+		}
+	}
+}
+
+// customHeaders sets the headers of rules on every response, Go or
+// sidecar, right before they are written.
+func customHeaders(next http.Handler, rules headerRules, routes routeMatcher) http.Handler {
+	if len(rules) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, before: func(h http.Header) {
+			route, params := routes.match(r)
+			data := map[string]string{"method": r.Method, "host": r.Host, "path": r.URL.Path}
+			for k, v := range params {
+				data[k] = v
+			}
+			for _, headers := range []map[string]*template.Template{rules["*"], rules[route]} {
+				for name, t := range headers {
+					var value bytes.Buffer
+					if err := t.Execute(&value, data); err != nil {
+						serverLog.Warnf("RESPONSE_HEADERS_FILE: %s of %s: %s", name, route, err)
+						continue
+					}
+					if v := strings.Map(dropControl, value.String()); v != "" {
+						h.Set(name, v)
+					} else {
+						h.Del(name)
+					}
+				}
+			}
+		}}, r)
+	})
+}
+
+// dropControl keeps path parameters from breaking header lines.
+func dropControl(r rune) rune {
+	if r < ' ' || r == 0x7f {
+		return -1
+	}
+	return r
+}
@@ -0,0 +1,246 @@
+package registry
+
+import (
+	"expvar"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Requests for a package, its lookup and the routes below it, are counted
+// per minute, per client and in total, to protect the registry from a
+// client hammering one package, e.g. a misconfigured CI farm:
+//
+//   - With PACKAGE_RATE_LIMIT set, a client making more requests a minute
+//     for one package gets 429 until the minute is over.
+//   - With HOT_PACKAGE_RATE set, a package getting more requests a minute
+//     from all clients is hot for the rest of that minute and the next.
+//     Lookups of hot packages are kept in memory for hotLookupTTL and may
+//     be cached for at least HOT_PACKAGE_MAX_AGE, so caches in front of
+//     the registry absorb the load.
+//
+// Hot packages and the requests limited in the last full minute are listed
+// in /metrics.
+
+// hotLookupTTL is how long lookups of hot packages are kept in memory.
+const hotLookupTTL = 10 * time.Second
+
+// maxTrackedPackages caps the packages listed in /metrics.
+const maxTrackedPackages = 20
+
+type hotspotKey struct {
+	pkg    string
+	client string
+}
+
+type hotLookup struct {
+	pkg     Package
+	expires time.Time
+}
+
+type hotspotTracker struct {
+	clientLimit int
+	hotRate     int
+	hotMaxAge   int
+
+	mu      sync.Mutex
+	window  time.Time
+	counts  map[string]int
+	clients map[hotspotKey]int
+	// hot holds the packages over hotRate with the minute they cool down.
+	hot map[string]time.Time
+	// limited counts the limited requests per package in the last full
+	// window, current those in this one.
+	limited map[string]int
+	current map[string]int
+	lookups map[string]hotLookup
+}
+
+func newHotspotTracker(clientLimit, hotRate int, hotMaxAge time.Duration) *hotspotTracker {
+	return &hotspotTracker{
+		clientLimit: clientLimit,
+		hotRate:     hotRate,
+		hotMaxAge:   int(hotMaxAge / time.Second),
+		counts:      map[string]int{},
+		clients:     map[hotspotKey]int{},
+		hot:         map[string]time.Time{},
+		limited:     map[string]int{},
+		current:     map[string]int{},
+		lookups:     map[string]hotLookup{},
+	}
+}
+
+// packageOfPath returns the package a path is about, or "" for paths
+// outside /packages/{name}.
+func packageOfPath(path string) string {
+	rest := strings.TrimPrefix(path, "/packages/")
+	if rest == path {
+		return ""
+	}
+	parts := strings.SplitN(rest, "/", 3)
+	name := parts[0]
+	if strings.HasPrefix(name, "@") && len(parts) > 1 {
+		name += "/" + parts[1]
+	}
+	if validatePackageName(name) != nil && validateScopedName(name) != nil {
+		return ""
+	}
+	return name
+}
+
+// rotate starts a new window once the minute is over. It must be called
+// with t.mu held.
+func (t *hotspotTracker) rotate(now time.Time) {
+	window := now.Truncate(time.Minute)
+	if window.Equal(t.window) {
+		return
+	}
+	// A gap of more than a minute leaves the last full window empty.
+	if window.Sub(t.window) == time.Minute {
+		t.limited = t.current
+	} else {
+		t.limited = map[string]int{}
+	}
+	t.current = map[string]int{}
+	t.window = window
+	t.counts = map[string]int{}
+	t.clients = map[hotspotKey]int{}
+	for name, until := range t.hot {
+		if !now.Before(until) {
+			delete(t.hot, name)
+		}
+	}
+	for name, l := range t.lookups {
+		if now.After(l.expires) {
+			delete(t.lookups, name)
+		}
+	}
+}
+
+// count records a request of client for pkg and reports whether it is over
+// the client limit.
+func (t *hotspotTracker) count(pkg, client string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate(now)
+	t.counts[pkg]++
+	if t.hotRate > 0 && t.counts[pkg] > t.hotRate {
+		if _, hot := t.hot[pkg]; !hot {
+			metrics.Add("hot_packages_detected", 1)
+		}
+		t.hot[pkg] = t.window.Add(2 * time.Minute)
+	}
+	if t.clientLimit <= 0 {
+		return false
+	}
+	key := hotspotKey{pkg, client}
+	t.clients[key]++
+	if t.clients[key] <= t.clientLimit {
+		return false
+	}
+	t.current[pkg]++
+	return true
+}
+
+func (t *hotspotTracker) isHot(pkg string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	_, hot := t.hot[pkg]
+	return hot
+}
+
+// cached returns the lookup of a hot package kept in memory.
+func (t *hotspotTracker) cached(name string) (Package, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l, ok := t.lookups[name]
+	if !ok || time.Now().After(l.expires) {
+		return Package{}, false
+	}
+	return l.pkg, true
+}
+
+// remember keeps the lookup of name in memory if the package is hot.
+func (t *hotspotTracker) remember(name string, pkg Package) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, hot := t.hot[name]; hot {
+		t.lookups[name] = hotLookup{pkg: pkg, expires: time.Now().Add(hotLookupTTL)}
+	}
+}
+
+// forget drops the lookups kept in memory, after packages changed.
+func (t *hotspotTracker) forget() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.lookups = map[string]hotLookup{}
+}
+
+func (t *hotspotTracker) publish() {
+	metrics.Set("package_hotspots", expvar.Func(func() interface{} {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		hot := map[string]int{}
+		for name := range t.hot {
+			hot[name] = t.counts[name]
+		}
+		return map[string]interface{}{
+			"hot":     topCounts(hot, maxTrackedPackages),
+			"limited": topCounts(t.limited, maxTrackedPackages),
+		}
+	}))
+}
+
+// topCounts returns the n largest counts.
+func topCounts(counts map[string]int, n int) map[string]int {
+	names := make([]string, 0, len(counts))
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool { return counts[names[i]] > counts[names[j]] })
+	if len(names) > n {
+		names = names[:n]
+	}
+	top := map[string]int{}
+	for _, name := range names {
+		top[name] = counts[name]
+	}
+	return top
+}
+
+// limitPackageRates counts the requests for packages and answers clients
+// over the limit with 429.
+func limitPackageRates(next http.Handler, t *hotspotTracker, clientIP func(*http.Request) string) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		pkg := packageOfPath(r.URL.Path)
+		if pkg == "" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		now := time.Now()
+		if t.count(pkg, clientIP(r), now) {
+			metrics.Add("package_rate_limited", 1)
+			retryAfter := now.Truncate(time.Minute).Add(time.Minute).Sub(now)
+			w.Header().Set("Retry-After", strconv.Itoa(int((retryAfter+time.Second-1)/time.Second)))
+			http.Error(w, "Too many requests for "+pkg+", please retry later", http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lookupMaxAge is the max-age of a lookup of pkg, raised to
+// HOT_PACKAGE_MAX_AGE while the package is hot.
+func (s *Server) lookupMaxAge(pkg Package) int {
+	maxAge := packageMaxAge(pkg)
+	if s.hotspots != nil && maxAge < s.hotspots.hotMaxAge && s.hotspots.isHot(pkg.Name) {
+		maxAge = s.hotspots.hotMaxAge
+	}
+	return maxAge
+}
@@ -0,0 +1,195 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Cache entries are invalidated on every instance at once. Stores shared by
+// several instances implement notifier to broadcast invalidations, which
+// each instance, the sender included, applies to its shared and in-process
+// caches. Other stores serve a single instance and apply them directly.
+//
+// With Postgres, a trigger on the packages table broadcasts every change of
+// a package, whether it was made by this app, the node app or by hand.
+
+const invalidationChannel = "registry_invalidations"
+
+// Postgres drops notifications with payloads of 8000 bytes or more.
+const maxInvalidationPayload = 7000
+
+type notifier interface {
+	Notify(channel, payload string) error
+	Listen(channel string, handle func(payload string))
+}
+
+// invalidation names cache keys and packages to drop. A "*" in either list
+// drops everything that can be enumerated. URLs are repositories whose tags
+// are dropped, and are sent by the packages trigger instead of names so
+// receivers don't have to look the packages up. ReadOnly and FeatureFlags
+// are sent on their own and switch read-only mode or reload the feature
+// flags from the store instead.
+type invalidation struct {
+	Keys         []string      `json:"keys,omitempty"`
+	Packages     []string      `json:"packages,omitempty"`
+	URLs         []string      `json:"urls,omitempty"`
+	ReadOnly     *readOnlyMode `json:"read_only,omitempty"`
+	FeatureFlags bool          `json:"feature_flags,omitempty"`
+}
+
+var packageListKeys = []string{"packages", "packages_count", "packages_feed"}
+
+func (inv invalidation) all() bool {
+	for _, list := range [][]string{inv.Keys, inv.Packages} {
+		for _, k := range list {
+			if k == "*" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// listenForInvalidations subscribes to invalidations from other instances
+// when the store can broadcast them.
+func (s *Server) listenForInvalidations() {
+	n, ok := s.store.(notifier)
+	if !ok {
+		return
+	}
+	n.Listen(invalidationChannel, func(payload string) {
+		var inv invalidation
+		if err := json.Unmarshal([]byte(payload), &inv); err != nil {
+			cacheLog.Warnf("Invalid cache invalidation %q: %s", payload, err)
+			return
+		}
+		s.applyInvalidation(inv)
+	})
+	s.broadcast = n
+}
+
+// invalidate drops inv on every instance.
+func (s *Server) invalidate(inv invalidation) error {
+	if s.broadcast == nil {
+		s.applyInvalidation(inv)
+		return nil
+	}
+	for _, part := range splitInvalidation(inv) {
+		payload, err := json.Marshal(part)
+		if err != nil {
+			return err
+		}
+		if err := s.broadcast.Notify(invalidationChannel, string(payload)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// splitInvalidation breaks inv into parts that fit a notification.
+func splitInvalidation(inv invalidation) []invalidation {
+	if inv.ReadOnly != nil || inv.FeatureFlags {
+		return []invalidation{{ReadOnly: inv.ReadOnly, FeatureFlags: inv.FeatureFlags}}
+	}
+	if inv.all() {
+		return []invalidation{{Keys: []string{"*"}}}
+	}
+	var parts []invalidation
+	var part invalidation
+	size := 0
+	add := func(list *[]string, item string) {
+		if size+len(item) > maxInvalidationPayload && size > 0 {
+			parts = append(parts, part)
+			part, size = invalidation{}, 0
+		}
+		*list = append(*list, item)
+		size += len(item) + 4
+	}
+	for _, k := range inv.Keys {
+		add(&part.Keys, k)
+	}
+	for _, name := range inv.Packages {
+		add(&part.Packages, name)
+	}
+	for _, url := range inv.URLs {
+		add(&part.URLs, url)
+	}
+	if size > 0 {
+		parts = append(parts, part)
+	}
+	return parts
+}
+
+// applyInvalidation drops inv from the caches of this instance. Only the
+// package list keys are known in the shared cache, so "*" can't reach other
+// entries there; they expire on their own.
+func (s *Server) applyInvalidation(inv invalidation) {
+	if inv.ReadOnly != nil {
+		s.switchReadOnly(*inv.ReadOnly)
+		return
+	}
+	if inv.FeatureFlags {
+		if err := s.loadFeatureFlags(); err != nil {
+			cacheLog.Errorf("Could not reload feature flags: %s", err)
+		}
+		return
+	}
+	if s.config.cdnPurger != nil {
+		s.purges.add(s.purgeKeys(inv))
+	}
+	if s.hotspots != nil {
+		s.hotspots.forget()
+	}
+	if inv.all() {
+		flushTagCache()
+		if c, ok := s.cache.(*memoryCache); ok {
+			c.Flush()
+			s.cacheKeys.reset()
+		}
+		for _, key := range []string{"packages", "packages_stale", "packages_count", "packages_feed"} {
+			s.cache.Delete(key)
+		}
+		return
+	}
+	for _, key := range inv.Keys {
+		s.cache.Delete(key)
+	}
+	s.cacheKeys.forget(inv.Keys...)
+	if len(inv.Packages) > 0 {
+		for _, key := range packageListKeys {
+			s.cache.Delete(key)
+		}
+	}
+	for _, name := range inv.Packages {
+		if p, err := s.store.GetPackage(name); err == nil {
+			forgetTags(p.URL)
+		}
+	}
+	for _, url := range inv.URLs {
+		forgetTags(url)
+	}
+}
+
+// packagesChanged drops what this instance cached about the changed
+// packages right away. Other instances hear of the change from the packages
+// trigger when the store broadcasts; single-instance stores don't need to.
+func (s *Server) packagesChanged(urls ...string) {
+	s.applyInvalidation(invalidation{Keys: packageListKeys, URLs: urls})
+}
+
+func (s *Server) invalidateCache(r *http.Request) *http.Response {
+	var inv invalidation
+	if err := json.NewDecoder(r.Body).Decode(&inv); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	inv.ReadOnly, inv.FeatureFlags = nil, false
+	if len(inv.Keys) == 0 && len(inv.Packages) == 0 {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "No keys or packages given")
+	}
+	if err := s.invalidate(inv); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Could not publish invalidation")
+	}
+	return jsonResponse(r, http.StatusAccepted, inv)
+}
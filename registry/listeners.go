@@ -0,0 +1,184 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LISTEN binds the server to several addresses, each serving a share of
+// the routes through its own middleware stack, e.g.
+// LISTEN=:3000=public,127.0.0.1:9090=admin. The roles are:
+//
+//	all     every route, as the single PORT listener serves them
+//	public  every route but the admin API, /metrics and /debug/slo
+//	admin   only those and /readyz, without the limits, IP filters and
+//	        headers meant for public traffic, so large imports and
+//	        scrapes get through
+//
+// Without LISTEN the server listens on PORT with the all role.
+
+const (
+	roleAll    = "all"
+	rolePublic = "public"
+	roleAdmin  = "admin"
+)
+
+type listenerConfig struct {
+	addr string
+	role string
+}
+
+// parseListeners reads LISTEN, defaulting to port with the all role.
+func parseListeners(value, port string) ([]listenerConfig, error) {
+	if strings.TrimSpace(value) == "" {
+		return []listenerConfig{{addr: ":" + port, role: roleAll}}, nil
+	}
+	var listeners []listenerConfig
+	seen := map[string]bool{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		l := listenerConfig{addr: item, role: roleAll}
+		if i := strings.LastIndex(item, "="); i >= 0 {
+			l.addr, l.role = item[:i], item[i+1:]
+		}
+		switch l.role {
+		case roleAll, rolePublic, roleAdmin:
+		default:
+			return nil, fmt.Errorf("unknown role %q for %s", l.role, l.addr)
+		}
+		if _, _, err := net.SplitHostPort(l.addr); err != nil {
+			return nil, fmt.Errorf("invalid address %q: %s", l.addr, err)
+		}
+		if seen[l.addr] {
+			return nil, fmt.Errorf("%s listed twice", l.addr)
+		}
+		seen[l.addr] = true
+		listeners = append(listeners, l)
+	}
+	if len(listeners) == 0 {
+		return nil, fmt.Errorf("no addresses")
+	}
+	return listeners, nil
+}
+
+// adminPath reports whether path is served by admin listeners.
+func adminPath(path string) bool {
+	return path == "/metrics" || path == "/debug/slo" || strings.HasPrefix(path, "/admin/")
+}
+
+// handlerFor returns the handler of listeners with role.
+func (s *Server) handlerFor(role string) http.Handler {
+	switch role {
+	case rolePublic:
+		return onlyPaths(s.handler, func(path string) bool { return !adminPath(path) })
+	case roleAdmin:
+		var h http.Handler = http.HandlerFunc(s.serveLocal)
+		h = recoverPanics(h, s.config.errorReporter)
+		return onlyPaths(h, func(path string) bool { return adminPath(path) || path == "/readyz" })
+	}
+	return s.handler
+}
+
+// onlyPaths answers requests for paths not allowed with 404.
+func onlyPaths(next http.Handler, allowed func(string) bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !allowed(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// openListeners opens a socket for every listener, taking over the ones
+// inherited through socket activation first, see upgrade.go.
+func openListeners(listeners []listenerConfig, reusePort bool) ([]net.Listener, error) {
+	inherited, err := inheritedSockets()
+	if err != nil {
+		return nil, err
+	}
+	lns := make([]net.Listener, len(listeners))
+	for i, l := range listeners {
+		if f := inherited.take(i, l.role); f != nil {
+			ln, err := net.FileListener(f)
+			f.Close()
+			if err != nil {
+				return nil, fmt.Errorf("inherited socket %s: %s", f.Name(), err)
+			}
+			serverLog.Infof("Listening at %s (%s) on an inherited socket", ln.Addr(), l.role)
+			lns[i] = ln
+			continue
+		}
+		lc := net.ListenConfig{}
+		if reusePort {
+			lc.Control = setReusePort
+		}
+		if lns[i], err = lc.Listen(context.Background(), "tcp", l.addr); err != nil {
+			return nil, err
+		}
+		serverLog.Infof("Listening at %s (%s)", l.addr, l.role)
+	}
+	inherited.closeRest()
+	return lns, nil
+}
+
+// httpServers are the servers running on the listeners.
+type httpServers struct {
+	mu      sync.Mutex
+	servers []*http.Server
+	errs    chan error
+}
+
+func newHTTPServers() *httpServers {
+	return &httpServers{errs: make(chan error, 1)}
+}
+
+// start serves handler on ln.
+func (h *httpServers) start(ln net.Listener, handler http.Handler) {
+	srv := &http.Server{Handler: handler}
+	h.mu.Lock()
+	h.servers = append(h.servers, srv)
+	h.mu.Unlock()
+	go func() {
+		if err := srv.Serve(ln); err != http.ErrServerClosed {
+			select {
+			case h.errs <- err:
+			default:
+			}
+		}
+	}()
+}
+
+// wait returns the error of the first server that fails.
+func (h *httpServers) wait() error {
+	return <-h.errs
+}
+
+// shutdown stops accepting requests and waits up to timeout for the ones
+// in flight.
+func (h *httpServers) shutdown(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	h.mu.Lock()
+	servers := h.servers
+	h.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				serverLog.Warnf("Shutdown: %s", err)
+			}
+		}(srv)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,228 @@
+package registry
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Messages are logged at a level, debug, info, warn or error, by one of the
+// modules below, as "WARN cache: ...". LOG_LEVEL (default info) drops the
+// messages below it, LOG_LEVELS overrides it per module, e.g.
+// LOG_LEVELS=cache=debug,db=warn, and LOG_SAMPLING keeps only a share of
+// the debug messages of a module, e.g. LOG_SAMPLING=cache=0.01, since
+// some, like cache hits, come with every request. The admin API changes
+// all three at runtime; like read-only mode, a change only affects the
+// process that receives it.
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = []string{"debug", "info", "warn", "error"}
+
+func (l logLevel) String() string { return logLevelNames[l] }
+
+func parseLogLevel(name string) (logLevel, error) {
+	for i, n := range logLevelNames {
+		if strings.EqualFold(name, n) {
+			return logLevel(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+var (
+	archiveLog = newLogger("archive")
+	authLog    = newLogger("auth")
+	cacheLog   = newLogger("cache")
+	dbLog      = newLogger("db")
+	jobLog     = newLogger("jobs")
+	packageLog = newLogger("packages")
+	searchLog  = newLogger("search")
+	serverLog  = newLogger("server")
+	sidecarLog = newLogger("sidecar")
+)
+
+// logModules are the names of the loggers.
+var logModules = map[string]bool{}
+
+// LogSettings are the levels and sampling rates in effect.
+type LogSettings struct {
+	Level    string             `json:"level"`
+	Modules  map[string]string  `json:"modules"`
+	Sampling map[string]float64 `json:"sampling"`
+}
+
+// logConfig holds the parsed LogSettings the loggers read.
+type logConfig struct {
+	mu       sync.RWMutex
+	level    logLevel
+	modules  map[string]logLevel
+	sampling map[string]float64
+}
+
+var logging = &logConfig{level: levelInfo}
+
+func (c *logConfig) settings() LogSettings {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	s := LogSettings{Level: c.level.String(), Modules: map[string]string{}, Sampling: map[string]float64{}}
+	for module, level := range c.modules {
+		s.Modules[module] = level.String()
+	}
+	for module, rate := range c.sampling {
+		s.Sampling[module] = rate
+	}
+	return s
+}
+
+// apply validates s and makes it effective.
+func (c *logConfig) apply(s LogSettings) error {
+	level, err := parseLogLevel(s.Level)
+	if err != nil {
+		return err
+	}
+	modules := map[string]logLevel{}
+	for module, name := range s.Modules {
+		if !logModules[module] {
+			return fmt.Errorf("unknown module %q", module)
+		}
+		if modules[module], err = parseLogLevel(name); err != nil {
+			return err
+		}
+	}
+	for module, rate := range s.Sampling {
+		if !logModules[module] {
+			return fmt.Errorf("unknown module %q", module)
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("sampling of %s must be between 0 and 1", module)
+		}
+	}
+	c.mu.Lock()
+	c.level, c.modules, c.sampling = level, modules, s.Sampling
+	c.mu.Unlock()
+	return nil
+}
+
+// enabled reports whether module logs at level, sampling debug messages.
+func (c *logConfig) enabled(module string, level logLevel) bool {
+	c.mu.RLock()
+	min, ok := c.modules[module]
+	if !ok {
+		min = c.level
+	}
+	rate, sampled := c.sampling[module]
+	c.mu.RUnlock()
+	if level < min {
+		return false
+	}
+	if level == levelDebug && sampled && rand.Float64() >= rate {
+		metrics.Add("log_sampled_out", 1)
+		return false
+	}
+	return true
+}
+
+// parseLogList reads "module=value,..." into a map.
+func parseLogList(value string) (map[string]string, error) {
+	list := map[string]string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("%q is not module=value", item)
+		}
+		list[strings.TrimSpace(kv[0])] = strings.TrimSpace(kv[1])
+	}
+	return list, nil
+}
+
+// configureLogging applies LOG_LEVEL, LOG_LEVELS and LOG_SAMPLING.
+func configureLogging() error {
+	modules, err := parseLogList(getEnv("LOG_LEVELS", ""))
+	if err != nil {
+		return fmt.Errorf("Invalid LOG_LEVELS: %s", err)
+	}
+	rates, err := parseLogList(getEnv("LOG_SAMPLING", ""))
+	if err != nil {
+		return fmt.Errorf("Invalid LOG_SAMPLING: %s", err)
+	}
+	s := LogSettings{Level: getEnv("LOG_LEVEL", "info"), Modules: modules, Sampling: map[string]float64{}}
+	for module, rate := range rates {
+		if s.Sampling[module], err = strconv.ParseFloat(rate, 64); err != nil {
+			return fmt.Errorf("Invalid LOG_SAMPLING: %q is not a number", rate)
+		}
+	}
+	if err := logging.apply(s); err != nil {
+		return fmt.Errorf("Invalid logging settings: %s", err)
+	}
+	metrics.Set("log_level", expvar.Func(func() interface{} { return logging.settings().Level }))
+	return nil
+}
+
+type logger struct {
+	module string
+}
+
+func newLogger(module string) logger {
+	logModules[module] = true
+	return logger{module: module}
+}
+
+func (l logger) logf(level logLevel, format string, args ...interface{}) {
+	if !logging.enabled(l.module, level) {
+		return
+	}
+	log.Printf("%s %s: %s", strings.ToUpper(level.String()), l.module, fmt.Sprintf(format, args...))
+}
+
+func (l logger) Debugf(format string, args ...interface{}) { l.logf(levelDebug, format, args...) }
+func (l logger) Infof(format string, args ...interface{})  { l.logf(levelInfo, format, args...) }
+func (l logger) Warnf(format string, args ...interface{})  { l.logf(levelWarn, format, args...) }
+func (l logger) Errorf(format string, args ...interface{}) { l.logf(levelError, format, args...) }
+
+func (s *Server) getLogSettings(r *http.Request) *http.Response {
+	return jsonResponse(r, http.StatusOK, logging.settings())
+}
+
+// setLogSettings replaces the levels and sampling rates. Modules left out
+// log at the level and without sampling.
+func (s *Server) setLogSettings(r *http.Request) *http.Response {
+	var req LogSettings
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if req.Level == "" {
+		req.Level = levelInfo.String()
+	}
+	if err := logging.apply(req); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, err.Error())
+	}
+	settings := logging.settings()
+	var overrides []string
+	for module, level := range settings.Modules {
+		overrides = append(overrides, module+"="+level)
+	}
+	sort.Strings(overrides)
+	s.audit(s.adminActor(r), "logging.changed", "", strings.Join(append([]string{settings.Level}, overrides...), " "))
+	return jsonResponse(r, http.StatusOK, settings)
+}
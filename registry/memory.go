@@ -0,0 +1,1635 @@
+package registry
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the registry in memory and periodically writes it to a
+// JSON file, for CI fixtures and local development without any services.
+// Like sqliteStore it needs SIDECAR_DISABLED=true, with which packages are
+// registered and unregistered by register.go.
+type memoryStore struct {
+	mu    sync.RWMutex
+	state memoryState
+	dirty bool
+	// clientStats, deprecatedStats, downloads, transfers and the audit log
+	// are kept in memory only.
+	clientStats     map[memoryClientKey]int64
+	deprecatedStats map[memoryDeprecatedKey]int64
+	downloads       map[memoryDownloadKey]int64
+	transfers       map[string]Transfer
+	audit           []AuditEntry
+
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+type memoryState struct {
+	// Packages is keyed by memoryKey.
+	Packages      map[string]*memoryPackage
+	Aliases       map[string]string
+	Organizations map[string]string
+	Tenants       map[string]*Tenant
+	// Contacts is keyed by organization; organizations without one have
+	// no email and notifications on.
+	Contacts map[string]*Contact
+	// Tombstones is keyed by package name.
+	Tombstones map[string]*memoryTombstone
+	// APIKeys is keyed by name.
+	APIKeys map[string]*memoryAPIKey
+	// Members and Teams are keyed by memoryKey(organization, name).
+	Members map[string]*memoryMember
+	Teams   map[string]*memoryTeam
+	// Checksums maps repository URLs to the sums of their tags.
+	Checksums map[string]map[string]string
+	// Dependencies maps repository URLs to their declared dependencies.
+	Dependencies map[string][]Dependency
+	// Held is keyed by package name.
+	Held map[string]*HeldRegistration
+	// FeatureFlags holds the flags switched through the admin API.
+	FeatureFlags map[string]bool
+}
+
+// memoryFile is the persisted form of memoryState. It is meant to be
+// readable and easy to write by hand as a fixture:
+//
+//	{"packages": [{"name": "jquery", "url": "https://github.com/jquery/jquery.git"}]}
+type memoryFile struct {
+	Packages      []*memoryPackage             `json:"packages"`
+	Aliases       map[string]string            `json:"aliases,omitempty"`
+	Organizations map[string]string            `json:"organizations,omitempty"`
+	Contacts      map[string]*Contact          `json:"contacts,omitempty"`
+	Tenants       []*Tenant                    `json:"tenants,omitempty"`
+	Tombstones    []*memoryTombstone           `json:"tombstones,omitempty"`
+	APIKeys       []*memoryAPIKey              `json:"api_keys,omitempty"`
+	Members       []*memoryMember              `json:"members,omitempty"`
+	Teams         []*memoryTeam                `json:"teams,omitempty"`
+	Checksums     map[string]map[string]string `json:"checksums,omitempty"`
+	Dependencies  map[string][]Dependency      `json:"dependencies,omitempty"`
+	Held          []*HeldRegistration          `json:"held_registrations,omitempty"`
+	FeatureFlags  map[string]bool              `json:"feature_flags,omitempty"`
+}
+
+type memoryTombstone struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+// memoryAPIKey is an APIKey with its hash and publications persisted.
+type memoryAPIKey struct {
+	Name         string              `json:"name"`
+	TokenHash    string              `json:"token_hash"`
+	Scopes       []string            `json:"scopes"`
+	DailyQuota   int                 `json:"daily_quota,omitempty"`
+	TotalQuota   int                 `json:"total_quota,omitempty"`
+	CreatedAt    time.Time           `json:"created_at"`
+	Publications []memoryPublication `json:"publications,omitempty"`
+}
+
+type memoryPublication struct {
+	Package   string    `json:"package"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type memoryMember struct {
+	Organization string    `json:"organization"`
+	Name         string    `json:"name"`
+	TokenHash    string    `json:"token_hash"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type memoryTeam struct {
+	Organization string   `json:"organization"`
+	Name         string   `json:"name"`
+	Members      []string `json:"members"`
+	// Packages maps package names to permissions.
+	Packages map[string]string `json:"packages"`
+}
+
+type memoryPackage struct {
+	PackageRecord
+	Description   string     `json:"description,omitempty"`
+	Keywords      []string   `json:"keywords,omitempty"`
+	Status        string     `json:"status"`
+	CheckFailures int32      `json:"check_failures"`
+	CheckedAt     *time.Time `json:"checked_at,omitempty"`
+	NextCheckAt   *time.Time `json:"next_check_at,omitempty"`
+	UpdatedAt     *time.Time `json:"updated_at,omitempty"`
+	Stars         int        `json:"stars,omitempty"`
+	License       string     `json:"license,omitempty"`
+	Archived      bool       `json:"archived,omitempty"`
+	EnrichedAt    *time.Time `json:"enriched_at,omitempty"`
+	Private       bool       `json:"private,omitempty"`
+}
+
+func (p *memoryPackage) pkg() Package {
+	return Package{Name: p.Name, URL: p.URL}
+}
+
+func (p *memoryPackage) hits() int32 {
+	if p.Hits == nil {
+		return 0
+	}
+	return *p.Hits
+}
+
+// listed packages are those of the default registry that listings show.
+func (p *memoryPackage) listed() bool {
+	return p.Tenant == "" && !p.Private
+}
+
+// demoted packages rank lower in search.
+func (p *memoryPackage) demoted() bool {
+	return p.Archived || p.Deprecated != nil
+}
+
+func (p *memoryPackage) details() PackageDetails {
+	return PackageDetails{
+		Name:        p.Name,
+		URL:         p.URL,
+		Description: p.Description,
+		Keywords:    p.Keywords,
+		CreatedAt:   p.CreatedAt,
+		UpdatedAt:   p.UpdatedAt,
+		Hits:        p.hits(),
+		Status:      p.Status,
+		Stars:       p.Stars,
+		License:     p.License,
+		Archived:    p.Archived,
+		Deprecated:  p.Deprecated,
+		Private:     p.Private,
+	}
+}
+
+type memoryClientKey struct {
+	day             time.Time
+	client, version string
+}
+
+type memoryDeprecatedKey struct {
+	day              time.Time
+	dimension, value string
+}
+
+type memoryDownloadKey struct {
+	name, interval string
+	start          time.Time
+}
+
+func memoryKey(tenant, name string) string {
+	return tenant + "/" + name
+}
+
+// openMemory loads path if it exists. With an empty path nothing is
+// persisted; otherwise changes are flushed every interval and on Close.
+func openMemory(path string, interval time.Duration) (*memoryStore, error) {
+	s := &memoryStore{
+		state: memoryState{
+			Packages:      map[string]*memoryPackage{},
+			Aliases:       map[string]string{},
+			Organizations: map[string]string{},
+			Contacts:      map[string]*Contact{},
+			Tenants:       map[string]*Tenant{},
+			Tombstones:    map[string]*memoryTombstone{},
+			APIKeys:       map[string]*memoryAPIKey{},
+			Members:       map[string]*memoryMember{},
+			Teams:         map[string]*memoryTeam{},
+			Checksums:     map[string]map[string]string{},
+			Dependencies:  map[string][]Dependency{},
+			Held:          map[string]*HeldRegistration{},
+			FeatureFlags:  map[string]bool{},
+		},
+		path: path,
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	if path == "" {
+		close(s.done)
+		return s, nil
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		var file memoryFile
+		if err := json.Unmarshal(data, &file); err != nil {
+			return nil, err
+		}
+		for _, p := range file.Packages {
+			if p.Status == "" {
+				p.Status = statusOK
+			}
+			s.state.Packages[memoryKey(p.Tenant, p.Name)] = p
+		}
+		for alias, target := range file.Aliases {
+			s.state.Aliases[alias] = target
+		}
+		for name, tokenHash := range file.Organizations {
+			s.state.Organizations[name] = tokenHash
+		}
+		for org, c := range file.Contacts {
+			s.state.Contacts[org] = c
+		}
+		for _, t := range file.Tenants {
+			s.state.Tenants[t.Name] = t
+		}
+		for _, t := range file.Tombstones {
+			s.state.Tombstones[t.Name] = t
+		}
+		for _, k := range file.APIKeys {
+			s.state.APIKeys[k.Name] = k
+		}
+		for _, m := range file.Members {
+			s.state.Members[memoryKey(m.Organization, m.Name)] = m
+		}
+		for _, t := range file.Teams {
+			s.state.Teams[memoryKey(t.Organization, t.Name)] = t
+		}
+		for url, sums := range file.Checksums {
+			s.state.Checksums[url] = sums
+		}
+		for url, deps := range file.Dependencies {
+			s.state.Dependencies[url] = deps
+		}
+		for _, h := range file.Held {
+			s.state.Held[h.Name] = h
+		}
+		for name, enabled := range file.FeatureFlags {
+			s.state.FeatureFlags[name] = enabled
+		}
+	}
+
+	go func() {
+		defer close(s.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if err := s.flush(); err != nil {
+					dbLog.Errorf("Could not write %s: %s", s.path, err)
+				}
+			case <-s.stop:
+				return
+			}
+		}
+	}()
+	return s, nil
+}
+
+// flush writes the state to a temporary file and renames it over path, so
+// a crash never leaves a truncated file behind.
+func (s *memoryStore) flush() error {
+	s.mu.Lock()
+	if !s.dirty {
+		s.mu.Unlock()
+		return nil
+	}
+	file := memoryFile{
+		Packages:      s.packages(func(*memoryPackage) bool { return true }),
+		Aliases:       s.state.Aliases,
+		Organizations: s.state.Organizations,
+		Contacts:      s.state.Contacts,
+		Checksums:     s.state.Checksums,
+		Dependencies:  s.state.Dependencies,
+		FeatureFlags:  s.state.FeatureFlags,
+	}
+	for _, t := range s.state.Tenants {
+		file.Tenants = append(file.Tenants, t)
+	}
+	for _, t := range s.state.Tombstones {
+		file.Tombstones = append(file.Tombstones, t)
+	}
+	sort.Slice(file.Tombstones, func(i, j int) bool { return file.Tombstones[i].Name < file.Tombstones[j].Name })
+	for _, k := range s.state.APIKeys {
+		file.APIKeys = append(file.APIKeys, k)
+	}
+	sort.Slice(file.APIKeys, func(i, j int) bool { return file.APIKeys[i].Name < file.APIKeys[j].Name })
+	for _, m := range s.state.Members {
+		file.Members = append(file.Members, m)
+	}
+	sort.Slice(file.Members, func(i, j int) bool {
+		return memoryKey(file.Members[i].Organization, file.Members[i].Name) < memoryKey(file.Members[j].Organization, file.Members[j].Name)
+	})
+	for _, t := range s.state.Teams {
+		file.Teams = append(file.Teams, t)
+	}
+	sort.Slice(file.Teams, func(i, j int) bool {
+		return memoryKey(file.Teams[i].Organization, file.Teams[i].Name) < memoryKey(file.Teams[j].Organization, file.Teams[j].Name)
+	})
+	for _, h := range s.state.Held {
+		file.Held = append(file.Held, h)
+	}
+	sort.Slice(file.Held, func(i, j int) bool { return file.Held[i].Name < file.Held[j].Name })
+	data, err := json.MarshalIndent(file, "", "  ")
+	s.dirty = false
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), filepath.Base(s.path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *memoryStore) Close() {
+	if s.path == "" {
+		return
+	}
+	close(s.stop)
+	<-s.done
+	if err := s.flush(); err != nil {
+		dbLog.Errorf("Could not write %s: %s", s.path, err)
+	}
+}
+
+// packages returns the packages matching keep, sorted by name.
+func (s *memoryStore) packages(keep func(*memoryPackage) bool) []*memoryPackage {
+	var list []*memoryPackage
+	for _, p := range s.state.Packages {
+		if keep(p) {
+			list = append(list, p)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+func toPackages(list []*memoryPackage) []Package {
+	var packages []Package
+	for _, p := range list {
+		packages = append(packages, p.pkg())
+	}
+	return packages
+}
+
+func (s *memoryStore) GetPackage(name string) (Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.state.Packages[memoryKey("", name)]
+	if !ok {
+		return Package{}, ErrNotFound
+	}
+	pkg := p.pkg()
+	pkg.CacheTTL = time.Duration(p.CacheTTL) * time.Second
+	pkg.Deprecated = p.Deprecated
+	pkg.Private = p.Private
+	if p.UpdatedAt != nil {
+		pkg.UpdatedAt = *p.UpdatedAt
+	} else if p.CreatedAt != nil {
+		pkg.UpdatedAt = *p.CreatedAt
+	}
+	return pkg, nil
+}
+
+func (s *memoryStore) ListPackages() ([]Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return toPackages(s.packages((*memoryPackage).listed)), nil
+}
+
+func (s *memoryStore) EachPackage(fn func(Package) error) error {
+	packages, err := s.ListPackages()
+	if err != nil {
+		return err
+	}
+	for _, p := range packages {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) CountPackages() (int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return int64(len(s.packages((*memoryPackage).listed))), nil
+}
+
+func (s *memoryStore) PackageDetails(name string) (PackageDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.state.Packages[memoryKey("", name)]
+	if !ok {
+		return PackageDetails{}, ErrNotFound
+	}
+	return p.details(), nil
+}
+
+func (s *memoryStore) ListPackageDetails(offset, limit int) ([]PackageDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := s.packages((*memoryPackage).listed)
+	if offset > len(list) {
+		offset = len(list)
+	}
+	if limit < len(list)-offset {
+		list = list[:offset+limit]
+	}
+	details := []PackageDetails{}
+	for _, p := range list[offset:] {
+		details = append(details, p.details())
+	}
+	return details, nil
+}
+
+func (s *memoryStore) RecentPackageDetails(limit int) ([]PackageDetails, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	list := s.packages(func(p *memoryPackage) bool { return p.listed() && p.UpdatedAt != nil })
+	sort.Slice(list, func(i, j int) bool {
+		if !list[i].UpdatedAt.Equal(*list[j].UpdatedAt) {
+			return list[i].UpdatedAt.After(*list[j].UpdatedAt)
+		}
+		return list[i].Name > list[j].Name
+	})
+	if limit < len(list) {
+		list = list[:limit]
+	}
+	details := []PackageDetails{}
+	for _, p := range list {
+		details = append(details, p.details())
+	}
+	return details, nil
+}
+
+func (s *memoryStore) PackageByURL(urls ...string) (Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found *memoryPackage
+	for _, p := range s.state.Packages {
+		if p.Tenant != "" {
+			continue
+		}
+		for _, u := range urls {
+			if strings.ToLower(p.URL) == u && (found == nil || (p.CreatedAt != nil && found.CreatedAt != nil && p.CreatedAt.Before(*found.CreatedAt))) {
+				found = p
+			}
+		}
+	}
+	if found == nil {
+		return Package{}, ErrNotFound
+	}
+	return found.pkg(), nil
+}
+
+// Search matches substrings of the name, URL and description like
+// sqliteStore, ranking exact names first, then packages neither archived
+// nor deprecated, then by GitHub stars and popularity.
+func (s *memoryStore) Search(term string, limit int) ([]SearchResult, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches := s.packages(func(p *memoryPackage) bool {
+		return p.listed() && (term == "" ||
+			strings.Contains(strings.ToLower(p.Name), term) ||
+			strings.Contains(strings.ToLower(p.URL), term) ||
+			strings.Contains(strings.ToLower(p.Description), term))
+	})
+	sort.SliceStable(matches, func(i, j int) bool {
+		if ei, ej := strings.ToLower(matches[i].Name) == term, strings.ToLower(matches[j].Name) == term; ei != ej {
+			return ei
+		}
+		if di, dj := matches[i].demoted(), matches[j].demoted(); di != dj {
+			return dj
+		}
+		if term != "" && matches[i].Stars != matches[j].Stars {
+			return matches[i].Stars > matches[j].Stars
+		}
+		return matches[i].hits() > matches[j].hits()
+	})
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	results := []SearchResult{}
+	for _, p := range matches {
+		results = append(results, SearchResult{Name: p.Name, URL: p.URL})
+	}
+	return results, nil
+}
+
+func (s *memoryStore) PackagesByPrefix(prefix string, limit int) ([]Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	matches := s.packages(func(p *memoryPackage) bool {
+		return p.listed() && strings.HasPrefix(p.Name, prefix)
+	})
+	sort.Slice(matches, func(i, j int) bool { return matches[i].Name < matches[j].Name })
+	if len(matches) > limit {
+		matches = matches[:limit]
+	}
+	return toPackages(matches), nil
+}
+
+func (s *memoryStore) DueURLChecks(limit int) ([]Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	now := time.Now()
+	due := s.packages(func(p *memoryPackage) bool { return p.NextCheckAt == nil || !p.NextCheckAt.After(now) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return toPackages(due), nil
+}
+
+// update applies fn to every package with the given name and URL.
+func (s *memoryStore) update(p Package, fn func(*memoryPackage)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, stored := range s.state.Packages {
+		if stored.Name == p.Name && stored.URL == p.URL {
+			fn(stored)
+			s.dirty = true
+		}
+	}
+}
+
+func (s *memoryStore) RecordURLSuccess(p Package, next time.Duration) error {
+	now := time.Now().UTC()
+	nextCheck := now.Add(next)
+	s.update(p, func(stored *memoryPackage) {
+		stored.Status, stored.CheckFailures = statusOK, 0
+		stored.CheckedAt, stored.NextCheckAt = &now, &nextCheck
+	})
+	return nil
+}
+
+func (s *memoryStore) RecordURLFailure(p Package, threshold int, base, max time.Duration) (bool, error) {
+	now := time.Now().UTC()
+	broken := false
+	s.update(p, func(stored *memoryPackage) {
+		backoff := time.Duration(math.Min(float64(base)*math.Pow(2, float64(stored.CheckFailures)), float64(max)))
+		nextCheck := now.Add(backoff)
+		stored.CheckFailures++
+		if int(stored.CheckFailures) >= threshold {
+			stored.Status = statusBroken
+		}
+		broken = broken || int(stored.CheckFailures) == threshold
+		stored.CheckedAt, stored.NextCheckAt = &now, &nextCheck
+	})
+	return broken, nil
+}
+
+func (s *memoryStore) DueEnrichments(before time.Time, limit int) ([]Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	due := s.packages(func(p *memoryPackage) bool {
+		return p.Tenant == "" && strings.Contains(strings.ToLower(p.URL), "github.com") &&
+			(p.EnrichedAt == nil || p.EnrichedAt.Before(before))
+	})
+	sort.SliceStable(due, func(i, j int) bool {
+		if due[i].EnrichedAt == nil || due[j].EnrichedAt == nil {
+			return due[i].EnrichedAt == nil && due[j].EnrichedAt != nil
+		}
+		return due[i].EnrichedAt.Before(*due[j].EnrichedAt)
+	})
+	if len(due) > limit {
+		due = due[:limit]
+	}
+	return toPackages(due), nil
+}
+
+func (s *memoryStore) RecordEnrichment(p Package, m *RepoMetadata) error {
+	now := time.Now().UTC()
+	s.update(p, func(stored *memoryPackage) {
+		if stored.Tenant != "" {
+			return
+		}
+		stored.EnrichedAt = &now
+		if m == nil {
+			return
+		}
+		if m.Description != "" {
+			stored.Description = m.Description
+		}
+		stored.Stars, stored.License, stored.Archived = m.Stars, m.License, m.Archived
+	})
+	return nil
+}
+
+func (s *memoryStore) VersionChecksums(url string) (map[string]string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	sums := map[string]string{}
+	for tag, sum := range s.state.Checksums[url] {
+		sums[tag] = sum
+	}
+	return sums, nil
+}
+
+func (s *memoryStore) RecordChecksum(url, tag, sum string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	sums := s.state.Checksums[url]
+	if sums == nil {
+		sums = map[string]string{}
+		s.state.Checksums[url] = sums
+	}
+	if _, ok := sums[tag]; !ok {
+		sums[tag] = sum
+		s.dirty = true
+	}
+	return nil
+}
+
+func (s *memoryStore) Dependencies(url string) ([]Dependency, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]Dependency{}, s.state.Dependencies[url]...), nil
+}
+
+func (s *memoryStore) RecordDependencies(url string, deps []Dependency) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deps = append([]Dependency{}, deps...)
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].Name != deps[j].Name {
+			return deps[i].Name < deps[j].Name
+		}
+		return !deps[i].Dev && deps[j].Dev
+	})
+	if len(deps) == 0 {
+		delete(s.state.Dependencies, url)
+	} else {
+		s.state.Dependencies[url] = deps
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) Dependents(name string, offset, limit int) ([]Dependency, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	dependents := []Dependency{}
+	for _, p := range s.packages((*memoryPackage).listed) {
+		for _, d := range s.state.Dependencies[p.URL] {
+			if d.Name == name {
+				dependents = append(dependents, Dependency{Name: p.Name, Range: d.Range, Dev: d.Dev})
+			}
+		}
+	}
+	if offset > len(dependents) {
+		offset = len(dependents)
+	}
+	dependents = dependents[offset:]
+	if limit < len(dependents) {
+		dependents = dependents[:limit]
+	}
+	return dependents, nil
+}
+
+func (s *memoryStore) BrokenPackages() ([]BrokenPackage, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	broken := []BrokenPackage{}
+	for _, p := range s.packages(func(p *memoryPackage) bool { return p.listed() && p.Status == statusBroken }) {
+		b := BrokenPackage{Name: p.Name, URL: p.URL, Failures: p.CheckFailures}
+		if p.CheckedAt != nil {
+			b.CheckedAt = *p.CheckedAt
+		}
+		broken = append(broken, b)
+	}
+	return broken, nil
+}
+
+func (s *memoryStore) ResolveAlias(alias string) (Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if target, ok := s.state.Aliases[alias]; ok {
+		if p, ok := s.state.Packages[memoryKey("", target)]; ok {
+			return p.pkg(), nil
+		}
+	}
+	return Package{}, ErrNotFound
+}
+
+func (s *memoryStore) ListAliases() ([]Alias, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	aliases := []Alias{}
+	for alias, target := range s.state.Aliases {
+		aliases = append(aliases, Alias{Alias: alias, Package: target})
+	}
+	sort.Slice(aliases, func(i, j int) bool { return aliases[i].Alias < aliases[j].Alias })
+	return aliases, nil
+}
+
+func (s *memoryStore) CreateAlias(a Alias) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Aliases[a.Alias]; ok {
+		return ErrExists
+	}
+	_, target := s.state.Packages[memoryKey("", a.Package)]
+	_, shadows := s.state.Packages[memoryKey("", a.Alias)]
+	if !target || shadows {
+		return ErrNotFound
+	}
+	s.state.Aliases[a.Alias] = a.Package
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) DeleteAlias(alias string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Aliases[alias]; !ok {
+		return ErrNotFound
+	}
+	delete(s.state.Aliases, alias)
+	s.dirty = true
+	return nil
+}
+
+func (k *memoryAPIKey) key() APIKey {
+	return APIKey{Name: k.Name, TokenHash: k.TokenHash, Scopes: k.Scopes, DailyQuota: k.DailyQuota, TotalQuota: k.TotalQuota, CreatedAt: k.CreatedAt}
+}
+
+func (s *memoryStore) APIKeyByTokenHash(tokenHash string) (APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, k := range s.state.APIKeys {
+		if k.TokenHash == tokenHash {
+			return k.key(), nil
+		}
+	}
+	return APIKey{}, ErrNotFound
+}
+
+func (s *memoryStore) ListAPIKeys() ([]APIKey, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	keys := []APIKey{}
+	for _, k := range s.state.APIKeys {
+		keys = append(keys, k.key())
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Name < keys[j].Name })
+	return keys, nil
+}
+
+func (s *memoryStore) CreateAPIKey(k APIKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.APIKeys[k.Name]; ok {
+		return ErrExists
+	}
+	s.state.APIKeys[k.Name] = &memoryAPIKey{Name: k.Name, TokenHash: k.TokenHash, Scopes: k.Scopes,
+		DailyQuota: k.DailyQuota, TotalQuota: k.TotalQuota, CreatedAt: k.CreatedAt}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) DeleteAPIKey(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.APIKeys[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.state.APIKeys, name)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) ReservePublication(key, pkg string, at, since, pending time.Time, daily, total int) (int, int, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.state.APIKeys[key]
+	if !ok {
+		return 0, 0, false, ErrNotFound
+	}
+	recent := 0
+	registered := map[string]bool{}
+	for _, p := range k.Publications {
+		if !p.CreatedAt.Before(since) {
+			recent++
+		}
+		if _, ok := s.state.Packages[memoryKey("", p.Package)]; ok || !p.CreatedAt.Before(pending) {
+			registered[p.Package] = true
+		}
+	}
+	if total > 0 && len(registered) >= total || daily > 0 && recent >= daily {
+		return recent, len(registered), false, nil
+	}
+	k.Publications = append(k.Publications, memoryPublication{Package: pkg, CreatedAt: at})
+	s.dirty = true
+	return recent, len(registered), true, nil
+}
+
+func (s *memoryStore) ReleasePublication(key, pkg string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	k, ok := s.state.APIKeys[key]
+	if !ok {
+		return ErrNotFound
+	}
+	for i, p := range k.Publications {
+		if p.Package == pkg && p.CreatedAt.Equal(at) {
+			k.Publications = append(k.Publications[:i], k.Publications[i+1:]...)
+			s.dirty = true
+			break
+		}
+	}
+	return nil
+}
+
+func (s *memoryStore) OrganizationTokenHash(org string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	tokenHash, ok := s.state.Organizations[org]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return tokenHash, nil
+}
+
+func (s *memoryStore) CreateOrganization(name, tokenHash string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Organizations[name]; ok {
+		return ErrExists
+	}
+	s.state.Organizations[name] = tokenHash
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) OrganizationContact(org string) (Contact, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if _, ok := s.state.Organizations[org]; !ok {
+		return Contact{}, ErrNotFound
+	}
+	if c, ok := s.state.Contacts[org]; ok {
+		return *c, nil
+	}
+	return Contact{Notifications: true}, nil
+}
+
+func (s *memoryStore) SetOrganizationContact(org string, c Contact) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Organizations[org]; !ok {
+		return ErrNotFound
+	}
+	s.state.Contacts[org] = &c
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) OrganizationPackages(org string) ([]Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var packages []Package
+	for _, p := range s.packages(func(p *memoryPackage) bool { return p.Tenant == "" && p.Organization == org }) {
+		pkg := p.pkg()
+		pkg.Private = p.Private
+		packages = append(packages, pkg)
+	}
+	return packages, nil
+}
+
+func (m *memoryMember) member() Member {
+	return Member{Organization: m.Organization, Name: m.Name, TokenHash: m.TokenHash, CreatedAt: m.CreatedAt}
+}
+
+func (s *memoryStore) OrganizationMembers(org string) ([]Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	members := []Member{}
+	for _, m := range s.state.Members {
+		if m.Organization == org {
+			members = append(members, m.member())
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i].Name < members[j].Name })
+	return members, nil
+}
+
+func (s *memoryStore) CreateMember(m Member) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Organizations[m.Organization]; !ok {
+		return ErrNotFound
+	}
+	key := memoryKey(m.Organization, m.Name)
+	if _, ok := s.state.Members[key]; ok {
+		return ErrExists
+	}
+	for _, other := range s.state.Members {
+		if other.TokenHash == m.TokenHash {
+			return ErrExists
+		}
+	}
+	s.state.Members[key] = &memoryMember{Organization: m.Organization, Name: m.Name, TokenHash: m.TokenHash, CreatedAt: m.CreatedAt}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) DeleteMember(org, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(org, name)
+	if _, ok := s.state.Members[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.state.Members, key)
+	for _, t := range s.state.Teams {
+		if t.Organization == org {
+			t.Members = removeString(t.Members, name)
+		}
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) MemberByTokenHash(tokenHash string) (Member, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, m := range s.state.Members {
+		if m.TokenHash == tokenHash {
+			return m.member(), nil
+		}
+	}
+	return Member{}, ErrNotFound
+}
+
+func (s *memoryStore) Teams(org string) ([]Team, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	teams := []Team{}
+	for _, t := range s.state.Teams {
+		if t.Organization != org {
+			continue
+		}
+		team := Team{Name: t.Name, Members: append([]string{}, t.Members...), Packages: []TeamPackage{}}
+		sort.Strings(team.Members)
+		for pkg, permission := range t.Packages {
+			team.Packages = append(team.Packages, TeamPackage{Package: pkg, Permission: permission})
+		}
+		sort.Slice(team.Packages, func(i, j int) bool { return team.Packages[i].Package < team.Packages[j].Package })
+		teams = append(teams, team)
+	}
+	sort.Slice(teams, func(i, j int) bool { return teams[i].Name < teams[j].Name })
+	return teams, nil
+}
+
+func (s *memoryStore) CreateTeam(org, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Organizations[org]; !ok {
+		return ErrNotFound
+	}
+	key := memoryKey(org, name)
+	if _, ok := s.state.Teams[key]; ok {
+		return ErrExists
+	}
+	s.state.Teams[key] = &memoryTeam{Organization: org, Name: name, Members: []string{}, Packages: map[string]string{}}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) DeleteTeam(org, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(org, name)
+	if _, ok := s.state.Teams[key]; !ok {
+		return ErrNotFound
+	}
+	delete(s.state.Teams, key)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) AddTeamMember(org, team, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.state.Teams[memoryKey(org, team)]
+	if _, exists := s.state.Members[memoryKey(org, member)]; !ok || !exists {
+		return ErrNotFound
+	}
+	if containsString(t.Members, member) {
+		return ErrExists
+	}
+	t.Members = append(t.Members, member)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) RemoveTeamMember(org, team, member string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.state.Teams[memoryKey(org, team)]
+	if !ok || !containsString(t.Members, member) {
+		return ErrNotFound
+	}
+	t.Members = removeString(t.Members, member)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) SetTeamPackage(org, team string, g TeamPackage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.state.Teams[memoryKey(org, team)]
+	if !ok {
+		return ErrNotFound
+	}
+	if g.Permission == "" {
+		if _, ok := t.Packages[g.Package]; !ok {
+			return ErrNotFound
+		}
+		delete(t.Packages, g.Package)
+	} else {
+		p, ok := s.state.Packages[memoryKey("", g.Package)]
+		if !ok || p.Organization != org {
+			return ErrNotFound
+		}
+		t.Packages[g.Package] = g.Permission
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) PackagePermission(org, member, pkg string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if p, ok := s.state.Packages[memoryKey("", pkg)]; !ok || p.Organization != org {
+		return "", nil
+	}
+	best := ""
+	for _, t := range s.state.Teams {
+		if t.Organization != org || !containsString(t.Members, member) {
+			continue
+		}
+		if permission := t.Packages[pkg]; permission == permissionMaintain || best == "" {
+			best = permission
+		}
+	}
+	return best, nil
+}
+
+func removeString(list []string, s string) []string {
+	kept := list[:0]
+	for _, item := range list {
+		if item != s {
+			kept = append(kept, item)
+		}
+	}
+	return kept
+}
+
+func (s *memoryStore) insert(p *memoryPackage) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(p.Tenant, p.Name)
+	if _, ok := s.state.Packages[key]; ok {
+		return ErrExists
+	}
+	if s.urlTaken(p.Tenant, p.Name, p.URL) {
+		return ErrURLTaken
+	}
+	now := time.Now().UTC()
+	p.CreatedAt, p.Status = &now, statusOK
+	s.state.Packages[key] = p
+	s.touch(p)
+	s.dirty = true
+	return nil
+}
+
+// urlTaken reports whether a package of tenant other than name has url, as
+// the unique normalized_url of the other stores would. The caller holds the
+// lock.
+func (s *memoryStore) urlTaken(tenant, name, url string) bool {
+	for _, p := range s.state.Packages {
+		if p.Tenant == tenant && p.Name != name && strings.EqualFold(p.URL, url) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *memoryStore) remove(tenant, name string, match func(*memoryPackage) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memoryKey(tenant, name)
+	p, ok := s.state.Packages[key]
+	if !ok || !match(p) {
+		return ErrNotFound
+	}
+	delete(s.state.Packages, key)
+	s.bury(p)
+	s.dirty = true
+	return nil
+}
+
+// touch records a change of a default registry package for PackageChanges.
+// The caller holds the write lock.
+func (s *memoryStore) touch(p *memoryPackage) {
+	if p.Tenant != "" {
+		return
+	}
+	now := time.Now().UTC()
+	p.UpdatedAt = &now
+	delete(s.state.Tombstones, p.Name)
+}
+
+// bury leaves a tombstone for a removed default registry package.
+func (s *memoryStore) bury(p *memoryPackage) {
+	if p.Tenant != "" {
+		return
+	}
+	s.state.Tombstones[p.Name] = &memoryTombstone{Name: p.Name, URL: p.URL, DeletedAt: time.Now().UTC()}
+}
+
+func (s *memoryStore) PackageChanges(since time.Time, after string, limit int) ([]PackageChange, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var changes []PackageChange
+	for _, p := range s.state.Packages {
+		if p.Tenant != "" {
+			continue
+		}
+		// Packages from before updated_at count as changed when created.
+		at := time.Unix(0, 0).UTC()
+		if p.UpdatedAt != nil {
+			at = *p.UpdatedAt
+		} else if p.CreatedAt != nil {
+			at = *p.CreatedAt
+		}
+		changes = append(changes, PackageChange{Name: p.Name, URL: p.URL, At: at, Deleted: p.Private})
+	}
+	for _, t := range s.state.Tombstones {
+		changes = append(changes, PackageChange{Name: t.Name, URL: t.URL, At: t.DeletedAt, Deleted: true})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].before(changes[j].At, changes[j].Name) })
+
+	list := []PackageChange{}
+	for _, c := range changes {
+		if len(list) == limit {
+			break
+		}
+		if c.after(since, after) {
+			list = append(list, c)
+		}
+	}
+	return list, nil
+}
+
+func (s *memoryStore) InsertScopedPackage(name, url, org string) error {
+	return s.insert(&memoryPackage{PackageRecord: PackageRecord{Name: name, URL: url, Organization: org}})
+}
+
+func (s *memoryStore) InsertPackage(name, url string) error {
+	return s.insert(&memoryPackage{PackageRecord: PackageRecord{Name: name, URL: url}})
+}
+
+func (s *memoryStore) DeletePackage(name string) error {
+	return s.remove("", name, func(p *memoryPackage) bool { return p.Organization == "" })
+}
+
+func (s *memoryStore) HoldRegistration(h HeldRegistration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Held[h.Name]; ok {
+		return ErrExists
+	}
+	s.state.Held[h.Name] = &h
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) HeldRegistrations() ([]HeldRegistration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	held := []HeldRegistration{}
+	for _, h := range s.state.Held {
+		held = append(held, *h)
+	}
+	sort.Slice(held, func(i, j int) bool {
+		if !held[i].CreatedAt.Equal(held[j].CreatedAt) {
+			return held[i].CreatedAt.Before(held[j].CreatedAt)
+		}
+		return held[i].Name < held[j].Name
+	})
+	return held, nil
+}
+
+func (s *memoryStore) ReleaseRegistration(name string) (HeldRegistration, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	h, ok := s.state.Held[name]
+	if !ok {
+		return HeldRegistration{}, ErrNotFound
+	}
+	delete(s.state.Held, name)
+	s.dirty = true
+	return *h, nil
+}
+
+func (s *memoryStore) DeleteScopedPackage(name, org string) error {
+	return s.remove("", name, func(p *memoryPackage) bool { return p.Organization == org })
+}
+
+func (s *memoryStore) SetDeprecation(name string, d *Deprecation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.state.Packages[memoryKey("", name)]
+	if !ok {
+		return ErrNotFound
+	}
+	p.Deprecated = d
+	s.touch(p)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) SetPackageURL(name, url string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.state.Packages[memoryKey("", name)]
+	if !ok {
+		return ErrNotFound
+	}
+	if s.urlTaken("", name, url) {
+		return ErrURLTaken
+	}
+	p.URL, p.Status, p.CheckFailures, p.NextCheckAt = url, statusOK, 0, nil
+	s.touch(p)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) SetVisibility(name string, private bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	p, ok := s.state.Packages[memoryKey("", name)]
+	if !ok {
+		return ErrNotFound
+	}
+	p.Private = private
+	s.touch(p)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) PackageOrganization(name string) (string, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.state.Packages[memoryKey("", name)]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return p.Organization, nil
+}
+
+func (s *memoryStore) CreateTransfer(t Transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transfers == nil {
+		s.transfers = map[string]Transfer{}
+	}
+	s.transfers[t.Package] = t
+	return nil
+}
+
+func (s *memoryStore) PendingTransfer(name string) (Transfer, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	t, ok := s.transfers[name]
+	if !ok {
+		return t, ErrNotFound
+	}
+	return t, nil
+}
+
+func (s *memoryStore) CompleteTransfer(t Transfer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	pending, ok := s.transfers[t.Package]
+	p, found := s.state.Packages[memoryKey("", t.Package)]
+	if !ok || pending.TokenHash != t.TokenHash || !found || p.Organization != t.From {
+		return ErrNotFound
+	}
+	delete(s.transfers, t.Package)
+	p.Organization = t.To
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) DeleteTransfer(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.transfers[name]; !ok {
+		return ErrNotFound
+	}
+	delete(s.transfers, name)
+	return nil
+}
+
+func (s *memoryStore) RecordAudit(e AuditEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.audit = append(s.audit, e)
+	return nil
+}
+
+func (s *memoryStore) AuditLog(pkg string, limit int) ([]AuditEntry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var entries []AuditEntry
+	for i := len(s.audit) - 1; i >= 0 && len(entries) < limit; i-- {
+		if pkg == "" || s.audit[i].Package == pkg {
+			entries = append(entries, s.audit[i])
+		}
+	}
+	return entries, nil
+}
+
+func (s *memoryStore) ListTenants() ([]*Tenant, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var list []*Tenant
+	for _, t := range s.state.Tenants {
+		tenant := *t
+		list = append(list, &tenant)
+	}
+	return list, nil
+}
+
+func (s *memoryStore) CreateTenant(t Tenant) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.state.Tenants[t.Name]; ok {
+		return ErrExists
+	}
+	s.state.Tenants[t.Name] = &t
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) FeatureFlags() (map[string]bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	flags := map[string]bool{}
+	for name, enabled := range s.state.FeatureFlags {
+		flags[name] = enabled
+	}
+	return flags, nil
+}
+
+func (s *memoryStore) SetFeatureFlag(name string, enabled bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state.FeatureFlags[name] = enabled
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) ResetFeatureFlag(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.state.FeatureFlags, name)
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) TenantGetPackage(tenant, name string) (Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	p, ok := s.state.Packages[memoryKey(tenant, name)]
+	if !ok {
+		return Package{}, ErrNotFound
+	}
+	return p.pkg(), nil
+}
+
+func (s *memoryStore) TenantListPackages(tenant string) ([]Package, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return toPackages(s.packages(func(p *memoryPackage) bool { return p.Tenant == tenant })), nil
+}
+
+func (s *memoryStore) TenantInsertPackage(tenant, name, url string) error {
+	return s.insert(&memoryPackage{PackageRecord: PackageRecord{Tenant: tenant, Name: name, URL: url}})
+}
+
+func (s *memoryStore) TenantDeletePackage(tenant, name string) error {
+	return s.remove(tenant, name, func(*memoryPackage) bool { return true })
+}
+
+func (s *memoryStore) Snapshot() ([]PackageRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	records := []PackageRecord{}
+	for _, p := range s.state.Packages {
+		r := p.PackageRecord
+		r.Visibility = "public"
+		if p.Private {
+			r.Visibility = "private"
+		}
+		records = append(records, r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].Tenant != records[j].Tenant {
+			return records[i].Tenant < records[j].Tenant
+		}
+		return records[i].Name < records[j].Name
+	})
+	return records, nil
+}
+
+func (s *memoryStore) RecordClientRequests(stats []ClientStat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.clientStats == nil {
+		s.clientStats = map[memoryClientKey]int64{}
+	}
+	for _, c := range stats {
+		s.clientStats[memoryClientKey{c.Day, c.Client, c.Version}] += c.Requests
+	}
+	return nil
+}
+
+func (s *memoryStore) ClientStats(since time.Time) ([]ClientStat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var stats []ClientStat
+	for k, n := range s.clientStats {
+		if !k.day.Before(since) {
+			stats = append(stats, ClientStat{Day: k.day, Client: k.client, Version: k.version, Requests: n})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].Day.Equal(stats[j].Day) {
+			return stats[i].Day.After(stats[j].Day)
+		}
+		return stats[i].Requests > stats[j].Requests
+	})
+	return stats, nil
+}
+
+func (s *memoryStore) RecordDeprecatedRequests(stats []DeprecatedRequestStat) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deprecatedStats == nil {
+		s.deprecatedStats = map[memoryDeprecatedKey]int64{}
+	}
+	for _, d := range stats {
+		s.deprecatedStats[memoryDeprecatedKey{d.Day, d.Dimension, d.Value}] += d.Requests
+	}
+	return nil
+}
+
+func (s *memoryStore) DeprecatedRequestStats(since time.Time) ([]DeprecatedRequestStat, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var stats []DeprecatedRequestStat
+	for k, n := range s.deprecatedStats {
+		if !k.day.Before(since) {
+			stats = append(stats, DeprecatedRequestStat{Day: k.day, Dimension: k.dimension, Value: k.value, Requests: n})
+		}
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		if !stats[i].Day.Equal(stats[j].Day) {
+			return stats[i].Day.After(stats[j].Day)
+		}
+		return stats[i].Requests > stats[j].Requests
+	})
+	return stats, nil
+}
+
+func (s *memoryStore) RecordDownloads(hour time.Time, downloads map[string]int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.downloads == nil {
+		s.downloads = map[memoryDownloadKey]int64{}
+	}
+	for name, n := range downloads {
+		s.downloads[memoryDownloadKey{name, "hour", hour.UTC()}] += n
+	}
+	return nil
+}
+
+func (s *memoryStore) Downloads(name string, since, until time.Time) ([]DownloadBucket, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var buckets []DownloadBucket
+	for k, n := range s.downloads {
+		if k.name == name && !k.start.Before(since) && k.start.Before(until) {
+			buckets = append(buckets, DownloadBucket{Interval: k.interval, Start: k.start, Downloads: n})
+		}
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].Start.Before(buckets[j].Start) })
+	return buckets, nil
+}
+
+func (s *memoryStore) CompactDownloads(interval, into string, before time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	deleted := 0
+	for k, n := range s.downloads {
+		if k.interval != interval || !k.start.Before(before) {
+			continue
+		}
+		if into != "" {
+			s.downloads[memoryDownloadKey{k.name, into, truncateToInterval(k.start, into)}] += n
+		}
+		delete(s.downloads, k)
+		deleted++
+	}
+	return deleted, nil
+}
+
+func (s *memoryStore) DownloadTotals(since, until time.Time) (map[string]int64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	totals := map[string]int64{}
+	for k, n := range s.downloads {
+		if k.interval != "month" && !k.start.Before(since) && k.start.Before(until) {
+			totals[k.name] += n
+		}
+	}
+	return totals, nil
+}
+
+func (s *memoryStore) Restore(records []PackageRecord, replace bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	restored := map[string]bool{}
+	for _, r := range records {
+		key := memoryKey(r.Tenant, r.Name)
+		restored[key] = true
+		private := r.Visibility == "private"
+		// The state keeps the visibility in Private.
+		r.Visibility = ""
+		if p, ok := s.state.Packages[key]; ok {
+			changed := p.URL != r.URL || p.Private != private
+			p.PackageRecord, p.Private = r, private
+			if changed {
+				s.touch(p)
+			}
+		} else {
+			p := &memoryPackage{PackageRecord: r, Private: private, Status: statusOK}
+			s.state.Packages[key] = p
+			s.touch(p)
+		}
+	}
+	if replace {
+		for key, p := range s.state.Packages {
+			if !restored[key] {
+				delete(s.state.Packages, key)
+				s.bury(p)
+			}
+		}
+	}
+	s.dirty = true
+	return nil
+}
+
+func (s *memoryStore) ApplyChanges(changes []PackageChange) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range changes {
+		key := memoryKey("", c.Name)
+		p, ok := s.state.Packages[key]
+		switch {
+		case c.Deleted && ok:
+			delete(s.state.Packages, key)
+			s.bury(p)
+		case c.Deleted:
+		case ok && p.URL != c.URL:
+			p.URL = c.URL
+			s.touch(p)
+		case !ok:
+			now := time.Now().UTC()
+			p = &memoryPackage{PackageRecord: PackageRecord{Name: c.Name, URL: c.URL, CreatedAt: &now}, Status: statusOK}
+			s.state.Packages[key] = p
+			s.touch(p)
+		}
+	}
+	s.dirty = true
+	return nil
+}
@@ -0,0 +1,29 @@
+package registry
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// metrics collects the registry's counters; they are published together with
+// the runtime's expvar variables at /metrics.
+var metrics = expvar.NewMap("registry")
+
+func serveMetrics(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	var buf bytes.Buffer
+	buf.WriteString("{\n")
+	first := true
+	expvar.Do(func(kv expvar.KeyValue) {
+		if !first {
+			buf.WriteString(",\n")
+		}
+		first = false
+		fmt.Fprintf(&buf, "%q: %s", kv.Key, kv.Value)
+	})
+	buf.WriteString("\n}\n")
+	return r, goproxy.NewResponse(r, "application/json", http.StatusOK, buf.String())
+}
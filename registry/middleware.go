@@ -0,0 +1,365 @@
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseCIDRs parses a comma separated list of networks; a bare address is a
+// network of one.
+func parseCIDRs(s string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", item)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func inNetworks(nets []*net.IPNet, addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// peerIP returns the address of the connection r came on.
+func peerIP(r *http.Request) string {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return host
+	}
+	return r.RemoteAddr
+}
+
+// clientIP returns the address of the client that sent the request. When
+// the connection comes from a trusted proxy, X-Forwarded-For is read from
+// the right, skipping further trusted proxies; entries left of the first
+// untrusted address could have been made up by the client and are ignored.
+func (s *Server) clientIP(r *http.Request) string {
+	ip := peerIP(r)
+	if !inNetworks(s.config.trustedProxies, ip) {
+		return ip
+	}
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		ip = hop
+		if !inNetworks(s.config.trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
+
+// filterIPs refuses clients on the deny list and, when the allow list isn't
+// empty, clients not on it, before anything else looks at the request.
+func filterIPs(next http.Handler, clientIP func(*http.Request) string, allow, deny []*net.IPNet) http.Handler {
+	if len(allow) == 0 && len(deny) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ip := clientIP(r)
+		if inNetworks(deny, ip) {
+			metrics.Add("ip_denied", 1)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		if len(allow) > 0 && !inNetworks(allow, ip) {
+			metrics.Add("ip_not_allowed", 1)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+var allowedMethods = []string{
+	http.MethodGet,
+	http.MethodHead,
+	http.MethodPost,
+	http.MethodDelete,
+	http.MethodOptions,
+}
+
+// limitRequests rejects methods the registry doesn't serve, such as TRACE,
+// and caps request bodies at maxBody bytes before anything is
+// forwarded to the sidecar.
+func limitRequests(next http.Handler, maxBody int64) http.Handler {
+	allow := strings.Join(allowedMethods, ", ")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := false
+		for _, m := range allowedMethods {
+			if r.Method == m {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			w.Header().Set("Allow", allow)
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if r.ContentLength > maxBody {
+			http.Error(w, "Request entity too large", http.StatusRequestEntityTooLarge)
+			return
+		}
+		r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseHostList splits a comma separated list of hostnames; "none" is an
+// empty list.
+func parseHostList(s string) map[string]bool {
+	hosts := map[string]bool{}
+	for _, h := range strings.Split(s, ",") {
+		if h = normalizeHost(strings.TrimSpace(h)); h != "" && h != "none" {
+			hosts[h] = true
+		}
+	}
+	return hosts
+}
+
+// restrictProxyRequests keeps the registry from being used as an open HTTP
+// proxy. Requests in absolute form, as sent to a proxy, are only passed on
+// when their destination is one of the allowed hosts.
+func restrictProxyRequests(next http.Handler, allowed map[string]bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.IsAbs() && !allowed[normalizeHost(r.URL.Host)] {
+			metrics.Add("proxy_requests_denied", 1)
+			http.Error(w, "Proxy destination not allowed", http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// parseConnectTargets parses a comma separated list of host[:port] tunnel
+// destinations; the port defaults to 443.
+func parseConnectTargets(s string) map[string]bool {
+	targets := map[string]bool{}
+	for _, t := range strings.Split(s, ",") {
+		t = strings.ToLower(strings.TrimSpace(t))
+		if t == "" || t == "none" {
+			continue
+		}
+		if _, _, err := net.SplitHostPort(t); err != nil {
+			t = net.JoinHostPort(t, "443")
+		}
+		targets[t] = true
+	}
+	return targets
+}
+
+var (
+	connectAllowed = new(expvar.Int)
+	connectDenied  = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("connect_allowed", connectAllowed)
+	metrics.Set("connect_denied", connectDenied)
+}
+
+// connectPolicy takes CONNECT requests out of the normal chain, which would
+// refuse them and can't hijack the connection. Every attempt is logged.
+// Tunnels to allowed destinations are handed to the proxy, which splices the
+// connections without terminating TLS; all others get 403.
+func connectPolicy(next, tunnel http.Handler, allowed map[string]bool) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodConnect {
+			next.ServeHTTP(w, r)
+			return
+		}
+		target := strings.ToLower(r.Host)
+		if !allowed[target] {
+			connectDenied.Add(1)
+			serverLog.Infof("CONNECT %s from %s denied", target, r.RemoteAddr)
+			http.Error(w, "Tunnel destination not allowed", http.StatusForbidden)
+			return
+		}
+		connectAllowed.Add(1)
+		serverLog.Debugf("CONNECT %s from %s", target, r.RemoteAddr)
+		tunnel.ServeHTTP(w, r)
+	})
+}
+
+type concurrencyLimit struct {
+	prefix string
+	slots  chan struct{}
+}
+
+// parseConcurrencyLimits parses "/prefix=n,/other=n" into one limit per
+// route group.
+func parseConcurrencyLimits(s string) ([]concurrencyLimit, error) {
+	var limits []concurrencyLimit
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid concurrency limit %q", item)
+		}
+		n, err := strconv.Atoi(parts[1])
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid concurrency limit %q", item)
+		}
+		limits = append(limits, concurrencyLimit{prefix: parts[0], slots: make(chan struct{}, n)})
+	}
+	return limits, nil
+}
+
+// limitConcurrency caps the requests in flight per route group. A request
+// belongs to the group with the longest matching path prefix, so a burst on
+// /packages/{name} can be kept from starving /packages. Requests wait up to
+// queueTimeout for a slot and are then shed with 503.
+func limitConcurrency(next http.Handler, limits []concurrencyLimit, queueTimeout time.Duration) http.Handler {
+	if len(limits) == 0 {
+		return next
+	}
+	retryAfter := strconv.Itoa(int((queueTimeout + time.Second - 1) / time.Second))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var limit *concurrencyLimit
+		for i := range limits {
+			if strings.HasPrefix(r.URL.Path, limits[i].prefix) && (limit == nil || len(limits[i].prefix) > len(limit.prefix)) {
+				limit = &limits[i]
+			}
+		}
+		if limit == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		select {
+		case limit.slots <- struct{}{}:
+		default:
+			timer := time.NewTimer(queueTimeout)
+			select {
+			case limit.slots <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				metrics.Add("requests_shed", 1)
+				w.Header().Set("Retry-After", retryAfter)
+				http.Error(w, "Service overloaded, please retry", http.StatusServiceUnavailable)
+				return
+			case <-r.Context().Done():
+				timer.Stop()
+				return
+			}
+		}
+		defer func() { <-limit.slots }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+type securityHeaderConfig struct {
+	hsts          string
+	contentPolicy string
+	frameOptions  string
+	noSniff       bool
+}
+
+// loadSecurityHeaderConfig reads SECURITY_* settings; "none" turns the
+// corresponding header off.
+func loadSecurityHeaderConfig() securityHeaderConfig {
+	header := func(key, def string) string {
+		if v := getEnv(key, def); v != "none" {
+			return v
+		}
+		return ""
+	}
+	return securityHeaderConfig{
+		hsts:          header("SECURITY_HSTS", "max-age=31536000"),
+		contentPolicy: header("SECURITY_CSP", "default-src 'self'; img-src 'self' https: data:; style-src 'self' 'unsafe-inline'"),
+		frameOptions:  header("SECURITY_FRAME_OPTIONS", "DENY"),
+		noSniff:       getEnv("SECURITY_NOSNIFF", "true") == "true",
+	}
+}
+
+// securityHeaders adds the configured headers to every response, whether it
+// was produced by a Go handler or proxied from the sidecar. The
+// Content-Security-Policy only applies to HTML.
+func securityHeaders(next http.Handler, cfg securityHeaderConfig) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(&headerWriter{ResponseWriter: w, before: func(h http.Header) {
+			if cfg.hsts != "" {
+				h.Set("Strict-Transport-Security", cfg.hsts)
+			}
+			if cfg.noSniff {
+				h.Set("X-Content-Type-Options", "nosniff")
+			}
+			if cfg.frameOptions != "" && h.Get("X-Frame-Options") == "" {
+				h.Set("X-Frame-Options", cfg.frameOptions)
+			}
+			if cfg.contentPolicy != "" && h.Get("Content-Security-Policy") == "" && strings.HasPrefix(h.Get("Content-Type"), "text/html") {
+				h.Set("Content-Security-Policy", cfg.contentPolicy)
+			}
+		}}, r)
+	})
+}
+
+// headerWriter calls before on the response headers right before they are
+// written. Copying a response sets the headers it carries, so they can't
+// be set up front.
+type headerWriter struct {
+	http.ResponseWriter
+	before      func(http.Header)
+	wroteHeader bool
+}
+
+func (w *headerWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		w.before(w.Header())
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *headerWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *headerWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,144 @@
+package registry
+
+import (
+	"flag"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/bower/registry/client"
+)
+
+// The mirror command runs a read-only replica of another instance of the
+// registry, e.g. in another region. It copies the upstream's packages once
+// before serving, then polls /packages?since= for changes and serves every
+// lookup from its own store. Only the default registry is replicated;
+// tenants, organizations and stats stay local.
+
+type mirror struct {
+	upstream string
+	client   *client.Client
+	interval time.Duration
+	// cursor is the since of the next delta sync, empty until a full sync
+	// succeeded.
+	cursor string
+}
+
+func runMirror(args []string) {
+	flags := flag.NewFlagSet("mirror", flag.ExitOnError)
+	upstream := flags.String("upstream", getEnv("MIRROR_UPSTREAM", ""), "base URL of the registry to mirror")
+	interval := flags.Duration("interval", 30*time.Second, "time between delta syncs")
+	warm := flags.Bool("warm", false, "fill caches and wait for the sidecar before accepting requests")
+	flags.Parse(args)
+	if *upstream == "" {
+		log.Fatal("mirror needs -upstream or MIRROR_UPSTREAM")
+	}
+
+	c := client.New(*upstream)
+	c.CacheTTL = 0
+	m := &mirror{upstream: *upstream, client: c, interval: *interval}
+	serve(*warm, m.start)
+}
+
+// start makes s read-only and syncs it before it serves requests. A mirror
+// that can't reach its upstream serves what it has and keeps trying.
+func (m *mirror) start(s *Server) {
+	s.maintenance = readOnlyMode{ReadOnly: true, Message: "This registry is a read-only mirror of " + m.upstream + "."}
+	if err := m.sync(s); err != nil {
+		jobLog.Errorf("Initial mirror sync failed, serving local packages: %s", err)
+		metrics.Add("mirror_sync_errors", 1)
+	}
+	go func() {
+		for range time.Tick(m.interval) {
+			if err := m.sync(s); err != nil {
+				jobLog.Errorf("Mirror sync failed: %s", err)
+				metrics.Add("mirror_sync_errors", 1)
+			}
+		}
+	}()
+}
+
+// sync applies the upstream's changes since the last sync, or all of its
+// packages on the first one. A full sync also deletes the local packages the
+// upstream doesn't have, such as those deleted before it kept tombstones.
+func (m *mirror) sync(s *Server) error {
+	full := m.cursor == ""
+	cursor := m.cursor
+	if full {
+		cursor = "0"
+	}
+	seen := map[string]bool{}
+	for {
+		page, err := m.client.Changes(cursor)
+		if err != nil {
+			return err
+		}
+		changes := mirroredChanges(page)
+		if err := m.apply(s, changes); err != nil {
+			return err
+		}
+		for _, c := range changes {
+			seen[c.Name] = !c.Deleted
+		}
+		cursor = page.Cursor
+		if !full {
+			m.cursor = cursor
+		}
+		if !page.More {
+			break
+		}
+	}
+	if !full {
+		return nil
+	}
+
+	local, err := s.store.ListPackages()
+	if err != nil {
+		return err
+	}
+	var stale []PackageChange
+	for _, p := range local {
+		if !seen[p.Name] {
+			stale = append(stale, PackageChange{Name: p.Name, Deleted: true})
+		}
+	}
+	if err := m.apply(s, stale); err != nil {
+		return err
+	}
+	jobLog.Infof("Mirrored %d packages from %s", len(local)-len(stale), m.upstream)
+	m.cursor = cursor
+	return nil
+}
+
+func (m *mirror) apply(s *Server, changes []PackageChange) error {
+	if len(changes) == 0 {
+		return nil
+	}
+	if err := s.store.ApplyChanges(changes); err != nil {
+		return err
+	}
+	metrics.Add("mirror_changes", int64(len(changes)))
+	var urls []string
+	for _, c := range changes {
+		if !c.Deleted {
+			urls = append(urls, c.URL)
+		}
+	}
+	return s.invalidate(invalidation{Keys: packageListKeys, URLs: urls})
+}
+
+// mirroredChanges puts the changes of a page back in the order they were
+// made in, so a package deleted and registered again ends up registered.
+func mirroredChanges(page *client.Changes) []PackageChange {
+	changes := make([]PackageChange, 0, len(page.Packages)+len(page.Deleted))
+	for _, p := range page.Packages {
+		changes = append(changes, PackageChange{Name: p.Name, URL: p.URL, At: p.UpdatedAt})
+	}
+	for _, d := range page.Deleted {
+		changes = append(changes, PackageChange{Name: d.Name, At: d.DeletedAt, Deleted: true})
+	}
+	sort.Slice(changes, func(i, j int) bool {
+		return changes[i].before(changes[j].At, changes[j].Name)
+	})
+	return changes
+}
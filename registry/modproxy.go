@@ -0,0 +1,180 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The module proxy facade implements the read side of the GOPROXY protocol
+// for GitHub repositories registered here. Version lists come from the
+// repository's tags; .mod and .zip files are redirected to an upstream module
+// proxy since GitHub archives are not valid module zips.
+
+// decodeModulePath reverses the GOPROXY case encoding, where every upper case
+// letter is written as '!' followed by its lower case form.
+func decodeModulePath(escaped string) (string, bool) {
+	var b bytes.Buffer
+	bang := false
+	for _, r := range escaped {
+		switch {
+		case bang:
+			if !unicode.IsLower(r) {
+				return "", false
+			}
+			b.WriteRune(unicode.ToUpper(r))
+			bang = false
+		case r == '!':
+			bang = true
+		case unicode.IsUpper(r):
+			return "", false
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String(), !bang
+}
+
+// trackedModule finds the package registered for a github.com module path and
+// returns its repository URL along with the major version the path selects.
+// Private packages are only found by those who may read them.
+func (s *Server) trackedModule(r *http.Request, modulePath string) (string, int, error) {
+	parts := strings.Split(modulePath, "/")
+	if len(parts) < 3 || parts[0] != "github.com" {
+		return "", 0, ErrNotFound
+	}
+	major := 0
+	if len(parts) == 4 && strings.HasPrefix(parts[3], "v") {
+		n, err := strconv.Atoi(parts[3][1:])
+		if err != nil || n < 2 {
+			return "", 0, ErrNotFound
+		}
+		major = n
+	} else if len(parts) != 3 {
+		return "", 0, ErrNotFound
+	}
+
+	repo := strings.ToLower(parts[1] + "/" + parts[2])
+	p, err := s.store.PackageByURL(
+		"https://github.com/"+repo+".git",
+		"https://github.com/"+repo,
+		"git://github.com/"+repo+".git",
+		"git@github.com:"+repo+".git",
+	)
+	if err != nil {
+		return "", 0, err
+	}
+	// PackageByURL only has the name and URL.
+	if p, err = s.store.GetPackage(p.Name); err != nil {
+		return "", 0, err
+	}
+	if err := s.checkVisible(r, p); err != nil {
+		return "", 0, err
+	}
+	return p.URL, major, nil
+}
+
+func moduleVersions(url string, major int) ([]Version, error) {
+	versions, err := repoVersions(url)
+	if err != nil {
+		return nil, err
+	}
+	var matching []Version
+	for _, v := range versions {
+		if v.Major == major || (major == 0 && v.Major <= 1) {
+			matching = append(matching, v)
+		}
+	}
+	return matching, nil
+}
+
+type moduleInfo struct {
+	Version string
+}
+
+func (s *Server) moduleProxyHandler(prefix string) func(*http.Request, *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	return func(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+		notFound := goproxy.NewResponse(r, "text/plain", http.StatusNotFound, "not found")
+
+		escaped := strings.TrimPrefix(r.URL.Path, prefix)
+		var escapedModule, file string
+		if strings.HasSuffix(escaped, "/@latest") {
+			escapedModule, file = strings.TrimSuffix(escaped, "/@latest"), "@latest"
+		} else if i := strings.Index(escaped, "/@v/"); i >= 0 {
+			escapedModule, file = escaped[:i], escaped[i+len("/@v/"):]
+		} else {
+			return r, notFound
+		}
+		modulePath, ok := decodeModulePath(escapedModule)
+		if !ok {
+			return r, notFound
+		}
+
+		url, major, err := s.trackedModule(r, modulePath)
+		if err == ErrNotFound {
+			return r, notFound
+		} else if err != nil {
+			return r, goproxy.NewResponse(r, "text/plain", http.StatusInternalServerError, "Internal server error")
+		}
+
+		if strings.HasSuffix(file, ".mod") || strings.HasSuffix(file, ".zip") {
+			response := goproxy.NewResponse(r, "text/plain", http.StatusFound, "")
+			response.Header.Set("Location", s.config.moduleUpstream+"/"+escapedModule+"/@v/"+file)
+			return r, response
+		}
+
+		versions, err := moduleVersions(url, major)
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/plain", http.StatusBadGateway, "Could not list repository tags")
+		}
+
+		var info moduleInfo
+		switch {
+		case file == "list":
+			var lines []string
+			for _, v := range versions {
+				lines = append(lines, "v"+v.String())
+			}
+			body := strings.Join(lines, "\n")
+			if body != "" {
+				body += "\n"
+			}
+			return r, goproxy.NewResponse(r, "text/plain", http.StatusOK, body)
+		case file == "@latest":
+			latest, ok := latestVersion(versions)
+			if !ok {
+				return r, notFound
+			}
+			info.Version = "v" + latest.String()
+		case strings.HasSuffix(file, ".info"):
+			want, ok := parseVersion(strings.TrimSuffix(file, ".info"))
+			if !ok {
+				return r, notFound
+			}
+			found := false
+			for _, v := range versions {
+				if compareVersions(v, want) == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return r, notFound
+			}
+			info.Version = "v" + want.String()
+		default:
+			return r, notFound
+		}
+
+		data, err := json.Marshal(info)
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/plain", http.StatusInternalServerError, "Internal server error")
+		}
+		return r, goproxy.NewResponse(r, "application/json", http.StatusOK, string(data))
+	}
+}
@@ -0,0 +1,46 @@
+package registry
+
+import (
+	"errors"
+	"regexp"
+	"strings"
+)
+
+var (
+	nameLengthRe      = regexp.MustCompile(`^.{1,50}$`)
+	nameCharactersRe  = regexp.MustCompile(`^[A-Za-z0-9._-]*$`)
+	nameConsecutiveRe = regexp.MustCompile(`[._-]{2,}`)
+	nameBoundaryRe    = regexp.MustCompile(`^[^._-].*[^._-]$`)
+)
+
+// reservedNames are routes under /packages/ that a package of the same name
+// would be shadowed by.
+var reservedNames = map[string]bool{"broken": true, "prefix": true, "search": true, "top": true, "trending": true}
+
+// validatePackageName applies the same rules as lib/validName.js, following
+// https://github.com/bower/bower.json-spec#name.
+func validatePackageName(name string) error {
+	var problems []string
+	if !nameLengthRe.MatchString(name) {
+		problems = append(problems, "be between 1 and 50 characters")
+	}
+	if !nameCharactersRe.MatchString(name) {
+		problems = append(problems, "only contain lower case a through z, 0 through 9, dots, dashes, and underscores")
+	}
+	if nameConsecutiveRe.MatchString(name) {
+		problems = append(problems, "not have consecutive dashes, dots, or underscores")
+	}
+	if !nameBoundaryRe.MatchString(name) {
+		problems = append(problems, "not start or end with dashes, dots, or underscores")
+	}
+	if reservedNames[strings.ToLower(name)] {
+		problems = append(problems, "not be broken, prefix, search, top or trending")
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	if len(problems) > 1 {
+		problems[len(problems)-1] = "and must " + problems[len(problems)-1]
+	}
+	return errors.New("Package names must " + strings.Join(problems, ", ") + ".")
+}
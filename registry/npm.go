@@ -0,0 +1,92 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The npm facade serves just enough of the npm registry document format for
+// `npm install` to resolve a package stored here to a GitHub tarball.
+
+type npmDist struct {
+	Tarball string `json:"tarball"`
+}
+
+type npmRepository struct {
+	Type string `json:"type"`
+	URL  string `json:"url"`
+}
+
+type npmVersion struct {
+	Name       string        `json:"name"`
+	Version    string        `json:"version"`
+	Repository npmRepository `json:"repository"`
+	Dist       npmDist       `json:"dist"`
+}
+
+type npmPackage struct {
+	Name       string                `json:"name"`
+	DistTags   map[string]string     `json:"dist-tags"`
+	Versions   map[string]npmVersion `json:"versions"`
+	Repository npmRepository         `json:"repository"`
+}
+
+func (s *Server) getNpmPackage(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	packageName := strings.TrimPrefix(r.URL.Path, "/npm/")
+	if packageName == "" || strings.Contains(packageName, "/") {
+		return r, goproxy.NewResponse(r, "application/json", http.StatusNotFound, `{"error":"Not found"}`)
+	}
+
+	p, err := s.store.GetPackage(packageName)
+	if err == nil {
+		err = s.checkVisible(r, p)
+	}
+	if err != nil {
+		if err == ErrNotFound {
+			return r, goproxy.NewResponse(r, "application/json", http.StatusNotFound, `{"error":"Not found"}`)
+		}
+		return r, goproxy.NewResponse(r, "application/json", http.StatusInternalServerError, `{"error":"Internal server error"}`)
+	}
+
+	name, url := p.Name, p.URL
+	versions, err := repoVersions(url)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "application/json", http.StatusBadGateway, `{"error":"Could not list repository tags"}`)
+	}
+
+	repository := npmRepository{Type: "git", URL: url}
+	pkg := npmPackage{
+		Name:       name,
+		DistTags:   map[string]string{},
+		Versions:   map[string]npmVersion{},
+		Repository: repository,
+	}
+	for _, v := range versions {
+		tarball, ok := githubArchiveURL(url, "tar.gz", v.Tag)
+		if !ok {
+			continue
+		}
+		pkg.Versions[v.String()] = npmVersion{
+			Name:       name,
+			Version:    v.String(),
+			Repository: repository,
+			Dist:       npmDist{Tarball: tarball},
+		}
+	}
+	if latest, ok := latestVersion(versions); ok {
+		if _, ok := pkg.Versions[latest.String()]; ok {
+			pkg.DistTags["latest"] = latest.String()
+		}
+	}
+
+	data, err := json.Marshal(pkg)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "application/json", http.StatusInternalServerError, `{"error":"Internal server error"}`)
+	}
+	response := goproxy.NewResponse(r, "application/json", http.StatusOK, string(data))
+	response.Header.Add("Cache-Control", cacheControl(p, 600))
+	return r, response
+}
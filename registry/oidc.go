@@ -0,0 +1,422 @@
+package registry
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With OIDC_ISSUER set, admins sign in with an OpenID Connect identity
+// provider. Browsers go through /admin/login and get a session cookie;
+// API clients send an ID token issued to OIDC_CLIENT_ID as the bearer
+// token. Only identities listed in OIDC_ADMINS, or in a group listed in
+// OIDC_ADMIN_GROUPS, are let in.
+
+const (
+	oidcStateCookie  = "registry_oidc_state"
+	oidcCallbackPath = "/admin/oidc/callback"
+	// oidcKeysRefresh limits how often unknown key IDs refetch the keys.
+	oidcKeysRefresh = time.Minute
+)
+
+type oidcConfig struct {
+	issuer       string
+	clientID     string
+	clientSecret string
+	redirectURL  string
+	// admins are emails or subjects.
+	admins      []string
+	adminGroups []string
+	groupsClaim string
+	// sessionSecret signs session cookies, so instances sharing it accept
+	// each other's sessions.
+	sessionSecret string
+	sessionTTL    time.Duration
+}
+
+// loadOIDCConfig returns nil unless OIDC_ISSUER is set.
+func loadOIDCConfig(siteURL string, sessionTTL time.Duration) (*oidcConfig, error) {
+	issuer := strings.TrimSuffix(getEnv("OIDC_ISSUER", ""), "/")
+	if issuer == "" {
+		return nil, nil
+	}
+	cfg := &oidcConfig{
+		issuer:        issuer,
+		clientID:      getEnv("OIDC_CLIENT_ID", ""),
+		clientSecret:  getEnv("OIDC_CLIENT_SECRET", ""),
+		redirectURL:   getEnv("OIDC_REDIRECT_URL", siteURL+oidcCallbackPath),
+		admins:        splitList(getEnv("OIDC_ADMINS", "")),
+		adminGroups:   splitList(getEnv("OIDC_ADMIN_GROUPS", "")),
+		groupsClaim:   getEnv("OIDC_GROUPS_CLAIM", "groups"),
+		sessionSecret: getEnv("SESSION_SECRET", ""),
+		sessionTTL:    sessionTTL,
+	}
+	if cfg.clientID == "" || cfg.clientSecret == "" {
+		return nil, errors.New("OIDC_ISSUER requires OIDC_CLIENT_ID and OIDC_CLIENT_SECRET")
+	}
+	if len(cfg.admins) == 0 && len(cfg.adminGroups) == 0 {
+		return nil, errors.New("OIDC_ISSUER requires OIDC_ADMINS or OIDC_ADMIN_GROUPS")
+	}
+	if cfg.sessionSecret == "" {
+		cfg.sessionSecret = cfg.clientSecret
+	}
+	return cfg, nil
+}
+
+// splitList splits a comma separated list, dropping empty items.
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+type oidcAuth struct {
+	config oidcConfig
+	client *http.Client
+
+	// The provider metadata and keys are fetched on first use, so the
+	// registry starts while the identity provider is down.
+	mu          sync.Mutex
+	provider    *oidcProvider
+	keys        map[string]*rsa.PublicKey
+	keysFetched time.Time
+}
+
+type oidcProvider struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+func newOIDCAuth(cfg oidcConfig) *oidcAuth {
+	return &oidcAuth{config: cfg, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+func (o *oidcAuth) Authenticate(r *http.Request) (string, error) {
+	if token := requestToken(r); strings.Count(token, ".") == 2 {
+		if _, err := o.discover(); err != nil {
+			return "", err
+		}
+		claims, err := o.verify(token)
+		if err != nil {
+			// Not one of our ID tokens; another provider may know it.
+			return "", nil
+		}
+		identity, ok := o.admit(claims)
+		if !ok {
+			return "", nil
+		}
+		return "admin:" + identity, nil
+	}
+	identity, ok := sessionIdentity(r, o.config.sessionSecret)
+	if !ok {
+		return "", nil
+	}
+	return "admin:" + identity, nil
+}
+
+// admit returns the identity in claims if it is an admin. The email is
+// the identity only when the provider has verified it.
+func (o *oidcAuth) admit(claims map[string]interface{}) (string, bool) {
+	sub, _ := claims["sub"].(string)
+	identity := sub
+	if email, _ := claims["email"].(string); email != "" && claims["email_verified"] == true {
+		identity = email
+	}
+	if identity == "" {
+		return "", false
+	}
+	if containsString(o.config.admins, identity) || sub != "" && containsString(o.config.admins, sub) {
+		return identity, true
+	}
+	groups, _ := claims[o.config.groupsClaim].([]interface{})
+	for _, g := range groups {
+		if group, ok := g.(string); ok && containsString(o.config.adminGroups, group) {
+			return identity, true
+		}
+	}
+	return "", false
+}
+
+// discover returns the provider metadata of the issuer.
+func (o *oidcAuth) discover() (*oidcProvider, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.provider != nil {
+		return o.provider, nil
+	}
+	var p oidcProvider
+	if err := o.getJSON(o.config.issuer+"/.well-known/openid-configuration", &p); err != nil {
+		return nil, err
+	}
+	if strings.TrimSuffix(p.Issuer, "/") != o.config.issuer {
+		return nil, fmt.Errorf("OIDC discovery returned issuer %q, expected %q", p.Issuer, o.config.issuer)
+	}
+	o.provider = &p
+	return o.provider, nil
+}
+
+type jsonWebKey struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// key returns the RSA signing key kid, refetching the keys of the provider
+// when kid is new to rotate with it.
+func (o *oidcAuth) key(kid string) (*rsa.PublicKey, error) {
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	if time.Since(o.keysFetched) < oidcKeysRefresh {
+		return nil, fmt.Errorf("Unknown OIDC signing key %q", kid)
+	}
+	o.keysFetched = time.Now()
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := o.getJSON(p.JWKSURI, &set); err != nil {
+		return nil, err
+	}
+	o.keys = map[string]*rsa.PublicKey{}
+	for _, k := range set.Keys {
+		if k.Kty != "RSA" || k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		n, errN := base64.RawURLEncoding.DecodeString(k.N)
+		e, errE := base64.RawURLEncoding.DecodeString(k.E)
+		if errN != nil || errE != nil {
+			continue
+		}
+		o.keys[k.Kid] = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+	}
+	if k, ok := o.keys[kid]; ok {
+		return k, nil
+	}
+	return nil, fmt.Errorf("Unknown OIDC signing key %q", kid)
+}
+
+// verify checks the signature, issuer, audience and lifetime of an RS256
+// signed ID token and returns its claims.
+func (o *oidcAuth) verify(token string) (map[string]interface{}, error) {
+	parts := strings.Split(token, ".")
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return nil, err
+	}
+	if header.Alg != "RS256" {
+		return nil, fmt.Errorf("Unsupported ID token algorithm %q", header.Alg)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, err
+	}
+	key, err := o.key(header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+		return nil, errors.New("Invalid ID token signature")
+	}
+
+	var claims map[string]interface{}
+	if err := decodeJWTPart(parts[1], &claims); err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != o.config.issuer {
+		return nil, errors.New("ID token from another issuer")
+	}
+	audience := false
+	switch aud := claims["aud"].(type) {
+	case string:
+		audience = aud == o.config.clientID
+	case []interface{}:
+		for _, a := range aud {
+			audience = audience || a == o.config.clientID
+		}
+	}
+	if !audience {
+		return nil, errors.New("ID token for another client")
+	}
+	now := float64(time.Now().Unix())
+	if exp, _ := claims["exp"].(float64); exp < now {
+		return nil, errors.New("Expired ID token")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && nbf > now+60 {
+		return nil, errors.New("ID token not valid yet")
+	}
+	return claims, nil
+}
+
+func decodeJWTPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (o *oidcAuth) getJSON(url string, v interface{}) error {
+	resp, err := o.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s returned %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func (o *oidcAuth) secureCookies() bool {
+	return strings.HasPrefix(o.config.redirectURL, "https://")
+}
+
+// oidcAuth returns the OIDC provider, or nil when it isn't configured.
+func (s *Server) oidcAuth() *oidcAuth {
+	for _, p := range s.auth {
+		if o, ok := p.(*oidcAuth); ok {
+			return o
+		}
+	}
+	return nil
+}
+
+// oidcHandler signs admins in. It answers /admin/login and the callback,
+// which need no authentication.
+func (s *Server) oidcHandler(r *http.Request) *http.Response {
+	o := s.oidcAuth()
+	if o == nil || r.Method != http.MethodGet {
+		return nil
+	}
+	switch r.URL.Path {
+	case "/admin/login":
+		return o.login(r)
+	case oidcCallbackPath:
+		return s.oidcCallback(o, r)
+	}
+	return nil
+}
+
+// login sends the browser to the identity provider. The state, which is
+// also the nonce of the ID token, is kept in a cookie until the callback.
+func (o *oidcAuth) login(r *http.Request) *http.Response {
+	p, err := o.discover()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not reach the identity provider")
+	}
+	state, err := newToken()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	query := url.Values{
+		"response_type": {"code"},
+		"client_id":     {o.config.clientID},
+		"redirect_uri":  {o.config.redirectURL},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+		"nonce":         {state},
+	}
+	location := p.AuthorizationEndpoint
+	if strings.Contains(location, "?") {
+		location += "&" + query.Encode()
+	} else {
+		location += "?" + query.Encode()
+	}
+	response := goproxy.NewResponse(r, "text/html", http.StatusFound, "")
+	response.Header.Set("Location", location)
+	response.Header.Add("Set-Cookie", (&http.Cookie{Name: oidcStateCookie, Value: state, Path: oidcCallbackPath, MaxAge: 600, HttpOnly: true, Secure: o.secureCookies()}).String())
+	return response
+}
+
+func (s *Server) oidcCallback(o *oidcAuth, r *http.Request) *http.Response {
+	state, err := r.Cookie(oidcStateCookie)
+	if err != nil || subtle.ConstantTimeCompare([]byte(state.Value), []byte(r.URL.Query().Get("state"))) != 1 {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid login state, please sign in again")
+	}
+	if e := r.URL.Query().Get("error"); e != "" {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "The identity provider refused the login: "+e)
+	}
+	claims, err := o.exchange(r.URL.Query().Get("code"))
+	if err != nil {
+		authLog.Warnf("Could not complete an OIDC login: %s", err)
+		return goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not complete the login")
+	}
+	if claims["nonce"] != state.Value {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid login state, please sign in again")
+	}
+	identity, ok := o.admit(claims)
+	if !ok {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "You are not an admin of this registry")
+	}
+	expires := time.Now().Add(o.config.sessionTTL)
+	s.audit("admin:"+identity, "admin.login", "", "")
+	response := goproxy.NewResponse(r, "text/html", http.StatusFound, "")
+	response.Header.Set("Location", "/admin/")
+	response.Header.Add("Set-Cookie", (&http.Cookie{Name: oidcStateCookie, Value: "", Path: oidcCallbackPath, MaxAge: -1, HttpOnly: true, Secure: o.secureCookies()}).String())
+	response.Header.Add("Set-Cookie", (&http.Cookie{Name: sessionCookie, Value: newSession(o.config.sessionSecret, identity, expires), Path: "/admin/", Expires: expires, HttpOnly: true, Secure: o.secureCookies()}).String())
+	return response
+}
+
+// exchange redeems an authorization code and returns the claims of the ID
+// token.
+func (o *oidcAuth) exchange(code string) (map[string]interface{}, error) {
+	p, err := o.discover()
+	if err != nil {
+		return nil, err
+	}
+	resp, err := o.client.PostForm(p.TokenEndpoint, url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {o.config.redirectURL},
+		"client_id":     {o.config.clientID},
+		"client_secret": {o.config.clientSecret},
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("OIDC token endpoint returned %s", resp.Status)
+	}
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokens); err != nil {
+		return nil, err
+	}
+	if strings.Count(tokens.IDToken, ".") != 2 {
+		return nil, errors.New("OIDC token endpoint returned no ID token")
+	}
+	return o.verify(tokens.IDToken)
+}
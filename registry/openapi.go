@@ -0,0 +1,172 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The OpenAPI document is built from the operations passed to handle when the
+// handlers are registered, so it only lists what this deployment serves.
+
+// apiOperation describes one endpoint for /openapi.json. Path parameters are
+// taken from {name} segments in Path.
+type apiOperation struct {
+	Method  string
+	Path    string
+	Summary string
+	Query   []string
+	// Form lists the fields of a form encoded request body.
+	Form []string
+	// Body and Result are zero values of the JSON request and response
+	// bodies; their schemas are derived from the Go types.
+	Body   interface{}
+	Result interface{}
+	// Auth marks operations that need a bearer token.
+	Auth bool
+}
+
+var pathParam = regexp.MustCompile(`\{(\w+)\}`)
+
+// handle registers a request handler together with the operations it serves.
+// A nil cond matches every request.
+func (s *Server) handle(cond goproxy.ReqCondition, h goproxy.FuncReqHandler, ops ...apiOperation) {
+	s.operations = append(s.operations, ops...)
+	s.routes = append(s.routes, route{cond: cond, handler: h})
+}
+
+func (s *Server) serveOpenAPI(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	s.openAPIOnce.Do(func() {
+		s.openAPIDoc, _ = json.Marshal(openAPISpec(s.operations))
+	})
+	if s.openAPIDoc == nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return r, goproxy.NewResponse(r, "application/json", http.StatusOK, string(s.openAPIDoc))
+}
+
+func openAPISpec(ops []apiOperation) map[string]interface{} {
+	schemas := map[string]interface{}{}
+	paths := map[string]map[string]interface{}{}
+	for _, op := range ops {
+		operation := map[string]interface{}{"summary": op.Summary}
+
+		params := []interface{}{}
+		for _, m := range pathParam.FindAllStringSubmatch(op.Path, -1) {
+			params = append(params, map[string]interface{}{
+				"name": m[1], "in": "path", "required": true,
+				"schema": map[string]string{"type": "string"},
+			})
+		}
+		for _, q := range op.Query {
+			params = append(params, map[string]interface{}{
+				"name": q, "in": "query", "schema": map[string]string{"type": "string"},
+			})
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+
+		if op.Form != nil {
+			properties := map[string]interface{}{}
+			for _, f := range op.Form {
+				properties[f] = map[string]string{"type": "string"}
+			}
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/x-www-form-urlencoded": map[string]interface{}{
+						"schema": map[string]interface{}{"type": "object", "properties": properties, "required": op.Form},
+					},
+				},
+			}
+		} else if op.Body != nil {
+			operation["requestBody"] = map[string]interface{}{
+				"required": true,
+				"content": map[string]interface{}{
+					"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(op.Body), schemas)},
+				},
+			}
+		}
+
+		success := map[string]interface{}{"description": "Success"}
+		if op.Result != nil {
+			success["content"] = map[string]interface{}{
+				"application/json": map[string]interface{}{"schema": jsonSchema(reflect.TypeOf(op.Result), schemas)},
+			}
+		}
+		operation["responses"] = map[string]interface{}{"2XX": success, "default": map[string]string{"description": "Error"}}
+		if op.Auth {
+			operation["security"] = []map[string][]string{{"bearer": {}}}
+		}
+
+		if paths[op.Path] == nil {
+			paths[op.Path] = map[string]interface{}{}
+		}
+		paths[op.Path][strings.ToLower(op.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]string{"title": "Bower registry", "version": "1.0.0"},
+		"paths":   paths,
+		"components": map[string]interface{}{
+			"schemas": schemas,
+			"securitySchemes": map[string]interface{}{
+				"bearer": map[string]string{"type": "http", "scheme": "bearer"},
+			},
+		},
+	}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// jsonSchema describes how encoding/json marshals t. Named structs are added
+// to schemas and referenced.
+func jsonSchema(t reflect.Type, schemas map[string]interface{}) interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch {
+	case t == timeType:
+		return map[string]string{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.String:
+		return map[string]string{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]string{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]string{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]string{"type": "number"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": jsonSchema(t.Elem(), schemas)}
+	case t.Kind() == reflect.Struct:
+		if _, ok := schemas[t.Name()]; !ok {
+			schemas[t.Name()] = nil // placeholder for recursive types
+			properties := map[string]interface{}{}
+			for i := 0; i < t.NumField(); i++ {
+				f := t.Field(i)
+				name := f.Name
+				if tag := strings.Split(f.Tag.Get("json"), ",")[0]; tag == "-" {
+					continue
+				} else if tag != "" {
+					name = tag
+				}
+				if f.PkgPath != "" {
+					continue
+				}
+				properties[name] = jsonSchema(f.Type, schemas)
+			}
+			schemas[t.Name()] = map[string]interface{}{"type": "object", "properties": properties}
+		}
+		return map[string]string{"$ref": "#/components/schemas/" + t.Name()}
+	}
+	return map[string]interface{}{}
+}
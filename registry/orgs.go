@@ -0,0 +1,269 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Scoped packages are named @org/name and can only be registered or removed
+// with the owning organization's token, so different teams can publish
+// components with the same base name.
+
+// parseScopedName splits "@org/name" into its parts.
+func parseScopedName(name string) (org, base string, ok bool) {
+	if !strings.HasPrefix(name, "@") {
+		return "", "", false
+	}
+	parts := strings.SplitN(name[1:], "/", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+func validateScopedName(name string) error {
+	org, base, ok := parseScopedName(name)
+	if !ok {
+		return errors.New("Scoped package names must look like @organization/name.")
+	}
+	if err := validatePackageName(org); err != nil {
+		return fmt.Errorf("Invalid organization name. %s", err)
+	}
+	return validatePackageName(base)
+}
+
+func (s *Server) isOrgMember(r *http.Request, org string) (bool, error) {
+	token := requestToken(r)
+	if token == "" {
+		return false, nil
+	}
+	tokenHash, err := s.store.OrganizationTokenHash(org)
+	if err != nil {
+		if err == ErrNotFound {
+			return false, nil
+		}
+		return false, err
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(tokenHash)) == 1, nil
+}
+
+// scopedWriteHandler registers and removes scoped packages. Requests for
+// unscoped names are left untouched for the node sidecar once they passed
+// checkPublishQuota and screenRegistration.
+func (s *Server) scopedWriteHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	switch {
+	case r.Method == http.MethodPost && r.URL.Path == "/packages":
+		// The form has to be read to know whether the name is scoped, so
+		// buffer the body and hand an untouched copy on to the sidecar.
+		body, err := ioutil.ReadAll(http.MaxBytesReader(nil, r.Body, 1<<20))
+		r.Body.Close()
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusRequestEntityTooLarge, "Request too large")
+		}
+		r.Body = ioutil.NopCloser(bytes.NewReader(body))
+		form := *r
+		form.Body = ioutil.NopCloser(bytes.NewReader(body))
+		if err := form.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			return r, nil
+		}
+		name, url := form.FormValue("name"), normalizeURL(form.FormValue("url"))
+		if response := s.checkPublishQuota(r, ctx, name); response != nil {
+			return r, response
+		}
+		if response := s.screenRegistration(r, ctx, name, url); response != nil {
+			return r, response
+		}
+		if !strings.HasPrefix(name, "@") {
+			return r, nil
+		}
+		return r, s.createScopedPackage(r, name, url)
+	case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/packages/@"):
+		return r, s.deleteScopedPackage(r, strings.TrimPrefix(r.URL.Path, "/packages/"))
+	}
+	return r, nil
+}
+
+func (s *Server) createScopedPackage(r *http.Request, name, url string) *http.Response {
+	if err := validateScopedName(name); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid Package Name. "+err.Error())
+	}
+	org, _, _ := parseScopedName(name)
+	member, err := s.isOrgMember(r, org)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !member {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "You are not a member of this organization")
+	}
+	if err := validateRepositoryURL(url); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL. "+err.Error())
+	}
+	if err := checkURL(url); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL")
+	}
+	switch err := s.store.InsertScopedPackage(name, url, org); err {
+	case nil:
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Package already registered")
+	case ErrURLTaken:
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Repository already registered as another package")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.packagesChanged(url)
+	return goproxy.NewResponse(r, "text/html", http.StatusCreated, "")
+}
+
+// deleteScopedPackage needs the token of the organization that owns the
+// package, which is not the one in its name after a transfer.
+func (s *Server) deleteScopedPackage(r *http.Request, name string) *http.Response {
+	org, err := s.store.PackageOrganization(name)
+	if err == ErrNotFound || err == nil && org == "" {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	member, err := s.isOrgMember(r, org)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !member {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "You are not a member of this organization")
+	}
+	if err := s.store.DeleteScopedPackage(name, org); err != nil {
+		if err == ErrNotFound {
+			return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+		}
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.packagesChanged()
+	return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+}
+
+// listOrgPackages serves GET /orgs/{org}/packages.
+func (s *Server) listOrgPackages(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	org := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orgs/"), "/packages")
+	if strings.Contains(org, "/") {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+	}
+	packages, err := s.store.OrganizationPackages(org)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	// Private packages are listed to those who can read them, which is the
+	// same for every package of one organization.
+	visible := []Package{}
+	checked, canRead := false, false
+	for _, p := range packages {
+		if p.Private && !checked {
+			if canRead, err = s.canReadPrivate(r, p.Name); err != nil {
+				return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+			}
+			checked = true
+		}
+		if !p.Private || canRead {
+			visible = append(visible, p)
+		}
+	}
+	return r, jsonResponse(r, http.StatusOK, visible)
+}
+
+func orgPackagesPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/orgs/") && strings.HasSuffix(req.URL.Path, "/packages")
+	}
+}
+
+func orgNotificationsPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return strings.HasPrefix(req.URL.Path, "/orgs/") && strings.HasSuffix(req.URL.Path, "/notifications")
+	}
+}
+
+// orgNotifications shows and changes where an organization is emailed,
+// see mail.go. Only its members can do either.
+func (s *Server) orgNotifications(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	org := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/orgs/"), "/notifications")
+	member, err := s.isOrgMember(r, org)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !member {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusForbidden, "You are not a member of this organization")
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		c, err := s.store.OrganizationContact(org)
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		return r, jsonResponse(r, http.StatusOK, c)
+	case http.MethodPost:
+		c, err := s.store.OrganizationContact(org)
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		// Fields left out keep their value.
+		if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+		}
+		if c.Email != "" {
+			if _, err := mail.ParseAddress(c.Email); err != nil {
+				return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid email address")
+			}
+		}
+		if err := s.store.SetOrganizationContact(org, c); err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		return r, jsonResponse(r, http.StatusOK, c)
+	}
+	return r, goproxy.NewResponse(r, "text/html", http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+// runOrg implements `registry org create -name acme [-email ...]`, printing the
+// organization's publish token once.
+func runOrg(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		log.Fatal("Usage: registry org create -name NAME [-email EMAIL]")
+	}
+	flags := flag.NewFlagSet("org create", flag.ExitOnError)
+	name := flags.String("name", "", "organization name, used as @name/ scope")
+	email := flags.String("email", "", "address for notifications about the organization's packages")
+	flags.Parse(args[1:])
+
+	if err := validatePackageName(*name); err != nil {
+		log.Fatalf("Invalid organization name: %s", err)
+	}
+
+	token, err := newToken()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatalf("Connection error: %s", err)
+	}
+	defer store.Close()
+	if err := store.CreateOrganization(*name, hashToken(token)); err != nil {
+		log.Fatalf("Could not create organization: %s", err)
+	}
+	if *email != "" {
+		if err := store.SetOrganizationContact(*name, Contact{Email: *email, Notifications: true}); err != nil {
+			log.Fatalf("Could not set the email of the organization: %s", err)
+		}
+	}
+	fmt.Printf("Created organization %s\nToken: %s\n", *name, token)
+}
@@ -0,0 +1,439 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Packages of every tenant can be exported and imported as CSV, with the
+// csvHeader columns, or as NDJSON, one PackageRecord per line. GET
+// /admin/export and POST /admin/import do it over HTTP, `registry dump`
+// and `registry load` from the command line. Imports upsert: new packages
+// are created and existing ones take the URL of the import, keeping their
+// creation date and hits unless the import has them. Rows without a
+// visibility keep the visibility, organization, cache TTL and deprecation
+// of the existing package, and new packages from them are public.
+// With dry_run nothing is written; the report shows what would change and
+// which packages would move to another URL.
+
+var csvHeader = []string{"tenant", "name", "url", "created_at", "hits", "visibility", "organization", "cache_ttl", "deprecation_message", "deprecation_replacement"}
+
+// ImportReport sums up an import.
+type ImportReport struct {
+	DryRun    bool `json:"dry_run"`
+	Created   int  `json:"created"`
+	Updated   int  `json:"updated"`
+	Unchanged int  `json:"unchanged"`
+	// Conflicts are existing packages the import moves to another URL.
+	Conflicts []ImportConflict `json:"conflicts"`
+	// Errors are invalid lines; an import with errors writes nothing.
+	Errors []ImportError `json:"errors"`
+}
+
+type ImportConflict struct {
+	Tenant string `json:"tenant,omitempty"`
+	Name   string `json:"name"`
+	URL    string `json:"url"`
+	NewURL string `json:"new_url"`
+}
+
+type ImportError struct {
+	Line    int    `json:"line"`
+	Message string `json:"message"`
+}
+
+func validFormat(format string) bool {
+	return format == "csv" || format == "ndjson"
+}
+
+// writePackages writes records in format.
+func writePackages(w io.Writer, format string, records []PackageRecord) error {
+	if format == "ndjson" {
+		enc := json.NewEncoder(w)
+		for _, r := range records {
+			if err := enc.Encode(r); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(csvHeader)
+	for _, r := range records {
+		var created, hits, ttl, message, replacement string
+		if r.CreatedAt != nil {
+			created = r.CreatedAt.UTC().Format(time.RFC3339)
+		}
+		if r.Hits != nil {
+			hits = strconv.Itoa(int(*r.Hits))
+		}
+		if r.CacheTTL != 0 {
+			ttl = strconv.Itoa(int(r.CacheTTL))
+		}
+		if r.Deprecated != nil {
+			message, replacement = r.Deprecated.Message, r.Deprecated.Replacement
+		}
+		if err := cw.Write([]string{r.Tenant, r.Name, r.URL, created, hits, r.Visibility, r.Organization, ttl, message, replacement}); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// readPackages parses records in format, with the line of each. Lines
+// that can't be parsed are reported as errors rather than failing the whole
+// read.
+func readPackages(r io.Reader, format string) ([]PackageRecord, []int, []ImportError, error) {
+	var records []PackageRecord
+	var lines []int
+	var errs []ImportError
+	if format == "ndjson" {
+		scanner := bufio.NewScanner(r)
+		scanner.Buffer(nil, 1<<20)
+		for line := 1; scanner.Scan(); line++ {
+			if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+				continue
+			}
+			var rec PackageRecord
+			if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+				errs = append(errs, ImportError{line, "Invalid JSON: " + err.Error()})
+				continue
+			}
+			records, lines = append(records, rec), append(lines, line)
+		}
+		return records, lines, errs, scanner.Err()
+	}
+
+	cr := csv.NewReader(r)
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, nil, nil, nil
+	} else if err != nil {
+		return nil, nil, nil, err
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.TrimSpace(strings.ToLower(name))] = i
+	}
+	if _, ok := columns["name"]; !ok {
+		return nil, nil, nil, errors.New("The CSV header has no name column")
+	}
+	if _, ok := columns["url"]; !ok {
+		return nil, nil, nil, errors.New("The CSV header has no url column")
+	}
+	field := func(row []string, name string) string {
+		if i, ok := columns[name]; ok && i < len(row) {
+			return strings.TrimSpace(row[i])
+		}
+		return ""
+	}
+	for line := 2; ; line++ {
+		row, err := cr.Read()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			errs = append(errs, ImportError{line, err.Error()})
+			continue
+		}
+		rec := PackageRecord{Tenant: field(row, "tenant"), Name: field(row, "name"), URL: field(row, "url")}
+		if v := field(row, "created_at"); v != "" {
+			t, err := time.Parse(time.RFC3339, v)
+			if err != nil {
+				errs = append(errs, ImportError{line, "Invalid created_at"})
+				continue
+			}
+			rec.CreatedAt = &t
+		}
+		if v := field(row, "hits"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 32)
+			if err != nil {
+				errs = append(errs, ImportError{line, "Invalid hits"})
+				continue
+			}
+			hits := int32(n)
+			rec.Hits = &hits
+		}
+		rec.Visibility, rec.Organization = field(row, "visibility"), field(row, "organization")
+		if v := field(row, "cache_ttl"); v != "" {
+			n, err := strconv.ParseInt(v, 10, 32)
+			if err != nil || n < 0 {
+				errs = append(errs, ImportError{line, "Invalid cache_ttl"})
+				continue
+			}
+			rec.CacheTTL = int32(n)
+		}
+		if v := field(row, "deprecation_message"); v != "" {
+			rec.Deprecated = &Deprecation{Message: v, Replacement: field(row, "deprecation_replacement")}
+		}
+		records, lines = append(records, rec), append(lines, line)
+	}
+	return records, lines, errs, nil
+}
+
+// importPackages compares records, read from lines, with the store and,
+// unless dryRun or the records have errors, upserts them.
+func importPackages(store Store, records []PackageRecord, lines []int, errs []ImportError, dryRun bool) (ImportReport, error) {
+	report := ImportReport{DryRun: dryRun, Conflicts: []ImportConflict{}, Errors: errs}
+	if report.Errors == nil {
+		report.Errors = []ImportError{}
+	}
+	existing, err := store.Snapshot()
+	if err != nil {
+		return report, err
+	}
+	current := map[string]PackageRecord{}
+	for _, p := range existing {
+		current[p.Tenant+"/"+p.Name] = p
+	}
+
+	seen := map[string]bool{}
+	var moved []int
+	for i := range records {
+		rec := &records[i]
+		key := rec.Tenant + "/" + rec.Name
+		rec.URL = normalizeURL(rec.URL)
+		var problem string
+		switch {
+		case validatePackageName(rec.Name) != nil && validateScopedName(rec.Name) != nil:
+			problem = "Invalid name " + strconv.Quote(rec.Name)
+		case rec.URL == "" || strings.ContainsAny(rec.URL, " \t\r\n"):
+			problem = "Invalid URL for " + rec.Name
+		case !validVisibility(rec.Visibility):
+			problem = "Invalid visibility " + strconv.Quote(rec.Visibility) + " for " + rec.Name
+		case seen[key]:
+			problem = "Duplicate package " + rec.Name
+		}
+		if problem != "" {
+			report.Errors = append(report.Errors, ImportError{lines[i], problem})
+			continue
+		}
+		seen[key] = true
+
+		old, ok := current[key]
+		if !ok || repositoryKey(old.URL) != repositoryKey(rec.URL) {
+			moved = append(moved, i)
+		}
+		if ok {
+			rec.keepSettings(&old)
+		} else {
+			rec.keepSettings(nil)
+		}
+		switch {
+		case !ok:
+			report.Created++
+		case old.URL != rec.URL:
+			report.Updated++
+			report.Conflicts = append(report.Conflicts, ImportConflict{Tenant: rec.Tenant, Name: rec.Name, URL: old.URL, NewURL: rec.URL})
+		case !sameSettings(old, *rec):
+			report.Updated++
+		default:
+			report.Unchanged++
+		}
+		if ok && rec.CreatedAt == nil {
+			rec.CreatedAt = old.CreatedAt
+		}
+		if ok && rec.Hits == nil {
+			rec.Hits = old.Hits
+		}
+
+	}
+	report.Errors = append(report.Errors, repositoryConflicts(current, records, lines, moved)...)
+	sort.Slice(report.Errors, func(i, j int) bool { return report.Errors[i].Line < report.Errors[j].Line })
+	if dryRun || len(report.Errors) > 0 {
+		return report, nil
+	}
+	return report, store.Restore(records, false)
+}
+
+func sameSettings(a, b PackageRecord) bool {
+	if (a.Deprecated == nil) != (b.Deprecated == nil) || a.Deprecated != nil && *a.Deprecated != *b.Deprecated {
+		return false
+	}
+	return a.Visibility == b.Visibility && a.Organization == b.Organization && a.CacheTTL == b.CacheTTL
+}
+
+// repositoryConflicts reports the records of moved, new or pointing at
+// another repository, whose repository another package has once the import
+// is done. Packages that shared a repository before are left alone.
+func repositoryConflicts(current map[string]PackageRecord, records []PackageRecord, lines []int, moved []int) []ImportError {
+	urls := map[string]string{}
+	for key, p := range current {
+		urls[key] = p.URL
+	}
+	for _, rec := range records {
+		urls[rec.Tenant+"/"+rec.Name] = rec.URL
+	}
+	owners := map[string][]string{}
+	for key, url := range urls {
+		tenant := strings.SplitN(key, "/", 2)[0]
+		repo := tenant + " " + repositoryKey(url)
+		owners[repo] = append(owners[repo], key)
+	}
+
+	var errs []ImportError
+	for _, i := range moved {
+		rec := records[i]
+		var others []string
+		for _, key := range owners[rec.Tenant+" "+repositoryKey(rec.URL)] {
+			if key != rec.Tenant+"/"+rec.Name {
+				others = append(others, strings.SplitN(key, "/", 2)[1])
+			}
+		}
+		if len(others) > 0 {
+			sort.Strings(others)
+			errs = append(errs, ImportError{lines[i], "Repository of " + rec.Name + " already registered as " + strings.Join(others, ", ")})
+		}
+	}
+	return errs
+}
+
+func requestFormat(r *http.Request) string {
+	if format := r.URL.Query().Get("format"); format != "" {
+		return format
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "text/csv") {
+		return "csv"
+	}
+	return "ndjson"
+}
+
+func (s *Server) exportPackages(r *http.Request) *http.Response {
+	format := requestFormat(r)
+	if !validFormat(format) {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid format, use csv or ndjson")
+	}
+	records, err := s.store.Snapshot()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	var buf bytes.Buffer
+	if err := writePackages(&buf, format, records); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	contentType := "application/x-ndjson"
+	if format == "csv" {
+		contentType = "text/csv; charset=utf-8"
+	}
+	response := goproxy.NewResponse(r, contentType, http.StatusOK, buf.String())
+	response.Header.Set("Content-Disposition", `attachment; filename="packages.`+format+`"`)
+	response.Header.Set("Cache-Control", "no-store")
+	return response
+}
+
+func (s *Server) importPackages(r *http.Request) *http.Response {
+	format := requestFormat(r)
+	if !validFormat(format) {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid format, use csv or ndjson")
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	records, lines, errs, err := readPackages(r.Body, format)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, err.Error())
+	}
+	report, err := importPackages(s.store, records, lines, errs, dryRun)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if len(report.Errors) > 0 {
+		return jsonResponse(r, http.StatusBadRequest, report)
+	}
+	if !dryRun {
+		s.audit(s.adminActor(r), "packages.imported", "", fmt.Sprintf("%d created, %d updated", report.Created, report.Updated))
+		if err := s.invalidate(invalidation{Keys: []string{"*"}}); err != nil {
+			cacheLog.Errorf("Could not invalidate caches after an import: %s", err)
+		}
+	}
+	return jsonResponse(r, http.StatusOK, report)
+}
+
+func runDump(args []string) {
+	flags := flag.NewFlagSet("dump", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "csv or ndjson")
+	out := flags.String("out", "", "file to write to (defaults to stdout)")
+	flags.Parse(args)
+	if !validFormat(*format) {
+		log.Fatalf("Invalid format %q, use csv or ndjson", *format)
+	}
+
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatalf("Connection error: %s", err)
+	}
+	defer store.Close()
+	records, err := store.Snapshot()
+	if err != nil {
+		log.Fatalf("Could not read packages: %s", err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			log.Fatal(err)
+		}
+		defer w.Close()
+	}
+	if err := writePackages(w, *format, records); err != nil {
+		log.Fatalf("Dump failed: %s", err)
+	}
+	log.Printf("Dumped %d packages", len(records))
+}
+
+func runLoad(args []string) {
+	flags := flag.NewFlagSet("load", flag.ExitOnError)
+	format := flags.String("format", "ndjson", "csv or ndjson")
+	dryRun := flags.Bool("dry-run", false, "report what would change without writing")
+	flags.Parse(args)
+	if !validFormat(*format) {
+		log.Fatalf("Invalid format %q, use csv or ndjson", *format)
+	}
+
+	in := os.Stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	records, lines, errs, err := readPackages(in, *format)
+	if err != nil {
+		log.Fatalf("Could not read packages: %s", err)
+	}
+
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatalf("Connection error: %s", err)
+	}
+	defer store.Close()
+	report, err := importPackages(store, records, lines, errs, *dryRun)
+	if err != nil {
+		log.Fatalf("Load failed: %s", err)
+	}
+	json.NewEncoder(os.Stdout).Encode(report)
+	if len(report.Errors) > 0 {
+		log.Fatalf("Nothing loaded: %d invalid lines", len(report.Errors))
+	}
+	if !*dryRun {
+		if cache, err := ConnectCache(); err == nil {
+			cache.Delete("packages")
+		}
+	}
+	log.Printf("%d created, %d updated, %d unchanged", report.Created, report.Updated, report.Unchanged)
+}
@@ -0,0 +1,155 @@
+package registry
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Server-rendered pages for browsers. Bower clients keep getting JSON from
+// /packages/{name}; the HTML page is only served when text/html is accepted.
+
+const layoutTemplate = `{{define "layout"}}<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{block "title" .}}Bower registry{{end}}</title>
+<style>
+body { font-family: -apple-system, "Helvetica Neue", Arial, sans-serif; max-width: 50em; margin: 2em auto; padding: 0 1em; color: #333; }
+a { color: #ef5734; }
+table { border-collapse: collapse; width: 100%; }
+td, th { text-align: left; padding: .3em .5em; border-bottom: 1px solid #eee; }
+input[type=search] { width: 70%; padding: .4em; }
+.muted { color: #888; }
+</style>
+</head>
+<body>
+<p><a href="/">Bower registry</a></p>
+{{template "content" .}}
+</body>
+</html>{{end}}`
+
+const homeTemplate = `{{define "content"}}
+<h1>Bower registry</h1>
+<p class="muted">{{.Count}} packages</p>
+<form action="/" method="get">
+<input type="search" name="q" value="{{.Query}}" placeholder="Search packages" autofocus>
+<button type="submit">Search</button>
+</form>
+{{if .Query}}<h2>Results for “{{.Query}}”</h2>{{else}}<h2>Popular packages</h2>{{end}}
+<table>
+{{range .Packages}}<tr><td><a href="/packages/{{.Name}}">{{.Name}}</a></td><td class="muted">{{.URL}}</td></tr>
+{{else}}<tr><td>No packages found.</td></tr>
+{{end}}</table>
+{{end}}`
+
+const packageTemplate = `{{define "title"}}{{.Name}} · Bower registry{{end}}
+{{define "content"}}
+<h1>{{.Name}}</h1>
+{{with .Description}}<p>{{.}}</p>{{end}}
+{{with .Deprecated}}<p><strong>Deprecated:</strong> {{.Message}}{{with .Replacement}} Use <a href="/packages/{{.}}">{{.}}</a> instead.{{end}}</p>{{end}}
+<table>
+<tr><th>Repository</th><td>{{.URL}}</td></tr>
+<tr><th>Install</th><td><code>bower install {{.Name}}</code></td></tr>
+{{with .Keywords}}<tr><th>Keywords</th><td>{{range $i, $k := .}}{{if $i}}, {{end}}{{$k}}{{end}}</td></tr>{{end}}
+{{if .CreatedAt}}<tr><th>Registered</th><td>{{.CreatedAt.Format "2006-01-02"}}</td></tr>{{end}}
+{{with .License}}<tr><th>License</th><td>{{.}}</td></tr>{{end}}
+{{if .Stars}}<tr><th>GitHub stars</th><td>{{.Stars}}</td></tr>{{end}}
+<tr><th>Lookups</th><td>{{.Hits}}</td></tr>
+{{if .Archived}}<tr><th>Repository</th><td>Archived, no longer maintained</td></tr>{{end}}
+{{if eq .Status "broken"}}<tr><th>Status</th><td>Repository unreachable</td></tr>{{end}}
+</table>
+<h2>Versions</h2>
+{{if .VersionsError}}<p class="muted">Versions are currently unavailable.</p>
+{{else}}<ul>{{range .Versions}}<li>{{.}}</li>{{else}}<li class="muted">No tagged versions.</li>{{end}}</ul>{{end}}
+{{end}}`
+
+var (
+	homePage    = template.Must(template.Must(template.New("home").Parse(layoutTemplate)).Parse(homeTemplate))
+	packagePage = template.Must(template.Must(template.New("package").Parse(layoutTemplate)).Parse(packageTemplate))
+)
+
+// PackageDetails is the full metadata of a package shown on its page.
+type PackageDetails struct {
+	Name          string
+	URL           string
+	Description   string
+	Keywords      []string
+	CreatedAt     *time.Time
+	UpdatedAt     *time.Time
+	Hits          int32
+	Status        string
+	Stars         int
+	License       string
+	Archived      bool
+	Deprecated    *Deprecation
+	Private       bool
+	Versions      []string
+	VersionsError bool
+}
+
+func wantsHTML(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/html")
+}
+
+func renderPage(r *http.Request, t *template.Template, data interface{}) *http.Response {
+	var buf bytes.Buffer
+	if err := t.ExecuteTemplate(&buf, "layout", data); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	response := goproxy.NewResponse(r, "text/html; charset=utf-8", http.StatusOK, buf.String())
+	response.Header.Set("Cache-Control", "public, max-age=300")
+	return response
+}
+
+func (s *Server) homePageHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	data := struct {
+		Count    int64
+		Query    string
+		Packages []SearchResult
+	}{Query: normalizeQuery(r.URL.Query().Get("q"))}
+
+	var err error
+	if data.Count, err = s.store.CountPackages(); err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if data.Packages, err = s.store.Search(data.Query, defaultSearchLimit); err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	return r, renderPage(r, homePage, data)
+}
+
+// packagePageHandler renders /packages/{name} for browsers and leaves every
+// other client to getPackage.
+func (s *Server) packagePageHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !wantsHTML(r) {
+		return r, nil
+	}
+	name := strings.TrimPrefix(r.URL.Path, "/packages/")
+
+	p, err := s.store.PackageDetails(name)
+	if err == nil {
+		err = s.checkVisible(r, Package{Name: p.Name, Private: p.Private})
+	}
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+
+	versions, err := repoVersions(p.URL)
+	p.VersionsError = err != nil
+	for i := len(versions) - 1; i >= 0; i-- {
+		p.Versions = append(p.Versions, versions[i].String())
+	}
+	response := renderPage(r, packagePage, p)
+	if p.Private {
+		response.Header.Set("Cache-Control", "private, max-age=300")
+	}
+	return r, response
+}
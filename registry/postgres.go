@@ -0,0 +1,1299 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+// postgresStore keeps the registry in the packages table shared with the
+// node app. Its statements are prepared on every connection, see
+// statements.go.
+type postgresStore struct {
+	pool *pgx.ConnPool
+	// trigram is set when pg_trgm and its GIN indexes are available;
+	// otherwise search has no typo tolerance.
+	trigram bool
+}
+
+// connectDatabase opens the Postgres pool from DATABASE_URL and prepares the
+// registered statements on every new connection.
+func connectDatabase() (*postgresStore, error) {
+	pgxcfg, err := pgx.ParseURI(os.Getenv("DATABASE_URL"))
+	if err != nil {
+		return nil, err
+	}
+	statementTimeout, err := time.ParseDuration(getEnv("DATABASE_STATEMENT_TIMEOUT", "5s"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid DATABASE_STATEMENT_TIMEOUT: %s", err)
+	}
+	slowQuery, err := time.ParseDuration(getEnv("SLOW_QUERY_THRESHOLD", "500ms"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid SLOW_QUERY_THRESHOLD: %s", err)
+	}
+	if pgxcfg.RuntimeParams == nil {
+		pgxcfg.RuntimeParams = map[string]string{}
+	}
+	pgxcfg.RuntimeParams["statement_timeout"] = strconv.FormatInt(int64(statementTimeout/time.Millisecond), 10)
+	// Used by the % operator in search; harmless when pg_trgm isn't installed.
+	pgxcfg.RuntimeParams["pg_trgm.similarity_threshold"] = getEnv("SEARCH_SIMILARITY_THRESHOLD", "0.3")
+	pgxcfg.Logger = newQueryLogger(slowQuery)
+	pgxcfg.LogLevel = pgx.LogLevelInfo
+	pool, err := pgx.NewConnPool(pgx.ConnPoolConfig{
+		ConnConfig:     pgxcfg,
+		MaxConnections: 20,
+		AfterConnect:   prepareStatements,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &postgresStore{pool: pool}, nil
+}
+
+// The store's statements, prepared on every connection.
+func init() {
+	registerStatement("searchFullText", searchFullTextSQL)
+	registerStatement("searchPopular", searchPopularSQL)
+	registerStatement("getPackage", `SELECT name, url, cache_ttl, deprecation_message, coalesce(deprecation_replacement, ''), visibility = 'private', updated_at FROM packages WHERE tenant = '' AND name = $1`)
+	registerStatement("dueURLChecks", `SELECT name, url FROM packages WHERE next_check_at IS NULL OR next_check_at <= now() ORDER BY next_check_at NULLS FIRST LIMIT $1`)
+	registerStatement("recordURLSuccess", `UPDATE packages SET status = 'ok', check_failures = 0, checked_at = now(), next_check_at = now() + $2::float8 * interval '1 second' WHERE name = $1 AND url = $3`)
+	registerStatement("dueEnrichments", `SELECT name, url FROM packages WHERE tenant = '' AND url ILIKE '%github.com%' AND (enriched_at IS NULL OR enriched_at < $1) ORDER BY enriched_at NULLS FIRST LIMIT $2`)
+	registerStatement("versionChecksums", `SELECT tag, sha256 FROM versions WHERE url = $1`)
+	registerStatement("recordChecksum", `INSERT INTO versions (url, tag, sha256) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING`)
+	registerStatement("dependencies", `SELECT name, version_range, dev FROM dependencies WHERE url = $1 ORDER BY name, dev`)
+	registerStatement("dependents", `SELECT p.name, d.version_range, d.dev FROM dependencies d JOIN packages p ON p.url = d.url
+				WHERE d.name = $1 AND p.tenant = '' AND p.visibility = 'public' ORDER BY p.name, d.dev OFFSET $2 LIMIT $3`)
+	registerStatement("recordEnrichment", `UPDATE packages SET description = coalesce(nullif($3, ''), description), stars = $4, license = nullif($5, ''), archived = $6, enriched_at = now() WHERE tenant = '' AND name = $1 AND url = $2`)
+	registerStatement("recordEnrichmentAttempt", `UPDATE packages SET enriched_at = now() WHERE tenant = '' AND name = $1 AND url = $2`)
+	registerStatement("recordURLFailure", `UPDATE packages SET check_failures = check_failures + 1, status = CASE WHEN check_failures + 1 >= $2 THEN 'broken' ELSE status END, checked_at = now(), next_check_at = now() + least($3::float8 * 2 ^ check_failures, $4::float8) * interval '1 second' WHERE name = $1 AND url = $5 RETURNING check_failures = $2`)
+	registerStatement("packageByURL", `SELECT name, url FROM packages WHERE tenant = '' AND (lower(url) = ANY($1::text[]) OR normalized_url = ANY($1::text[])) ORDER BY created_at LIMIT 1`)
+	registerStatement("listPackages", `SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY name`)
+	registerStatement("packagesByPrefix", `SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' AND name COLLATE "C" LIKE $1 ESCAPE '\' ORDER BY name COLLATE "C" LIMIT $2`)
+	registerStatement("snapshotPackages", `SELECT tenant, name, url, created_at, hits, visibility, coalesce(organization, ''), coalesce(cache_ttl, 0), deprecation_message, coalesce(deprecation_replacement, '') FROM packages ORDER BY tenant, name`)
+	// Organizations aren't backed up, so packages of an organization that
+	// doesn't exist are restored without one.
+	registerStatement("restorePackage", `INSERT INTO packages (tenant, name, url, created_at, hits, visibility, organization, cache_ttl, deprecation_message, deprecation_replacement)
+				VALUES ($1, $2, $3, $4, coalesce($5, 0), $6, (SELECT name FROM organizations WHERE name = $7), nullif($8, 0), $9, nullif($10, ''))
+				ON CONFLICT (tenant, name) DO UPDATE SET url = excluded.url, created_at = excluded.created_at, hits = excluded.hits, visibility = excluded.visibility,
+					organization = excluded.organization, cache_ttl = excluded.cache_ttl, deprecation_message = excluded.deprecation_message, deprecation_replacement = excluded.deprecation_replacement`)
+	registerStatement("mirrorPackage", `INSERT INTO packages (name, url, created_at) VALUES ($1, $2, now()) ON CONFLICT (tenant, name) DO UPDATE SET url = excluded.url WHERE packages.url <> excluded.url`)
+	registerStatement("unmirrorPackage", `DELETE FROM packages WHERE tenant = '' AND name = $1`)
+	registerStatement("deletePackagesNotIn", `DELETE FROM packages WHERE tenant || '/' || name <> ALL($1::text[])`)
+	registerStatement("listTenants", `SELECT name, hosts, admin_token_hash FROM tenants`)
+	registerStatement("createTenant", `INSERT INTO tenants (name, hosts, admin_token_hash) VALUES ($1, $2::text[], $3)`)
+	registerStatement("featureFlags", `SELECT name, enabled FROM feature_flags`)
+	registerStatement("setFeatureFlag", `INSERT INTO feature_flags (name, enabled, updated_at) VALUES ($1, $2, now())
+				ON CONFLICT (name) DO UPDATE SET enabled = excluded.enabled, updated_at = excluded.updated_at`)
+	registerStatement("resetFeatureFlag", `DELETE FROM feature_flags WHERE name = $1`)
+	registerStatement("tenantGetPackage", `SELECT name, url FROM packages WHERE tenant = $1 AND name = $2`)
+	registerStatement("tenantListPackages", `SELECT name, url FROM packages WHERE tenant = $1 ORDER BY name`)
+	registerStatement("tenantInsertPackage", `INSERT INTO packages (tenant, name, url, created_at) VALUES ($1, $2, $3, now())`)
+	registerStatement("tenantDeletePackage", `DELETE FROM packages WHERE tenant = $1 AND name = $2`)
+	registerStatement("getOrganization", `SELECT token_hash FROM organizations WHERE name = $1`)
+	registerStatement("createOrganization", `INSERT INTO organizations (name, token_hash) VALUES ($1, $2)`)
+	registerStatement("organizationContact", `SELECT coalesce(email, ''), notifications FROM organizations WHERE name = $1`)
+	registerStatement("setOrganizationContact", `UPDATE organizations SET email = nullif($2, ''), notifications = $3 WHERE name = $1`)
+	registerStatement("orgPackages", `SELECT name, url, visibility = 'private' FROM packages WHERE tenant = '' AND organization = $1 ORDER BY name`)
+	registerStatement("orgMembers", `SELECT organization, name, token_hash, created_at FROM organization_members WHERE organization = $1 ORDER BY name`)
+	registerStatement("createMember", `INSERT INTO organization_members (organization, name, token_hash, created_at) SELECT $1, $2, $3, $4 WHERE EXISTS (SELECT 1 FROM organizations WHERE name = $1)`)
+	registerStatement("deleteMember", `DELETE FROM organization_members WHERE organization = $1 AND name = $2`)
+	registerStatement("memberByTokenHash", `SELECT organization, name, token_hash, created_at FROM organization_members WHERE token_hash = $1`)
+	registerStatement("orgTeams", `SELECT name FROM teams WHERE organization = $1 ORDER BY name`)
+	registerStatement("orgTeamMembers", `SELECT team, member FROM team_members WHERE organization = $1 ORDER BY member`)
+	registerStatement("orgTeamPackages", `SELECT team, package, permission FROM team_packages WHERE organization = $1 ORDER BY package`)
+	registerStatement("createTeam", `INSERT INTO teams (organization, name) SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM organizations WHERE name = $1)`)
+	registerStatement("deleteTeam", `DELETE FROM teams WHERE organization = $1 AND name = $2`)
+	registerStatement("addTeamMember", `INSERT INTO team_members (organization, team, member) SELECT $1, $2, $3
+				WHERE EXISTS (SELECT 1 FROM teams WHERE organization = $1 AND name = $2) AND EXISTS (SELECT 1 FROM organization_members WHERE organization = $1 AND name = $3)`)
+	registerStatement("removeTeamMember", `DELETE FROM team_members WHERE organization = $1 AND team = $2 AND member = $3`)
+	registerStatement("grantTeamPackage", `INSERT INTO team_packages (organization, team, package, permission) SELECT $1, $2, $3, $4
+				WHERE EXISTS (SELECT 1 FROM teams WHERE organization = $1 AND name = $2) AND EXISTS (SELECT 1 FROM packages WHERE tenant = '' AND name = $3 AND organization = $1)
+				ON CONFLICT (organization, team, package) DO UPDATE SET permission = excluded.permission`)
+	registerStatement("revokeTeamPackage", `DELETE FROM team_packages WHERE organization = $1 AND team = $2 AND package = $3`)
+	registerStatement("packagePermission", `SELECT tp.permission FROM team_packages tp
+				JOIN team_members tm ON tm.organization = tp.organization AND tm.team = tp.team
+				JOIN packages p ON p.tenant = '' AND p.name = tp.package AND p.organization = tp.organization
+				WHERE tp.organization = $1 AND tm.member = $2 AND tp.package = $3 ORDER BY tp.permission = 'maintain' DESC LIMIT 1`)
+	registerStatement("holdRegistration", `INSERT INTO held_registrations (name, url, similar_to, distance, created_at) VALUES ($1, $2, $3, $4, $5)`)
+	registerStatement("heldRegistrations", `SELECT name, url, similar_to, distance, created_at FROM held_registrations ORDER BY created_at, name`)
+	registerStatement("releaseRegistration", `DELETE FROM held_registrations WHERE name = $1 RETURNING name, url, similar_to, distance, created_at`)
+	registerStatement("insertScopedPackage", `INSERT INTO packages (name, url, organization, created_at) VALUES ($1, $2, $3, now())`)
+	registerStatement("deleteScopedPackage", `DELETE FROM packages WHERE tenant = '' AND name = $1 AND organization = $2`)
+	registerStatement("deletePackage", `DELETE FROM packages WHERE tenant = '' AND name = $1 AND organization IS NULL`)
+	registerStatement("setDeprecation", `UPDATE packages SET deprecation_message = $2, deprecation_replacement = $3, updated_at = clock_timestamp() WHERE tenant = '' AND name = $1`)
+	registerStatement("setPackageURL", `UPDATE packages SET url = $2, status = 'ok', check_failures = 0, next_check_at = NULL WHERE tenant = '' AND name = $1`)
+	registerStatement("setVisibility", `UPDATE packages SET visibility = $2, updated_at = clock_timestamp() WHERE tenant = '' AND name = $1`)
+	registerStatement("packageOrganization", `SELECT coalesce(organization, '') FROM packages WHERE tenant = '' AND name = $1`)
+	registerStatement("createTransfer", `INSERT INTO package_transfers (package, from_org, to_org, token_hash, created_at, expires_at) VALUES ($1, $2, $3, $4, $5, $6)
+				ON CONFLICT (package) DO UPDATE SET from_org = excluded.from_org, to_org = excluded.to_org, token_hash = excluded.token_hash, created_at = excluded.created_at, expires_at = excluded.expires_at`)
+	registerStatement("pendingTransfer", `SELECT package, from_org, to_org, token_hash, created_at, expires_at FROM package_transfers WHERE package = $1`)
+	registerStatement("deleteTransfer", `DELETE FROM package_transfers WHERE package = $1`)
+	registerStatement("recordAudit", `INSERT INTO audit_log (at, actor, action, package, detail) VALUES ($1, $2, $3, nullif($4, ''), nullif($5, ''))`)
+	registerStatement("auditLog", `SELECT at, actor, action, coalesce(package, ''), coalesce(detail, '') FROM audit_log WHERE $1 = '' OR package = $1 ORDER BY id DESC LIMIT $2`)
+	registerStatement("resolveAlias", `SELECT p.name, p.url FROM aliases a JOIN packages p ON p.tenant = '' AND p.name = a.package WHERE a.alias = $1`)
+	registerStatement("listAliases", `SELECT alias, package FROM aliases ORDER BY alias`)
+	registerStatement("createAlias", `INSERT INTO aliases (alias, package) SELECT $1, $2 WHERE EXISTS (SELECT 1 FROM packages WHERE tenant = '' AND name = $2) AND NOT EXISTS (SELECT 1 FROM packages WHERE tenant = '' AND name = $1)`)
+	registerStatement("deleteAlias", `DELETE FROM aliases WHERE alias = $1`)
+	registerStatement("countPackages", `SELECT count(*) FROM packages WHERE tenant = '' AND visibility = 'public'`)
+	registerStatement("packageDetails", `SELECT name, url, coalesce(description, ''), keywords, created_at, hits, status, stars, coalesce(license, ''), archived, deprecation_message, coalesce(deprecation_replacement, ''), visibility = 'private' FROM packages WHERE tenant = '' AND name = $1`)
+	registerStatement("listPackageDetails", `SELECT name, url, coalesce(description, ''), keywords, created_at, updated_at, hits, status, stars, coalesce(license, ''), archived, deprecation_message, coalesce(deprecation_replacement, '') FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY name LIMIT $1 OFFSET $2`)
+	registerStatement("recentPackageDetails", `SELECT name, url, coalesce(description, ''), keywords, created_at, updated_at, hits, status, stars, coalesce(license, ''), archived, deprecation_message, coalesce(deprecation_replacement, '') FROM packages WHERE tenant = '' AND visibility = 'public' AND updated_at IS NOT NULL ORDER BY updated_at DESC, name DESC LIMIT $1`)
+	registerStatement("packageChanges", `SELECT name, url, updated_at, visibility = 'private' FROM packages WHERE tenant = '' AND (updated_at, name) > ($1, $2)
+				UNION ALL SELECT name, url, deleted_at, true FROM package_tombstones WHERE (deleted_at, name) > ($1, $2)
+				ORDER BY 3, 1 LIMIT $3`)
+	registerStatement("apiKeyByTokenHash", `SELECT name, token_hash, scopes, daily_quota, total_quota, created_at FROM api_keys WHERE token_hash = $1`)
+	registerStatement("listAPIKeys", `SELECT name, token_hash, scopes, daily_quota, total_quota, created_at FROM api_keys ORDER BY name`)
+	registerStatement("createAPIKey", `INSERT INTO api_keys (name, token_hash, scopes, daily_quota, total_quota, created_at) VALUES ($1, $2, $3::text[], $4, $5, $6)`)
+	registerStatement("deleteAPIKey", `DELETE FROM api_keys WHERE name = $1`)
+	registerStatement("recordPublication", `INSERT INTO api_key_publications (key_name, package, created_at) VALUES ($1, $2, $3)`)
+	registerStatement("releasePublication", `DELETE FROM api_key_publications WHERE key_name = $1 AND package = $2 AND created_at = $3`)
+	registerStatement("lockAPIKey", `SELECT 1 FROM api_keys WHERE name = $1 FOR UPDATE`)
+	registerStatement("publications", `SELECT count(*) FILTER (WHERE p.created_at >= $2),
+			count(DISTINCT p.package) FILTER (WHERE p.created_at >= $3 OR EXISTS (SELECT 1 FROM packages WHERE tenant = '' AND name = p.package))
+		FROM api_key_publications p WHERE p.key_name = $1`)
+	registerStatement("recordClientRequests", `INSERT INTO client_stats (day, client, version, requests) VALUES ($1, $2, $3, $4) ON CONFLICT (day, client, version) DO UPDATE SET requests = client_stats.requests + excluded.requests`)
+	registerStatement("recordDeprecatedRequests", `INSERT INTO deprecated_requests (day, dimension, value, requests) VALUES ($1, $2, $3, $4) ON CONFLICT (day, dimension, value) DO UPDATE SET requests = deprecated_requests.requests + excluded.requests`)
+	registerStatement("deprecatedRequestStats", `SELECT day, dimension, value, requests FROM deprecated_requests WHERE day >= $1 ORDER BY day DESC, requests DESC`)
+	registerStatement("recordDownloads", `INSERT INTO package_downloads (name, period, start, downloads) VALUES ($1, 'hour', $2, $3) ON CONFLICT (name, period, start) DO UPDATE SET downloads = package_downloads.downloads + excluded.downloads`)
+	registerStatement("downloads", `SELECT period, start, downloads FROM package_downloads WHERE name = $1 AND start >= $2 AND start < $3 ORDER BY start`)
+	registerStatement("rollUpDownloads", `INSERT INTO package_downloads (name, period, start, downloads)
+				SELECT name, $2::text, date_trunc($2::text, start AT TIME ZONE 'UTC') AT TIME ZONE 'UTC', sum(downloads) FROM package_downloads WHERE period = $1 AND start < $3 GROUP BY 1, 3
+				ON CONFLICT (name, period, start) DO UPDATE SET downloads = package_downloads.downloads + excluded.downloads`)
+	registerStatement("downloadTotals", `SELECT name, sum(downloads)::bigint FROM package_downloads WHERE period <> 'month' AND start >= $1 AND start < $2 GROUP BY name`)
+	registerStatement("deleteDownloads", `DELETE FROM package_downloads WHERE period = $1 AND start < $2`)
+	registerStatement("clientStats", `SELECT day, client, version, requests FROM client_stats WHERE day >= $1 ORDER BY day DESC, requests DESC`)
+	registerStatement("brokenPackages", `SELECT name, url, check_failures, checked_at FROM packages WHERE tenant = '' AND visibility = 'public' AND status = 'broken' ORDER BY name`)
+}
+
+func (s *postgresStore) Close() {
+	s.pool.Close()
+}
+
+// queryPackages runs a statement returning (name, url) rows.
+func (s *postgresStore) queryPackages(sql string, args ...interface{}) ([]Package, error) {
+	rows, err := s.pool.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packages []Package
+	for rows.Next() {
+		var p Package
+		if err := rows.Scan(&p.Name, &p.URL); err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	return packages, rows.Err()
+}
+
+func (s *postgresStore) queryPackage(sql string, args ...interface{}) (Package, error) {
+	var p Package
+	err := s.pool.QueryRow(sql, args...).Scan(&p.Name, &p.URL)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return p, err
+}
+
+// exec runs a statement, translating unique violations to ErrExists and, when
+// mustAffect is set, a statement that changed nothing to ErrNotFound.
+func (s *postgresStore) exec(mustAffect bool, sql string, args ...interface{}) error {
+	tag, err := s.pool.Exec(sql, args...)
+	if pgErr, ok := err.(pgx.PgError); ok && pgErr.Code == "23505" {
+		if pgErr.ConstraintName == "packages_normalized_url_unique" {
+			return ErrURLTaken
+		}
+		return ErrExists
+	}
+	if err == nil && mustAffect && tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (s *postgresStore) GetPackage(name string) (Package, error) {
+	var p Package
+	var ttl *int32
+	var message *string
+	var replacement string
+	var updated *time.Time
+	err := s.pool.QueryRow(statement("getPackage"), name).Scan(&p.Name, &p.URL, &ttl, &message, &replacement, &p.Private, &updated)
+	if err == pgx.ErrNoRows {
+		return p, ErrNotFound
+	}
+	if updated != nil {
+		p.UpdatedAt = *updated
+	}
+	if ttl != nil {
+		p.CacheTTL = time.Duration(*ttl) * time.Second
+	}
+	if message != nil {
+		p.Deprecated = &Deprecation{Message: *message, Replacement: replacement}
+	}
+	return p, err
+}
+
+func (s *postgresStore) ListPackages() ([]Package, error) {
+	return s.queryPackages(statement("listPackages"))
+}
+
+func (s *postgresStore) EachPackage(fn func(Package) error) error {
+	rows, err := s.pool.Query(statement("listPackages"))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var p Package
+		if err := rows.Scan(&p.Name, &p.URL); err != nil {
+			return err
+		}
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *postgresStore) CountPackages() (int64, error) {
+	var n int64
+	err := s.pool.QueryRow(statement("countPackages")).Scan(&n)
+	return n, err
+}
+
+func (s *postgresStore) PackageDetails(name string) (PackageDetails, error) {
+	var p PackageDetails
+	var hits *int32
+	var message *string
+	var replacement string
+	err := s.pool.QueryRow(statement("packageDetails"), name).Scan(&p.Name, &p.URL, &p.Description, &p.Keywords, &p.CreatedAt, &hits, &p.Status, &p.Stars, &p.License, &p.Archived, &message, &replacement, &p.Private)
+	if err == pgx.ErrNoRows {
+		return p, ErrNotFound
+	}
+	if hits != nil {
+		p.Hits = *hits
+	}
+	if message != nil {
+		p.Deprecated = &Deprecation{Message: *message, Replacement: replacement}
+	}
+	return p, err
+}
+
+func (s *postgresStore) ListPackageDetails(offset, limit int) ([]PackageDetails, error) {
+	return s.queryPackageDetails(statement("listPackageDetails"), limit, offset)
+}
+
+func (s *postgresStore) RecentPackageDetails(limit int) ([]PackageDetails, error) {
+	return s.queryPackageDetails(statement("recentPackageDetails"), limit)
+}
+
+// queryPackageDetails runs a statement returning the columns of
+// listPackageDetails.
+func (s *postgresStore) queryPackageDetails(sql string, args ...interface{}) ([]PackageDetails, error) {
+	rows, err := s.pool.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []PackageDetails{}
+	for rows.Next() {
+		var p PackageDetails
+		var hits *int32
+		var message *string
+		var replacement string
+		if err := rows.Scan(&p.Name, &p.URL, &p.Description, &p.Keywords, &p.CreatedAt, &p.UpdatedAt, &hits, &p.Status, &p.Stars, &p.License, &p.Archived, &message, &replacement); err != nil {
+			return nil, err
+		}
+		if hits != nil {
+			p.Hits = *hits
+		}
+		if message != nil {
+			p.Deprecated = &Deprecation{Message: *message, Replacement: replacement}
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresStore) PackageChanges(since time.Time, after string, limit int) ([]PackageChange, error) {
+	rows, err := s.pool.Query(statement("packageChanges"), since, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []PackageChange{}
+	for rows.Next() {
+		var c PackageChange
+		if err := rows.Scan(&c.Name, &c.URL, &c.At, &c.Deleted); err != nil {
+			return nil, err
+		}
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (s *postgresStore) PackageByURL(urls ...string) (Package, error) {
+	return s.queryPackage(statement("packageByURL"), urls)
+}
+
+// Notify sends payload to every connection listening on channel, in this
+// and every other instance.
+func (s *postgresStore) Notify(channel, payload string) error {
+	_, err := s.pool.Exec(`SELECT pg_notify($1, $2)`, channel, payload)
+	return err
+}
+
+// Listen calls handle with every notification on channel. It holds one
+// connection of the pool and reconnects after errors.
+func (s *postgresStore) Listen(channel string, handle func(payload string)) {
+	go func() {
+		for {
+			if err := s.listen(channel, handle); err != nil {
+				dbLog.Errorf("Listening on %s failed: %s", channel, err)
+			}
+			time.Sleep(5 * time.Second)
+		}
+	}()
+}
+
+func (s *postgresStore) listen(channel string, handle func(payload string)) error {
+	conn, err := s.pool.Acquire()
+	if err != nil {
+		return err
+	}
+	defer s.pool.Release(conn)
+	if err := conn.Listen(channel); err != nil {
+		return err
+	}
+	defer conn.Unlisten(channel)
+	for {
+		n, err := conn.WaitForNotification(context.Background())
+		if err != nil {
+			return err
+		}
+		handle(n.Payload)
+	}
+}
+
+// ensureSearchIndexes creates the pg_trgm extension and GIN indexes used by
+// native search. Missing privileges or an unavailable extension only disable
+// similarity ranking.
+func (s *postgresStore) ensureSearchIndexes() {
+	for _, sql := range []string{
+		`CREATE EXTENSION IF NOT EXISTS pg_trgm`,
+		`CREATE INDEX IF NOT EXISTS packages_name_trgm_gin ON packages USING gin (name gin_trgm_ops)`,
+		`CREATE INDEX IF NOT EXISTS packages_description_trgm_gin ON packages USING gin (description gin_trgm_ops)`,
+	} {
+		if _, err := s.pool.Exec(sql); err != nil {
+			dbLog.Warnf("Trigram search unavailable, typo tolerance disabled: %s", err)
+			s.trigram = false
+			return
+		}
+	}
+	s.trigram = true
+}
+
+// escapeLike escapes the LIKE wildcards in user input.
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// The trigram query isn't registered as a statement: it can't be prepared
+// when pg_trgm is missing. Matches come from
+// the full-text vector (with prefix matching), a substring match on name or
+// URL as the node implementation did, and, with pg_trgm, names within the
+// similarity threshold to tolerate typos. Scores are boosted by the GitHub
+// stars of the repository and halved for archived or deprecated packages.
+const (
+	searchBoost      = `(1 + ln(1 + stars) / 10) * CASE WHEN ` + searchDemoted + ` THEN 0.5 ELSE 1 END`
+	searchDemoted    = `(archived OR deprecation_message IS NOT NULL)`
+	searchTrigramSQL = `SELECT name, url, ((ts_rank(search_vector, q) + similarity(name, $1)) * ` + searchBoost + `)::float8 AS score
+		FROM packages, to_tsquery('simple', $2) q
+		WHERE tenant = '' AND visibility = 'public' AND (search_vector @@ q OR name ILIKE $3 OR url ILIKE $3 OR name % $1)
+		ORDER BY score DESC, hits DESC NULLS LAST LIMIT $4`
+	searchFullTextSQL = `SELECT name, url, (ts_rank(search_vector, q) * ` + searchBoost + `)::float8 AS score
+		FROM packages, to_tsquery('simple', $2) q
+		WHERE tenant = '' AND visibility = 'public' AND (search_vector @@ q OR name ILIKE $3 OR url ILIKE $3)
+		ORDER BY score DESC, lower(name) = lower($1) DESC, hits DESC NULLS LAST LIMIT $4`
+	searchPopularSQL = `SELECT name, url, 0::float8 FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY ` + searchDemoted + `, hits DESC NULLS LAST LIMIT $1`
+)
+
+var nonWordRe = regexp.MustCompile(`[^\pL\pN]+`)
+
+// prefixQuery turns free text into a tsquery where every word may be a
+// prefix, e.g. "jq ui" becomes "jq:* & ui:*".
+func prefixQuery(term string) string {
+	var words []string
+	for _, w := range nonWordRe.Split(strings.ToLower(term), -1) {
+		if w != "" {
+			words = append(words, w+":*")
+		}
+	}
+	return strings.Join(words, " & ")
+}
+
+func (s *postgresStore) querySearchResults(sql string, args ...interface{}) ([]SearchResult, error) {
+	rows, err := s.pool.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	results := []SearchResult{}
+	for rows.Next() {
+		var res SearchResult
+		if err := rows.Scan(&res.Name, &res.URL, &res.Score); err != nil {
+			return nil, err
+		}
+		results = append(results, res)
+	}
+	return results, rows.Err()
+}
+
+func (s *postgresStore) Search(term string, limit int) ([]SearchResult, error) {
+	switch {
+	case term == "":
+		return s.querySearchResults(statement("searchPopular"), limit)
+	case s.trigram:
+		return s.querySearchResults(searchTrigramSQL, term, prefixQuery(term), "%"+escapeLike(term)+"%", limit)
+	default:
+		return s.querySearchResults(statement("searchFullText"), term, prefixQuery(term), "%"+escapeLike(term)+"%", limit)
+	}
+}
+
+func (s *postgresStore) PackagesByPrefix(prefix string, limit int) ([]Package, error) {
+	return s.queryPackages(statement("packagesByPrefix"), escapeLike(prefix)+"%", limit)
+}
+
+func (s *postgresStore) DueURLChecks(limit int) ([]Package, error) {
+	return s.queryPackages(statement("dueURLChecks"), limit)
+}
+
+func (s *postgresStore) RecordURLSuccess(p Package, next time.Duration) error {
+	return s.exec(false, statement("recordURLSuccess"), p.Name, next.Seconds(), p.URL)
+}
+
+func (s *postgresStore) RecordURLFailure(p Package, threshold int, base, max time.Duration) (bool, error) {
+	var broken bool
+	err := s.pool.QueryRow(statement("recordURLFailure"), p.Name, threshold, base.Seconds(), max.Seconds(), p.URL).Scan(&broken)
+	if err == pgx.ErrNoRows {
+		return false, nil
+	}
+	return broken, err
+}
+
+func (s *postgresStore) DueEnrichments(before time.Time, limit int) ([]Package, error) {
+	return s.queryPackages(statement("dueEnrichments"), before, limit)
+}
+
+func (s *postgresStore) RecordEnrichment(p Package, m *RepoMetadata) error {
+	if m == nil {
+		return s.exec(false, statement("recordEnrichmentAttempt"), p.Name, p.URL)
+	}
+	return s.exec(false, statement("recordEnrichment"), p.Name, p.URL, m.Description, int32(m.Stars), m.License, m.Archived)
+}
+
+func (s *postgresStore) VersionChecksums(url string) (map[string]string, error) {
+	rows, err := s.pool.Query(statement("versionChecksums"), url)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[string]string{}
+	for rows.Next() {
+		var tag, sum string
+		if err := rows.Scan(&tag, &sum); err != nil {
+			return nil, err
+		}
+		sums[tag] = sum
+	}
+	return sums, rows.Err()
+}
+
+func (s *postgresStore) RecordChecksum(url, tag, sum string) error {
+	return s.exec(false, statement("recordChecksum"), url, tag, sum)
+}
+
+func (s *postgresStore) Dependencies(url string) ([]Dependency, error) {
+	return s.queryDependencies(statement("dependencies"), url)
+}
+
+func (s *postgresStore) RecordDependencies(url string, deps []Dependency) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM dependencies WHERE url = $1`, url); err != nil {
+		return err
+	}
+	for _, d := range deps {
+		if _, err := tx.Exec(`INSERT INTO dependencies (url, name, version_range, dev) VALUES ($1, $2, $3, $4) ON CONFLICT DO NOTHING`, url, d.Name, d.Range, d.Dev); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) Dependents(name string, offset, limit int) ([]Dependency, error) {
+	return s.queryDependencies(statement("dependents"), name, offset, limit)
+}
+
+func (s *postgresStore) queryDependencies(sql string, args ...interface{}) ([]Dependency, error) {
+	rows, err := s.pool.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := []Dependency{}
+	for rows.Next() {
+		var d Dependency
+		if err := rows.Scan(&d.Name, &d.Range, &d.Dev); err != nil {
+			return nil, err
+		}
+		deps = append(deps, d)
+	}
+	return deps, rows.Err()
+}
+
+func (s *postgresStore) BrokenPackages() ([]BrokenPackage, error) {
+	rows, err := s.pool.Query(statement("brokenPackages"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	broken := []BrokenPackage{}
+	for rows.Next() {
+		var p BrokenPackage
+		if err := rows.Scan(&p.Name, &p.URL, &p.Failures, &p.CheckedAt); err != nil {
+			return nil, err
+		}
+		broken = append(broken, p)
+	}
+	return broken, rows.Err()
+}
+
+func (s *postgresStore) ResolveAlias(alias string) (Package, error) {
+	return s.queryPackage(statement("resolveAlias"), alias)
+}
+
+func (s *postgresStore) ListAliases() ([]Alias, error) {
+	rows, err := s.pool.Query(statement("listAliases"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []Alias{}
+	for rows.Next() {
+		var a Alias
+		if err := rows.Scan(&a.Alias, &a.Package); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+func (s *postgresStore) CreateAlias(a Alias) error {
+	// The insert only happens when the target exists and the alias does not
+	// shadow a registered package.
+	return s.exec(true, statement("createAlias"), a.Alias, a.Package)
+}
+
+func (s *postgresStore) DeleteAlias(alias string) error {
+	return s.exec(true, statement("deleteAlias"), alias)
+}
+
+func scanAPIKey(row interface {
+	Scan(dest ...interface{}) error
+}) (APIKey, error) {
+	var k APIKey
+	var daily, total int32
+	err := row.Scan(&k.Name, &k.TokenHash, &k.Scopes, &daily, &total, &k.CreatedAt)
+	k.DailyQuota, k.TotalQuota = int(daily), int(total)
+	return k, err
+}
+
+func (s *postgresStore) APIKeyByTokenHash(tokenHash string) (APIKey, error) {
+	k, err := scanAPIKey(s.pool.QueryRow(statement("apiKeyByTokenHash"), tokenHash))
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return k, err
+}
+
+func (s *postgresStore) ListAPIKeys() ([]APIKey, error) {
+	rows, err := s.pool.Query(statement("listAPIKeys"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *postgresStore) CreateAPIKey(k APIKey) error {
+	return s.exec(false, statement("createAPIKey"), k.Name, k.TokenHash, k.Scopes, int32(k.DailyQuota), int32(k.TotalQuota), k.CreatedAt)
+}
+
+func (s *postgresStore) DeleteAPIKey(name string) error {
+	return s.exec(true, statement("deleteAPIKey"), name)
+}
+
+func (s *postgresStore) ReservePublication(key, pkg string, at, since, pending time.Time, daily, total int) (int, int, bool, error) {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer tx.Rollback()
+
+	// Locking the key makes concurrent reservations with it wait for each
+	// other's counts.
+	var one int
+	if err := tx.QueryRow(statement("lockAPIKey"), key).Scan(&one); err == pgx.ErrNoRows {
+		return 0, 0, false, ErrNotFound
+	} else if err != nil {
+		return 0, 0, false, err
+	}
+	var recent, registered int64
+	if err := tx.QueryRow(statement("publications"), key, since, pending).Scan(&recent, &registered); err != nil {
+		return 0, 0, false, err
+	}
+	if total > 0 && registered >= int64(total) || daily > 0 && recent >= int64(daily) {
+		return int(recent), int(registered), false, nil
+	}
+	if _, err := tx.Exec(statement("recordPublication"), key, pkg, at); err != nil {
+		return 0, 0, false, err
+	}
+	return int(recent), int(registered), true, tx.Commit()
+}
+
+func (s *postgresStore) ReleasePublication(key, pkg string, at time.Time) error {
+	return s.exec(false, statement("releasePublication"), key, pkg, at)
+}
+
+func (s *postgresStore) OrganizationTokenHash(org string) (string, error) {
+	var tokenHash string
+	err := s.pool.QueryRow(statement("getOrganization"), org).Scan(&tokenHash)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return tokenHash, err
+}
+
+func (s *postgresStore) CreateOrganization(name, tokenHash string) error {
+	return s.exec(false, statement("createOrganization"), name, tokenHash)
+}
+
+func (s *postgresStore) OrganizationContact(org string) (Contact, error) {
+	var c Contact
+	err := s.pool.QueryRow(statement("organizationContact"), org).Scan(&c.Email, &c.Notifications)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return c, err
+}
+
+func (s *postgresStore) SetOrganizationContact(org string, c Contact) error {
+	return s.exec(true, statement("setOrganizationContact"), org, c.Email, c.Notifications)
+}
+
+func (s *postgresStore) OrganizationPackages(org string) ([]Package, error) {
+	rows, err := s.pool.Query(statement("orgPackages"), org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packages []Package
+	for rows.Next() {
+		var p Package
+		if err := rows.Scan(&p.Name, &p.URL, &p.Private); err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	return packages, rows.Err()
+}
+
+func (s *postgresStore) queryMembers(sql string, args ...interface{}) ([]Member, error) {
+	rows, err := s.pool.Query(sql, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Organization, &m.Name, &m.TokenHash, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *postgresStore) OrganizationMembers(org string) ([]Member, error) {
+	return s.queryMembers(statement("orgMembers"), org)
+}
+
+func (s *postgresStore) CreateMember(m Member) error {
+	return s.exec(true, statement("createMember"), m.Organization, m.Name, m.TokenHash, m.CreatedAt)
+}
+
+func (s *postgresStore) DeleteMember(org, name string) error {
+	return s.exec(true, statement("deleteMember"), org, name)
+}
+
+func (s *postgresStore) MemberByTokenHash(tokenHash string) (Member, error) {
+	var m Member
+	err := s.pool.QueryRow(statement("memberByTokenHash"), tokenHash).Scan(&m.Organization, &m.Name, &m.TokenHash, &m.CreatedAt)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return m, err
+}
+
+// Teams reads the teams, their members and their packages in three
+// queries and puts them together.
+func (s *postgresStore) Teams(org string) ([]Team, error) {
+	rows, err := s.pool.Query(statement("orgTeams"), org)
+	if err != nil {
+		return nil, err
+	}
+	teams := []Team{}
+	index := map[string]int{}
+	for rows.Next() {
+		t := Team{Members: []string{}, Packages: []TeamPackage{}}
+		if err := rows.Scan(&t.Name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		index[t.Name] = len(teams)
+		teams = append(teams, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.pool.Query(statement("orgTeamMembers"), org)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var team, member string
+		if err := rows.Scan(&team, &member); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if i, ok := index[team]; ok {
+			teams[i].Members = append(teams[i].Members, member)
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = s.pool.Query(statement("orgTeamPackages"), org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var team string
+		var g TeamPackage
+		if err := rows.Scan(&team, &g.Package, &g.Permission); err != nil {
+			return nil, err
+		}
+		if i, ok := index[team]; ok {
+			teams[i].Packages = append(teams[i].Packages, g)
+		}
+	}
+	return teams, rows.Err()
+}
+
+func (s *postgresStore) CreateTeam(org, name string) error {
+	return s.exec(true, statement("createTeam"), org, name)
+}
+
+func (s *postgresStore) DeleteTeam(org, name string) error {
+	return s.exec(true, statement("deleteTeam"), org, name)
+}
+
+func (s *postgresStore) AddTeamMember(org, team, member string) error {
+	return s.exec(true, statement("addTeamMember"), org, team, member)
+}
+
+func (s *postgresStore) RemoveTeamMember(org, team, member string) error {
+	return s.exec(true, statement("removeTeamMember"), org, team, member)
+}
+
+func (s *postgresStore) SetTeamPackage(org, team string, g TeamPackage) error {
+	if g.Permission == "" {
+		return s.exec(true, statement("revokeTeamPackage"), org, team, g.Package)
+	}
+	return s.exec(true, statement("grantTeamPackage"), org, team, g.Package, g.Permission)
+}
+
+func (s *postgresStore) PackagePermission(org, member, pkg string) (string, error) {
+	var permission string
+	err := s.pool.QueryRow(statement("packagePermission"), org, member, pkg).Scan(&permission)
+	if err == pgx.ErrNoRows {
+		return "", nil
+	}
+	return permission, err
+}
+
+func (s *postgresStore) InsertScopedPackage(name, url, org string) error {
+	return s.exec(false, statement("insertScopedPackage"), name, url, org)
+}
+
+func (s *postgresStore) InsertPackage(name, url string) error {
+	return s.exec(false, statement("insertScopedPackage"), name, url, nil)
+}
+
+func (s *postgresStore) DeletePackage(name string) error {
+	return s.exec(true, statement("deletePackage"), name)
+}
+
+func (s *postgresStore) HoldRegistration(h HeldRegistration) error {
+	return s.exec(false, statement("holdRegistration"), h.Name, h.URL, h.SimilarTo, int32(h.Distance), h.CreatedAt)
+}
+
+func (s *postgresStore) HeldRegistrations() ([]HeldRegistration, error) {
+	rows, err := s.pool.Query(statement("heldRegistrations"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := []HeldRegistration{}
+	for rows.Next() {
+		var h HeldRegistration
+		var distance int32
+		if err := rows.Scan(&h.Name, &h.URL, &h.SimilarTo, &distance, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		h.Distance = int(distance)
+		held = append(held, h)
+	}
+	return held, rows.Err()
+}
+
+func (s *postgresStore) ReleaseRegistration(name string) (HeldRegistration, error) {
+	var h HeldRegistration
+	var distance int32
+	err := s.pool.QueryRow(statement("releaseRegistration"), name).Scan(&h.Name, &h.URL, &h.SimilarTo, &distance, &h.CreatedAt)
+	if err == pgx.ErrNoRows {
+		return h, ErrNotFound
+	}
+	h.Distance = int(distance)
+	return h, err
+}
+
+func (s *postgresStore) DeleteScopedPackage(name, org string) error {
+	return s.exec(true, statement("deleteScopedPackage"), name, org)
+}
+
+func (s *postgresStore) SetDeprecation(name string, d *Deprecation) error {
+	if d == nil {
+		return s.exec(true, statement("setDeprecation"), name, nil, nil)
+	}
+	return s.exec(true, statement("setDeprecation"), name, d.Message, d.Replacement)
+}
+
+func (s *postgresStore) SetPackageURL(name, url string) error {
+	return s.exec(true, statement("setPackageURL"), name, url)
+}
+
+func (s *postgresStore) SetVisibility(name string, private bool) error {
+	return s.exec(true, statement("setVisibility"), name, visibility(private))
+}
+
+func (s *postgresStore) PackageOrganization(name string) (string, error) {
+	var org string
+	err := s.pool.QueryRow(statement("packageOrganization"), name).Scan(&org)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return org, err
+}
+
+func (s *postgresStore) CreateTransfer(t Transfer) error {
+	return s.exec(false, statement("createTransfer"), t.Package, t.From, t.To, t.TokenHash, t.CreatedAt, t.ExpiresAt)
+}
+
+func (s *postgresStore) PendingTransfer(name string) (Transfer, error) {
+	var t Transfer
+	err := s.pool.QueryRow(statement("pendingTransfer"), name).Scan(&t.Package, &t.From, &t.To, &t.TokenHash, &t.CreatedAt, &t.ExpiresAt)
+	if err == pgx.ErrNoRows {
+		err = ErrNotFound
+	}
+	return t, err
+}
+
+func (s *postgresStore) CompleteTransfer(t Transfer) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tag, err := tx.Exec(`DELETE FROM package_transfers WHERE package = $1 AND token_hash = $2`, t.Package, t.TokenHash)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	tag, err = tx.Exec(`UPDATE packages SET organization = $3 WHERE tenant = '' AND name = $1 AND organization = $2`, t.Package, t.From, t.To)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrNotFound
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) DeleteTransfer(name string) error {
+	return s.exec(true, statement("deleteTransfer"), name)
+}
+
+func (s *postgresStore) RecordAudit(e AuditEntry) error {
+	return s.exec(false, statement("recordAudit"), e.At, e.Actor, e.Action, e.Package, e.Detail)
+}
+
+func (s *postgresStore) AuditLog(pkg string, limit int) ([]AuditEntry, error) {
+	rows, err := s.pool.Query(statement("auditLog"), pkg, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.At, &e.Actor, &e.Action, &e.Package, &e.Detail); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *postgresStore) ListTenants() ([]*Tenant, error) {
+	rows, err := s.pool.Query(statement("listTenants"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Tenant
+	for rows.Next() {
+		t := &Tenant{}
+		if err := rows.Scan(&t.Name, &t.Hosts, &t.AdminTokenHash); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func (s *postgresStore) CreateTenant(t Tenant) error {
+	return s.exec(false, statement("createTenant"), t.Name, t.Hosts, t.AdminTokenHash)
+}
+
+func (s *postgresStore) FeatureFlags() (map[string]bool, error) {
+	rows, err := s.pool.Query(statement("featureFlags"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var enabled bool
+		if err := rows.Scan(&name, &enabled); err != nil {
+			return nil, err
+		}
+		flags[name] = enabled
+	}
+	return flags, rows.Err()
+}
+
+func (s *postgresStore) SetFeatureFlag(name string, enabled bool) error {
+	return s.exec(false, statement("setFeatureFlag"), name, enabled)
+}
+
+func (s *postgresStore) ResetFeatureFlag(name string) error {
+	return s.exec(false, statement("resetFeatureFlag"), name)
+}
+
+func (s *postgresStore) TenantGetPackage(tenant, name string) (Package, error) {
+	return s.queryPackage(statement("tenantGetPackage"), tenant, name)
+}
+
+func (s *postgresStore) TenantListPackages(tenant string) ([]Package, error) {
+	return s.queryPackages(statement("tenantListPackages"), tenant)
+}
+
+func (s *postgresStore) TenantInsertPackage(tenant, name, url string) error {
+	return s.exec(false, statement("tenantInsertPackage"), tenant, name, url)
+}
+
+func (s *postgresStore) TenantDeletePackage(tenant, name string) error {
+	return s.exec(true, statement("tenantDeletePackage"), tenant, name)
+}
+
+func (s *postgresStore) Snapshot() ([]PackageRecord, error) {
+	rows, err := s.pool.Query(statement("snapshotPackages"))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []PackageRecord{}
+	for rows.Next() {
+		var p PackageRecord
+		var message *string
+		var replacement string
+		if err := rows.Scan(&p.Tenant, &p.Name, &p.URL, &p.CreatedAt, &p.Hits, &p.Visibility, &p.Organization, &p.CacheTTL, &message, &replacement); err != nil {
+			return nil, err
+		}
+		if message != nil {
+			p.Deprecated = &Deprecation{Message: *message, Replacement: replacement}
+		}
+		records = append(records, p)
+	}
+	return records, rows.Err()
+}
+
+func (s *postgresStore) RecordClientRequests(stats []ClientStat) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range stats {
+		if _, err := tx.Exec(statement("recordClientRequests"), c.Day, c.Client, c.Version, c.Requests); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) ClientStats(since time.Time) ([]ClientStat, error) {
+	rows, err := s.pool.Query(statement("clientStats"), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []ClientStat
+	for rows.Next() {
+		var c ClientStat
+		if err := rows.Scan(&c.Day, &c.Client, &c.Version, &c.Requests); err != nil {
+			return nil, err
+		}
+		stats = append(stats, c)
+	}
+	return stats, rows.Err()
+}
+
+func (s *postgresStore) RecordDeprecatedRequests(stats []DeprecatedRequestStat) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range stats {
+		if _, err := tx.Exec(statement("recordDeprecatedRequests"), d.Day, d.Dimension, d.Value, d.Requests); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) DeprecatedRequestStats(since time.Time) ([]DeprecatedRequestStat, error) {
+	rows, err := s.pool.Query(statement("deprecatedRequestStats"), since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []DeprecatedRequestStat
+	for rows.Next() {
+		var d DeprecatedRequestStat
+		if err := rows.Scan(&d.Day, &d.Dimension, &d.Value, &d.Requests); err != nil {
+			return nil, err
+		}
+		stats = append(stats, d)
+	}
+	return stats, rows.Err()
+}
+
+func (s *postgresStore) RecordDownloads(hour time.Time, downloads map[string]int64) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for name, n := range downloads {
+		if _, err := tx.Exec(statement("recordDownloads"), name, hour, n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *postgresStore) Downloads(name string, since, until time.Time) ([]DownloadBucket, error) {
+	rows, err := s.pool.Query(statement("downloads"), name, since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []DownloadBucket
+	for rows.Next() {
+		var b DownloadBucket
+		if err := rows.Scan(&b.Interval, &b.Start, &b.Downloads); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+func (s *postgresStore) CompactDownloads(interval, into string, before time.Time) (int, error) {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if into != "" {
+		if _, err := tx.Exec(statement("rollUpDownloads"), interval, into, before); err != nil {
+			return 0, err
+		}
+	}
+	tag, err := tx.Exec(statement("deleteDownloads"), interval, before)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), tx.Commit()
+}
+
+func (s *postgresStore) DownloadTotals(since, until time.Time) (map[string]int64, error) {
+	rows, err := s.pool.Query(statement("downloadTotals"), since, until)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var n int64
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		totals[name] = n
+	}
+	return totals, rows.Err()
+}
+
+func (s *postgresStore) Restore(records []PackageRecord, replace bool) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	// One invalidation of everything replaces a notification per row.
+	if _, err := tx.Exec(`SET LOCAL registry.skip_invalidation = 'on'`); err != nil {
+		return err
+	}
+	// Copies keep packages that share a repository, see the
+	// packages_normalized_url trigger.
+	if _, err := tx.Exec(`SET LOCAL registry.skip_url_check = 'on'`); err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(records))
+	for _, p := range records {
+		var message, replacement *string
+		if p.Deprecated != nil {
+			message, replacement = &p.Deprecated.Message, &p.Deprecated.Replacement
+		}
+		if _, err := tx.Exec(statement("restorePackage"), p.Tenant, p.Name, p.URL, p.CreatedAt, p.Hits, p.Visibility, p.Organization, p.CacheTTL, message, replacement); err != nil {
+			return err
+		}
+		names = append(names, p.Tenant+"/"+p.Name)
+	}
+	if replace {
+		if _, err := tx.Exec(statement("deletePackagesNotIn"), names); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return s.Notify(invalidationChannel, `{"keys":["*"]}`)
+}
+
+// ApplyChanges leaves invalidating caches to the caller, which knows the
+// changed URLs without a notification per row.
+func (s *postgresStore) ApplyChanges(changes []PackageChange) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`SET LOCAL registry.skip_invalidation = 'on'`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`SET LOCAL registry.skip_url_check = 'on'`); err != nil {
+		return err
+	}
+	for _, c := range changes {
+		if c.Deleted {
+			_, err = tx.Exec(statement("unmirrorPackage"), c.Name)
+		} else {
+			_, err = tx.Exec(statement("mirrorPackage"), c.Name, c.URL)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
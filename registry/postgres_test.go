@@ -0,0 +1,88 @@
+//go:build dockertest
+// +build dockertest
+
+package registry
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+)
+
+// With the dockertest tag the API scenarios also run against Postgres and
+// memcached started with docker, after the knex migrations, so docker, node
+// and the node modules are needed:
+//
+//	go test -tags dockertest -run Postgres ./registry
+
+// migrateScript runs the knex migrations against DATABASE_URL.
+const migrateScript = `require('knex')({client: 'pg', connection: process.env.DATABASE_URL}).migrate.latest().then(
+	function () { process.exit(0); },
+	function (err) { console.error(err); process.exit(1); })`
+
+// dockerRun starts image, removed when the test ends, and returns the host
+// address of its port.
+func dockerRun(t *testing.T, image, port string, env ...string) string {
+	args := []string{"run", "-d", "--rm", "-p", "127.0.0.1::" + port}
+	for _, kv := range env {
+		args = append(args, "-e", kv)
+	}
+	out, err := exec.Command("docker", append(args, image)...).Output()
+	if err != nil {
+		t.Fatalf("docker run %s: %s", image, err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", id).Run() })
+
+	out, err = exec.Command("docker", "port", id, port+"/tcp").Output()
+	if err != nil {
+		t.Fatalf("docker port %s: %s", image, err)
+	}
+	return strings.TrimSpace(strings.Split(string(out), "\n")[0])
+}
+
+// migrate runs the migrations once Postgres accepts connections.
+func migrate(t *testing.T, databaseURL string) {
+	var out []byte
+	var err error
+	for deadline := time.Now().Add(time.Minute); time.Now().Before(deadline); time.Sleep(time.Second) {
+		cmd := exec.Command("node", "-e", migrateScript)
+		cmd.Dir = ".."
+		cmd.Env = append(os.Environ(), "DATABASE_URL="+databaseURL)
+		if out, err = cmd.CombinedOutput(); err == nil {
+			return
+		}
+	}
+	t.Fatalf("migrations: %s: %s", err, out)
+}
+
+func TestAPIPostgres(t *testing.T) {
+	databaseURL := "postgres://registry:registry@" + dockerRun(t, "postgres:13", "5432",
+		"POSTGRES_USER=registry", "POSTGRES_PASSWORD=registry", "POSTGRES_DB=registry") + "/registry?sslmode=disable"
+	memcached := dockerRun(t, "memcached:1.6", "11211")
+	migrate(t, databaseURL)
+
+	for key, value := range map[string]string{"DATABASE_URL": databaseURL, "MEMCACHEDCLOUD_SERVERS": memcached} {
+		old, set := os.LookupEnv(key)
+		os.Setenv(key, value)
+		defer func(key string) {
+			if set {
+				os.Setenv(key, old)
+			} else {
+				os.Unsetenv(key)
+			}
+		}(key)
+	}
+	store, err := OpenStore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	cache, err := ConnectCache()
+	if err != nil {
+		t.Fatal(err)
+	}
+	testAPI(t, store, cache)
+}
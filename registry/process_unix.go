@@ -0,0 +1,48 @@
+//go:build !windows
+// +build !windows
+
+package registry
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReload relays SIGUSR1 to c, see reloadOnSignal.
+func notifyReload(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR1)
+}
+
+// notifyUpgrade relays SIGUSR2 to c, see upgradeOnSignal.
+func notifyUpgrade(c chan<- os.Signal) {
+	signal.Notify(c, syscall.SIGUSR2)
+}
+
+// terminateProcess asks the process pid to stop.
+func terminateProcess(pid int) {
+	syscall.Kill(pid, syscall.SIGTERM)
+}
+
+// signalProcessGroup sends SIGTERM, or with kill SIGKILL, to the process
+// group led by p.
+func signalProcessGroup(p *os.Process, kill bool) {
+	sig := syscall.SIGTERM
+	if kill {
+		sig = syscall.SIGKILL
+	}
+	syscall.Kill(-p.Pid, sig)
+}
+
+func closeOnExec(fd int) {
+	syscall.CloseOnExec(fd)
+}
+
+// openFileLimit returns the soft limit of open files, or 0 if unknown.
+func openFileLimit() int {
+	var limit syscall.Rlimit
+	if syscall.Getrlimit(syscall.RLIMIT_NOFILE, &limit) != nil {
+		return 0
+	}
+	return int(limit.Cur)
+}
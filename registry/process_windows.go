@@ -0,0 +1,23 @@
+package registry
+
+import "os"
+
+// Windows has neither SIGUSR1 and SIGUSR2 nor process groups to signal, so
+// caches are only reloaded through the admin API, deploys without downtime
+// aren't available and node is killed outright.
+
+func notifyReload(c chan<- os.Signal) {}
+
+func notifyUpgrade(c chan<- os.Signal) {}
+
+func terminateProcess(pid int) {}
+
+func signalProcessGroup(p *os.Process, kill bool) {
+	p.Kill()
+}
+
+func closeOnExec(fd int) {}
+
+func openFileLimit() int {
+	return 0
+}
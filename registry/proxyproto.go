@@ -0,0 +1,228 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Behind a TCP load balancer every connection comes from the balancer. With
+// PROXY_PROTOCOL set, listeners expect the PROXY protocol header (v1 or v2)
+// the balancer sends first and take the client address from it, so
+// RemoteAddr, and with it rate limits, IP filters and logs, see the real
+// client. When TRUSTED_PROXIES is set, only connections from those
+// networks may send the header; others are served as they are.
+
+// proxyHeaderTimeout bounds the wait for the header of a new connection.
+const proxyHeaderTimeout = 10 * time.Second
+
+var proxySignatureV2 = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+var errProxyHeader = errors.New("invalid PROXY protocol header")
+
+// parseProxyProtocol reads PROXY_PROTOCOL: true for every listener or the
+// addresses of the listeners that expect the header.
+func parseProxyProtocol(value string, listeners []listenerConfig) (map[string]bool, error) {
+	enabled := map[string]bool{}
+	switch value = strings.TrimSpace(value); value {
+	case "", "false":
+		return enabled, nil
+	case "true":
+		for _, l := range listeners {
+			enabled[l.addr] = true
+		}
+		return enabled, nil
+	}
+	known := map[string]bool{}
+	for _, l := range listeners {
+		known[l.addr] = true
+	}
+	for _, addr := range strings.Split(value, ",") {
+		addr = strings.TrimSpace(addr)
+		if !known[addr] {
+			return nil, fmt.Errorf("%s is not a listener", addr)
+		}
+		enabled[addr] = true
+	}
+	return enabled, nil
+}
+
+// acceptProxyProtocol wraps the sockets of the listeners PROXY_PROTOCOL
+// names.
+func acceptProxyProtocol(listeners []listenerConfig, lns []net.Listener) error {
+	enabled, err := parseProxyProtocol(getEnv("PROXY_PROTOCOL", ""), listeners)
+	if err != nil {
+		return fmt.Errorf("Invalid PROXY_PROTOCOL: %s", err)
+	}
+	trusted, err := parseCIDRs(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		return fmt.Errorf("Invalid TRUSTED_PROXIES: %s", err)
+	}
+	for i, l := range listeners {
+		if enabled[l.addr] {
+			lns[i] = &proxyListener{Listener: lns[i], trusted: trusted}
+		}
+	}
+	return nil
+}
+
+type proxyListener struct {
+	net.Listener
+	trusted []*net.IPNet
+}
+
+func (l *proxyListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	if len(l.trusted) > 0 && !inNetworks(l.trusted, host) {
+		return conn, nil
+	}
+	return &proxyConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+}
+
+// File returns the socket for handing it to a new process.
+func (l *proxyListener) File() (*os.File, error) {
+	fl, ok := l.Listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return nil, errors.New("listener has no file")
+	}
+	return fl.File()
+}
+
+// proxyConn reads the header on first use, in the goroutine serving the
+// connection rather than the one accepting them.
+type proxyConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once   sync.Once
+	remote net.Addr
+	err    error
+}
+
+func (c *proxyConn) readHeader() {
+	c.once.Do(func() {
+		c.Conn.SetReadDeadline(time.Now().Add(proxyHeaderTimeout))
+		c.remote, c.err = readProxyHeader(c.reader)
+		c.Conn.SetReadDeadline(time.Time{})
+		if c.err == nil && c.remote == nil {
+			c.remote = c.Conn.RemoteAddr()
+		}
+	})
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	if c.remote == nil {
+		return c.Conn.RemoteAddr()
+	}
+	return c.remote
+}
+
+// readProxyHeader parses a v1 or v2 header. It returns a nil address for
+// connections the balancer makes itself, e.g. health checks.
+func readProxyHeader(r *bufio.Reader) (net.Addr, error) {
+	peek, err := r.Peek(len(proxySignatureV2))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(peek, proxySignatureV2) {
+		return readProxyHeaderV2(r)
+	}
+	if !bytes.HasPrefix(peek, []byte("PROXY ")) {
+		return nil, errProxyHeader
+	}
+	return readProxyHeaderV1(r)
+}
+
+// readProxyHeaderV1 parses "PROXY TCP4 src dst sport dport\r\n".
+func readProxyHeaderV1(r *bufio.Reader) (net.Addr, error) {
+	var line []byte
+	for len(line) < 107 {
+		b, err := r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+		if b == '\n' {
+			break
+		}
+	}
+	if !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errProxyHeader
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 65535 {
+		return nil, errProxyHeader
+	}
+	return &net.TCPAddr{IP: unmapIP(ip), Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[12]>>4 != 2 {
+		return nil, errProxyHeader
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[14:16]))
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	if header[12]&0xf == 0 {
+		// LOCAL: the balancer's own connection.
+		return nil, nil
+	}
+	switch header[13] >> 4 {
+	case 1:
+		if len(body) < 12 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if len(body) < 36 {
+			return nil, errProxyHeader
+		}
+		return &net.TCPAddr{IP: unmapIP(net.IP(body[0:16])), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	// Unix sockets and unspecified families carry no client IP.
+	return nil, nil
+}
+
+// unmapIP turns IPv4-mapped IPv6 addresses into IPv4 ones, so a client
+// has the same address whichever way a dual-stack balancer reports it.
+func unmapIP(ip net.IP) net.IP {
+	if v4 := ip.To4(); v4 != nil {
+		return v4
+	}
+	return ip
+}
@@ -0,0 +1,100 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// API keys with the publish scope register packages within quotas, so an
+// automated squatting run stops after a few names: a key registering more
+// than its daily quota of packages in a UTC day gets 429 until the day is
+// over, and one that registered its total quota of packages still
+// registered gets 403. Keys without quotas of their own have
+// PUBLISH_DAILY_QUOTA (default 20) and PUBLISH_TOTAL_QUOTA (default 0, no
+// limit). The quota is charged before the registration is let through, so
+// concurrent registrations can't overshoot it, and given back when it fails.
+// Registrations without a key have no limit, unless PUBLISH_REQUIRES_KEY=true
+// makes only admins and keys with the publish scope register packages at all.
+
+// publicationPending is how long a charge counts against the total quota
+// before the package is registered, long enough for any registration to
+// finish.
+const publicationPending = 10 * time.Minute
+
+// publishQuotas returns the quotas of k, 0 being no limit.
+func (s *Server) publishQuotas(k APIKey) (daily, total int) {
+	daily, total = k.DailyQuota, k.TotalQuota
+	if daily == 0 {
+		daily = s.config.publishDailyQuota
+	}
+	if total == 0 {
+		total = s.config.publishTotalQuota
+	}
+	return daily, total
+}
+
+// checkPublishQuota returns the response refusing the registration of name
+// by r, or nil to let it through.
+func (s *Server) checkPublishQuota(r *http.Request, ctx *goproxy.ProxyCtx, name string) *http.Response {
+	if s.isAdmin(r) {
+		return nil
+	}
+	k, ok, err := s.requestAPIKey(r)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !ok || !containsString(k.Scopes, scopePublish) {
+		if s.config.publishRequiresKey {
+			return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Registering packages requires an API key with the publish scope")
+		}
+		return nil
+	}
+
+	daily, total := s.publishQuotas(k)
+	// Stores keep microseconds, which the charge is given back by.
+	now := time.Now().UTC().Truncate(time.Microsecond)
+	day := now.Truncate(24 * time.Hour)
+	recent, registered, ok, err := s.store.ReservePublication(k.Name, name, now, day, now.Add(-publicationPending), daily, total)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !ok && total > 0 && registered >= total {
+		metrics.Add("publish_quota_exceeded", 1)
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden,
+			fmt.Sprintf("API key %s has registered %d packages, its quota; remove some or ask an admin for a higher quota", k.Name, registered))
+	}
+	if !ok {
+		metrics.Add("publish_quota_exceeded", 1)
+		response := goproxy.NewResponse(r, "text/html", http.StatusTooManyRequests,
+			fmt.Sprintf("API key %s has registered %d packages today, its daily quota; try again tomorrow (UTC)", k.Name, recent))
+		response.Header.Set("Retry-After", strconv.Itoa(int(day.Add(24*time.Hour).Sub(now)/time.Second)+1))
+		return response
+	}
+	reg := registrationOf(ctx)
+	reg.name, reg.apiKey, reg.chargedAt = name, k.Name, now
+	return nil
+}
+
+// settlePublication gives the charge of a registration back unless the
+// package was registered.
+func (s *Server) settlePublication(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if resp == nil || resp.StatusCode != http.StatusCreated {
+		s.releasePublication(ctx)
+	}
+	return resp
+}
+
+func (s *Server) releasePublication(ctx *goproxy.ProxyCtx) {
+	reg, ok := ctx.UserData.(*registration)
+	if !ok || reg.apiKey == "" {
+		return
+	}
+	if err := s.store.ReleasePublication(reg.apiKey, reg.name, reg.chargedAt); err != nil {
+		packageLog.Errorf("Could not give API key %s the charge of %s back: %s", reg.apiKey, reg.name, err)
+	}
+	reg.apiKey = ""
+}
@@ -0,0 +1,77 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/elazarl/goproxy"
+)
+
+// In read-only mode lookups keep working while every write is refused with
+// 503, e.g. during database migrations. It starts from READ_ONLY and can be
+// switched at runtime through the admin API. Switches are broadcast like
+// cache invalidations, so every instance sharing the store follows them;
+// instances started later begin from READ_ONLY again.
+
+const defaultReadOnlyMessage = "The registry is in read-only mode for maintenance. Please try again later."
+
+type readOnlyMode struct {
+	ReadOnly bool   `json:"read_only"`
+	Message  string `json:"message"`
+}
+
+func (s *Server) readOnly() (bool, string) {
+	s.maintenanceMu.RLock()
+	defer s.maintenanceMu.RUnlock()
+	return s.maintenance.ReadOnly, s.maintenance.Message
+}
+
+// readOnlyHandler must run before any handler that writes. Only the admin
+// endpoint that turns read-only mode off, and signing in to reach it, get
+// through.
+func (s *Server) readOnlyHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return r, nil
+	}
+	// GraphQL queries are posted but never write.
+	if r.URL.Path == "/admin/read-only" || r.URL.Path == "/admin/login" || r.URL.Path == "/graphql" {
+		return r, nil
+	}
+	readOnly, message := s.readOnly()
+	if !readOnly {
+		return r, nil
+	}
+	response := goproxy.NewResponse(r, "text/plain", http.StatusServiceUnavailable, message)
+	response.Header.Set("Retry-After", "300")
+	return r, response
+}
+
+func (s *Server) getReadOnly(r *http.Request) *http.Response {
+	s.maintenanceMu.RLock()
+	mode := s.maintenance
+	s.maintenanceMu.RUnlock()
+	return jsonResponse(r, http.StatusOK, mode)
+}
+
+func (s *Server) setReadOnly(r *http.Request) *http.Response {
+	var req readOnlyMode
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if req.Message == "" {
+		req.Message = defaultReadOnlyMessage
+	}
+	s.switchReadOnly(req)
+	if err := s.invalidate(invalidation{ReadOnly: &req}); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Could not publish read-only mode")
+	}
+	return jsonResponse(r, http.StatusOK, req)
+}
+
+// switchReadOnly applies a read-only mode to this instance.
+func (s *Server) switchReadOnly(mode readOnlyMode) {
+	s.maintenanceMu.Lock()
+	s.maintenance = mode
+	s.maintenanceMu.Unlock()
+}
@@ -0,0 +1,297 @@
+package registry
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With RECORD_PERCENT set, that share of requests is recorded with its
+// response into a ring buffer of the last RECORD_BUFFER exchanges, shown
+// newest first at GET /admin/recordings. It is meant for debugging odd
+// client behaviour in production: credentials in headers and query strings
+// are redacted, bodies are cut at recordBodyLimit, and event streams,
+// CONNECT tunnels and the admin API aren't recorded.
+
+const recordBodyLimit = 16 << 10
+
+const redacted = "[redacted]"
+
+// RecordedExchange is a request and the response it got.
+type RecordedExchange struct {
+	At       time.Time        `json:"at"`
+	Duration float64          `json:"duration_ms"`
+	ClientIP string           `json:"client_ip"`
+	Request  RecordedRequest  `json:"request"`
+	Response RecordedResponse `json:"response"`
+}
+
+type RecordedRequest struct {
+	Method    string      `json:"method"`
+	URL       string      `json:"url"`
+	Header    http.Header `json:"header"`
+	Body      string      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+type RecordedResponse struct {
+	Status    int         `json:"status"`
+	Header    http.Header `json:"header"`
+	Body      string      `json:"body,omitempty"`
+	Truncated bool        `json:"truncated,omitempty"`
+}
+
+type trafficRecorder struct {
+	percent float64
+
+	mu        sync.Mutex
+	exchanges []RecordedExchange
+	next      int
+	full      bool
+}
+
+func newTrafficRecorder(percent float64, size int) *trafficRecorder {
+	return &trafficRecorder{percent: percent, exchanges: make([]RecordedExchange, size)}
+}
+
+func (t *trafficRecorder) add(e RecordedExchange) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exchanges[t.next] = e
+	t.next = (t.next + 1) % len(t.exchanges)
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+// recent returns up to limit exchanges, newest first.
+func (t *trafficRecorder) recent(limit int) []RecordedExchange {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	n := t.next
+	if t.full {
+		n = len(t.exchanges)
+	}
+	if limit > n {
+		limit = n
+	}
+	recent := make([]RecordedExchange, 0, limit)
+	for i := 1; i <= limit; i++ {
+		recent = append(recent, t.exchanges[(t.next-i+len(t.exchanges))%len(t.exchanges)])
+	}
+	return recent
+}
+
+func (t *trafficRecorder) clear() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.exchanges = make([]RecordedExchange, len(t.exchanges))
+	t.next, t.full = 0, false
+}
+
+// secretName reports whether a header or parameter name suggests its value
+// is a credential.
+func secretName(name string) bool {
+	name = strings.ToLower(name)
+	for _, s := range []string{"authorization", "cookie", "token", "secret", "password", "api-key", "api_key", "apikey", "signature"} {
+		if strings.Contains(name, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func redactHeader(h http.Header) http.Header {
+	copied := http.Header{}
+	for name, values := range h {
+		if secretName(name) {
+			copied[name] = []string{redacted}
+			continue
+		}
+		copied[name] = append([]string(nil), values...)
+	}
+	return copied
+}
+
+func redactURL(u *url.URL) string {
+	copied := *u
+	query := copied.Query()
+	for name := range query {
+		if secretName(name) {
+			query.Set(name, redacted)
+		}
+	}
+	copied.RawQuery = query.Encode()
+	copied.User = nil
+	return copied.String()
+}
+
+// recordBody returns the start of a body and whether it was cut. Form and
+// JSON fields with credential names are redacted.
+func recordBody(contentType string, data []byte) (string, bool) {
+	truncated := len(data) > recordBodyLimit
+	if truncated {
+		data = data[:recordBodyLimit]
+	}
+	if strings.HasPrefix(contentType, "application/x-www-form-urlencoded") && !truncated {
+		if form, err := url.ParseQuery(string(data)); err == nil {
+			for name := range form {
+				if secretName(name) {
+					form.Set(name, redacted)
+				}
+			}
+			return form.Encode(), false
+		}
+	}
+	body := string(data)
+	if strings.Contains(contentType, "json") {
+		body = redactJSONSecrets(body)
+	}
+	return body, truncated
+}
+
+// redactJSONSecrets blanks the string values of fields with credential
+// names, e.g. "token":"abc" becomes "token":"[redacted]", without parsing,
+// since bodies may be cut.
+func redactJSONSecrets(body string) string {
+	var out strings.Builder
+	for {
+		i := strings.Index(body, `":`)
+		if i < 0 {
+			break
+		}
+		start := strings.LastIndexByte(body[:i], '"')
+		name := body[start+1 : i]
+		out.WriteString(body[:i+2])
+		body = body[i+2:]
+		if !secretName(name) {
+			continue
+		}
+		rest := strings.TrimLeft(body, " \t\r\n")
+		out.WriteString(body[:len(body)-len(rest)])
+		body = rest
+		if !strings.HasPrefix(body, `"`) {
+			continue
+		}
+		end := 1
+		for end < len(body) && body[end] != '"' {
+			if body[end] == '\\' {
+				end++
+			}
+			end++
+		}
+		out.WriteString(`"` + redacted + `"`)
+		if end < len(body) {
+			body = body[end+1:]
+		} else {
+			body = ""
+		}
+	}
+	out.WriteString(body)
+	return out.String()
+}
+
+// recordWriter keeps the start of the response body.
+type recordWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if room := recordBodyLimit + 1 - w.body.Len(); room > 0 {
+		if len(b) < room {
+			room = len(b)
+		}
+		w.body.Write(b[:room])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *recordWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// recordTraffic records a sample of the requests to t.
+func recordTraffic(next http.Handler, t *trafficRecorder, clientIP func(*http.Request) string) http.Handler {
+	if t == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || r.URL.Path == "/events" || strings.HasPrefix(r.URL.Path, "/admin/") || rand.Float64()*100 >= t.percent {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var body []byte
+		if r.Body != nil {
+			// Only the recorded start is buffered; the rest streams on.
+			body, _ = ioutil.ReadAll(io.LimitReader(r.Body, recordBodyLimit+1))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), r.Body), r.Body}
+		}
+		e := RecordedExchange{
+			At:       time.Now(),
+			ClientIP: clientIP(r),
+			Request: RecordedRequest{
+				Method: r.Method,
+				URL:    redactURL(r.URL),
+				Header: redactHeader(r.Header),
+			},
+		}
+		e.Request.Body, e.Request.Truncated = recordBody(r.Header.Get("Content-Type"), body)
+
+		rw := &recordWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+
+		e.Duration = float64(time.Since(e.At)) / float64(time.Millisecond)
+		e.Response.Status = rw.status
+		e.Response.Header = redactHeader(w.Header())
+		e.Response.Body, e.Response.Truncated = recordBody(w.Header().Get("Content-Type"), rw.body.Bytes())
+		t.add(e)
+	})
+}
+
+func (s *Server) listRecordings(r *http.Request) *http.Response {
+	if s.recorder == nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Recording is off, set RECORD_PERCENT")
+	}
+	limit := 50
+	if l := r.URL.Query().Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 1 {
+			return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid limit")
+		}
+	}
+	return jsonResponse(r, http.StatusOK, s.recorder.recent(limit))
+}
+
+func (s *Server) clearRecordings(r *http.Request) *http.Response {
+	if s.recorder == nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Recording is off, set RECORD_PERCENT")
+	}
+	s.recorder.clear()
+	return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+}
@@ -0,0 +1,175 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"time"
+)
+
+// A panic in a request handler is answered with a 500 JSON error instead of
+// a dropped connection, logged with its stack and sent to the error tracker
+// of SENTRY_DSN, if any. Any service that accepts Sentry's store API works,
+// e.g. GlitchTip.
+
+// panicReport is what error trackers get about a panic. URL has no query,
+// which may hold tokens.
+type panicReport struct {
+	Message string
+	Stack   string
+	Method  string
+	URL     string
+	At      time.Time
+}
+
+type errorReporter interface {
+	Report(panicReport) error
+}
+
+// sentryReporter sends panics as events to the store endpoint of a DSN such
+// as https://<key>@sentry.example.com/<project>.
+type sentryReporter struct {
+	endpoint string
+	key      string
+	server   string
+	client   *http.Client
+}
+
+func loadErrorReporter() (errorReporter, error) {
+	dsn := getEnv("SENTRY_DSN", "")
+	if dsn == "" {
+		return nil, nil
+	}
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || u.Host == "" {
+		return nil, fmt.Errorf("Invalid SENTRY_DSN")
+	}
+	i := strings.LastIndex(u.Path, "/")
+	project := u.Path[i+1:]
+	if project == "" {
+		return nil, fmt.Errorf("Invalid SENTRY_DSN: no project")
+	}
+	server, _ := os.Hostname()
+	return sentryReporter{
+		endpoint: u.Scheme + "://" + u.Host + u.Path[:i] + "/api/" + project + "/store/",
+		key:      u.User.Username(),
+		server:   server,
+		client:   &http.Client{Timeout: 10 * time.Second},
+	}, nil
+}
+
+type sentryException struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sentryEvent struct {
+	EventID    string `json:"event_id"`
+	Timestamp  string `json:"timestamp"`
+	Level      string `json:"level"`
+	Platform   string `json:"platform"`
+	Logger     string `json:"logger"`
+	ServerName string `json:"server_name,omitempty"`
+	Message    string `json:"message"`
+	Exception  struct {
+		Values []sentryException `json:"values"`
+	} `json:"exception"`
+	Request struct {
+		Method string `json:"method"`
+		URL    string `json:"url"`
+	} `json:"request"`
+	Extra map[string]string `json:"extra"`
+}
+
+func (s sentryReporter) Report(p panicReport) error {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return err
+	}
+	event := sentryEvent{
+		EventID:    hex.EncodeToString(id),
+		Timestamp:  p.At.UTC().Format("2006-01-02T15:04:05"),
+		Level:      "error",
+		Platform:   "go",
+		Logger:     "registry",
+		ServerName: s.server,
+		Message:    "panic: " + p.Message,
+		Extra:      map[string]string{"stack": p.Stack},
+	}
+	event.Exception.Values = []sentryException{{Type: "panic", Value: p.Message}}
+	event.Request.Method, event.Request.URL = p.Method, p.URL
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=bower-registry/1.0, sentry_key="+s.key)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(resp.Body)
+		return fmt.Errorf("Error tracker returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
+
+// recoverPanics answers requests whose handler panicked with 500, unless
+// the response was already under way, and reports the panic.
+// http.ErrAbortHandler is passed on, since it is how handlers abort a
+// response on purpose.
+func recoverPanics(next http.Handler, reporter errorReporter) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hw := &headerWriter{ResponseWriter: w, before: func(http.Header) {}}
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			p := panicReport{
+				Message: fmt.Sprint(v),
+				Stack:   string(debug.Stack()),
+				Method:  r.Method,
+				URL:     r.URL.Path,
+				At:      time.Now(),
+			}
+			serverLog.Errorf("Panic serving %s %s: %s\n%s", p.Method, p.URL, p.Message, p.Stack)
+			metrics.Add("panics", 1)
+			if reporter != nil {
+				go func() {
+					if err := reporter.Report(p); err != nil {
+						serverLog.Errorf("Could not report panic: %s", err)
+					}
+				}()
+			}
+			if hw.wroteHeader {
+				// Too late for a response of our own; drop the connection
+				// so the client sees the response is cut short.
+				panic(http.ErrAbortHandler)
+			}
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"Internal server error"}` + "\n"))
+		}()
+		next.ServeHTTP(hw, r)
+	})
+}
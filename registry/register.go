@@ -0,0 +1,166 @@
+package registry
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With the sidecar disabled, as the SQLite and memory stores require, the
+// registry registers and unregisters unscoped packages itself, the way the
+// node app does: POST /packages checks the name and that git can reach the
+// repository, and DELETE /packages/{name} takes the GitHub token of a
+// collaborator of the package's repository, or of one of REGISTRY_EDITORS,
+// in access_token. Admins need no token. Scoped packages are left to
+// scopedWriteHandler, and the quota and similar name checks to the handlers
+// before it, as with the sidecar.
+
+var githubClient = &http.Client{Timeout: 10 * time.Second}
+
+// nativeRegistrationPath matches the registrations the sidecar would
+// handle, while it is disabled.
+func nativeRegistrationPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		if !sidecarDisabled {
+			return false
+		}
+		switch req.Method {
+		case http.MethodPost:
+			return req.URL.Path == "/packages"
+		case http.MethodDelete:
+			name := strings.TrimPrefix(req.URL.Path, "/packages/")
+			return name != req.URL.Path && name != "" && !strings.ContainsAny(name, "/@")
+		}
+		return false
+	}
+}
+
+func (s *Server) nativeRegistrationHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if r.Method == http.MethodDelete {
+		return r, s.unregisterPackage(r, strings.TrimPrefix(r.URL.Path, "/packages/"))
+	}
+	return r, s.registerPackage(r)
+}
+
+func (s *Server) registerPackage(r *http.Request) *http.Response {
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid form")
+	}
+	name, url := r.FormValue("name"), normalizeURL(r.FormValue("url"))
+	if err := validatePackageName(name); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid Package Name. "+err.Error())
+	}
+	if err := validateRepositoryURL(url); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL. "+err.Error())
+	}
+	if err := checkURL(url); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL")
+	}
+	switch err := s.store.InsertPackage(name, url); err {
+	case nil:
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Package already registered")
+	case ErrURLTaken:
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Repository already registered as another package")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	packageLog.Infof("Registered %s (%s)", name, url)
+	s.packagesChanged(url)
+	return goproxy.NewResponse(r, "text/html", http.StatusCreated, "")
+}
+
+func (s *Server) unregisterPackage(r *http.Request, name string) *http.Response {
+	p, err := s.store.GetPackage(name)
+	if err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !s.isAdmin(r) {
+		allowed, err := s.canUnregister(r.URL.Query().Get("access_token"), p.URL)
+		if err == errNotOnGitHub {
+			return goproxy.NewResponse(r, "text/html", http.StatusNotImplemented, "Can only unregister packages hosted on GitHub.com")
+		} else if err != nil {
+			packageLog.Errorf("Could not check who may unregister %s: %s", name, err)
+			return goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Error fetching GitHub user info")
+		}
+		if !allowed {
+			return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Repository does not exist or you are not a collaborator of it")
+		}
+	}
+	switch err := s.store.DeletePackage(name); err {
+	case nil:
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	packageLog.Infof("Unregistered %s (%s)", name, p.URL)
+	s.packagesChanged(p.URL)
+	return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+}
+
+var errNotOnGitHub = errors.New("the repository is not on GitHub")
+
+// canUnregister reports whether the GitHub user of token is one of the
+// registry editors or a collaborator of the repository at url. Renamed
+// repositories are followed by the API's redirects.
+func (s *Server) canUnregister(token, url string) (bool, error) {
+	if token == "" {
+		return false, nil
+	}
+	resp, err := s.githubGet(token, "/user")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusUnauthorized {
+		return false, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("GitHub returned %s", resp.Status)
+	}
+	var user struct {
+		Login string `json:"login"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
+		return false, err
+	}
+	for _, editor := range s.config.registryEditors {
+		if strings.EqualFold(editor, user.Login) {
+			return true, nil
+		}
+	}
+	owner, repo, ok := parseGitHubURL(url)
+	if !ok {
+		return false, errNotOnGitHub
+	}
+
+	resp, err = s.githubGet(token, "/repos/"+owner+"/"+repo+"/collaborators/"+user.Login)
+	if err != nil {
+		return false, err
+	}
+	resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return true, nil
+	case http.StatusNotFound, http.StatusForbidden:
+		return false, nil
+	}
+	return false, fmt.Errorf("GitHub returned %s", resp.Status)
+}
+
+func (s *Server) githubGet(token, path string) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodGet, s.config.githubAPI+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("Authorization", "token "+token)
+	return githubClient.Do(req)
+}
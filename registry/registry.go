@@ -0,0 +1,505 @@
+// Package registry is the Bower registry server. Main runs it as the
+// registry command does; other Go services can serve the API themselves:
+//
+//	store, err := registry.OpenStore()
+//	cache, err := registry.ConnectCache()
+//	cfg, err := registry.LoadServerConfig()
+//	http.Handle("/", registry.NewServer(store, cache, cfg))
+package registry
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+func urlHasPrefix(prefix string) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		isGET := req.Method == http.MethodGet
+		hasPrefix := strings.HasPrefix(req.URL.Path, prefix)
+		isSearch := strings.HasPrefix(req.URL.Path, "/packages/search/")
+		return isGET && hasPrefix && !isSearch
+	}
+}
+
+func pathIs(path string) goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && req.URL.Path == path
+	}
+}
+
+func getEnv(key, def string) string {
+	k := os.Getenv(key)
+	if k == "" {
+		return def
+	}
+	return k
+}
+
+// Main runs the registry command: the web server, or the subcommand named
+// by the first argument.
+func Main() {
+	if len(os.Args) > 1 && !strings.HasPrefix(os.Args[1], "-") {
+		switch os.Args[1] {
+		case "export":
+			runExport(os.Args[2:])
+		case "backup":
+			runBackup(os.Args[2:])
+		case "restore":
+			runRestore(os.Args[2:])
+		case "tenant":
+			runTenant(os.Args[2:])
+		case "org":
+			runOrg(os.Args[2:])
+		case "mirror":
+			runMirror(os.Args[2:])
+		case "dump":
+			runDump(os.Args[2:])
+		case "load":
+			runLoad(os.Args[2:])
+		case "replay":
+			runReplay(os.Args[2:])
+		default:
+			log.Fatalf("Unknown command: %s", os.Args[1])
+		}
+		return
+	}
+
+	warm := flag.Bool("warm", false, "fill caches and wait for the sidecar before accepting requests")
+	flag.Parse()
+	serve(*warm, nil)
+}
+
+// serve runs the web server until the process is stopped. start, if set,
+// is called once the server is set up, before it accepts requests.
+func serve(warm bool, start func(*Server)) {
+	if err := configureLogging(); err != nil {
+		log.Fatal(err)
+	}
+	cache, err := ConnectCache()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	listeners, err := parseListeners(getEnv("LISTEN", ""), getEnv("PORT", "3000"))
+	if err != nil {
+		log.Fatalf("Invalid LISTEN: %s", err)
+	}
+	shutdownTimeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "20s"))
+	if err != nil {
+		log.Fatalf("Invalid SHUTDOWN_TIMEOUT: %s", err)
+	}
+	lns, err := openListeners(listeners, getEnv("REUSE_PORT", "") == "true")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := acceptProxyProtocol(listeners, lns); err != nil {
+		log.Fatal(err)
+	}
+	servers := newHTTPServers()
+
+	store, err := OpenStore()
+	var degraded []*degradedHandler
+	if err != nil {
+		dbLog.Errorf("Connection error: %s, serving degraded responses until the database is up", err)
+		for i, l := range listeners {
+			h := &degradedHandler{cache: cache, role: l.role}
+			servers.start(lns[i], h)
+			degraded = append(degraded, h)
+		}
+		store = openStoreRetrying()
+	}
+	defer store.Close()
+	go func() {
+		// Serving never returns normally, so close the store here to let
+		// the in-memory store write its file.
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		serverLog.Infof("Shutting down")
+		servers.shutdown(shutdownTimeout)
+		stopSidecar(shutdownTimeout)
+		store.Close()
+		os.Exit(0)
+	}()
+	upgradeOnSignal(listeners, lns)
+
+	cfg, err := LoadServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if pg, ok := store.(*postgresStore); ok && cfg.nativeSearch {
+		pg.ensureSearchIndexes()
+	}
+	mail, err := loadOwnerMail(store)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if interval := getEnv("URL_CHECK_INTERVAL", ""); interval != "" {
+		checkInterval, err := time.ParseDuration(interval)
+		if err != nil {
+			log.Fatalf("Invalid URL_CHECK_INTERVAL: %s", err)
+		}
+		checkBackoff, err := time.ParseDuration(getEnv("URL_CHECK_BACKOFF", "1h"))
+		if err != nil {
+			log.Fatalf("Invalid URL_CHECK_BACKOFF: %s", err)
+		}
+		startURLChecker(store, mail, checkInterval, checkBackoff)
+	}
+
+	if err := startDiagnostics(); err != nil {
+		log.Fatal(err)
+	}
+	watchdog, err := loadWatchdogConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	startWatchdog(watchdog, store)
+
+	if err := startGitHubEnricher(store); err != nil {
+		log.Fatal(err)
+	}
+
+	backups, err := loadBackupConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if backups != nil {
+		backupInterval, err := time.ParseDuration(getEnv("BACKUP_INTERVAL", "24h"))
+		if err != nil {
+			log.Fatalf("Invalid BACKUP_INTERVAL: %s", err)
+		}
+		startBackups(backups, store, backupInterval)
+	}
+
+	artifacts, err := loadArtifactCache()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	sidecar, err := loadSidecarConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := startSidecar(sidecar); err != nil {
+		log.Fatal(err)
+	}
+
+	server := NewServer(store, cache, cfg)
+	server.mail = mail
+	server.artifacts = artifacts
+	if err := server.loadTenants(); err != nil {
+		log.Fatalf("Could not load tenants: %s", err)
+	}
+	server.startTenantRefresh(time.Minute)
+	if err := server.loadFeatureFlags(); err != nil {
+		log.Fatalf("Could not load feature flags: %s", err)
+	}
+	server.startFeatureFlagRefresh(time.Minute)
+	server.reloadOnSignal()
+	server.listenForInvalidations()
+	server.listenForEvents()
+	server.startClientStats(time.Minute)
+	server.startDeprecatedTrafficStats(time.Minute)
+	server.startDownloadStats(time.Minute)
+	server.startCDNPurges()
+	server.startAutocomplete()
+	server.startReadFallback()
+	server.startCacheGC()
+	if err := server.startSearchIndex(); err != nil {
+		log.Fatalf("Could not build the search index: %s", err)
+	}
+	if start != nil {
+		start(server)
+	}
+
+	if warm {
+		popular, err := strconv.Atoi(getEnv("WARM_PACKAGES", "100"))
+		if err != nil {
+			log.Fatalf("Invalid WARM_PACKAGES: %s", err)
+		}
+		timeout, err := time.ParseDuration(getEnv("WARM_TIMEOUT", "2m"))
+		if err != nil {
+			log.Fatalf("Invalid WARM_TIMEOUT: %s", err)
+		}
+		if err := server.warmUp(popular, timeout); err != nil {
+			log.Fatalf("Warm-up failed: %s", err)
+		}
+	}
+
+	if degraded != nil {
+		for _, h := range degraded {
+			h.ready(server)
+		}
+	} else {
+		for i, l := range listeners {
+			servers.start(lns[i], server.handlerFor(l.role))
+		}
+	}
+	serverLog.Infof("Serving requests")
+	finishUpgrade()
+	log.Fatal(servers.wait())
+}
+
+type Package struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	// CanonicalName is set when the package was looked up through an alias.
+	CanonicalName string `json:"canonical_name,omitempty"`
+	// CacheTTL overrides the max-age of lookups when set; only GetPackage
+	// fills it in.
+	CacheTTL time.Duration `json:"-"`
+	// Deprecated is set for deprecated packages; only GetPackage fills it
+	// in.
+	Deprecated *Deprecation `json:"deprecated,omitempty"`
+	// Private packages are only found by readers allowed to see them;
+	// only GetPackage and OrganizationPackages fill it in.
+	Private bool `json:"private,omitempty"`
+	// UpdatedAt is when the package last changed, zero when unknown; only
+	// GetPackage fills it in.
+	UpdatedAt time.Time `json:"-"`
+}
+
+func jsonResponse(r *http.Request, status int, v interface{}) *http.Response {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return goproxy.NewResponse(r, "application/json", status, string(data))
+}
+
+// packageMaxAge is the lookup max-age in seconds, a week unless the
+// package sets its own cache_ttl.
+func packageMaxAge(pkg Package) int {
+	if pkg.CacheTTL > 0 {
+		return int(pkg.CacheTTL / time.Second)
+	}
+	return 604800
+}
+
+// lookupPackage finds a package by name or alias. Packages found through an
+// alias keep the alias as their name and have CanonicalName set.
+// Concurrent lookups of a name share one, see coalesce.go, and lookups of
+// hot packages are kept in memory for a few seconds, see hotspot.go.
+func (s *Server) lookupPackage(name string) (Package, error) {
+	if s.hotspots != nil {
+		if pkg, ok := s.hotspots.cached(name); ok {
+			metrics.Add("hot_lookups", 1)
+			return pkg, nil
+		}
+	}
+	pkg, err, shared := s.lookups.do(name, func() (Package, error) {
+		return s.findPackage(name)
+	})
+	if shared {
+		metrics.Add("coalesced_lookups", 1)
+	}
+	if err == nil && s.hotspots != nil {
+		s.hotspots.remember(name, pkg)
+	}
+	return pkg, err
+}
+
+func (s *Server) findPackage(name string) (Package, error) {
+	pkg, err := s.store.GetPackage(name)
+	if err == ErrNotFound {
+		var canonical Package
+		if canonical, err = s.store.ResolveAlias(name); err == nil {
+			// The full record carries the deprecation, visibility, max-age
+			// and modification time.
+			if canonical, err = s.store.GetPackage(canonical.Name); err == nil {
+				pkg = Package{Name: name, URL: canonical.URL, CanonicalName: canonical.Name,
+					CacheTTL: canonical.CacheTTL, Deprecated: canonical.Deprecated, Private: canonical.Private,
+					UpdatedAt: canonical.UpdatedAt}
+			}
+		}
+	}
+	return pkg, err
+}
+
+func (s *Server) getPackage(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if repo, ok := shorthandLookup(r); ok && s.config.shorthandLookups {
+		return r, s.getShorthand(r, repo)
+	}
+	packageName := strings.TrimPrefix(r.URL.Path, "/packages/")
+	if _, _, scoped := parseScopedName(packageName); !scoped {
+		elements := strings.Split(r.URL.Path, "/")
+		packageName = elements[len(elements)-1]
+	}
+
+	pkg, err := s.readPackage(r, packageName)
+	if err != nil {
+		if err == ErrNotFound {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+		}
+		if s.config.readFallbackRefresh > 0 {
+			return r, s.fallbackLookup(r, packageName)
+		}
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	if pkg.CanonicalName != "" {
+		s.downloads.add(pkg.CanonicalName)
+	} else {
+		s.downloads.add(pkg.Name)
+	}
+
+	// Only the plain lookup has a Last-Modified: the extended one carries
+	// GitHub metadata that changes without touching updated_at.
+	extended := s.config.responseFormat.extended(r)
+	var lastModified string
+	if !extended && !pkg.UpdatedAt.IsZero() {
+		lastModified = pkg.UpdatedAt.UTC().Format(http.TimeFormat)
+		if notModifiedSince(r, pkg.UpdatedAt) {
+			response := goproxy.NewResponse(r, "application/json", http.StatusNotModified, "")
+			response.Header.Set("Last-Modified", lastModified)
+			response.Header.Add("Cache-Control", cacheControl(pkg, s.lookupMaxAge(pkg)))
+			response.Header.Add("Vary", "Accept")
+			return r, response
+		}
+	}
+
+	contentType := "application/json"
+	var data []byte
+	if extended {
+		canonical := pkg.Name
+		if pkg.CanonicalName != "" {
+			canonical = pkg.CanonicalName
+		}
+		var details PackageDetails
+		if details, err = s.store.PackageDetails(canonical); err == nil {
+			data, err = s.config.responseFormat.marshalExtended(details, pkg.Name, pkg.CanonicalName)
+		}
+		contentType = mediaTypeV2
+	} else {
+		data, err = json.Marshal(pkg)
+	}
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	response := goproxy.NewResponse(r, contentType, http.StatusOK, string(data))
+	if key := s.config.responseSigningKey; key != nil {
+		response.Header.Set(signatureHeader, responseSignature(key, data))
+	}
+	response.Header.Add("Cache-Control", cacheControl(pkg, s.lookupMaxAge(pkg)))
+	response.Header.Add("Vary", "Accept")
+	if lastModified != "" {
+		response.Header.Set("Last-Modified", lastModified)
+	}
+	if pkg.Deprecated != nil {
+		response.Header.Set("Warning", pkg.Deprecated.warning(pkg.Name))
+	}
+	return r, response
+}
+
+// notModifiedSince reports whether If-Modified-Since is at or after
+// modified, which HTTP dates only carry to the second. If-None-Match takes
+// precedence, and lookups have no ETag to match.
+func notModifiedSince(r *http.Request, modified time.Time) bool {
+	if r.Header.Get("If-None-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(r.Header.Get("If-Modified-Since"))
+	return err == nil && !modified.Truncate(time.Second).After(since)
+}
+
+// packageListTTL matches the expiry the sidecar uses for the package list.
+const packageListTTL = 10 * time.Minute
+
+// listPackages serves the package list from the cache. Once it has expired,
+// the last list is served from packages_stale while one refresh runs in the
+// background. With a cold cache the list is streamed from the store, so
+// concurrent requests don't each hold the whole list in memory. With since,
+// the changes since then are served instead, see delta.go.
+func (s *Server) listPackages(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if r.URL.Query().Get("since") != "" {
+		return r, s.listPackageChanges(r)
+	}
+	cache := s.cacheFor(r)
+	val, err := cache.Get("packages")
+	if err != nil {
+		go s.refresh.Do("packages", s.refreshPackageList)
+		if val, err = cache.Get("packages_stale"); err != nil {
+			return r, s.streamPackages(r)
+		}
+		metrics.Add("packages_stale_served", 1)
+	}
+	response := goproxy.NewResponse(r, "application/json", http.StatusOK, val)
+	response.Header.Add("Cache-Control", "public, max-age=604800")
+	return r, response
+}
+
+// streamPackages writes the package list as a JSON array while it is read
+// from the store. The response has no length and is sent chunked; an error
+// midway cuts it off, which clients see as a broken response.
+func (s *Server) streamPackages(r *http.Request) *http.Response {
+	body, w := io.Pipe()
+	go func() {
+		buf := bufio.NewWriterSize(w, 32*1024)
+		buf.WriteByte('[')
+		first := true
+		err := s.store.EachPackage(func(p Package) error {
+			data, err := json.Marshal(p)
+			if err != nil {
+				return err
+			}
+			if !first {
+				buf.WriteByte(',')
+			}
+			first = false
+			_, err = buf.Write(data)
+			return err
+		})
+		if err == nil {
+			buf.WriteByte(']')
+			err = buf.Flush()
+		}
+		if err != nil && err != io.ErrClosedPipe {
+			serverLog.Warnf("Package list stream error: %s", err)
+		}
+		w.CloseWithError(err)
+	}()
+
+	response := goproxy.NewResponse(r, "application/json", http.StatusOK, "")
+	response.Body = body
+	response.ContentLength = -1
+	response.Header.Add("Cache-Control", "public, max-age=604800")
+	return response
+}
+
+// refreshPackageList rebuilds the cached package list. packages expires like
+// the one written by the sidecar; packages_stale is kept until it is replaced.
+func (s *Server) refreshPackageList() (string, error) {
+	packages, err := s.store.ListPackages()
+	if err != nil {
+		dbLog.Errorf("Package list refresh error: %s", err)
+		return "", err
+	}
+	if packages == nil {
+		packages = []Package{}
+	}
+	data, err := json.Marshal(packages)
+	if err != nil {
+		return "", err
+	}
+	val := string(data)
+	count := strconv.Itoa(len(packages))
+	s.cache.Set("packages", val, packageListTTL)
+	s.cache.Set("packages_stale", val, 0)
+	s.cache.Set("packages_count", count, packageListTTL)
+	s.cacheKeys.add("packages", len(val), packageListTTL)
+	s.cacheKeys.add("packages_stale", len(val), 0)
+	s.cacheKeys.add("packages_count", len(count), packageListTTL)
+	return val, nil
+}
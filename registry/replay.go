@@ -0,0 +1,297 @@
+package registry
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// replay sends recorded traffic to another instance, to load test changes
+// to the cache and database layers with real request patterns. It reads
+// exchanges saved from GET /admin/recordings (a JSON array or one exchange
+// per line) or access logs, in the Common or Combined Log Format of nginx
+// and Apache or the format of Heroku's router.
+//
+// Only GET and HEAD requests are replayed unless -writes is given, and
+// redacted headers are dropped, so replaying production traffic against a
+// staging instance doesn't register packages or act with stale credentials.
+
+var (
+	// "GET /packages/jquery HTTP/1.1" in Common and Combined Log Format.
+	commonLogRequest = regexp.MustCompile(`"([A-Z]+) (\S+) HTTP/[0-9.]+"`)
+	// method=GET path="/packages/jquery" in Heroku router logs.
+	herokuLogMethod = regexp.MustCompile(`\bmethod=([A-Z]+)\b`)
+	herokuLogPath   = regexp.MustCompile(`\bpath="([^"]*)"`)
+)
+
+// hopHeaders aren't replayed; the client sets them for its own connection.
+var hopHeaders = map[string]bool{
+	"Connection":        true,
+	"Content-Length":    true,
+	"Host":              true,
+	"Keep-Alive":        true,
+	"Transfer-Encoding": true,
+	"Upgrade":           true,
+}
+
+type replayRequest struct {
+	method string
+	uri    string
+	header http.Header
+	body   string
+}
+
+// readReplayRequests reads recorded exchanges or access log lines from r.
+// Lines that aren't requests are skipped and counted.
+func readReplayRequests(r io.Reader) ([]replayRequest, int, error) {
+	br := bufio.NewReader(r)
+	first, err := br.Peek(1)
+	for err == nil && (first[0] == ' ' || first[0] == '\t' || first[0] == '\r' || first[0] == '\n') {
+		br.ReadByte()
+		first, err = br.Peek(1)
+	}
+	if err == io.EOF {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if first[0] == '[' {
+		var exchanges []RecordedExchange
+		if err := json.NewDecoder(br).Decode(&exchanges); err != nil {
+			return nil, 0, err
+		}
+		var requests []replayRequest
+		for _, e := range exchanges {
+			requests = append(requests, recordedRequest(e.Request))
+		}
+		return requests, 0, nil
+	}
+
+	var requests []replayRequest
+	skipped := 0
+	scanner := bufio.NewScanner(br)
+	scanner.Buffer(make([]byte, 64<<10), 4<<20)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if req, ok := parseReplayLine(line); ok {
+			requests = append(requests, req)
+		} else {
+			skipped++
+		}
+	}
+	return requests, skipped, scanner.Err()
+}
+
+func parseReplayLine(line string) (replayRequest, bool) {
+	if strings.HasPrefix(line, "{") {
+		var e RecordedExchange
+		if err := json.Unmarshal([]byte(line), &e); err != nil || e.Request.Method == "" {
+			return replayRequest{}, false
+		}
+		return recordedRequest(e.Request), true
+	}
+	if m := commonLogRequest.FindStringSubmatch(line); m != nil {
+		return replayRequest{method: m[1], uri: m[2]}, true
+	}
+	method, path := herokuLogMethod.FindStringSubmatch(line), herokuLogPath.FindStringSubmatch(line)
+	if method != nil && path != nil {
+		return replayRequest{method: method[1], uri: path[1]}, true
+	}
+	return replayRequest{}, false
+}
+
+func recordedRequest(rec RecordedRequest) replayRequest {
+	req := replayRequest{method: rec.Method, uri: rec.URL, header: http.Header{}}
+	if u, err := url.Parse(rec.URL); err == nil {
+		req.uri = u.RequestURI()
+	}
+	for name, values := range rec.Header {
+		if hopHeaders[http.CanonicalHeaderKey(name)] || (len(values) == 1 && values[0] == redacted) {
+			continue
+		}
+		req.header[name] = values
+	}
+	if !rec.Truncated {
+		req.body = rec.Body
+	}
+	return req
+}
+
+// replayReport sums up the responses of a replay.
+type replayReport struct {
+	mu        sync.Mutex
+	statuses  map[int]int
+	errors    int
+	firstErr  error
+	durations []time.Duration
+}
+
+func (r *replayReport) add(status int, d time.Duration, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err != nil {
+		r.errors++
+		if r.firstErr == nil {
+			r.firstErr = err
+		}
+		return
+	}
+	r.statuses[status]++
+	r.durations = append(r.durations, d)
+}
+
+func (r *replayReport) print(w io.Writer, elapsed time.Duration) {
+	sort.Slice(r.durations, func(i, j int) bool { return r.durations[i] < r.durations[j] })
+	n := len(r.durations)
+	fmt.Fprintf(w, "%d responses, %d errors in %s (%.1f req/s)\n", n, r.errors, elapsed.Round(time.Millisecond), float64(n+r.errors)/elapsed.Seconds())
+	var statuses []int
+	for status := range r.statuses {
+		statuses = append(statuses, status)
+	}
+	sort.Ints(statuses)
+	if r.firstErr != nil {
+		fmt.Fprintf(w, "  first error: %s\n", r.firstErr)
+	}
+	for _, status := range statuses {
+		fmt.Fprintf(w, "  %d: %d\n", status, r.statuses[status])
+	}
+	if n == 0 {
+		return
+	}
+	at := func(q float64) time.Duration { return r.durations[int(q*float64(n-1))] }
+	fmt.Fprintf(w, "latency p50 %s, p90 %s, p99 %s, max %s\n", at(0.5), at(0.9), at(0.99), r.durations[n-1])
+}
+
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	target := flags.String("target", "", "base URL of the instance to replay against")
+	concurrency := flags.Int("concurrency", 10, "requests in flight at once")
+	rate := flags.Float64("rate", 0, "requests per second at most, 0 for as fast as possible")
+	timeout := flags.Duration("timeout", 30*time.Second, "timeout of each request")
+	writes := flags.Bool("writes", false, "also replay requests other than GET and HEAD")
+	token := flags.String("token", "", "bearer token sent with every request")
+	host := flags.String("host", "", "Host header to send, e.g. registry.bower.io for a target that redirects other hosts")
+	flags.Parse(args)
+	if *target == "" {
+		log.Fatal("replay needs -target")
+	}
+	base, err := url.Parse(strings.TrimSuffix(*target, "/"))
+	if err != nil || base.Scheme == "" || base.Host == "" {
+		log.Fatalf("Invalid target %q", *target)
+	}
+	if *concurrency < 1 {
+		log.Fatal("-concurrency must be at least 1")
+	}
+
+	in := os.Stdin
+	if flags.NArg() > 0 {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+	requests, skipped, err := readReplayRequests(in)
+	if err != nil {
+		log.Fatalf("Could not read requests: %s", err)
+	}
+	if skipped > 0 {
+		log.Printf("Skipped %d lines that aren't requests", skipped)
+	}
+	if !*writes {
+		kept := requests[:0]
+		for _, req := range requests {
+			if req.method == http.MethodGet || req.method == http.MethodHead {
+				kept = append(kept, req)
+			}
+		}
+		if dropped := len(requests) - len(kept); dropped > 0 {
+			log.Printf("Skipped %d writes, replay them with -writes", dropped)
+		}
+		requests = kept
+	}
+	log.Printf("Replaying %d requests against %s", len(requests), base)
+
+	client := &http.Client{
+		Timeout:   *timeout,
+		Transport: &http.Transport{MaxIdleConnsPerHost: *concurrency},
+		// Redirects are measured as responses of their own.
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+	var tick <-chan time.Time
+	if *rate > 0 {
+		ticker := time.NewTicker(time.Duration(float64(time.Second) / *rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	report := &replayReport{statuses: map[int]int{}}
+	queue := make(chan replayRequest)
+	var wg sync.WaitGroup
+	for i := 0; i < *concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for req := range queue {
+				status, d, err := sendReplayRequest(client, base, req, *host, *token)
+				report.add(status, d, err)
+			}
+		}()
+	}
+	start := time.Now()
+	for _, req := range requests {
+		if tick != nil {
+			<-tick
+		}
+		queue <- req
+	}
+	close(queue)
+	wg.Wait()
+	report.print(os.Stdout, time.Since(start))
+}
+
+func sendReplayRequest(client *http.Client, base *url.URL, req replayRequest, host, token string) (int, time.Duration, error) {
+	if !strings.HasPrefix(req.uri, "/") {
+		req.uri = "/" + req.uri
+	}
+	r, err := http.NewRequest(req.method, base.String()+req.uri, bytes.NewReader([]byte(req.body)))
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, values := range req.header {
+		r.Header[name] = values
+	}
+	if host != "" {
+		r.Host = host
+	}
+	if token != "" {
+		r.Header.Set("Authorization", "Bearer "+token)
+	}
+	start := time.Now()
+	resp, err := client.Do(r)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
@@ -0,0 +1,68 @@
+package registry
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Resolution is the version of a package that satisfies a range, with its
+// archive URLs when the repository is on GitHub.
+type Resolution struct {
+	Name    string `json:"name"`
+	Range   string `json:"range"`
+	Version string `json:"version"`
+	Tag     string `json:"tag"`
+	Tarball string `json:"tarball,omitempty"`
+	Zip     string `json:"zip,omitempty"`
+}
+
+func resolvePath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/") && strings.HasSuffix(req.URL.Path, "/resolve")
+	}
+}
+
+// resolveVersion serves /packages/{name}/resolve?range=^1.2.0 from the
+// repository's tags. Without a range, or with "latest", it resolves the
+// latest version.
+func (s *Server) resolveVersion(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/packages/"), "/resolve")
+	spec := strings.TrimSpace(r.URL.Query().Get("range"))
+	if spec == "latest" {
+		spec = ""
+	}
+	rng, err := parseRange(spec)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid range")
+	}
+	pkg, err := s.readPackage(r, name)
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	versions, err := repoVersions(pkg.URL)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not list repository tags")
+	}
+
+	var v Version
+	var ok bool
+	if spec == "" {
+		v, ok = latestVersion(versions)
+	} else {
+		v, ok = rng.maxSatisfying(versions)
+	}
+	if !ok {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "No version matches the range")
+	}
+
+	res := Resolution{Name: name, Range: spec, Version: v.String(), Tag: v.Tag}
+	res.Tarball, _ = githubArchiveURL(pkg.URL, "tar.gz", v.Tag)
+	res.Zip, _ = githubArchiveURL(pkg.URL, "zip", v.Tag)
+	response := jsonResponse(r, http.StatusOK, res)
+	response.Header.Set("Cache-Control", cacheControl(pkg, int(tagCacheTTL.Seconds())))
+	return r, response
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package registry
+
+import (
+	"errors"
+	"syscall"
+)
+
+func setReusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("REUSE_PORT is only supported on Linux")
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	defaultSearchLimit = 30
+	maxSearchLimit     = 1000
+	defaultPrefixLimit = 20
+	maxPrefixLimit     = 100
+)
+
+// SearchResult is a package matched by search with its relevance score.
+type SearchResult struct {
+	Name  string  `json:"name"`
+	URL   string  `json:"url"`
+	Score float64 `json:"score"`
+}
+
+func searchLimit(r *http.Request) int {
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		return defaultSearchLimit
+	}
+	if limit > maxSearchLimit {
+		return maxSearchLimit
+	}
+	return limit
+}
+
+var (
+	searchCacheHits   = new(expvar.Int)
+	searchCacheMisses = new(expvar.Int)
+)
+
+func init() {
+	metrics.Set("search_cache_hits", searchCacheHits)
+	metrics.Set("search_cache_misses", searchCacheMisses)
+}
+
+// normalizeQuery lowercases a search term and collapses whitespace, so
+// "jQuery ", "jquery" and "JQUERY" share one cache entry.
+func normalizeQuery(term string) string {
+	return strings.Join(strings.Fields(strings.ToLower(term)), " ")
+}
+
+func searchCacheKey(term string, limit int) string {
+	sum := sha256.Sum256([]byte(term))
+	return "search:" + strconv.Itoa(limit) + ":" + hex.EncodeToString(sum[:])
+}
+
+// searchesNatively reports whether the registry serves searches itself,
+// with NATIVE_SEARCH or the in-memory index of SEARCH_INDEX_REFRESH, rather
+// than the node process.
+func (s *Server) searchesNatively() bool {
+	return s.config.nativeSearch || s.config.searchIndexRefresh > 0
+}
+
+// searchPackages serves /packages/search/{term} with the same response
+// format as the node implementation. Results are cached for searchCacheTTL,
+// since a few popular queries dominate traffic. The in-memory index, when
+// there is one, answers without either. With the native_search flag off
+// the node process answers instead.
+func (s *Server) searchPackages(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !s.flags.on("native_search") {
+		return r, nil
+	}
+	term := normalizeQuery(strings.TrimPrefix(r.URL.Path, "/packages/search/"))
+	limit := searchLimit(r)
+	if index := s.search.get(); index != nil {
+		return r, jsonResponse(r, http.StatusOK, index.search(term, limit))
+	}
+
+	key := searchCacheKey(term, limit)
+	cache := s.cacheFor(r)
+	if s.config.searchCacheTTL > 0 {
+		if val, err := cache.Get(key); err == nil {
+			searchCacheHits.Add(1)
+			cacheLog.Debugf("Hit %s for search %q", key, term)
+			return r, goproxy.NewResponse(r, "application/json", http.StatusOK, val)
+		}
+		searchCacheMisses.Add(1)
+		cacheLog.Debugf("Miss %s for search %q", key, term)
+	}
+
+	results, err := s.store.Search(term, limit)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	data, err := json.Marshal(results)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	if s.config.searchCacheTTL > 0 {
+		names := make([]string, len(results))
+		for i, result := range results {
+			names[i] = result.Name
+		}
+		if cache.Set(key, string(data), s.config.searchCacheTTL) == nil {
+			s.cacheKeys.add(key, len(data), s.config.searchCacheTTL, names...)
+		}
+	}
+	return r, goproxy.NewResponse(r, "application/json", http.StatusOK, string(data))
+}
+
+// prefixPackages serves /packages/prefix/{prefix}, the packages whose name
+// starts with prefix in name order. It is cheap enough to call on every
+// keystroke of an editor.
+func (s *Server) prefixPackages(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	prefix := strings.ToLower(strings.TrimPrefix(r.URL.Path, "/packages/prefix/"))
+	if prefix == "" {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Missing prefix")
+	}
+	limit, ok := queryInt(r, "limit", defaultPrefixLimit)
+	if !ok {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid limit")
+	}
+	if limit > maxPrefixLimit {
+		limit = maxPrefixLimit
+	}
+	packages, err := s.store.PackagesByPrefix(prefix, limit)
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if packages == nil {
+		packages = []Package{}
+	}
+	response := jsonResponse(r, http.StatusOK, packages)
+	response.Header.Set("Cache-Control", "public, max-age=300")
+	return r, response
+}
+
+func prefixPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/prefix/")
+	}
+}
+
+func searchPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/packages/search/")
+	}
+}
@@ -0,0 +1,280 @@
+package registry
+
+import (
+	"expvar"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With SEARCH_INDEX_REFRESH set, search and autocomplete are answered from
+// an inverted index of the public packages kept in memory: the words of
+// their names, keywords and descriptions point at the packages using them.
+// The index is built before the server starts listening and rebuilt every
+// interval, so requests never touch the database. Ranking follows the
+// database's full-text search, but scores aren't comparable with its.
+
+// searchIndexPage is how many packages a rebuild reads per query.
+const searchIndexPage = 1000
+
+// Words weigh more in names than in keywords, and more in keywords than in
+// descriptions. A word matched only as a prefix counts half.
+const (
+	nameWeight        = 3
+	keywordWeight     = 2
+	descriptionWeight = 1
+	// substringScore scores packages whose name or URL merely contains
+	// the query, as the node implementation matched them.
+	substringScore = 0.1
+)
+
+type searchDoc struct {
+	name, url string
+	// lower is the lowercased name and URL, for substring matches.
+	lower   string
+	hits    int32
+	boost   float64
+	demoted bool
+}
+
+type posting struct {
+	doc    int32
+	weight float32
+}
+
+// invertedIndex is immutable once built; a rebuild replaces it.
+type invertedIndex struct {
+	// docs are ordered by popularity: demoted packages last, then by hits.
+	docs []searchDoc
+	// words are sorted, so the words starting with a prefix are adjacent.
+	words    []string
+	postings [][]posting
+}
+
+func searchWords(text string) []string {
+	var words []string
+	for _, w := range nonWordRe.Split(strings.ToLower(text), -1) {
+		if w != "" {
+			words = append(words, w)
+		}
+	}
+	return words
+}
+
+func newInvertedIndex(packages []PackageDetails) *invertedIndex {
+	sort.SliceStable(packages, func(i, j int) bool {
+		di, dj := packages[i].Archived || packages[i].Deprecated != nil, packages[j].Archived || packages[j].Deprecated != nil
+		if di != dj {
+			return dj
+		}
+		return packages[i].Hits > packages[j].Hits
+	})
+	idx := &invertedIndex{docs: make([]searchDoc, len(packages))}
+	weights := map[string]map[int32]float32{}
+	add := func(doc int32, text string, weight float32) {
+		for _, w := range searchWords(text) {
+			docs := weights[w]
+			if docs == nil {
+				docs = map[int32]float32{}
+				weights[w] = docs
+			}
+			if weight > docs[doc] {
+				docs[doc] = weight
+			}
+		}
+	}
+	for i, p := range packages {
+		demoted := p.Archived || p.Deprecated != nil
+		boost := 1 + math.Log(1+float64(p.Stars))/10
+		if demoted {
+			boost /= 2
+		}
+		idx.docs[i] = searchDoc{
+			name:    p.Name,
+			url:     p.URL,
+			lower:   strings.ToLower(p.Name + " " + p.URL),
+			hits:    p.Hits,
+			boost:   boost,
+			demoted: demoted,
+		}
+		add(int32(i), p.Name, nameWeight)
+		add(int32(i), strings.Join(p.Keywords, " "), keywordWeight)
+		add(int32(i), p.Description, descriptionWeight)
+	}
+	idx.words = make([]string, 0, len(weights))
+	for w := range weights {
+		idx.words = append(idx.words, w)
+	}
+	sort.Strings(idx.words)
+	idx.postings = make([][]posting, len(idx.words))
+	for i, w := range idx.words {
+		list := make([]posting, 0, len(weights[w]))
+		for doc, weight := range weights[w] {
+			list = append(list, posting{doc, weight})
+		}
+		sort.Slice(list, func(a, b int) bool { return list[a].doc < list[b].doc })
+		idx.postings[i] = list
+	}
+	return idx
+}
+
+// match scores the packages with a word starting with prefix.
+func (idx *invertedIndex) match(prefix string) map[int32]float64 {
+	scores := map[int32]float64{}
+	for i := sort.SearchStrings(idx.words, prefix); i < len(idx.words) && strings.HasPrefix(idx.words[i], prefix); i++ {
+		factor := 0.5
+		if idx.words[i] == prefix {
+			factor = 1
+		}
+		for _, p := range idx.postings[i] {
+			if score := float64(p.weight) * factor; score > scores[p.doc] {
+				scores[p.doc] = score
+			}
+		}
+	}
+	return scores
+}
+
+// search returns the packages matching every word of term, a normalized
+// query, best first. An empty term returns the most popular packages.
+func (idx *invertedIndex) search(term string, limit int) []SearchResult {
+	results := []SearchResult{}
+	if term == "" {
+		for i := 0; i < len(idx.docs) && i < limit; i++ {
+			results = append(results, SearchResult{Name: idx.docs[i].name, URL: idx.docs[i].url})
+		}
+		return results
+	}
+
+	var scores map[int32]float64
+	for _, w := range searchWords(term) {
+		matched := idx.match(w)
+		if scores == nil {
+			scores = matched
+			continue
+		}
+		for doc, score := range scores {
+			if m, ok := matched[doc]; ok {
+				scores[doc] = score + m
+			} else {
+				delete(scores, doc)
+			}
+		}
+	}
+	if scores == nil {
+		scores = map[int32]float64{}
+	}
+	for i := range idx.docs {
+		if _, ok := scores[int32(i)]; !ok && strings.Contains(idx.docs[i].lower, term) {
+			scores[int32(i)] = substringScore
+		}
+	}
+
+	docs := make([]int32, 0, len(scores))
+	for doc, score := range scores {
+		scores[doc] = score * idx.docs[doc].boost
+		docs = append(docs, doc)
+	}
+	sort.Slice(docs, func(i, j int) bool {
+		a, b := docs[i], docs[j]
+		if scores[a] != scores[b] {
+			return scores[a] > scores[b]
+		}
+		if ea, eb := strings.EqualFold(idx.docs[a].name, term), strings.EqualFold(idx.docs[b].name, term); ea != eb {
+			return ea
+		}
+		return a < b
+	})
+	if len(docs) > limit {
+		docs = docs[:limit]
+	}
+	for _, doc := range docs {
+		results = append(results, SearchResult{Name: idx.docs[doc].name, URL: idx.docs[doc].url, Score: scores[doc]})
+	}
+	return results
+}
+
+// searchIndex holds the current inverted index.
+type searchIndex struct {
+	mu    sync.RWMutex
+	index *invertedIndex
+	built time.Time
+}
+
+func (s *searchIndex) get() *invertedIndex {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.index
+}
+
+// rebuild reads the public packages of the default registry page by page
+// and swaps in a new index. It returns the names for autocomplete, most
+// popular first.
+func (s *searchIndex) rebuild(store Store) ([]string, error) {
+	var packages []PackageDetails
+	for offset := 0; ; offset += searchIndexPage {
+		page, err := store.ListPackageDetails(offset, searchIndexPage)
+		if err != nil {
+			return nil, err
+		}
+		packages = append(packages, page...)
+		if len(page) < searchIndexPage {
+			break
+		}
+	}
+	index := newInvertedIndex(packages)
+	s.mu.Lock()
+	s.index, s.built = index, time.Now()
+	s.mu.Unlock()
+
+	names := make([]string, len(index.docs))
+	for i, doc := range index.docs {
+		names[i] = strings.ToLower(doc.name)
+	}
+	return names, nil
+}
+
+// rebuildSearch rebuilds the search index and the autocomplete trie from
+// the same read.
+func (s *Server) rebuildSearch() error {
+	names, err := s.search.rebuild(s.store)
+	if err != nil {
+		return err
+	}
+	trie := newNameTrie(names)
+	s.autocomplete.mu.Lock()
+	s.autocomplete.trie, s.autocomplete.built = trie, s.search.built
+	s.autocomplete.mu.Unlock()
+	return nil
+}
+
+// startSearchIndex builds the index, failing when it can't, and then
+// rebuilds it every interval in the background.
+func (s *Server) startSearchIndex() error {
+	if s.config.searchIndexRefresh <= 0 {
+		return nil
+	}
+	if err := s.rebuildSearch(); err != nil {
+		return err
+	}
+	metrics.Set("search_index", expvar.Func(func() interface{} {
+		s.search.mu.RLock()
+		defer s.search.mu.RUnlock()
+		return map[string]interface{}{
+			"packages": len(s.search.index.docs),
+			"words":    len(s.search.index.words),
+			"built_at": s.search.built,
+		}
+	}))
+	go func() {
+		for {
+			time.Sleep(s.config.searchIndexRefresh)
+			if err := s.rebuildSearch(); err != nil {
+				searchLog.Errorf("Could not rebuild the search index: %s", err)
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,537 @@
+package registry
+
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// ServerConfig selects and tunes the request handlers.
+type ServerConfig struct {
+	adminToken      string
+	readOnly        bool
+	readOnlyMessage string
+	nativeSearch    bool
+	searchCacheTTL  time.Duration
+	htmlPages       bool
+	npmFacade       bool
+	composerFacade  bool
+	composerVendor  string
+	goproxyPrefix   string
+	moduleUpstream  string
+	sidecarCacheTTL time.Duration
+	// sidecarCacheRules override sidecarCacheTTL by path prefix.
+	sidecarCacheRules []sidecarCacheRule
+	maxBodySize       int64
+	securityHeaders   securityHeaderConfig
+	concurrencyLimits []concurrencyLimit
+	queueTimeout      time.Duration
+	// proxyAllowedHosts are the destinations accepted in proxy requests.
+	proxyAllowedHosts map[string]bool
+	// connectAllowed are the host:port pairs CONNECT may tunnel to.
+	connectAllowed map[string]bool
+	// deprecatedClients limit the deprecated host behaviour to some
+	// clients; empty means all of them.
+	deprecatedClients []clientRule
+	deprecation       deprecationConfig
+	// trustedProxies may set X-Forwarded-For.
+	trustedProxies []*net.IPNet
+	// ipAllow, when not empty, and ipDeny restrict the clients served.
+	ipAllow        []*net.IPNet
+	ipDeny         []*net.IPNet
+	responseFormat responseFormat
+	// transferWebhook receives the confirmation tokens of package
+	// transfers, which are disabled without it.
+	transferWebhook       string
+	transferWebhookSecret string
+	transferTTL           time.Duration
+	// siteURL is the root of absolute links, e.g. in sitemaps.
+	siteURL   string
+	robotsTxt string
+	// archiveProxy streams package archives instead of redirecting to
+	// GitHub.
+	archiveProxy bool
+	// sessionTTL is how long admins stay signed in to the dashboard.
+	sessionTTL time.Duration
+	// oidc is nil unless admins sign in through OIDC_ISSUER.
+	oidc *oidcConfig
+	// responseSigningKey signs package lookups, see signing.go.
+	responseSigningKey ed25519.PrivateKey
+	typosquat          typosquatConfig
+	// sloTarget is the response time /debug/slo measures routes against.
+	sloTarget time.Duration
+	// errorReporter is nil unless SENTRY_DSN is set, see recovery.go.
+	errorReporter errorReporter
+	// responseHeaders are set on responses by route, see headers.go.
+	responseHeaders headerRules
+	// cdnPurger is nil unless CDN_PURGE is set, see cdn.go.
+	cdnPurger cdnPurger
+	// shorthandLookups resolves /packages/owner%2Frepo, see urls.go.
+	shorthandLookups bool
+	// autocompleteRefresh is how often the autocomplete trie is rebuilt;
+	// 0 leaves autocomplete to the database.
+	autocompleteRefresh time.Duration
+	// searchIndexRefresh is how often the in-memory search index is
+	// rebuilt; 0 leaves search to the database, see searchindex.go.
+	searchIndexRefresh time.Duration
+	// readFallbackRefresh is how often the snapshot serving lookups during
+	// database outages is taken; 0 disables it, see fallback.go.
+	readFallbackRefresh time.Duration
+	// recordPercent is the share of requests recorded, see recording.go.
+	recordPercent float64
+	recordBuffer  int
+	// faultToken unlocks fault injection, see faults.go.
+	faultToken string
+	// featureFlags overrides the defaults of feature flags, see flags.go.
+	featureFlags map[string]bool
+	// packageRateLimit and hotPackageRate are requests per minute for one
+	// package, see hotspot.go.
+	packageRateLimit int
+	hotPackageRate   int
+	hotPackageMaxAge time.Duration
+	cacheGCInterval  time.Duration
+	// downloadStatsHours, downloadStatsDays and downloadStatsMonths are
+	// how long download counts are kept per interval, see downloads.go.
+	downloadStatsHours  int
+	downloadStatsDays   int
+	downloadStatsMonths int
+	// publishDailyQuota and publishTotalQuota apply to API keys without
+	// quotas of their own, see quota.go.
+	publishDailyQuota  int
+	publishTotalQuota  int
+	publishRequiresKey bool
+	// registryEditors may unregister any package while the sidecar is
+	// disabled, see register.go.
+	registryEditors []string
+	githubAPI       string
+}
+
+// LoadServerConfig reads the environment that selects and tunes the request
+// handlers.
+func LoadServerConfig() (ServerConfig, error) {
+	cfg := ServerConfig{
+		adminToken:      getEnv("ADMIN_TOKEN", ""),
+		faultToken:      getEnv("FAULT_TOKEN", ""),
+		readOnly:        getEnv("READ_ONLY", "") == "true",
+		readOnlyMessage: getEnv("READ_ONLY_MESSAGE", defaultReadOnlyMessage),
+		nativeSearch:    getEnv("NATIVE_SEARCH", "") == "true",
+		htmlPages:       getEnv("HTML_PAGES", "") == "true",
+		npmFacade:       getEnv("NPM_FACADE", "") == "true",
+		composerFacade:  getEnv("COMPOSER_FACADE", "") == "true",
+		composerVendor:  getEnv("COMPOSER_VENDOR", "bower-asset"),
+		moduleUpstream:  strings.TrimSuffix(getEnv("GOPROXY_UPSTREAM", "https://proxy.golang.org"), "/"),
+		securityHeaders: loadSecurityHeaderConfig(),
+
+		transferWebhook:       getEnv("TRANSFER_WEBHOOK_URL", ""),
+		transferWebhookSecret: getEnv("TRANSFER_WEBHOOK_SECRET", ""),
+		siteURL:               strings.TrimSuffix(getEnv("SITE_URL", "https://registry.bower.io"), "/"),
+		archiveProxy:          getEnv("ARCHIVE_PROXY", "") == "true",
+		shorthandLookups:      getEnv("SHORTHAND_LOOKUPS", "") == "true",
+		publishRequiresKey:    getEnv("PUBLISH_REQUIRES_KEY", "") == "true",
+		registryEditors:       splitList(getEnv("REGISTRY_EDITORS", "")),
+		githubAPI:             strings.TrimSuffix(getEnv("GITHUB_API_URL", "https://api.github.com"), "/"),
+	}
+	cfg.responseFormat = loadResponseFormat()
+	cfg.proxyAllowedHosts = parseHostList(getEnv("PROXY_ALLOWED_HOSTS", "registry.bower.io,github.com"))
+	cfg.connectAllowed = parseConnectTargets(getEnv("CONNECT_ALLOWED_HOSTS", "none"))
+	if prefix := getEnv("GOPROXY_PREFIX", ""); prefix != "" {
+		cfg.goproxyPrefix = "/" + strings.Trim(prefix, "/") + "/"
+	}
+
+	var err error
+	if cfg.searchCacheTTL, err = time.ParseDuration(getEnv("SEARCH_CACHE_TTL", "60s")); err != nil {
+		return cfg, fmt.Errorf("Invalid SEARCH_CACHE_TTL: %s", err)
+	}
+	if cfg.sidecarCacheTTL, err = time.ParseDuration(getEnv("SIDECAR_CACHE_TTL", "0")); err != nil {
+		return cfg, fmt.Errorf("Invalid SIDECAR_CACHE_TTL: %s", err)
+	}
+	if cfg.sidecarCacheRules, err = parseCacheTTLs(getEnv("SIDECAR_CACHE_TTLS", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid SIDECAR_CACHE_TTLS: %s", err)
+	}
+	if cfg.maxBodySize, err = strconv.ParseInt(getEnv("MAX_BODY_SIZE", "1048576"), 10, 64); err != nil {
+		return cfg, fmt.Errorf("Invalid MAX_BODY_SIZE: %s", err)
+	}
+	if cfg.responseSigningKey, err = parseSigningKey(getEnv("RESPONSE_SIGNING_KEY", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid RESPONSE_SIGNING_KEY: %s", err)
+	}
+	if cfg.trustedProxies, err = parseCIDRs(getEnv("TRUSTED_PROXIES", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid TRUSTED_PROXIES: %s", err)
+	}
+	if cfg.ipAllow, err = parseCIDRs(getEnv("IP_ALLOW", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid IP_ALLOW: %s", err)
+	}
+	if cfg.ipDeny, err = parseCIDRs(getEnv("IP_DENY", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid IP_DENY: %s", err)
+	}
+	if cfg.deprecation, err = loadDeprecationConfig(); err != nil {
+		return cfg, err
+	}
+	if cfg.deprecatedClients, err = parseClientRules(getEnv("DEPRECATED_CLIENTS", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid DEPRECATED_CLIENTS: %s", err)
+	}
+	if cfg.concurrencyLimits, err = parseConcurrencyLimits(getEnv("CONCURRENCY_LIMITS", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid CONCURRENCY_LIMITS: %s", err)
+	}
+	if cfg.queueTimeout, err = time.ParseDuration(getEnv("CONCURRENCY_QUEUE_TIMEOUT", "1s")); err != nil {
+		return cfg, fmt.Errorf("Invalid CONCURRENCY_QUEUE_TIMEOUT: %s", err)
+	}
+	if cfg.transferTTL, err = time.ParseDuration(getEnv("TRANSFER_TTL", "72h")); err != nil {
+		return cfg, fmt.Errorf("Invalid TRANSFER_TTL: %s", err)
+	}
+	if cfg.sloTarget, err = time.ParseDuration(getEnv("SLO_TARGET", "1s")); err != nil {
+		return cfg, fmt.Errorf("Invalid SLO_TARGET: %s", err)
+	}
+	if cfg.autocompleteRefresh, err = time.ParseDuration(getEnv("AUTOCOMPLETE_REFRESH", "5m")); err != nil {
+		return cfg, fmt.Errorf("Invalid AUTOCOMPLETE_REFRESH: %s", err)
+	}
+	if cfg.searchIndexRefresh, err = time.ParseDuration(getEnv("SEARCH_INDEX_REFRESH", "0")); err != nil {
+		return cfg, fmt.Errorf("Invalid SEARCH_INDEX_REFRESH: %s", err)
+	}
+	if cfg.readFallbackRefresh, err = time.ParseDuration(getEnv("READ_FALLBACK_REFRESH", "0")); err != nil {
+		return cfg, fmt.Errorf("Invalid READ_FALLBACK_REFRESH: %s", err)
+	}
+	if cfg.recordPercent, err = strconv.ParseFloat(getEnv("RECORD_PERCENT", "0"), 64); err != nil || cfg.recordPercent < 0 || cfg.recordPercent > 100 {
+		return cfg, fmt.Errorf("Invalid RECORD_PERCENT: %s", getEnv("RECORD_PERCENT", "0"))
+	}
+	if cfg.recordBuffer, err = strconv.Atoi(getEnv("RECORD_BUFFER", "200")); err != nil || cfg.recordBuffer < 1 {
+		return cfg, fmt.Errorf("Invalid RECORD_BUFFER: %s", getEnv("RECORD_BUFFER", "200"))
+	}
+	if cfg.packageRateLimit, err = strconv.Atoi(getEnv("PACKAGE_RATE_LIMIT", "0")); err != nil || cfg.packageRateLimit < 0 {
+		return cfg, fmt.Errorf("Invalid PACKAGE_RATE_LIMIT: %s", getEnv("PACKAGE_RATE_LIMIT", "0"))
+	}
+	if cfg.hotPackageRate, err = strconv.Atoi(getEnv("HOT_PACKAGE_RATE", "0")); err != nil || cfg.hotPackageRate < 0 {
+		return cfg, fmt.Errorf("Invalid HOT_PACKAGE_RATE: %s", getEnv("HOT_PACKAGE_RATE", "0"))
+	}
+	if cfg.hotPackageMaxAge, err = time.ParseDuration(getEnv("HOT_PACKAGE_MAX_AGE", "1h")); err != nil {
+		return cfg, fmt.Errorf("Invalid HOT_PACKAGE_MAX_AGE: %s", err)
+	}
+	if cfg.cacheGCInterval, err = time.ParseDuration(getEnv("CACHE_GC_INTERVAL", "1h")); err != nil {
+		return cfg, fmt.Errorf("Invalid CACHE_GC_INTERVAL: %s", err)
+	}
+	if cfg.downloadStatsHours, err = strconv.Atoi(getEnv("DOWNLOAD_STATS_HOURS", "168")); err != nil || cfg.downloadStatsHours < 0 {
+		return cfg, fmt.Errorf("Invalid DOWNLOAD_STATS_HOURS: %s", getEnv("DOWNLOAD_STATS_HOURS", "168"))
+	}
+	if cfg.downloadStatsDays, err = strconv.Atoi(getEnv("DOWNLOAD_STATS_DAYS", "90")); err != nil || cfg.downloadStatsDays < 0 {
+		return cfg, fmt.Errorf("Invalid DOWNLOAD_STATS_DAYS: %s", getEnv("DOWNLOAD_STATS_DAYS", "90"))
+	}
+	if cfg.downloadStatsMonths, err = strconv.Atoi(getEnv("DOWNLOAD_STATS_MONTHS", "0")); err != nil || cfg.downloadStatsMonths < 0 {
+		return cfg, fmt.Errorf("Invalid DOWNLOAD_STATS_MONTHS: %s", getEnv("DOWNLOAD_STATS_MONTHS", "0"))
+	}
+	if cfg.publishDailyQuota, err = strconv.Atoi(getEnv("PUBLISH_DAILY_QUOTA", "20")); err != nil || cfg.publishDailyQuota < 0 {
+		return cfg, fmt.Errorf("Invalid PUBLISH_DAILY_QUOTA: %s", getEnv("PUBLISH_DAILY_QUOTA", "20"))
+	}
+	if cfg.publishTotalQuota, err = strconv.Atoi(getEnv("PUBLISH_TOTAL_QUOTA", "0")); err != nil || cfg.publishTotalQuota < 0 {
+		return cfg, fmt.Errorf("Invalid PUBLISH_TOTAL_QUOTA: %s", getEnv("PUBLISH_TOTAL_QUOTA", "0"))
+	}
+	if cfg.featureFlags, err = parseFeatureFlags(getEnv("FEATURE_FLAGS", "")); err != nil {
+		return cfg, fmt.Errorf("Invalid FEATURE_FLAGS: %s", err)
+	}
+	if cfg.robotsTxt, err = loadRobotsTxt(cfg); err != nil {
+		return cfg, err
+	}
+	if cfg.sessionTTL, err = time.ParseDuration(getEnv("SESSION_TTL", "8h")); err != nil {
+		return cfg, fmt.Errorf("Invalid SESSION_TTL: %s", err)
+	}
+	if cfg.oidc, err = loadOIDCConfig(cfg.siteURL, cfg.sessionTTL); err != nil {
+		return cfg, err
+	}
+	if cfg.typosquat, err = loadTyposquatConfig(); err != nil {
+		return cfg, err
+	}
+	if cfg.errorReporter, err = loadErrorReporter(); err != nil {
+		return cfg, err
+	}
+	if cfg.responseHeaders, err = loadHeaderRules(); err != nil {
+		return cfg, err
+	}
+	if cfg.cdnPurger, err = loadCDNPurger(); err != nil {
+		return cfg, err
+	}
+	return cfg, nil
+}
+
+// Server answers registry requests from its Store and Cache and forwards
+// everything else to the node sidecar.
+type Server struct {
+	store   Store
+	cache   Cache
+	config  ServerConfig
+	tenants tenantRegistry
+	clients clientCounter
+	// auth authenticates admins, see auth.go.
+	auth []authProvider
+	// broadcast is set once invalidations are received from the store.
+	broadcast notifier
+	// mail is nil unless MAIL_PROVIDER is set.
+	mail *ownerMail
+	// artifacts is nil unless an artifact cache is configured.
+	artifacts *artifactCache
+	events    eventHub
+	// maintenance is the current read-only mode, see readonly.go.
+	maintenanceMu sync.RWMutex
+	maintenance   readOnlyMode
+	// popular are the names registrations are compared with, see
+	// typosquat.go.
+	popular popularNames
+	// deprecatedTraffic counts requests to the deprecated hosts, see
+	// telemetry.go.
+	deprecatedTraffic trafficCounter
+	// upstream is whether registry.bower.io is up, see deprecation.go.
+	upstream upstreamProbe
+	// purges are the surrogate keys to purge from the CDN, see cdn.go.
+	purges purgeQueue
+	// latency has the response times of each route, see slo.go.
+	latency *latencyTracker
+	// autocomplete has the package names for typeahead, see
+	// autocomplete.go.
+	autocomplete autocompleteIndex
+	// search is the in-memory search index, see searchindex.go.
+	search searchIndex
+	// lookups coalesces concurrent package lookups, see coalesce.go.
+	lookups lookupGroup
+	// fallback serves lookups while the database is down, see fallback.go.
+	fallback fallbackSnapshot
+	// recorder is nil unless RECORD_PERCENT is set, see recording.go.
+	recorder *trafficRecorder
+	// flags are the feature flags, see flags.go.
+	flags *featureFlags
+	// hotspots is nil unless PACKAGE_RATE_LIMIT or HOT_PACKAGE_RATE is set,
+	// see hotspot.go.
+	hotspots *hotspotTracker
+	// cacheKeys are the shared cache keys this instance wrote, see
+	// cachegc.go.
+	cacheKeys cacheKeyIndex
+	// downloads counts package lookups, see downloads.go.
+	downloads downloadCounter
+
+	// routes answer requests in order, see serveLocal; responseHandlers
+	// then see every response.
+	routes           []route
+	responseHandlers []goproxy.FuncRespHandler
+	sidecarProxy     *httputil.ReverseProxy
+	// proxy only tunnels the CONNECT requests connectPolicy allows.
+	proxy   *goproxy.ProxyHttpServer
+	handler http.Handler
+	refresh flightGroup
+
+	operations  []apiOperation
+	openAPIOnce sync.Once
+	openAPIDoc  []byte
+}
+
+// NewServer returns the handler of the registry API, serving packages from
+// store.
+func NewServer(store Store, cache Cache, cfg ServerConfig) *Server {
+	s := &Server{store: store, cache: cache, config: cfg, auth: newAuthProviders(cfg)}
+	s.maintenance = readOnlyMode{ReadOnly: cfg.readOnly, Message: cfg.readOnlyMessage}
+	s.deprecatedTraffic.publish()
+	s.flags = newFeatureFlags(cfg.featureFlags)
+	s.flags.publish()
+
+	s.proxy = goproxy.NewProxyHttpServer()
+	s.proxy.Verbose = false
+	s.sidecarProxy = s.newSidecarProxy()
+	s.registerRoutes()
+	s.responseHandlers = []goproxy.FuncRespHandler{addTyposquatWarning, s.settlePublication, negotiateFormat}
+	routes := newRouteMatcher(s.operations)
+	s.latency = newLatencyTracker(routes, cfg.sloTarget)
+	s.latency.publish()
+	cfg.responseHeaders.check(routes)
+	s.proxy.OnRequest().HandleConnectFunc(func(host string, ctx *goproxy.ProxyCtx) (*goproxy.ConnectAction, string) {
+		if cfg.connectAllowed[strings.ToLower(host)] {
+			return goproxy.OkConnect, host
+		}
+		return goproxy.RejectConnect, host
+	})
+
+	var h http.Handler = http.HandlerFunc(s.serveLocal)
+	h = flushEventStreams(h)
+	h = recoverPanics(h, cfg.errorReporter)
+	h = injectFaults(h, cfg.faultToken)
+	h = trackLatency(h, s.latency)
+	h = limitConcurrency(h, cfg.concurrencyLimits, cfg.queueTimeout)
+	if cfg.packageRateLimit > 0 || cfg.hotPackageRate > 0 {
+		s.hotspots = newHotspotTracker(cfg.packageRateLimit, cfg.hotPackageRate, cfg.hotPackageMaxAge)
+		s.hotspots.publish()
+	}
+	h = limitPackageRates(h, s.hotspots, s.clientIP)
+	h = restrictProxyRequests(h, cfg.proxyAllowedHosts)
+	h = limitRequests(h, cfg.maxBodySize)
+	h = securityHeaders(h, cfg.securityHeaders)
+	if cfg.cdnPurger != nil {
+		h = addSurrogateKeys(h)
+	}
+	h = customHeaders(h, cfg.responseHeaders, routes)
+	h = connectPolicy(h, s.proxy, cfg.connectAllowed)
+	if cfg.recordPercent > 0 {
+		s.recorder = newTrafficRecorder(cfg.recordPercent, cfg.recordBuffer)
+	}
+	h = recordTraffic(h, s.recorder, s.clientIP)
+	s.handler = filterIPs(h, s.clientIP, cfg.ipAllow, cfg.ipDeny)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// route is a request handler and the condition, nil for every request,
+// under which it runs.
+type route struct {
+	cond    goproxy.ReqCondition
+	handler goproxy.FuncReqHandler
+}
+
+// serveLocal runs the routes until one answers and passes the answer
+// through the response handlers. sidecarHandler, the last route, answers
+// with nothing when the request is for the sidecar, which sidecarProxy
+// then forwards it to.
+func (s *Server) serveLocal(w http.ResponseWriter, r *http.Request) {
+	ctx := &goproxy.ProxyCtx{Req: r}
+	var resp *http.Response
+	for _, rt := range s.routes {
+		if rt.cond != nil && !rt.cond.HandleReq(r, ctx) {
+			continue
+		}
+		if r, resp = rt.handler(r, ctx); resp != nil {
+			break
+		}
+		ctx.Req = r
+	}
+	if resp == nil {
+		if ctx.RoundTripper == nil {
+			http.NotFound(w, r)
+			return
+		}
+		s.sidecarProxy.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), proxyCtxKey{}, ctx)))
+		return
+	}
+
+	body := resp.Body
+	defer body.Close()
+	resp = s.filterResponse(resp, ctx)
+	if resp.Body != body {
+		// The length is that of the body replaced.
+		resp.Header.Del("Content-Length")
+		defer resp.Body.Close()
+	}
+	for k, v := range resp.Header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// filterResponse runs the response handlers on resp.
+func (s *Server) filterResponse(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	for _, h := range s.responseHandlers {
+		ctx.Resp = resp
+		resp = h(resp, ctx)
+	}
+	return resp
+}
+
+// registerRoutes registers the request handlers. The first handler to
+// return a response wins, so sidecarHandler has to come last.
+func (s *Server) registerRoutes() {
+	s.handle(pathIs("/readyz"), readyz)
+	s.handle(pathIs("/metrics"), serveMetrics)
+	s.handle(pathIs("/debug/slo"), s.serveSLO)
+	s.handle(pathIs("/openapi.json"), s.serveOpenAPI,
+		apiOperation{Method: http.MethodGet, Path: "/openapi.json", Summary: "This OpenAPI document"})
+	s.handle(nil, s.countClient)
+	s.handle(nil, s.readOnlyHandler)
+	s.handle(nil, s.tenantHandler, tenantOperations...)
+	s.handle(nil, s.adminHandler, s.adminOperations()...)
+	s.handle(nil, s.deprecatedHostHandler)
+
+	s.handle(transferPath(), s.transferHandler, transferOperations...)
+	s.handle(deprecationPath(), s.deprecationHandler, deprecateOperations...)
+	s.handle(visibilityPath(), s.visibilityHandler, visibilityOperations...)
+	s.handle(nil, s.scopedWriteHandler)
+	s.handle(teamsPath(), s.teamsHandler, teamOperations...)
+	s.handle(orgPackagesPath(), s.listOrgPackages,
+		apiOperation{Method: http.MethodGet, Path: "/orgs/{org}/packages", Summary: "List the packages of an organization", Result: []Package{}})
+	s.handle(orgNotificationsPath(), s.orgNotifications,
+		apiOperation{Method: http.MethodGet, Path: "/orgs/{org}/notifications", Summary: "Show where an organization is emailed", Result: Contact{}, Auth: true},
+		apiOperation{Method: http.MethodPost, Path: "/orgs/{org}/notifications", Summary: "Change the email or turn notifications off", Body: Contact{}, Result: Contact{}, Auth: true})
+	s.handle(pathIs("/packages"), s.listPackages,
+		apiOperation{Method: http.MethodGet, Path: "/packages", Summary: "List all packages, or with since the changes since then", Query: []string{"since", "limit"}, Result: []Package{}})
+	if s.searchesNatively() {
+		s.handle(searchPath(), s.searchPackages,
+			apiOperation{Method: http.MethodGet, Path: "/packages/search/{query}", Summary: "Search packages", Query: []string{"limit"}, Result: []SearchResult{}})
+	}
+	s.handle(pathIs("/autocomplete"), s.flagged("autocomplete", s.serveAutocomplete),
+		apiOperation{Method: http.MethodGet, Path: "/autocomplete", Summary: "Names of the most popular packages starting with q, for typeahead", Query: []string{"q"}, Result: []string{}})
+	s.handle(prefixPath(), s.prefixPackages,
+		apiOperation{Method: http.MethodGet, Path: "/packages/prefix/{prefix}", Summary: "List packages whose name starts with a prefix, e.g. for autocomplete", Query: []string{"limit"}, Result: []Package{}})
+	if s.config.responseSigningKey != nil {
+		s.handle(pathIs(signingKeyPath), s.serveSigningKey,
+			apiOperation{Method: http.MethodGet, Path: signingKeyPath, Summary: "The public key package lookups are signed with, as PEM"})
+	}
+	s.handle(pathIs("/packages/broken"), s.listBrokenPackages,
+		apiOperation{Method: http.MethodGet, Path: "/packages/broken", Summary: "List packages whose repository is unreachable", Result: []BrokenPackage{}})
+	s.handle(pathIs("/packages/top"), s.servePackageRanking,
+		apiOperation{Method: http.MethodGet, Path: "/packages/top", Summary: "Packages downloaded most in the last week", Query: []string{"limit"}, Result: []RankedPackage{}})
+	s.handle(pathIs("/packages/trending"), s.servePackageRanking,
+		apiOperation{Method: http.MethodGet, Path: "/packages/trending", Summary: "Packages whose downloads grew most week over week", Query: []string{"limit"}, Result: []RankedPackage{}})
+	s.handle(pathIs("/feed.xml"), s.serveFeed,
+		apiOperation{Method: http.MethodGet, Path: "/feed.xml", Summary: "Atom feed of the packages registered or updated last"})
+	s.handle(pathIs("/robots.txt"), s.serveRobotsTxt,
+		apiOperation{Method: http.MethodGet, Path: "/robots.txt", Summary: "Rules for crawlers"})
+	s.handle(resolvePath(), s.resolveVersion,
+		apiOperation{Method: http.MethodGet, Path: "/packages/{name}/resolve", Summary: "Resolve a semver range to a version and its archives", Query: []string{"range"}, Result: Resolution{}})
+	s.handle(archivePath(), s.serveArchive, archiveOperations...)
+	s.handle(versionsPath(), s.listVersions,
+		apiOperation{Method: http.MethodGet, Path: "/packages/{name}/versions", Summary: "List the versions of a package with the SHA-256 of their tarballs", Result: []VersionChecksum{}})
+	s.handle(downloadsPath(), s.listDownloads,
+		apiOperation{Method: http.MethodGet, Path: "/packages/{name}/downloads", Summary: "Downloads of a package per hour, day or month", Query: []string{"interval", "from", "to"}, Result: DownloadSeries{}})
+	s.handle(dependenciesPath(), s.dependenciesHandler, dependencyOperations...)
+	s.handle(badgePath(), s.serveBadge,
+		apiOperation{Method: http.MethodGet, Path: "/packages/{name}/badge.svg", Summary: "SVG badge with the latest version of a package"})
+	if s.config.htmlPages {
+		s.handle(sitemapPath(), s.sitemapHandler, sitemapOperations...)
+		s.handle(pathIs("/"), s.homePageHandler)
+		s.handle(urlHasPrefix("/packages/"), s.packagePageHandler)
+	}
+	s.handle(urlHasPrefix("/packages/"), s.getPackage,
+		apiOperation{Method: http.MethodGet, Path: "/packages/{name}", Summary: "Look up a package by name or alias", Result: Package{}})
+	s.handle(urlHasPrefix("/v2/"), s.flagged("api_v2", s.v2Handler), v2Operations...)
+	s.handle(graphqlPath(), s.flagged("graphql", s.graphqlHandler), graphqlOperations...)
+	s.handle(pathIs("/events"), s.flagged("events", s.streamEvents),
+		apiOperation{Method: http.MethodGet, Path: "/events", Summary: "Stream package changes as Server-Sent Events"})
+
+	if s.config.npmFacade {
+		s.handle(urlHasPrefix("/npm/"), s.getNpmPackage,
+			apiOperation{Method: http.MethodGet, Path: "/npm/{name}", Summary: "npm registry document of a package", Result: npmPackage{}})
+	}
+
+	if s.config.composerFacade {
+		s.handle(pathIs("/packages.json"), s.composerRoot,
+			apiOperation{Method: http.MethodGet, Path: "/packages.json", Summary: "Composer repository root"})
+		s.handle(urlHasPrefix("/p/"), s.composerPackage,
+			apiOperation{Method: http.MethodGet, Path: "/p/{vendor}/{name}.json", Summary: "Composer 1 package metadata"})
+		s.handle(urlHasPrefix("/p2/"), s.composerPackage,
+			apiOperation{Method: http.MethodGet, Path: "/p2/{vendor}/{name}.json", Summary: "Composer 2 package metadata"})
+	}
+
+	if prefix := s.config.goproxyPrefix; prefix != "" {
+		s.handle(urlHasPrefix(prefix), s.moduleProxyHandler(prefix),
+			apiOperation{Method: http.MethodGet, Path: prefix + "{module}/@v/list", Summary: "List module versions"},
+			apiOperation{Method: http.MethodGet, Path: prefix + "{module}/@v/{version}.info", Summary: "Module version metadata"},
+			apiOperation{Method: http.MethodGet, Path: prefix + "{module}/@latest", Summary: "Latest module version"})
+	}
+
+	s.handle(nativeRegistrationPath(), s.nativeRegistrationHandler)
+	s.handle(nil, s.sidecarHandler, s.sidecarOperations()...)
+}
@@ -0,0 +1,397 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+const (
+	minSidecarBackoff = time.Second
+	maxSidecarBackoff = 30 * time.Second
+	// A sidecar that stayed up this long is considered healthy again and
+	// the restart backoff is reset.
+	sidecarStableAfter = time.Minute
+)
+
+var (
+	sidecarUp       int32
+	sidecarDisabled bool
+	sidecarAddr     = "localhost:3001"
+	sidecarSocket   string
+	sidecarDialer   = &net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}
+)
+
+type sidecarConfig struct {
+	disabled bool
+	// command is empty when the upstream is managed outside this process.
+	command []string
+	dir     string
+	env     []string
+	addr    string
+	// socket, when set, replaces addr with a Unix domain socket.
+	socket string
+}
+
+// loadSidecarConfig reads the SIDECAR_* environment. By default node serves
+// index.js on localhost:3001.
+//
+//	SIDECAR_DISABLED=true   don't proxy to a sidecar at all
+//	SIDECAR_COMMAND         command line, or "none" to use an external upstream
+//	SIDECAR_DIR             working directory of the command
+//	SIDECAR_ENV             extra KEY=value pairs, comma separated
+//	SIDECAR_ADDR            upstream host:port
+//	SIDECAR_SOCKET          upstream Unix socket, passed to the command as PORT
+func loadSidecarConfig() (sidecarConfig, error) {
+	cfg := sidecarConfig{
+		disabled: getEnv("SIDECAR_DISABLED", "") == "true",
+		dir:      getEnv("SIDECAR_DIR", ""),
+		addr:     getEnv("SIDECAR_ADDR", sidecarAddr),
+		socket:   getEnv("SIDECAR_SOCKET", ""),
+	}
+	if command := getEnv("SIDECAR_COMMAND", "node --expose_gc index.js"); command != "none" {
+		cfg.command = strings.Fields(command)
+	}
+
+	_, port, err := net.SplitHostPort(cfg.addr)
+	if err != nil {
+		return cfg, fmt.Errorf("Invalid SIDECAR_ADDR: %s", err)
+	}
+	cfg.env = append(os.Environ(), "PORT="+port)
+	if cfg.socket != "" {
+		// node's listen() treats a path as a Unix socket.
+		cfg.env = append(os.Environ(), "PORT="+cfg.socket, "SIDECAR_SOCKET="+cfg.socket)
+	}
+	for _, kv := range strings.Split(getEnv("SIDECAR_ENV", ""), ",") {
+		if kv = strings.TrimSpace(kv); kv == "" {
+			continue
+		}
+		if !strings.Contains(kv, "=") {
+			return cfg, fmt.Errorf("Invalid SIDECAR_ENV entry %q", kv)
+		}
+		cfg.env = append(cfg.env, kv)
+	}
+	return cfg, nil
+}
+
+// startSidecar supervises the configured command, or only watches the
+// upstream when the command is managed elsewhere.
+func startSidecar(cfg sidecarConfig) error {
+	sidecarAddr, sidecarSocket = cfg.addr, cfg.socket
+	if cfg.disabled {
+		sidecarDisabled = true
+		return nil
+	}
+	if len(cfg.command) == 0 {
+		go monitorSidecar(cfg.addr)
+		return nil
+	}
+	binary, err := exec.LookPath(cfg.command[0])
+	if err != nil {
+		return fmt.Errorf("Could not lookup %s path: %s", cfg.command[0], err)
+	}
+	if parent := upgradeParent(); parent != 0 {
+		go func() {
+			borrowSidecar(cfg.addr, parent)
+			superviseSidecar(binary, cfg.command[1:], cfg.dir, cfg.env, cfg.addr)
+		}()
+		return nil
+	}
+	superviseSidecar(binary, cfg.command[1:], cfg.dir, cfg.env, cfg.addr)
+	return nil
+}
+
+// borrowSidecar uses the node process of the process this one takes over
+// from until that process, which stops it on the way out, has exited.
+func borrowSidecar(addr string, parent int) {
+	sidecarLog.Infof("Using the node process of process %d until it exits", parent)
+	for os.Getppid() == parent {
+		up := int32(0)
+		if probeSidecar(addr) {
+			up = 1
+		}
+		atomic.StoreInt32(&sidecarUp, up)
+		time.Sleep(200 * time.Millisecond)
+	}
+	atomic.StoreInt32(&sidecarUp, 0)
+}
+
+func monitorSidecar(addr string) {
+	for {
+		up := int32(0)
+		if probeSidecar(addr) {
+			up = 1
+		}
+		atomic.StoreInt32(&sidecarUp, up)
+		time.Sleep(5 * time.Second)
+	}
+}
+
+func sidecarReady() bool {
+	return atomic.LoadInt32(&sidecarUp) == 1
+}
+
+// sidecarProcess is the node process superviseSidecar runs.
+type sidecarProcess struct {
+	mu       sync.Mutex
+	cmd      *exec.Cmd
+	exited   chan struct{}
+	stopping bool
+}
+
+var sidecarChild sidecarProcess
+
+// start starts cmd unless the sidecar is being stopped.
+func (p *sidecarProcess) start(cmd *exec.Cmd) (chan struct{}, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.stopping {
+		return nil, errSidecarStopped
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	p.cmd, p.exited = cmd, make(chan struct{})
+	return p.exited, nil
+}
+
+var errSidecarStopped = errors.New("the sidecar is stopped")
+
+// stopSidecar stops the node process and keeps it from being restarted. It
+// sends SIGTERM to its process group and, if it hasn't exited within
+// timeout, SIGKILL.
+func stopSidecar(timeout time.Duration) {
+	p := &sidecarChild
+	p.mu.Lock()
+	p.stopping = true
+	cmd, exited := p.cmd, p.exited
+	p.mu.Unlock()
+	if cmd == nil {
+		return
+	}
+	signalProcessGroup(cmd.Process, false)
+	select {
+	case <-exited:
+		return
+	case <-time.After(timeout):
+	}
+	sidecarLog.Warnf("Node didn't stop within %s, killing it", timeout)
+	signalProcessGroup(cmd.Process, true)
+	<-exited
+}
+
+// superviseSidecar runs the node process and restarts it with exponential
+// backoff whenever it exits, until stopSidecar. The sidecar counts as up
+// once it accepts connections on addr.
+func superviseSidecar(binary string, args []string, dir string, env []string, addr string) {
+	restarts := new(expvar.Int)
+	metrics.Set("sidecar_restarts", restarts)
+
+	go func() {
+		backoff := minSidecarBackoff
+		for {
+			started := time.Now()
+			if sidecarSocket != "" {
+				os.Remove(sidecarSocket)
+			}
+			cmd := exec.Command(binary, args...)
+			cmd.Dir = dir
+			cmd.Env = env
+			cmd.Stdout = os.Stdout
+			cmd.Stderr = os.Stderr
+			cmd.SysProcAttr = sidecarProcAttr()
+			if exited, err := sidecarChild.start(cmd); err == errSidecarStopped {
+				return
+			} else if err != nil {
+				sidecarLog.Errorf("Could not start node: %s", err)
+			} else {
+				go waitForSidecar(addr, exited)
+				err := cmd.Wait()
+				close(exited)
+				atomic.StoreInt32(&sidecarUp, 0)
+				sidecarChild.mu.Lock()
+				stopping := sidecarChild.stopping
+				sidecarChild.mu.Unlock()
+				if stopping {
+					sidecarLog.Infof("Node process stopped")
+					return
+				}
+				sidecarLog.Errorf("Node process exited: %v", err)
+			}
+
+			if time.Since(started) > sidecarStableAfter {
+				backoff = minSidecarBackoff
+			}
+			sidecarLog.Infof("Restarting node in %s", backoff)
+			time.Sleep(backoff)
+			restarts.Add(1)
+			if backoff *= 2; backoff > maxSidecarBackoff {
+				backoff = maxSidecarBackoff
+			}
+		}
+	}()
+}
+
+func waitForSidecar(addr string, exited chan struct{}) {
+	for {
+		select {
+		case <-exited:
+			return
+		case <-time.After(200 * time.Millisecond):
+		}
+		if probeSidecar(addr) {
+			atomic.StoreInt32(&sidecarUp, 1)
+			return
+		}
+	}
+}
+
+func readyz(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if !sidecarDisabled && !sidecarReady() {
+		return r, goproxy.NewResponse(r, "text/plain", http.StatusServiceUnavailable, "sidecar unavailable\n")
+	}
+	return r, goproxy.NewResponse(r, "text/plain", http.StatusOK, "ok\n")
+}
+
+// dialSidecar connects to the sidecar's Unix socket when one is configured
+// and to addr otherwise.
+func dialSidecar(ctx context.Context, network, addr string) (net.Conn, error) {
+	if sidecarSocket != "" {
+		return sidecarDialer.DialContext(ctx, "unix", sidecarSocket)
+	}
+	return sidecarDialer.DialContext(ctx, network, addr)
+}
+
+func probeSidecar(addr string) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	conn, err := dialSidecar(ctx, "tcp", addr)
+	if err != nil {
+		return false
+	}
+	conn.Close()
+	return true
+}
+
+// sidecarTransport carries every request forwarded to the sidecar. The
+// default transport keeps only two idle connections per host, so bursts of
+// traffic opened a fresh connection per request and ran out of ports.
+var sidecarTransport = &http.Transport{
+	DialContext:           dialSidecar,
+	MaxIdleConns:          256,
+	MaxIdleConnsPerHost:   256,
+	IdleConnTimeout:       90 * time.Second,
+	ResponseHeaderTimeout: 60 * time.Second,
+	ExpectContinueTimeout: time.Second,
+	ForceAttemptHTTP2:     true,
+}
+
+// forwardToSidecar sends a request sidecarProxy addressed to the sidecar.
+func forwardToSidecar(r *http.Request) (*http.Response, error) {
+	return sidecarTransport.RoundTrip(r)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
+
+// proxyCtxKey holds the *goproxy.ProxyCtx of a request for sidecarProxy.
+type proxyCtxKey struct{}
+
+func proxyCtxOf(r *http.Request) *goproxy.ProxyCtx {
+	return r.Context().Value(proxyCtxKey{}).(*goproxy.ProxyCtx)
+}
+
+// newSidecarProxy forwards requests to the sidecar by the round trip
+// sidecarHandler picked, straight or through the response cache, and runs
+// the response handlers on what comes back.
+func (s *Server) newSidecarProxy() *httputil.ReverseProxy {
+	return &httputil.ReverseProxy{
+		Director: func(r *http.Request) {
+			r.URL.Scheme = "http"
+			r.URL.Host = sidecarAddr
+			// The transport asks for and decompresses gzip itself, so the
+			// response handlers and the cache see plain bodies.
+			r.Header.Del("Accept-Encoding")
+			// ReverseProxy appends the peer's address. What came before is
+			// only kept from trusted proxies; anyone else could claim any
+			// address.
+			if !inNetworks(s.config.trustedProxies, peerIP(r)) {
+				r.Header.Del("X-Forwarded-For")
+			}
+			if r.Header.Get("X-Forwarded-Host") == "" {
+				r.Header.Set("X-Forwarded-Host", r.Host)
+			}
+		},
+		Transport: roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+			ctx := proxyCtxOf(r)
+			return ctx.RoundTripper.RoundTrip(r, ctx)
+		}),
+		ModifyResponse: func(resp *http.Response) error {
+			if filtered := s.filterResponse(resp, proxyCtxOf(resp.Request)); filtered != resp {
+				*resp = *filtered
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+			sidecarLog.Errorf("Could not forward %s %s: %s", r.Method, r.URL.Path, err)
+			metrics.Add("sidecar_errors", 1)
+			s.releasePublication(proxyCtxOf(r))
+			http.Error(w, "Bad gateway", http.StatusBadGateway)
+		},
+	}
+}
+
+// sidecarOperations describes the endpoints still served by the node app.
+func (s *Server) sidecarOperations() []apiOperation {
+	ops := []apiOperation{
+		// Scoped packages are handled by scopedWriteHandler under the same paths.
+		{Method: http.MethodPost, Path: "/packages", Summary: "Register a package", Form: []string{"name", "url"}},
+		{Method: http.MethodDelete, Path: "/packages/{name}", Summary: "Unregister a package", Query: []string{"access_token"}},
+		{Method: http.MethodGet, Path: "/stats", Summary: "Package count"},
+		{Method: http.MethodGet, Path: "/status", Summary: "Service status"},
+	}
+	if !s.searchesNatively() {
+		ops = append(ops, apiOperation{Method: http.MethodGet, Path: "/packages/search/{query}", Summary: "Search packages", Result: []Package{}})
+	}
+	return ops
+}
+
+// sidecarHandler must be registered after every Go handler. It answers for
+// the sidecar while it is disabled (but for registrations, see register.go)
+// or restarting, and otherwise routes the request through the response
+// cache or straight to the sidecar.
+func (s *Server) sidecarHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if sidecarDisabled {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+	}
+	if !sidecarReady() {
+		response := goproxy.NewResponse(r, "text/html", http.StatusServiceUnavailable, "Service temporarily unavailable")
+		response.Header.Set("Retry-After", "5")
+		return r, response
+	}
+
+	var ttl time.Duration
+	if r.Method == http.MethodGet && r.Header.Get("Authorization") == "" {
+		ttl = s.sidecarCacheTTLFor(r.URL.Path)
+	}
+	ctx.RoundTripper = goproxy.RoundTripperFunc(func(req *http.Request, ctx *goproxy.ProxyCtx) (*http.Response, error) {
+		if ttl > 0 {
+			return s.cachedRoundTrip(req, ttl)
+		}
+		return forwardToSidecar(req)
+	})
+	return r, nil
+}
@@ -0,0 +1,10 @@
+package registry
+
+import "syscall"
+
+// sidecarProcAttr starts node in its own process group, so it can be
+// stopped with its children, and has the kernel stop it should the
+// registry die without stopping it.
+func sidecarProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true, Pdeathsig: syscall.SIGTERM}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !windows
+// +build !linux,!windows
+
+package registry
+
+import "syscall"
+
+// sidecarProcAttr starts node in its own process group. Only Linux stops it
+// when the registry dies.
+func sidecarProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
@@ -0,0 +1,9 @@
+package registry
+
+import "syscall"
+
+// sidecarProcAttr starts node like any other process; see
+// signalProcessGroup.
+func sidecarProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
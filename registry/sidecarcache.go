@@ -0,0 +1,124 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Successful GET responses from the node sidecar are cached in the Cache,
+// keyed by host and request URI. Requests answered by the Go handlers never
+// reach sidecarHandler and are not affected.
+
+const maxCachedResponse = 512 * 1024
+
+type sidecarCacheRule struct {
+	prefix string
+	ttl    time.Duration
+}
+
+type cachedResponse struct {
+	Status int         `json:"status"`
+	Header http.Header `json:"header"`
+	Body   []byte      `json:"body"`
+}
+
+// parseCacheTTLs parses "/prefix=ttl,/other=ttl" overrides of the default TTL.
+func parseCacheTTLs(s string) ([]sidecarCacheRule, error) {
+	var rules []sidecarCacheRule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		parts := strings.SplitN(item, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid cache rule %q", item)
+		}
+		ttl, err := time.ParseDuration(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid cache rule %q: %s", item, err)
+		}
+		rules = append(rules, sidecarCacheRule{prefix: parts[0], ttl: ttl})
+	}
+	return rules, nil
+}
+
+// sidecarCacheTTLFor returns the TTL of the longest matching prefix rule, or
+// the default TTL.
+func (s *Server) sidecarCacheTTLFor(path string) time.Duration {
+	ttl, longest := s.config.sidecarCacheTTL, -1
+	for _, rule := range s.config.sidecarCacheRules {
+		if strings.HasPrefix(path, rule.prefix) && len(rule.prefix) > longest {
+			ttl, longest = rule.ttl, len(rule.prefix)
+		}
+	}
+	return ttl
+}
+
+func sidecarCacheKey(r *http.Request) string {
+	sum := sha256.Sum256([]byte(normalizeHost(r.Host) + " " + r.URL.RequestURI()))
+	return "sidecar:" + hex.EncodeToString(sum[:])
+}
+
+func cacheable(resp *http.Response) bool {
+	cc := resp.Header.Get("Cache-Control")
+	return resp.StatusCode == http.StatusOK &&
+		resp.Header.Get("Set-Cookie") == "" &&
+		!strings.Contains(cc, "no-store") &&
+		!strings.Contains(cc, "private")
+}
+
+func (s *Server) cachedRoundTrip(r *http.Request, ttl time.Duration) (*http.Response, error) {
+	key := sidecarCacheKey(r)
+	cache := s.cacheFor(r)
+	if val, err := cache.Get(key); err == nil {
+		var cached cachedResponse
+		if json.Unmarshal([]byte(val), &cached) == nil {
+			resp := goproxy.NewResponse(r, "", cached.Status, "")
+			resp.Header = cached.Header
+			resp.Header.Set("X-Cache", "HIT")
+			cacheLog.Debugf("Hit %s for %s", key, r.URL.RequestURI())
+			resp.Body = ioutil.NopCloser(bytes.NewReader(cached.Body))
+			resp.ContentLength = int64(len(cached.Body))
+			return resp, nil
+		}
+	}
+
+	cacheLog.Debugf("Miss %s for %s", key, r.URL.RequestURI())
+	resp, err := forwardToSidecar(r)
+	if err != nil || !cacheable(resp) {
+		return resp, err
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	if len(body) <= maxCachedResponse && resp.Header.Get("Content-Encoding") == "" {
+		header := http.Header{}
+		for _, h := range []string{"Content-Type", "Cache-Control", "Etag", "Last-Modified"} {
+			if v := resp.Header.Get(h); v != "" {
+				header.Set(h, v)
+			}
+		}
+		header.Set("Content-Length", strconv.Itoa(len(body)))
+		if data, err := json.Marshal(cachedResponse{Status: resp.StatusCode, Header: header, Body: body}); err == nil {
+			if cache.Set(key, string(data), ttl) == nil {
+				s.cacheKeys.add(key, len(data), ttl, packageOfPath(r.URL.Path))
+			}
+		}
+	}
+	resp.Header.Set("X-Cache", "MISS")
+	return resp, nil
+}
@@ -0,0 +1,78 @@
+package registry
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With RESPONSE_SIGNING_KEY set, package lookups carry a detached Ed25519
+// signature of their body in X-Registry-Signature, so resolvers can tell
+// whether a cache or proxy on the way altered the response. They verify it
+// with the public key served at /.well-known/registry-signing-key.pem and
+// can't sign anything themselves. Transfer webhooks are signed with an HMAC
+// of TRANSFER_WEBHOOK_SECRET, which the receiver shares.
+
+const signatureHeader = "X-Registry-Signature"
+
+// signingKeyPath serves the public key of RESPONSE_SIGNING_KEY.
+const signingKeyPath = "/.well-known/registry-signing-key.pem"
+
+// parseSigningKey reads an Ed25519 private key, either PKCS #8 PEM as
+// written by openssl genpkey -algorithm ed25519, or the base64 of its 32
+// byte seed.
+func parseSigningKey(s string) (ed25519.PrivateKey, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, nil
+	}
+	if block, _ := pem.Decode([]byte(s)); block != nil {
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		if key, ok := key.(ed25519.PrivateKey); ok {
+			return key, nil
+		}
+		return nil, errors.New("not an Ed25519 key")
+	}
+	seed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, errors.New("must be PEM or the base64 of a 32 byte seed")
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+// responseSignature returns the X-Registry-Signature of a lookup:
+// "ed25519=" and the base64 Ed25519 signature of body.
+func responseSignature(key ed25519.PrivateKey, body []byte) string {
+	return "ed25519=" + base64.StdEncoding.EncodeToString(ed25519.Sign(key, body))
+}
+
+// webhookSignature returns the X-Registry-Signature of a webhook request:
+// "sha256=" and the hex HMAC-SHA256 of body under secret.
+func webhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// serveSigningKey serves the public key lookups are verified with.
+func (s *Server) serveSigningKey(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	der, err := x509.MarshalPKIXPublicKey(s.config.responseSigningKey.Public())
+	if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	response := goproxy.NewResponse(r, "application/x-pem-file", http.StatusOK, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der})))
+	response.Header.Set("Cache-Control", "public, max-age=3600")
+	return r, response
+}
@@ -0,0 +1,133 @@
+package registry
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// With HTML pages on, /sitemap.xml indexes the package pages for search
+// engines. It lists one /sitemap-{n}.xml per sitemapPageSize packages, each
+// with absolute URLs under SITE_URL. /robots.txt is always served and points
+// crawlers at the sitemap when there is one.
+
+const sitemapPageSize = 10000
+
+const sitemapNamespace = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+type sitemapLocation struct {
+	Loc string `xml:"loc"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name          `xml:"sitemapindex"`
+	Xmlns    string            `xml:"xmlns,attr"`
+	Sitemaps []sitemapLocation `xml:"sitemap"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name          `xml:"urlset"`
+	Xmlns   string            `xml:"xmlns,attr"`
+	URLs    []sitemapLocation `xml:"url"`
+}
+
+var sitemapOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/sitemap.xml", Summary: "Sitemap index of the package pages"},
+	{Method: http.MethodGet, Path: "/sitemap-{page}.xml", Summary: "Package pages for search engines"},
+}
+
+func sitemapPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return req.Method == http.MethodGet && strings.HasPrefix(req.URL.Path, "/sitemap") && strings.HasSuffix(req.URL.Path, ".xml")
+	}
+}
+
+func (s *Server) sitemapHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if r.URL.Path == "/sitemap.xml" {
+		return r, s.sitemapIndex(r)
+	}
+	page, err := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/sitemap-"), ".xml"))
+	if err != nil || page < 1 {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+	}
+	return r, s.sitemapPage(r, page)
+}
+
+func (s *Server) sitemapIndex(r *http.Request) *http.Response {
+	count, err := s.store.CountPackages()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	index := sitemapIndex{Xmlns: sitemapNamespace}
+	// The first page also has the home page, so there is always one.
+	for page := 1; page == 1 || int64(page-1)*sitemapPageSize < count; page++ {
+		index.Sitemaps = append(index.Sitemaps, sitemapLocation{fmt.Sprintf("%s/sitemap-%d.xml", s.config.siteURL, page)})
+	}
+	return xmlResponse(r, index)
+}
+
+func (s *Server) sitemapPage(r *http.Request, page int) *http.Response {
+	packages, err := s.store.ListPackageDetails((page-1)*sitemapPageSize, sitemapPageSize)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if len(packages) == 0 && page > 1 {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+	}
+	set := sitemapURLSet{Xmlns: sitemapNamespace}
+	if page == 1 {
+		set.URLs = append(set.URLs, sitemapLocation{s.config.siteURL + "/"})
+	}
+	for _, p := range packages {
+		set.URLs = append(set.URLs, sitemapLocation{s.config.siteURL + "/packages/" + url.PathEscape(p.Name)})
+	}
+	return xmlResponse(r, set)
+}
+
+func xmlResponse(r *http.Request, v interface{}) *http.Response {
+	data, err := xml.Marshal(v)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	response := goproxy.NewResponse(r, "application/xml", http.StatusOK, xml.Header+string(data))
+	response.Header.Set("Cache-Control", "public, max-age=3600")
+	return response
+}
+
+// loadRobotsTxt reads ROBOTS_TXT_FILE, or else disallows ROBOTS_DISALLOW:
+// by default only /admin/ with HTML pages on, and everything without them.
+func loadRobotsTxt(cfg ServerConfig) (string, error) {
+	if path := getEnv("ROBOTS_TXT_FILE", ""); path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("Invalid ROBOTS_TXT_FILE: %s", err)
+		}
+		return string(data), nil
+	}
+	disallow := "/"
+	if cfg.htmlPages {
+		disallow = "/admin/"
+	}
+	robots := "User-agent: *\n"
+	for _, path := range strings.Split(getEnv("ROBOTS_DISALLOW", disallow), ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			robots += "Disallow: " + path + "\n"
+		}
+	}
+	if cfg.htmlPages {
+		robots += "\nSitemap: " + cfg.siteURL + "/sitemap.xml\n"
+	}
+	return robots, nil
+}
+
+func (s *Server) serveRobotsTxt(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	response := goproxy.NewResponse(r, "text/plain", http.StatusOK, s.config.robotsTxt)
+	response.Header.Set("Cache-Control", "public, max-age=86400")
+	return r, response
+}
@@ -0,0 +1,310 @@
+package registry
+
+import (
+	"expvar"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Response times are recorded per route in histograms with exponential
+// buckets. /metrics has the histograms since the start of the process and
+// /debug/slo the 50th, 95th and 99th percentiles of the last minute, five
+// minutes and hour, with the share of requests served within SLO_TARGET.
+
+// latencyBounds are the upper bounds of the histogram buckets, doubling
+// from 1ms to about 33s; slower requests fall in a last, open bucket.
+var latencyBounds = func() []time.Duration {
+	bounds := make([]time.Duration, 16)
+	for i := range bounds {
+		bounds[i] = time.Millisecond << uint(i)
+	}
+	return bounds
+}()
+
+// sloWindows are the sliding windows of /debug/slo, at most an hour.
+var sloWindows = []struct {
+	name    string
+	minutes int
+}{
+	{"1m", 1},
+	{"5m", 5},
+	{"1h", 60},
+}
+
+type latencyHistogram struct {
+	counts [17]int64
+	total  int64
+	sum    time.Duration
+}
+
+func (h *latencyHistogram) observe(d time.Duration) {
+	i := sort.Search(len(latencyBounds), func(i int) bool { return d <= latencyBounds[i] })
+	h.counts[i]++
+	h.total++
+	h.sum += d
+}
+
+func (h *latencyHistogram) merge(o *latencyHistogram) {
+	for i, n := range o.counts {
+		h.counts[i] += n
+	}
+	h.total += o.total
+	h.sum += o.sum
+}
+
+// quantile estimates the q-quantile by interpolating within its bucket.
+// The open bucket is reported at its lower bound.
+func (h *latencyHistogram) quantile(q float64) time.Duration {
+	if h.total == 0 {
+		return 0
+	}
+	rank := q * float64(h.total)
+	var seen float64
+	for i, n := range h.counts {
+		if n == 0 || seen+float64(n) < rank {
+			seen += float64(n)
+			continue
+		}
+		if i == len(latencyBounds) {
+			return latencyBounds[i-1]
+		}
+		var lower time.Duration
+		if i > 0 {
+			lower = latencyBounds[i-1]
+		}
+		return lower + time.Duration(float64(latencyBounds[i]-lower)*(rank-seen)/float64(n))
+	}
+	return latencyBounds[len(latencyBounds)-1]
+}
+
+// within counts the requests served in at most target, rounded to the
+// bucket that contains target.
+func (h *latencyHistogram) within(target time.Duration) int64 {
+	var n int64
+	for i, bound := range latencyBounds {
+		if bound > target {
+			break
+		}
+		n += h.counts[i]
+	}
+	return n
+}
+
+// routeLatency keeps the histogram of a route since the start of the
+// process and one per minute of the last hour.
+type routeLatency struct {
+	total   latencyHistogram
+	minutes [60]latencyHistogram
+	// stamps are the minutes, since the epoch, minutes[i] counts.
+	stamps [60]int64
+}
+
+func (l *routeLatency) observe(now time.Time, d time.Duration) {
+	minute := now.Unix() / 60
+	i := minute % 60
+	if l.stamps[i] != minute {
+		l.minutes[i], l.stamps[i] = latencyHistogram{}, minute
+	}
+	l.minutes[i].observe(d)
+	l.total.observe(d)
+}
+
+// window merges the histograms of the last n minutes.
+func (l *routeLatency) window(now time.Time, n int) latencyHistogram {
+	var h latencyHistogram
+	minute := now.Unix() / 60
+	for m := minute - int64(n) + 1; m <= minute; m++ {
+		if i := m % 60; l.stamps[i] == m {
+			h.merge(&l.minutes[i])
+		}
+	}
+	return h
+}
+
+type routePattern struct {
+	method string
+	re     *regexp.Regexp
+	name   string
+	// literal is the length of the template without its parameters; the
+	// most specific template wins.
+	literal int
+}
+
+var routeParam = regexp.MustCompile(`\{([^}]+)\}`)
+
+// routeMatcher sorts requests into the routes of the OpenAPI document,
+// named like "GET /packages/{name}".
+type routeMatcher []routePattern
+
+func newRouteMatcher(ops []apiOperation) routeMatcher {
+	var m routeMatcher
+	for _, op := range ops {
+		literals := routeParam.Split(op.Path, -1)
+		params := routeParam.FindAllStringSubmatch(op.Path, -1)
+		expr := "^" + regexp.QuoteMeta(literals[0])
+		for i, p := range params {
+			expr += "(?P<" + p[1] + ">.+)" + regexp.QuoteMeta(literals[i+1])
+		}
+		m = append(m, routePattern{
+			method:  op.Method,
+			re:      regexp.MustCompile(expr + "$"),
+			name:    op.Method + " " + op.Path,
+			literal: len(routeParam.ReplaceAllString(op.Path, "")),
+		})
+	}
+	sort.SliceStable(m, func(i, j int) bool { return m[i].literal > m[j].literal })
+	return m
+}
+
+// match returns the route of r with its path parameters, or "other".
+func (m routeMatcher) match(r *http.Request) (string, map[string]string) {
+	method := r.Method
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	for _, p := range m {
+		if p.method != method {
+			continue
+		}
+		if values := p.re.FindStringSubmatch(r.URL.Path); values != nil {
+			params := map[string]string{}
+			for i, name := range p.re.SubexpNames()[1:] {
+				params[name] = values[i+1]
+			}
+			return p.name, params
+		}
+	}
+	return "other", nil
+}
+
+// route names the route of r, or "other".
+func (m routeMatcher) route(r *http.Request) string {
+	name, _ := m.match(r)
+	return name
+}
+
+// latencyTracker keeps the response times of each route.
+type latencyTracker struct {
+	routes routeMatcher
+	target time.Duration
+
+	mu        sync.Mutex
+	latencies map[string]*routeLatency
+}
+
+func newLatencyTracker(routes routeMatcher, target time.Duration) *latencyTracker {
+	return &latencyTracker{routes: routes, target: target, latencies: map[string]*routeLatency{}}
+}
+
+func (t *latencyTracker) observe(route string, now time.Time, d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := t.latencies[route]
+	if l == nil {
+		l = &routeLatency{}
+		t.latencies[route] = l
+	}
+	l.observe(now, d)
+}
+
+// trackLatency times every request but event streams and CONNECT tunnels,
+// which stay open for as long as the client wants.
+func trackLatency(next http.Handler, t *latencyTracker) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect || r.URL.Path == "/events" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		next.ServeHTTP(w, r)
+		t.observe(t.routes.route(r), start, time.Since(start))
+	})
+}
+
+// metric shows the cumulative histograms in /metrics, keyed by the upper
+// bound of each bucket in milliseconds.
+func (t *latencyTracker) metric() interface{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	m := map[string]interface{}{}
+	for route, l := range t.latencies {
+		buckets := map[string]int64{}
+		var cumulative int64
+		for i, n := range l.total.counts {
+			cumulative += n
+			le := "+Inf"
+			if i < len(latencyBounds) {
+				le = strconv.FormatInt(int64(latencyBounds[i]/time.Millisecond), 10)
+			}
+			buckets[le] = cumulative
+		}
+		m[route] = map[string]interface{}{
+			"buckets": buckets,
+			"count":   l.total.total,
+			"sum_ms":  milliseconds(l.total.sum),
+		}
+	}
+	return m
+}
+
+// SLOWindow summarizes the response times of a route over a window.
+type SLOWindow struct {
+	Requests int64   `json:"requests"`
+	P50      float64 `json:"p50_ms"`
+	P95      float64 `json:"p95_ms"`
+	P99      float64 `json:"p99_ms"`
+	// WithinTarget is the share of requests served within the target.
+	WithinTarget float64 `json:"within_target"`
+}
+
+// SLOReport is served at /debug/slo.
+type SLOReport struct {
+	TargetMS float64                         `json:"target_ms"`
+	Routes   map[string]map[string]SLOWindow `json:"routes"`
+}
+
+func (t *latencyTracker) report(now time.Time) SLOReport {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := SLOReport{TargetMS: milliseconds(t.target), Routes: map[string]map[string]SLOWindow{}}
+	for route, l := range t.latencies {
+		windows := map[string]SLOWindow{}
+		for _, w := range sloWindows {
+			h := l.window(now, w.minutes)
+			if h.total == 0 {
+				continue
+			}
+			windows[w.name] = SLOWindow{
+				Requests:     h.total,
+				P50:          milliseconds(h.quantile(0.50)),
+				P95:          milliseconds(h.quantile(0.95)),
+				P99:          milliseconds(h.quantile(0.99)),
+				WithinTarget: float64(h.within(t.target)) / float64(h.total),
+			}
+		}
+		if len(windows) > 0 {
+			report.Routes[route] = windows
+		}
+	}
+	return report
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Nanoseconds()/1000) / 1000
+}
+
+func (s *Server) serveSLO(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	response := jsonResponse(r, http.StatusOK, s.latency.report(time.Now()))
+	response.Header.Set("Cache-Control", "no-store")
+	return r, response
+}
+
+func (t *latencyTracker) publish() {
+	metrics.Set("latency", expvar.Func(t.metric))
+}
@@ -0,0 +1,1394 @@
+package registry
+
+import (
+	"database/sql"
+	"encoding/json"
+	"math"
+	"strings"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// sqliteStore keeps the registry in a single SQLite file for deployments
+// without Postgres. The node app only speaks Postgres, so it has to be run
+// with SIDECAR_DISABLED=true; the registry then registers packages itself,
+// see register.go.
+//
+// The driver needs cgo; without it, opening the database fails.
+type sqliteStore struct {
+	db *sql.DB
+}
+
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS packages (
+	id INTEGER PRIMARY KEY,
+	tenant TEXT NOT NULL DEFAULT '',
+	name TEXT NOT NULL,
+	url TEXT NOT NULL,
+	description TEXT,
+	keywords TEXT,
+	organization TEXT,
+	created_at TIMESTAMP,
+	hits INTEGER DEFAULT 0,
+	cache_ttl INTEGER,
+	updated_at INTEGER,
+	status TEXT NOT NULL DEFAULT 'ok',
+	check_failures INTEGER NOT NULL DEFAULT 0,
+	checked_at TIMESTAMP,
+	next_check_at TIMESTAMP,
+	stars INTEGER NOT NULL DEFAULT 0,
+	license TEXT,
+	archived INTEGER NOT NULL DEFAULT 0,
+	enriched_at TIMESTAMP,
+	deprecation_message TEXT,
+	deprecation_replacement TEXT,
+	visibility TEXT NOT NULL DEFAULT 'public',
+	normalized_url TEXT,
+	UNIQUE (tenant, name)
+);
+CREATE INDEX IF NOT EXISTS packages_next_check_at_index ON packages (next_check_at);
+CREATE TABLE IF NOT EXISTS tenants (
+	name TEXT PRIMARY KEY,
+	hosts TEXT NOT NULL DEFAULT '[]',
+	admin_token_hash TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS organizations (
+	name TEXT PRIMARY KEY,
+	token_hash TEXT NOT NULL,
+	email TEXT,
+	notifications INTEGER NOT NULL DEFAULT 1
+);
+CREATE TABLE IF NOT EXISTS organization_members (
+	organization TEXT NOT NULL,
+	name TEXT NOT NULL,
+	token_hash TEXT NOT NULL UNIQUE,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (organization, name)
+);
+CREATE TABLE IF NOT EXISTS teams (
+	organization TEXT NOT NULL,
+	name TEXT NOT NULL,
+	PRIMARY KEY (organization, name)
+);
+CREATE TABLE IF NOT EXISTS team_members (
+	organization TEXT NOT NULL,
+	team TEXT NOT NULL,
+	member TEXT NOT NULL,
+	PRIMARY KEY (organization, team, member)
+);
+CREATE TABLE IF NOT EXISTS team_packages (
+	organization TEXT NOT NULL,
+	team TEXT NOT NULL,
+	package TEXT NOT NULL,
+	permission TEXT NOT NULL,
+	PRIMARY KEY (organization, team, package)
+);
+CREATE TABLE IF NOT EXISTS api_keys (
+	name TEXT PRIMARY KEY,
+	token_hash TEXT NOT NULL UNIQUE,
+	scopes TEXT NOT NULL DEFAULT '[]',
+	created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS api_key_publications (
+	key_name TEXT NOT NULL,
+	package TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS api_key_publications_key_index ON api_key_publications (key_name, created_at);
+CREATE TABLE IF NOT EXISTS versions (
+	url TEXT NOT NULL,
+	tag TEXT NOT NULL,
+	sha256 TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	PRIMARY KEY (url, tag)
+);
+CREATE TABLE IF NOT EXISTS dependencies (
+	url TEXT NOT NULL,
+	name TEXT NOT NULL,
+	version_range TEXT NOT NULL,
+	dev INTEGER NOT NULL DEFAULT 0,
+	PRIMARY KEY (url, name, dev)
+);
+CREATE INDEX IF NOT EXISTS dependencies_name_index ON dependencies (name);
+CREATE TABLE IF NOT EXISTS held_registrations (
+	name TEXT PRIMARY KEY,
+	url TEXT NOT NULL,
+	similar_to TEXT NOT NULL,
+	distance INTEGER NOT NULL,
+	created_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS aliases (
+	alias TEXT PRIMARY KEY,
+	package TEXT NOT NULL
+);
+CREATE TABLE IF NOT EXISTS client_stats (
+	day TIMESTAMP NOT NULL,
+	client TEXT NOT NULL,
+	version TEXT NOT NULL,
+	requests INTEGER NOT NULL,
+	PRIMARY KEY (day, client, version)
+);
+CREATE TABLE IF NOT EXISTS deprecated_requests (
+	day TIMESTAMP NOT NULL,
+	dimension TEXT NOT NULL,
+	value TEXT NOT NULL,
+	requests INTEGER NOT NULL,
+	PRIMARY KEY (day, dimension, value)
+);
+CREATE TABLE IF NOT EXISTS package_downloads (
+	name TEXT NOT NULL,
+	period TEXT NOT NULL,
+	start TIMESTAMP NOT NULL,
+	downloads INTEGER NOT NULL,
+	PRIMARY KEY (name, period, start)
+);
+CREATE INDEX IF NOT EXISTS package_downloads_period_index ON package_downloads (period, start);
+CREATE TABLE IF NOT EXISTS package_tombstones (
+	name TEXT PRIMARY KEY,
+	url TEXT NOT NULL,
+	deleted_at INTEGER NOT NULL
+);
+CREATE TABLE IF NOT EXISTS package_transfers (
+	package TEXT PRIMARY KEY,
+	from_org TEXT NOT NULL,
+	to_org TEXT NOT NULL,
+	token_hash TEXT NOT NULL,
+	created_at TIMESTAMP NOT NULL,
+	expires_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS feature_flags (
+	name TEXT PRIMARY KEY,
+	enabled BOOLEAN NOT NULL,
+	updated_at TIMESTAMP NOT NULL
+);
+CREATE TABLE IF NOT EXISTS audit_log (
+	id INTEGER PRIMARY KEY,
+	at TIMESTAMP NOT NULL,
+	actor TEXT NOT NULL,
+	action TEXT NOT NULL,
+	package TEXT,
+	detail TEXT
+);
+CREATE INDEX IF NOT EXISTS audit_log_package_index ON audit_log (package);`
+
+// sqliteChangeTriggers keep updated_at and the tombstones of the default
+// registry, in Unix nanoseconds, whoever writes to the database. They are
+// created after the columns they use have been added.
+const sqliteChangeTriggers = `
+CREATE INDEX IF NOT EXISTS packages_updated_at_index ON packages (updated_at, name);
+CREATE TRIGGER IF NOT EXISTS packages_insert_change AFTER INSERT ON packages WHEN NEW.tenant = '' BEGIN
+	UPDATE packages SET updated_at = CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER) WHERE id = NEW.id;
+	DELETE FROM package_tombstones WHERE name = NEW.name;
+END;
+CREATE TRIGGER IF NOT EXISTS packages_update_change AFTER UPDATE OF name, url, description, keywords ON packages
+WHEN NEW.tenant = '' AND (NEW.name IS NOT OLD.name OR NEW.url IS NOT OLD.url OR NEW.description IS NOT OLD.description OR NEW.keywords IS NOT OLD.keywords) BEGIN
+	UPDATE packages SET updated_at = CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER) WHERE id = NEW.id;
+	DELETE FROM package_tombstones WHERE name = NEW.name;
+	INSERT OR REPLACE INTO package_tombstones (name, url, deleted_at)
+		SELECT OLD.name, OLD.url, CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER) WHERE NEW.name IS NOT OLD.name;
+END;
+CREATE TRIGGER IF NOT EXISTS packages_delete_change AFTER DELETE ON packages WHEN OLD.tenant = '' BEGIN
+	INSERT OR REPLACE INTO package_tombstones (name, url, deleted_at)
+		VALUES (OLD.name, OLD.url, CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER));
+END;`
+
+// sqliteNormalizedURLs gives packages without a normalized_url, created
+// before there was one or copied by Restore and ApplyChanges, their
+// lowercased URL unless another package of the tenant has it, see
+// normalizeURL.
+const sqliteNormalizedURLs = `
+CREATE UNIQUE INDEX IF NOT EXISTS packages_normalized_url_unique ON packages (tenant, normalized_url);
+UPDATE OR IGNORE packages SET normalized_url = lower(url) WHERE normalized_url IS NULL;`
+
+// openSQLite opens or creates the database file at path.
+func openSQLite(path string) (*sqliteStore, error) {
+	db, err := sql.Open("sqlite3", path+"?_busy_timeout=5000&_journal_mode=WAL")
+	if err != nil {
+		return nil, err
+	}
+	// SQLite allows a single writer; one connection avoids "database is
+	// locked" errors between concurrent requests.
+	db.SetMaxOpenConns(1)
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	// Columns added after a database was created. SQLite has no ADD COLUMN
+	// IF NOT EXISTS, so the error for an existing column is ignored.
+	for _, column := range []string{
+		"packages ADD COLUMN cache_ttl INTEGER",
+		"packages ADD COLUMN updated_at INTEGER",
+		"packages ADD COLUMN stars INTEGER NOT NULL DEFAULT 0",
+		"packages ADD COLUMN license TEXT",
+		"packages ADD COLUMN archived INTEGER NOT NULL DEFAULT 0",
+		"packages ADD COLUMN enriched_at TIMESTAMP",
+		"packages ADD COLUMN deprecation_message TEXT",
+		"packages ADD COLUMN deprecation_replacement TEXT",
+		"packages ADD COLUMN visibility TEXT NOT NULL DEFAULT 'public'",
+		"packages ADD COLUMN normalized_url TEXT",
+		"organizations ADD COLUMN email TEXT",
+		"organizations ADD COLUMN notifications INTEGER NOT NULL DEFAULT 1",
+		"api_keys ADD COLUMN daily_quota INTEGER NOT NULL DEFAULT 0",
+		"api_keys ADD COLUMN total_quota INTEGER NOT NULL DEFAULT 0",
+	} {
+		if _, err := db.Exec(`ALTER TABLE ` + column); err != nil && !strings.Contains(err.Error(), "duplicate column") {
+			db.Close()
+			return nil, err
+		}
+	}
+	if _, err := db.Exec(sqliteChangeTriggers); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteNormalizedURLs); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStore{db: db}, nil
+}
+
+func (s *sqliteStore) Close() {
+	s.db.Close()
+}
+
+func (s *sqliteStore) queryPackages(query string, args ...interface{}) ([]Package, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packages []Package
+	for rows.Next() {
+		var p Package
+		if err := rows.Scan(&p.Name, &p.URL); err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	return packages, rows.Err()
+}
+
+func (s *sqliteStore) queryPackage(query string, args ...interface{}) (Package, error) {
+	var p Package
+	err := s.db.QueryRow(query, args...).Scan(&p.Name, &p.URL)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return p, err
+}
+
+// exec mirrors postgresStore.exec. The driver isn't imported here, so unique
+// violations are recognized by their message.
+func (s *sqliteStore) exec(mustAffect bool, query string, args ...interface{}) error {
+	res, err := s.db.Exec(query, args...)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE constraint failed: packages.tenant, packages.normalized_url") {
+			return ErrURLTaken
+		}
+		if strings.Contains(err.Error(), "UNIQUE constraint failed") {
+			return ErrExists
+		}
+		return err
+	}
+	if mustAffect {
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) GetPackage(name string) (Package, error) {
+	var p Package
+	var ttl sql.NullInt64
+	var message, replacement sql.NullString
+	var updated sql.NullInt64
+	err := s.db.QueryRow(`SELECT name, url, cache_ttl, deprecation_message, deprecation_replacement, visibility = 'private', updated_at FROM packages WHERE tenant = '' AND name = ?`, name).
+		Scan(&p.Name, &p.URL, &ttl, &message, &replacement, &p.Private, &updated)
+	if err == sql.ErrNoRows {
+		return p, ErrNotFound
+	}
+	if updated.Valid {
+		p.UpdatedAt = time.Unix(0, updated.Int64).UTC()
+	}
+	if ttl.Valid {
+		p.CacheTTL = time.Duration(ttl.Int64) * time.Second
+	}
+	p.Deprecated = sqliteDeprecation(message, replacement)
+	return p, err
+}
+
+func (s *sqliteStore) ListPackages() ([]Package, error) {
+	return s.queryPackages(`SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY name`)
+}
+
+// EachPackage loads the list first: holding the only connection while a
+// slow client reads would block every other query.
+func (s *sqliteStore) EachPackage(fn func(Package) error) error {
+	packages, err := s.ListPackages()
+	if err != nil {
+		return err
+	}
+	for _, p := range packages {
+		if err := fn(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *sqliteStore) CountPackages() (int64, error) {
+	var n int64
+	err := s.db.QueryRow(`SELECT count(*) FROM packages WHERE tenant = '' AND visibility = 'public'`).Scan(&n)
+	return n, err
+}
+
+func (s *sqliteStore) PackageDetails(name string) (PackageDetails, error) {
+	var p PackageDetails
+	var keywords, message, replacement sql.NullString
+	var hits sql.NullInt64
+	err := s.db.QueryRow(`SELECT name, url, coalesce(description, ''), keywords, created_at, hits, status, stars, coalesce(license, ''), archived, deprecation_message, deprecation_replacement, visibility = 'private' FROM packages WHERE tenant = '' AND name = ?`, name).
+		Scan(&p.Name, &p.URL, &p.Description, &keywords, &p.CreatedAt, &hits, &p.Status, &p.Stars, &p.License, &p.Archived, &message, &replacement, &p.Private)
+	if err == sql.ErrNoRows {
+		return p, ErrNotFound
+	} else if err != nil {
+		return p, err
+	}
+	p.Hits = int32(hits.Int64)
+	p.Deprecated = sqliteDeprecation(message, replacement)
+	if keywords.Valid {
+		json.Unmarshal([]byte(keywords.String), &p.Keywords)
+	}
+	return p, nil
+}
+
+func (s *sqliteStore) ListPackageDetails(offset, limit int) ([]PackageDetails, error) {
+	return s.queryPackageDetails(`SELECT name, url, coalesce(description, ''), keywords, created_at, updated_at, hits, status, stars, coalesce(license, ''), archived, deprecation_message, deprecation_replacement FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY name LIMIT ? OFFSET ?`, limit, offset)
+}
+
+func (s *sqliteStore) RecentPackageDetails(limit int) ([]PackageDetails, error) {
+	return s.queryPackageDetails(`SELECT name, url, coalesce(description, ''), keywords, created_at, updated_at, hits, status, stars, coalesce(license, ''), archived, deprecation_message, deprecation_replacement FROM packages WHERE tenant = '' AND visibility = 'public' AND updated_at IS NOT NULL ORDER BY updated_at DESC, name DESC LIMIT ?`, limit)
+}
+
+func (s *sqliteStore) queryPackageDetails(query string, args ...interface{}) ([]PackageDetails, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []PackageDetails{}
+	for rows.Next() {
+		var p PackageDetails
+		var keywords, message, replacement sql.NullString
+		var hits, updated sql.NullInt64
+		if err := rows.Scan(&p.Name, &p.URL, &p.Description, &keywords, &p.CreatedAt, &updated, &hits, &p.Status, &p.Stars, &p.License, &p.Archived, &message, &replacement); err != nil {
+			return nil, err
+		}
+		if updated.Valid {
+			t := time.Unix(0, updated.Int64).UTC()
+			p.UpdatedAt = &t
+		}
+		p.Hits = int32(hits.Int64)
+		p.Deprecated = sqliteDeprecation(message, replacement)
+		if keywords.Valid {
+			json.Unmarshal([]byte(keywords.String), &p.Keywords)
+		}
+		list = append(list, p)
+	}
+	return list, rows.Err()
+}
+
+// PackageChanges treats packages from before updated_at was added as
+// changed at the epoch, so a full sync picks them up.
+func (s *sqliteStore) PackageChanges(since time.Time, after string, limit int) ([]PackageChange, error) {
+	at := since.UnixNano()
+	rows, err := s.db.Query(`SELECT name, url, coalesce(updated_at, 0), visibility = 'private' FROM packages
+		WHERE tenant = '' AND (coalesce(updated_at, 0) > ? OR coalesce(updated_at, 0) = ? AND name > ?)
+		UNION ALL SELECT name, url, deleted_at, 1 FROM package_tombstones WHERE deleted_at > ? OR deleted_at = ? AND name > ?
+		ORDER BY 3, 1 LIMIT ?`, at, at, after, at, at, after, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	changes := []PackageChange{}
+	for rows.Next() {
+		var c PackageChange
+		var nanos int64
+		if err := rows.Scan(&c.Name, &c.URL, &nanos, &c.Deleted); err != nil {
+			return nil, err
+		}
+		c.At = time.Unix(0, nanos).UTC()
+		changes = append(changes, c)
+	}
+	return changes, rows.Err()
+}
+
+func (s *sqliteStore) PackageByURL(urls ...string) (Package, error) {
+	if len(urls) == 0 {
+		return Package{}, ErrNotFound
+	}
+	query := `SELECT name, url FROM packages WHERE tenant = '' AND lower(url) IN (?` + strings.Repeat(", ?", len(urls)-1) + `) ORDER BY created_at LIMIT 1`
+	args := make([]interface{}, len(urls))
+	for i, u := range urls {
+		args[i] = u
+	}
+	return s.queryPackage(query, args...)
+}
+
+// Search matches substrings of the name, URL and description; there is no
+// full-text ranking, so exact names come first, then packages neither
+// archived nor deprecated, then by GitHub stars and popularity.
+func (s *sqliteStore) Search(term string, limit int) ([]SearchResult, error) {
+	query := `SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' ORDER BY archived OR deprecation_message IS NOT NULL, hits DESC LIMIT ?1`
+	args := []interface{}{limit}
+	if term != "" {
+		query = `SELECT name, url FROM packages
+			WHERE tenant = '' AND visibility = 'public' AND (name LIKE ?2 ESCAPE '\' OR url LIKE ?2 ESCAPE '\' OR description LIKE ?2 ESCAPE '\')
+			ORDER BY lower(name) = ?3 DESC, archived OR deprecation_message IS NOT NULL, stars DESC, hits DESC LIMIT ?1`
+		args = append(args, "%"+escapeLike(term)+"%", term)
+	}
+	packages, err := s.queryPackages(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]SearchResult, len(packages))
+	for i, p := range packages {
+		results[i] = SearchResult{Name: p.Name, URL: p.URL}
+	}
+	return results, nil
+}
+
+// PackagesByPrefix uses GLOB, which unlike LIKE is case sensitive and so
+// served by the (tenant, name) index. Names have no GLOB wildcards.
+func (s *sqliteStore) PackagesByPrefix(prefix string, limit int) ([]Package, error) {
+	if strings.ContainsAny(prefix, "*?[") {
+		return nil, nil
+	}
+	return s.queryPackages(`SELECT name, url FROM packages WHERE tenant = '' AND visibility = 'public' AND name GLOB ? ORDER BY name LIMIT ?`, prefix+"*", limit)
+}
+
+func (s *sqliteStore) DueURLChecks(limit int) ([]Package, error) {
+	return s.queryPackages(`SELECT name, url FROM packages WHERE next_check_at IS NULL OR next_check_at <= ? ORDER BY next_check_at IS NOT NULL, next_check_at LIMIT ?`, time.Now().UTC(), limit)
+}
+
+func (s *sqliteStore) RecordURLSuccess(p Package, next time.Duration) error {
+	now := time.Now().UTC()
+	return s.exec(false, `UPDATE packages SET status = 'ok', check_failures = 0, checked_at = ?, next_check_at = ? WHERE name = ? AND url = ?`,
+		now, now.Add(next), p.Name, p.URL)
+}
+
+func (s *sqliteStore) RecordURLFailure(p Package, threshold int, base, max time.Duration) (bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var failures int
+	if err := tx.QueryRow(`SELECT check_failures FROM packages WHERE name = ? AND url = ?`, p.Name, p.URL).Scan(&failures); err != nil {
+		if err == sql.ErrNoRows {
+			return false, nil
+		}
+		return false, err
+	}
+	backoff := time.Duration(math.Min(float64(base)*math.Pow(2, float64(failures)), float64(max)))
+	now := time.Now().UTC()
+	if _, err := tx.Exec(`UPDATE packages SET check_failures = check_failures + 1, status = CASE WHEN check_failures + 1 >= ? THEN 'broken' ELSE status END, checked_at = ?, next_check_at = ? WHERE name = ? AND url = ?`,
+		threshold, now, now.Add(backoff), p.Name, p.URL); err != nil {
+		return false, err
+	}
+	return failures+1 == threshold, tx.Commit()
+}
+
+func (s *sqliteStore) DueEnrichments(before time.Time, limit int) ([]Package, error) {
+	return s.queryPackages(`SELECT name, url FROM packages WHERE tenant = '' AND lower(url) LIKE '%github.com%' AND (enriched_at IS NULL OR enriched_at < ?) ORDER BY enriched_at IS NOT NULL, enriched_at LIMIT ?`, before.UTC(), limit)
+}
+
+func (s *sqliteStore) RecordEnrichment(p Package, m *RepoMetadata) error {
+	now := time.Now().UTC()
+	if m == nil {
+		return s.exec(false, `UPDATE packages SET enriched_at = ? WHERE tenant = '' AND name = ? AND url = ?`, now, p.Name, p.URL)
+	}
+	return s.exec(false, `UPDATE packages SET description = coalesce(nullif(?, ''), description), stars = ?, license = nullif(?, ''), archived = ?, enriched_at = ? WHERE tenant = '' AND name = ? AND url = ?`,
+		m.Description, m.Stars, m.License, m.Archived, now, p.Name, p.URL)
+}
+
+func (s *sqliteStore) VersionChecksums(url string) (map[string]string, error) {
+	rows, err := s.db.Query(`SELECT tag, sha256 FROM versions WHERE url = ?`, url)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sums := map[string]string{}
+	for rows.Next() {
+		var tag, sum string
+		if err := rows.Scan(&tag, &sum); err != nil {
+			return nil, err
+		}
+		sums[tag] = sum
+	}
+	return sums, rows.Err()
+}
+
+func (s *sqliteStore) RecordChecksum(url, tag, sum string) error {
+	return s.exec(false, `INSERT OR IGNORE INTO versions (url, tag, sha256, created_at) VALUES (?, ?, ?, ?)`, url, tag, sum, time.Now().UTC())
+}
+
+func (s *sqliteStore) Dependencies(url string) ([]Dependency, error) {
+	return s.queryDependencies(`SELECT name, version_range, dev FROM dependencies WHERE url = ? ORDER BY name, dev`, url)
+}
+
+func (s *sqliteStore) RecordDependencies(url string, deps []Dependency) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM dependencies WHERE url = ?`, url); err != nil {
+		return err
+	}
+	for _, d := range deps {
+		if _, err := tx.Exec(`INSERT OR IGNORE INTO dependencies (url, name, version_range, dev) VALUES (?, ?, ?, ?)`, url, d.Name, d.Range, d.Dev); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Dependents(name string, offset, limit int) ([]Dependency, error) {
+	return s.queryDependencies(`SELECT p.name, d.version_range, d.dev FROM dependencies d JOIN packages p ON p.url = d.url
+		WHERE d.name = ? AND p.tenant = '' AND p.visibility = 'public' ORDER BY p.name, d.dev LIMIT ? OFFSET ?`, name, limit, offset)
+}
+
+func (s *sqliteStore) queryDependencies(query string, args ...interface{}) ([]Dependency, error) {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deps := []Dependency{}
+	for rows.Next() {
+		var d Dependency
+		if err := rows.Scan(&d.Name, &d.Range, &d.Dev); err != nil {
+			return nil, err
+		}
+		deps = append(deps, d)
+	}
+	return deps, rows.Err()
+}
+
+func (s *sqliteStore) BrokenPackages() ([]BrokenPackage, error) {
+	rows, err := s.db.Query(`SELECT name, url, check_failures, checked_at FROM packages WHERE tenant = '' AND visibility = 'public' AND status = 'broken' ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	broken := []BrokenPackage{}
+	for rows.Next() {
+		var p BrokenPackage
+		if err := rows.Scan(&p.Name, &p.URL, &p.Failures, &p.CheckedAt); err != nil {
+			return nil, err
+		}
+		broken = append(broken, p)
+	}
+	return broken, rows.Err()
+}
+
+func (s *sqliteStore) ResolveAlias(alias string) (Package, error) {
+	return s.queryPackage(`SELECT p.name, p.url FROM aliases a JOIN packages p ON p.tenant = '' AND p.name = a.package WHERE a.alias = ?`, alias)
+}
+
+func (s *sqliteStore) ListAliases() ([]Alias, error) {
+	rows, err := s.db.Query(`SELECT alias, package FROM aliases ORDER BY alias`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	aliases := []Alias{}
+	for rows.Next() {
+		var a Alias
+		if err := rows.Scan(&a.Alias, &a.Package); err != nil {
+			return nil, err
+		}
+		aliases = append(aliases, a)
+	}
+	return aliases, rows.Err()
+}
+
+func (s *sqliteStore) CreateAlias(a Alias) error {
+	return s.exec(true, `INSERT INTO aliases (alias, package) SELECT ?1, ?2
+		WHERE EXISTS (SELECT 1 FROM packages WHERE tenant = '' AND name = ?2)
+		AND NOT EXISTS (SELECT 1 FROM packages WHERE tenant = '' AND name = ?1)`, a.Alias, a.Package)
+}
+
+func (s *sqliteStore) DeleteAlias(alias string) error {
+	return s.exec(true, `DELETE FROM aliases WHERE alias = ?`, alias)
+}
+
+func scanSQLiteAPIKey(row interface {
+	Scan(dest ...interface{}) error
+}) (APIKey, error) {
+	var k APIKey
+	var scopes string
+	if err := row.Scan(&k.Name, &k.TokenHash, &scopes, &k.DailyQuota, &k.TotalQuota, &k.CreatedAt); err != nil {
+		return k, err
+	}
+	return k, json.Unmarshal([]byte(scopes), &k.Scopes)
+}
+
+func (s *sqliteStore) APIKeyByTokenHash(tokenHash string) (APIKey, error) {
+	k, err := scanSQLiteAPIKey(s.db.QueryRow(`SELECT name, token_hash, scopes, daily_quota, total_quota, created_at FROM api_keys WHERE token_hash = ?`, tokenHash))
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return k, err
+}
+
+func (s *sqliteStore) ListAPIKeys() ([]APIKey, error) {
+	rows, err := s.db.Query(`SELECT name, token_hash, scopes, daily_quota, total_quota, created_at FROM api_keys ORDER BY name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		k, err := scanSQLiteAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	return keys, rows.Err()
+}
+
+func (s *sqliteStore) CreateAPIKey(k APIKey) error {
+	scopes, err := json.Marshal(k.Scopes)
+	if err != nil {
+		return err
+	}
+	return s.exec(false, `INSERT INTO api_keys (name, token_hash, scopes, daily_quota, total_quota, created_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		k.Name, k.TokenHash, string(scopes), k.DailyQuota, k.TotalQuota, k.CreatedAt.UTC())
+}
+
+func (s *sqliteStore) DeleteAPIKey(name string) error {
+	if err := s.exec(true, `DELETE FROM api_keys WHERE name = ?`, name); err != nil {
+		return err
+	}
+	return s.exec(false, `DELETE FROM api_key_publications WHERE key_name = ?`, name)
+}
+
+// ReservePublication runs in a transaction, which the single connection
+// serializes with every other statement.
+func (s *sqliteStore) ReservePublication(key, pkg string, at, since, pending time.Time, daily, total int) (int, int, bool, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, 0, false, err
+	}
+	defer tx.Rollback()
+
+	var recent, registered int
+	err = tx.QueryRow(`SELECT
+			(SELECT count(*) FROM api_key_publications WHERE key_name = ? AND created_at >= ?),
+			(SELECT count(DISTINCT p.package) FROM api_key_publications p WHERE p.key_name = ? AND (p.created_at >= ?
+				OR EXISTS (SELECT 1 FROM packages WHERE packages.tenant = '' AND packages.name = p.package)))`,
+		key, since.UTC(), key, pending.UTC()).Scan(&recent, &registered)
+	if err != nil {
+		return 0, 0, false, err
+	}
+	if total > 0 && registered >= total || daily > 0 && recent >= daily {
+		return recent, registered, false, nil
+	}
+	if _, err := tx.Exec(`INSERT INTO api_key_publications (key_name, package, created_at) VALUES (?, ?, ?)`, key, pkg, at.UTC()); err != nil {
+		return 0, 0, false, err
+	}
+	return recent, registered, true, tx.Commit()
+}
+
+func (s *sqliteStore) ReleasePublication(key, pkg string, at time.Time) error {
+	return s.exec(false, `DELETE FROM api_key_publications WHERE key_name = ? AND package = ? AND created_at = ?`, key, pkg, at.UTC())
+}
+
+func (s *sqliteStore) OrganizationTokenHash(org string) (string, error) {
+	var tokenHash string
+	err := s.db.QueryRow(`SELECT token_hash FROM organizations WHERE name = ?`, org).Scan(&tokenHash)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return tokenHash, err
+}
+
+func (s *sqliteStore) CreateOrganization(name, tokenHash string) error {
+	return s.exec(false, `INSERT INTO organizations (name, token_hash) VALUES (?, ?)`, name, tokenHash)
+}
+
+func (s *sqliteStore) OrganizationContact(org string) (Contact, error) {
+	var c Contact
+	err := s.db.QueryRow(`SELECT coalesce(email, ''), notifications FROM organizations WHERE name = ?`, org).Scan(&c.Email, &c.Notifications)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return c, err
+}
+
+func (s *sqliteStore) SetOrganizationContact(org string, c Contact) error {
+	return s.exec(true, `UPDATE organizations SET email = nullif(?, ''), notifications = ? WHERE name = ?`, c.Email, c.Notifications, org)
+}
+
+func (s *sqliteStore) OrganizationPackages(org string) ([]Package, error) {
+	rows, err := s.db.Query(`SELECT name, url, visibility = 'private' FROM packages WHERE tenant = '' AND organization = ? ORDER BY name`, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var packages []Package
+	for rows.Next() {
+		var p Package
+		if err := rows.Scan(&p.Name, &p.URL, &p.Private); err != nil {
+			return nil, err
+		}
+		packages = append(packages, p)
+	}
+	return packages, rows.Err()
+}
+
+func (s *sqliteStore) OrganizationMembers(org string) ([]Member, error) {
+	rows, err := s.db.Query(`SELECT organization, name, token_hash, created_at FROM organization_members WHERE organization = ? ORDER BY name`, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	members := []Member{}
+	for rows.Next() {
+		var m Member
+		if err := rows.Scan(&m.Organization, &m.Name, &m.TokenHash, &m.CreatedAt); err != nil {
+			return nil, err
+		}
+		members = append(members, m)
+	}
+	return members, rows.Err()
+}
+
+func (s *sqliteStore) CreateMember(m Member) error {
+	return s.exec(true, `INSERT INTO organization_members (organization, name, token_hash, created_at) SELECT ?1, ?2, ?3, ?4
+		WHERE EXISTS (SELECT 1 FROM organizations WHERE name = ?1)`, m.Organization, m.Name, m.TokenHash, m.CreatedAt.UTC())
+}
+
+// DeleteMember removes the member from its teams itself; the schema has no
+// foreign keys to cascade.
+func (s *sqliteStore) DeleteMember(org, name string) error {
+	if err := s.exec(true, `DELETE FROM organization_members WHERE organization = ? AND name = ?`, org, name); err != nil {
+		return err
+	}
+	return s.exec(false, `DELETE FROM team_members WHERE organization = ? AND member = ?`, org, name)
+}
+
+func (s *sqliteStore) MemberByTokenHash(tokenHash string) (Member, error) {
+	var m Member
+	err := s.db.QueryRow(`SELECT organization, name, token_hash, created_at FROM organization_members WHERE token_hash = ?`, tokenHash).
+		Scan(&m.Organization, &m.Name, &m.TokenHash, &m.CreatedAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return m, err
+}
+
+func (s *sqliteStore) Teams(org string) ([]Team, error) {
+	names, err := s.db.Query(`SELECT name FROM teams WHERE organization = ? ORDER BY name`, org)
+	if err != nil {
+		return nil, err
+	}
+	teams := []Team{}
+	index := map[string]int{}
+	for names.Next() {
+		t := Team{Members: []string{}, Packages: []TeamPackage{}}
+		if err := names.Scan(&t.Name); err != nil {
+			names.Close()
+			return nil, err
+		}
+		index[t.Name] = len(teams)
+		teams = append(teams, t)
+	}
+	names.Close()
+	if err := names.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.Query(`SELECT team, member, '' FROM team_members WHERE organization = ?1
+		UNION ALL SELECT team, package, permission FROM team_packages WHERE organization = ?1 ORDER BY 2`, org)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var team, name, permission string
+		if err := rows.Scan(&team, &name, &permission); err != nil {
+			return nil, err
+		}
+		i, ok := index[team]
+		if !ok {
+			continue
+		}
+		if permission == "" {
+			teams[i].Members = append(teams[i].Members, name)
+		} else {
+			teams[i].Packages = append(teams[i].Packages, TeamPackage{Package: name, Permission: permission})
+		}
+	}
+	return teams, rows.Err()
+}
+
+func (s *sqliteStore) CreateTeam(org, name string) error {
+	return s.exec(true, `INSERT INTO teams (organization, name) SELECT ?1, ?2 WHERE EXISTS (SELECT 1 FROM organizations WHERE name = ?1)`, org, name)
+}
+
+func (s *sqliteStore) DeleteTeam(org, name string) error {
+	if err := s.exec(true, `DELETE FROM teams WHERE organization = ? AND name = ?`, org, name); err != nil {
+		return err
+	}
+	if err := s.exec(false, `DELETE FROM team_members WHERE organization = ? AND team = ?`, org, name); err != nil {
+		return err
+	}
+	return s.exec(false, `DELETE FROM team_packages WHERE organization = ? AND team = ?`, org, name)
+}
+
+func (s *sqliteStore) AddTeamMember(org, team, member string) error {
+	return s.exec(true, `INSERT INTO team_members (organization, team, member) SELECT ?1, ?2, ?3
+		WHERE EXISTS (SELECT 1 FROM teams WHERE organization = ?1 AND name = ?2) AND EXISTS (SELECT 1 FROM organization_members WHERE organization = ?1 AND name = ?3)`, org, team, member)
+}
+
+func (s *sqliteStore) RemoveTeamMember(org, team, member string) error {
+	return s.exec(true, `DELETE FROM team_members WHERE organization = ? AND team = ? AND member = ?`, org, team, member)
+}
+
+func (s *sqliteStore) SetTeamPackage(org, team string, g TeamPackage) error {
+	if g.Permission == "" {
+		return s.exec(true, `DELETE FROM team_packages WHERE organization = ? AND team = ? AND package = ?`, org, team, g.Package)
+	}
+	return s.exec(true, `INSERT OR REPLACE INTO team_packages (organization, team, package, permission) SELECT ?1, ?2, ?3, ?4
+		WHERE EXISTS (SELECT 1 FROM teams WHERE organization = ?1 AND name = ?2) AND EXISTS (SELECT 1 FROM packages WHERE tenant = '' AND name = ?3 AND organization = ?1)`, org, team, g.Package, g.Permission)
+}
+
+func (s *sqliteStore) PackagePermission(org, member, pkg string) (string, error) {
+	var permission string
+	err := s.db.QueryRow(`SELECT tp.permission FROM team_packages tp
+		JOIN team_members tm ON tm.organization = tp.organization AND tm.team = tp.team
+		JOIN packages p ON p.tenant = '' AND p.name = tp.package AND p.organization = tp.organization
+		WHERE tp.organization = ? AND tm.member = ? AND tp.package = ? ORDER BY tp.permission = 'maintain' DESC LIMIT 1`, org, member, pkg).Scan(&permission)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return permission, err
+}
+
+func (s *sqliteStore) InsertScopedPackage(name, url, org string) error {
+	return s.exec(false, `INSERT INTO packages (name, url, organization, created_at, normalized_url) VALUES (?, ?, ?, ?, lower(?))`, name, url, org, time.Now().UTC(), url)
+}
+
+func (s *sqliteStore) InsertPackage(name, url string) error {
+	return s.exec(false, `INSERT INTO packages (name, url, created_at, normalized_url) VALUES (?, ?, ?, lower(?))`, name, url, time.Now().UTC(), url)
+}
+
+func (s *sqliteStore) DeletePackage(name string) error {
+	return s.exec(true, `DELETE FROM packages WHERE tenant = '' AND name = ? AND organization IS NULL`, name)
+}
+
+func (s *sqliteStore) HoldRegistration(h HeldRegistration) error {
+	return s.exec(false, `INSERT INTO held_registrations (name, url, similar_to, distance, created_at) VALUES (?, ?, ?, ?, ?)`,
+		h.Name, h.URL, h.SimilarTo, h.Distance, h.CreatedAt.UTC())
+}
+
+func (s *sqliteStore) HeldRegistrations() ([]HeldRegistration, error) {
+	rows, err := s.db.Query(`SELECT name, url, similar_to, distance, created_at FROM held_registrations ORDER BY created_at, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	held := []HeldRegistration{}
+	for rows.Next() {
+		var h HeldRegistration
+		if err := rows.Scan(&h.Name, &h.URL, &h.SimilarTo, &h.Distance, &h.CreatedAt); err != nil {
+			return nil, err
+		}
+		held = append(held, h)
+	}
+	return held, rows.Err()
+}
+
+func (s *sqliteStore) ReleaseRegistration(name string) (HeldRegistration, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return HeldRegistration{}, err
+	}
+	defer tx.Rollback()
+
+	var h HeldRegistration
+	err = tx.QueryRow(`SELECT name, url, similar_to, distance, created_at FROM held_registrations WHERE name = ?`, name).
+		Scan(&h.Name, &h.URL, &h.SimilarTo, &h.Distance, &h.CreatedAt)
+	if err == sql.ErrNoRows {
+		return h, ErrNotFound
+	} else if err != nil {
+		return h, err
+	}
+	if _, err := tx.Exec(`DELETE FROM held_registrations WHERE name = ?`, name); err != nil {
+		return h, err
+	}
+	return h, tx.Commit()
+}
+
+func (s *sqliteStore) DeleteScopedPackage(name, org string) error {
+	return s.exec(true, `DELETE FROM packages WHERE tenant = '' AND name = ? AND organization = ?`, name, org)
+}
+
+func sqliteDeprecation(message, replacement sql.NullString) *Deprecation {
+	if !message.Valid {
+		return nil
+	}
+	return &Deprecation{Message: message.String, Replacement: replacement.String}
+}
+
+// SetDeprecation stamps updated_at like SetVisibility, for the
+// Last-Modified of lookups.
+func (s *sqliteStore) SetDeprecation(name string, d *Deprecation) error {
+	if d == nil {
+		return s.exec(true, `UPDATE packages SET deprecation_message = NULL, deprecation_replacement = NULL, updated_at = CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER) WHERE tenant = '' AND name = ?`, name)
+	}
+	return s.exec(true, `UPDATE packages SET deprecation_message = ?, deprecation_replacement = nullif(?, ''), updated_at = CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER) WHERE tenant = '' AND name = ?`, d.Message, d.Replacement, name)
+}
+
+func (s *sqliteStore) SetPackageURL(name, url string) error {
+	return s.exec(true, `UPDATE packages SET url = ?, normalized_url = lower(?), status = 'ok', check_failures = 0, next_check_at = NULL WHERE tenant = '' AND name = ?`, url, url, name)
+}
+
+// SetVisibility stamps updated_at itself, since the change triggers only
+// watch the columns mirrors copy.
+func (s *sqliteStore) SetVisibility(name string, private bool) error {
+	return s.exec(true, `UPDATE packages SET visibility = ?, updated_at = CAST((julianday('now') - 2440587.5) * 86400000000000 AS INTEGER) WHERE tenant = '' AND name = ?`, visibility(private), name)
+}
+
+func (s *sqliteStore) PackageOrganization(name string) (string, error) {
+	var org string
+	err := s.db.QueryRow(`SELECT coalesce(organization, '') FROM packages WHERE tenant = '' AND name = ?`, name).Scan(&org)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return org, err
+}
+
+func (s *sqliteStore) CreateTransfer(t Transfer) error {
+	return s.exec(false, `INSERT OR REPLACE INTO package_transfers (package, from_org, to_org, token_hash, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)`,
+		t.Package, t.From, t.To, t.TokenHash, t.CreatedAt, t.ExpiresAt)
+}
+
+func (s *sqliteStore) PendingTransfer(name string) (Transfer, error) {
+	var t Transfer
+	err := s.db.QueryRow(`SELECT package, from_org, to_org, token_hash, created_at, expires_at FROM package_transfers WHERE package = ?`, name).
+		Scan(&t.Package, &t.From, &t.To, &t.TokenHash, &t.CreatedAt, &t.ExpiresAt)
+	if err == sql.ErrNoRows {
+		err = ErrNotFound
+	}
+	return t, err
+}
+
+func (s *sqliteStore) CompleteTransfer(t Transfer) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, stmt := range []struct {
+		query string
+		args  []interface{}
+	}{
+		{`DELETE FROM package_transfers WHERE package = ? AND token_hash = ?`, []interface{}{t.Package, t.TokenHash}},
+		{`UPDATE packages SET organization = ? WHERE tenant = '' AND name = ? AND organization = ?`, []interface{}{t.To, t.Package, t.From}},
+	} {
+		res, err := tx.Exec(stmt.query, stmt.args...)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil {
+			return err
+		} else if n == 0 {
+			return ErrNotFound
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeleteTransfer(name string) error {
+	return s.exec(true, `DELETE FROM package_transfers WHERE package = ?`, name)
+}
+
+func (s *sqliteStore) RecordAudit(e AuditEntry) error {
+	return s.exec(false, `INSERT INTO audit_log (at, actor, action, package, detail) VALUES (?, ?, ?, nullif(?, ''), nullif(?, ''))`,
+		e.At, e.Actor, e.Action, e.Package, e.Detail)
+}
+
+func (s *sqliteStore) AuditLog(pkg string, limit int) ([]AuditEntry, error) {
+	rows, err := s.db.Query(`SELECT at, actor, action, coalesce(package, ''), coalesce(detail, '') FROM audit_log WHERE ?1 = '' OR package = ?1 ORDER BY id DESC LIMIT ?2`, pkg, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.At, &e.Actor, &e.Action, &e.Package, &e.Detail); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *sqliteStore) ListTenants() ([]*Tenant, error) {
+	rows, err := s.db.Query(`SELECT name, hosts, admin_token_hash FROM tenants`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []*Tenant
+	for rows.Next() {
+		t := &Tenant{}
+		var hosts string
+		if err := rows.Scan(&t.Name, &hosts, &t.AdminTokenHash); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(hosts), &t.Hosts); err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+func (s *sqliteStore) CreateTenant(t Tenant) error {
+	hosts, err := json.Marshal(t.Hosts)
+	if err != nil {
+		return err
+	}
+	return s.exec(false, `INSERT INTO tenants (name, hosts, admin_token_hash) VALUES (?, ?, ?)`, t.Name, string(hosts), t.AdminTokenHash)
+}
+
+func (s *sqliteStore) FeatureFlags() (map[string]bool, error) {
+	rows, err := s.db.Query(`SELECT name, enabled FROM feature_flags`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	flags := map[string]bool{}
+	for rows.Next() {
+		var name string
+		var enabled bool
+		if err := rows.Scan(&name, &enabled); err != nil {
+			return nil, err
+		}
+		flags[name] = enabled
+	}
+	return flags, rows.Err()
+}
+
+func (s *sqliteStore) SetFeatureFlag(name string, enabled bool) error {
+	return s.exec(false, `INSERT INTO feature_flags (name, enabled, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT (name) DO UPDATE SET enabled = excluded.enabled, updated_at = excluded.updated_at`, name, enabled, time.Now().UTC())
+}
+
+func (s *sqliteStore) ResetFeatureFlag(name string) error {
+	return s.exec(false, `DELETE FROM feature_flags WHERE name = ?`, name)
+}
+
+func (s *sqliteStore) TenantGetPackage(tenant, name string) (Package, error) {
+	return s.queryPackage(`SELECT name, url FROM packages WHERE tenant = ? AND name = ?`, tenant, name)
+}
+
+func (s *sqliteStore) TenantListPackages(tenant string) ([]Package, error) {
+	return s.queryPackages(`SELECT name, url FROM packages WHERE tenant = ? ORDER BY name`, tenant)
+}
+
+func (s *sqliteStore) TenantInsertPackage(tenant, name, url string) error {
+	return s.exec(false, `INSERT INTO packages (tenant, name, url, created_at, normalized_url) VALUES (?, ?, ?, ?, lower(?))`, tenant, name, url, time.Now().UTC(), url)
+}
+
+func (s *sqliteStore) TenantDeletePackage(tenant, name string) error {
+	return s.exec(true, `DELETE FROM packages WHERE tenant = ? AND name = ?`, tenant, name)
+}
+
+func (s *sqliteStore) Snapshot() ([]PackageRecord, error) {
+	rows, err := s.db.Query(`SELECT tenant, name, url, created_at, hits, visibility, coalesce(organization, ''), coalesce(cache_ttl, 0), deprecation_message, deprecation_replacement FROM packages ORDER BY tenant, name`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	records := []PackageRecord{}
+	for rows.Next() {
+		var p PackageRecord
+		var message, replacement sql.NullString
+		if err := rows.Scan(&p.Tenant, &p.Name, &p.URL, &p.CreatedAt, &p.Hits, &p.Visibility, &p.Organization, &p.CacheTTL, &message, &replacement); err != nil {
+			return nil, err
+		}
+		p.Deprecated = sqliteDeprecation(message, replacement)
+		records = append(records, p)
+	}
+	return records, rows.Err()
+}
+
+func (s *sqliteStore) RecordClientRequests(stats []ClientStat) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, c := range stats {
+		if _, err := tx.Exec(`INSERT INTO client_stats (day, client, version, requests) VALUES (?, ?, ?, ?)
+			ON CONFLICT (day, client, version) DO UPDATE SET requests = requests + excluded.requests`,
+			c.Day, c.Client, c.Version, c.Requests); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ClientStats(since time.Time) ([]ClientStat, error) {
+	rows, err := s.db.Query(`SELECT day, client, version, requests FROM client_stats WHERE day >= ? ORDER BY day DESC, requests DESC`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []ClientStat
+	for rows.Next() {
+		var c ClientStat
+		if err := rows.Scan(&c.Day, &c.Client, &c.Version, &c.Requests); err != nil {
+			return nil, err
+		}
+		stats = append(stats, c)
+	}
+	return stats, rows.Err()
+}
+
+func (s *sqliteStore) RecordDeprecatedRequests(stats []DeprecatedRequestStat) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, d := range stats {
+		if _, err := tx.Exec(`INSERT INTO deprecated_requests (day, dimension, value, requests) VALUES (?, ?, ?, ?)
+			ON CONFLICT (day, dimension, value) DO UPDATE SET requests = requests + excluded.requests`,
+			d.Day, d.Dimension, d.Value, d.Requests); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) DeprecatedRequestStats(since time.Time) ([]DeprecatedRequestStat, error) {
+	rows, err := s.db.Query(`SELECT day, dimension, value, requests FROM deprecated_requests WHERE day >= ? ORDER BY day DESC, requests DESC`, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []DeprecatedRequestStat
+	for rows.Next() {
+		var d DeprecatedRequestStat
+		if err := rows.Scan(&d.Day, &d.Dimension, &d.Value, &d.Requests); err != nil {
+			return nil, err
+		}
+		stats = append(stats, d)
+	}
+	return stats, rows.Err()
+}
+
+func (s *sqliteStore) RecordDownloads(hour time.Time, downloads map[string]int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for name, n := range downloads {
+		if _, err := tx.Exec(`INSERT INTO package_downloads (name, period, start, downloads) VALUES (?, 'hour', ?, ?)
+			ON CONFLICT (name, period, start) DO UPDATE SET downloads = downloads + excluded.downloads`,
+			name, hour.UTC(), n); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) Downloads(name string, since, until time.Time) ([]DownloadBucket, error) {
+	rows, err := s.db.Query(`SELECT period, start, downloads FROM package_downloads WHERE name = ? AND start >= ? AND start < ? ORDER BY start`, name, since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var buckets []DownloadBucket
+	for rows.Next() {
+		var b DownloadBucket
+		if err := rows.Scan(&b.Interval, &b.Start, &b.Downloads); err != nil {
+			return nil, err
+		}
+		buckets = append(buckets, b)
+	}
+	return buckets, rows.Err()
+}
+
+// CompactDownloads adds up the buckets in Go, since SQLite has no
+// date_trunc.
+func (s *sqliteStore) CompactDownloads(interval, into string, before time.Time) (int, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if into != "" {
+		rows, err := tx.Query(`SELECT name, start, downloads FROM package_downloads WHERE period = ? AND start < ?`, interval, before.UTC())
+		if err != nil {
+			return 0, err
+		}
+		type bucketKey struct {
+			name  string
+			start time.Time
+		}
+		sums := map[bucketKey]int64{}
+		for rows.Next() {
+			var name string
+			var start time.Time
+			var n int64
+			if err := rows.Scan(&name, &start, &n); err != nil {
+				rows.Close()
+				return 0, err
+			}
+			sums[bucketKey{name, truncateToInterval(start, into)}] += n
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return 0, err
+		}
+		for k, n := range sums {
+			if _, err := tx.Exec(`INSERT INTO package_downloads (name, period, start, downloads) VALUES (?, ?, ?, ?)
+				ON CONFLICT (name, period, start) DO UPDATE SET downloads = downloads + excluded.downloads`,
+				k.name, into, k.start, n); err != nil {
+				return 0, err
+			}
+		}
+	}
+	res, err := tx.Exec(`DELETE FROM package_downloads WHERE period = ? AND start < ?`, interval, before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+func (s *sqliteStore) DownloadTotals(since, until time.Time) (map[string]int64, error) {
+	rows, err := s.db.Query(`SELECT name, sum(downloads) FROM package_downloads WHERE period <> 'month' AND start >= ? AND start < ? GROUP BY name`, since.UTC(), until.UTC())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := map[string]int64{}
+	for rows.Next() {
+		var name string
+		var n int64
+		if err := rows.Scan(&name, &n); err != nil {
+			return nil, err
+		}
+		totals[name] = n
+	}
+	return totals, rows.Err()
+}
+
+func (s *sqliteStore) Restore(records []PackageRecord, replace bool) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`CREATE TEMP TABLE IF NOT EXISTS restored (tenant TEXT, name TEXT)`); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM restored`); err != nil {
+		return err
+	}
+	for _, p := range records {
+		var message, replacement interface{}
+		if p.Deprecated != nil {
+			message, replacement = p.Deprecated.Message, p.Deprecated.Replacement
+		}
+		if _, err := tx.Exec(`INSERT INTO packages (tenant, name, url, created_at, hits, visibility, organization, cache_ttl, deprecation_message, deprecation_replacement)
+			VALUES (?, ?, ?, ?, coalesce(?, 0), ?, nullif(?, ''), nullif(?, 0), ?, nullif(?, ''))
+			ON CONFLICT (tenant, name) DO UPDATE SET url = excluded.url, created_at = excluded.created_at, hits = excluded.hits,
+				visibility = excluded.visibility, organization = excluded.organization, cache_ttl = excluded.cache_ttl,
+				deprecation_message = excluded.deprecation_message, deprecation_replacement = excluded.deprecation_replacement,
+				normalized_url = CASE WHEN url = excluded.url THEN normalized_url END`,
+			p.Tenant, p.Name, p.URL, p.CreatedAt, p.Hits, p.Visibility, p.Organization, p.CacheTTL, message, replacement); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO restored (tenant, name) VALUES (?, ?)`, p.Tenant, p.Name); err != nil {
+			return err
+		}
+	}
+	if replace {
+		if _, err := tx.Exec(`DELETE FROM packages WHERE NOT EXISTS (SELECT 1 FROM restored r WHERE r.tenant = packages.tenant AND r.name = packages.name)`); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(sqliteNormalizedURLs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (s *sqliteStore) ApplyChanges(changes []PackageChange) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, c := range changes {
+		if c.Deleted {
+			_, err = tx.Exec(`DELETE FROM packages WHERE tenant = '' AND name = ?`, c.Name)
+		} else {
+			_, err = tx.Exec(`INSERT INTO packages (name, url, created_at) VALUES (?, ?, ?)
+				ON CONFLICT (tenant, name) DO UPDATE SET url = excluded.url, normalized_url = NULL WHERE url <> excluded.url`,
+				c.Name, c.URL, time.Now().UTC())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(sqliteNormalizedURLs); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
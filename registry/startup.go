@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// When the database can't be reached at startup, the registry listens
+// anyway and answers in a degraded mode while it keeps connecting: lookups
+// are served from the package list in the shared cache, /readyz reports
+// the database as unavailable and everything else gets 503. Once the store
+// is open the server is set up as usual and takes over, so a database
+// hiccup during a rolling restart doesn't crash-loop the instances.
+
+// maxConnectDelay caps the backoff between connection attempts.
+const maxConnectDelay = 30 * time.Second
+
+// openStoreRetrying opens the store, retrying with backoff until it is
+// open.
+func openStoreRetrying() Store {
+	for delay := time.Second; ; delay *= 2 {
+		if delay > maxConnectDelay {
+			delay = maxConnectDelay
+		}
+		store, err := OpenStore()
+		if err == nil {
+			dbLog.Infof("Connected to the database")
+			return store
+		}
+		dbLog.Errorf("Connection error: %s, retrying in %s", err, delay)
+		time.Sleep(delay)
+	}
+}
+
+// degradedHandler serves requests of a listener until the server is ready.
+type degradedHandler struct {
+	cache Cache
+	role  string
+
+	mu       sync.RWMutex
+	handler  http.Handler
+	snapshot fallbackSnapshot
+}
+
+// ready hands requests over to server.
+func (h *degradedHandler) ready(server *Server) {
+	handler := server.handlerFor(h.role)
+	h.mu.Lock()
+	h.handler = handler
+	h.mu.Unlock()
+}
+
+func (h *degradedHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	h.mu.RLock()
+	handler := h.handler
+	h.mu.RUnlock()
+	if handler != nil {
+		handler.ServeHTTP(w, r)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/packages/")
+	switch {
+	case r.URL.Path == "/readyz":
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusServiceUnavailable)
+		w.Write([]byte("database unavailable\n"))
+		return
+	case h.role != roleAdmin && r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/packages/") && name != "" && !strings.Contains(name, "/"):
+		pkg, found, loaded := h.snapshot.lookup(name)
+		if !loaded {
+			if packages, err := cachedPackageList(h.cache); err == nil {
+				h.snapshot.set(packages, time.Time{})
+				pkg, found, _ = h.snapshot.lookup(name)
+			}
+		}
+		if found {
+			data, err := json.Marshal(pkg)
+			if err == nil {
+				metrics.Add("degraded_lookups", 1)
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("Cache-Control", cacheControl(pkg, fallbackMaxAge))
+				w.Header().Set("Warning", `111 - "Database unavailable, response may be stale"`)
+				w.Write(data)
+				return
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Retry-After", strconv.Itoa(fallbackRetryAfter))
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("Registry temporarily unavailable"))
+}
@@ -0,0 +1,101 @@
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"sync"
+
+	"github.com/jackc/pgx"
+)
+
+// The Postgres store runs named statements. They are registered with
+// registerStatement from an init function of the file using them and
+// prepared on every new connection of the pool, so adding one doesn't touch
+// the pool setup.
+// A statement Postgres rejects, e.g. because its migration hasn't run yet,
+// doesn't fail the connection: it is logged and run unprepared, so only the
+// requests using it fail.
+
+type registeredStatement struct {
+	name, sql string
+}
+
+var statements struct {
+	mu   sync.RWMutex
+	list []registeredStatement
+	sql  map[string]string
+	// unprepared are the statements Postgres refused to prepare, with the
+	// error it gave.
+	unprepared map[string]string
+}
+
+func init() {
+	metrics.Set("unprepared_statements", expvar.Func(func() interface{} {
+		statements.mu.RLock()
+		defer statements.mu.RUnlock()
+		unprepared := map[string]string{}
+		for name, err := range statements.unprepared {
+			unprepared[name] = err
+		}
+		return unprepared
+	}))
+}
+
+// registerStatement adds a statement to prepare. Names must be unique.
+func registerStatement(name, sql string) {
+	statements.mu.Lock()
+	defer statements.mu.Unlock()
+	if _, ok := statements.sql[name]; ok {
+		panic(fmt.Sprintf("statement %s registered twice", name))
+	}
+	if statements.sql == nil {
+		statements.sql = map[string]string{}
+	}
+	statements.list = append(statements.list, registeredStatement{name, sql})
+	statements.sql[name] = sql
+}
+
+// statement returns what to run for the registered statement name: the name
+// of the prepared statement or, when it couldn't be prepared, its SQL.
+func statement(name string) string {
+	statements.mu.RLock()
+	defer statements.mu.RUnlock()
+	sql, ok := statements.sql[name]
+	if !ok {
+		panic(fmt.Sprintf("statement %s isn't registered", name))
+	}
+	if _, failed := statements.unprepared[name]; failed {
+		return sql
+	}
+	return name
+}
+
+// prepareStatements is the pool's AfterConnect. Only errors of the
+// connection itself fail it.
+func prepareStatements(conn *pgx.Conn) error {
+	statements.mu.RLock()
+	list := statements.list
+	statements.mu.RUnlock()
+	for _, st := range list {
+		_, err := conn.Prepare(st.name, st.sql)
+		if pgErr, ok := err.(pgx.PgError); ok {
+			markUnprepared(st.name, pgErr)
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func markUnprepared(name string, err pgx.PgError) {
+	statements.mu.Lock()
+	defer statements.mu.Unlock()
+	if _, ok := statements.unprepared[name]; ok {
+		return
+	}
+	if statements.unprepared == nil {
+		statements.unprepared = map[string]string{}
+	}
+	statements.unprepared[name] = err.Error()
+	dbLog.Warnf("Could not prepare statement %s, running it unprepared: %s", name, err)
+}
@@ -0,0 +1,257 @@
+package registry
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned by Store lookups and deletes that match nothing.
+	ErrNotFound = errors.New("not found")
+	// ErrExists is returned when an insert conflicts with an existing row.
+	ErrExists = errors.New("already exists")
+	// ErrURLTaken is returned when another package of the tenant is
+	// registered with the same repository, see normalizeURL.
+	ErrURLTaken = errors.New("repository already registered")
+)
+
+// Store is the registry's persistent state. Packages without a tenant belong
+// to the default registry. postgresStore is the production implementation;
+// sqliteStore and memoryStore serve small deployments without Postgres.
+type Store interface {
+	// GetPackage returns public and private packages alike; every listing
+	// below leaves private packages out.
+	GetPackage(name string) (Package, error)
+	ListPackages() ([]Package, error)
+	// EachPackage calls fn with the packages of ListPackages one by one,
+	// stopping at the first error, without loading them all where the
+	// backend allows it.
+	EachPackage(fn func(Package) error) error
+	CountPackages() (int64, error)
+	PackageDetails(name string) (PackageDetails, error)
+	// ListPackageDetails returns up to limit packages ordered by name,
+	// skipping the first offset.
+	ListPackageDetails(offset, limit int) ([]PackageDetails, error)
+	// RecentPackageDetails returns up to limit packages, the most recently
+	// registered or changed first.
+	RecentPackageDetails(limit int) ([]PackageDetails, error)
+	// PackageByURL returns the oldest package registered with any of urls,
+	// compared case-insensitively.
+	PackageByURL(urls ...string) (Package, error)
+	// PackageChanges returns up to limit changes of the default registry
+	// that come after the position (since, after) in the order of their
+	// time and name. Deleted packages are reported from their tombstones,
+	// and private packages as deleted.
+	PackageChanges(since time.Time, after string, limit int) ([]PackageChange, error)
+	// Search returns up to limit packages matching a normalized query, or
+	// the most popular packages when the query is empty.
+	Search(term string, limit int) ([]SearchResult, error)
+	// PackagesByPrefix returns up to limit public packages whose name
+	// starts with prefix, ordered by name.
+	PackagesByPrefix(prefix string, limit int) ([]Package, error)
+
+	DueURLChecks(limit int) ([]Package, error)
+	RecordURLSuccess(p Package, next time.Duration) error
+	// RecordURLFailure marks the package broken after threshold failures
+	// and backs off exponentially from base up to max. It reports whether
+	// this failure marked the package broken.
+	RecordURLFailure(p Package, threshold int, base, max time.Duration) (bool, error)
+	BrokenPackages() ([]BrokenPackage, error)
+
+	// DueEnrichments returns up to limit packages of the default registry
+	// hosted on GitHub that weren't enriched since before, least recently
+	// enriched first.
+	DueEnrichments(before time.Time, limit int) ([]Package, error)
+	// RecordEnrichment stores the repository metadata of a package, or
+	// with a nil m only that it was attempted. An empty description keeps
+	// the current one.
+	RecordEnrichment(p Package, m *RepoMetadata) error
+	// VersionChecksums returns the SHA-256 sums of the tarballs of the tags
+	// of a repository, keyed by tag.
+	VersionChecksums(url string) (map[string]string, error)
+	// RecordChecksum stores the sum of a tag's tarball. The first sum
+	// recorded for a tag is kept.
+	RecordChecksum(url, tag, sum string) error
+	// Dependencies returns the dependencies declared in the bower.json of
+	// a repository, sorted by name.
+	Dependencies(url string) ([]Dependency, error)
+	// RecordDependencies replaces the dependencies of a repository.
+	RecordDependencies(url string, deps []Dependency) error
+	// Dependents returns up to limit of the public packages of the default
+	// registry whose repository declares a dependency on name, sorted by
+	// package name and skipping the first offset. Name and Range of each
+	// are the dependent package and its range.
+	Dependents(name string, offset, limit int) ([]Dependency, error)
+
+	ResolveAlias(alias string) (Package, error)
+	ListAliases() ([]Alias, error)
+	// CreateAlias returns ErrNotFound when the target isn't registered or
+	// the alias is itself a package name.
+	CreateAlias(a Alias) error
+	DeleteAlias(alias string) error
+
+	OrganizationTokenHash(org string) (string, error)
+	CreateOrganization(name, tokenHash string) error
+	OrganizationContact(org string) (Contact, error)
+	// SetOrganizationContact returns ErrNotFound for unknown organizations.
+	SetOrganizationContact(org string, c Contact) error
+	OrganizationPackages(org string) ([]Package, error)
+	OrganizationMembers(org string) ([]Member, error)
+	// CreateMember returns ErrNotFound for unknown organizations.
+	CreateMember(m Member) error
+	// DeleteMember also removes the member from its teams.
+	DeleteMember(org, name string) error
+	MemberByTokenHash(tokenHash string) (Member, error)
+	// Teams returns the teams of an organization with their members and
+	// packages.
+	Teams(org string) ([]Team, error)
+	// CreateTeam returns ErrNotFound for unknown organizations.
+	CreateTeam(org, name string) error
+	DeleteTeam(org, name string) error
+	// AddTeamMember returns ErrNotFound when the team or member doesn't
+	// exist.
+	AddTeamMember(org, team, member string) error
+	RemoveTeamMember(org, team, member string) error
+	// SetTeamPackage grants a team a permission on a package the
+	// organization owns, or with an empty permission revokes it. Granting
+	// returns ErrNotFound when the team doesn't exist or the organization
+	// doesn't own the package.
+	SetTeamPackage(org, team string, g TeamPackage) error
+	// PackagePermission returns the highest permission the teams of a
+	// member have on a package its organization owns, or "".
+	PackagePermission(org, member, pkg string) (string, error)
+	InsertScopedPackage(name, url, org string) error
+	DeleteScopedPackage(name, org string) error
+	// InsertPackage registers an unscoped package, which is otherwise up
+	// to the sidecar. It returns ErrExists when the name is taken and
+	// ErrURLTaken when the repository is.
+	InsertPackage(name, url string) error
+	// DeletePackage unregisters an unscoped package, returning ErrNotFound
+	// when there is none of that name.
+	DeletePackage(name string) error
+	// HoldRegistration keeps a registration for review, returning
+	// ErrExists when one of the same name is already held.
+	HoldRegistration(h HeldRegistration) error
+	// HeldRegistrations returns the held registrations, oldest first.
+	HeldRegistrations() ([]HeldRegistration, error)
+	// ReleaseRegistration removes a held registration and returns it.
+	ReleaseRegistration(name string) (HeldRegistration, error)
+	// SetDeprecation marks a package of the default registry deprecated,
+	// or with a nil d no longer. It returns ErrNotFound for unknown
+	// packages.
+	SetDeprecation(name string, d *Deprecation) error
+	// SetPackageURL moves a package of the default registry to another
+	// repository, which is checked again on the next round. It returns
+	// ErrNotFound for unknown packages and ErrURLTaken when another package
+	// has the repository.
+	SetPackageURL(name, url string) error
+	// SetVisibility makes a package of the default registry private or
+	// public again. It returns ErrNotFound for unknown packages.
+	SetVisibility(name string, private bool) error
+	// PackageOrganization returns the organization owning a package of the
+	// default registry, or "" when no organization does.
+	PackageOrganization(name string) (string, error)
+
+	// APIKeyByTokenHash returns ErrNotFound for unknown keys.
+	APIKeyByTokenHash(tokenHash string) (APIKey, error)
+	ListAPIKeys() ([]APIKey, error)
+	CreateAPIKey(k APIKey) error
+	DeleteAPIKey(name string) error
+	// ReservePublication charges the API key named key with pkg at at,
+	// unless it registered daily packages since since or total packages
+	// that are still registered, 0 being no limit. Reservations made after
+	// pending count as registered. The check and the charge are atomic; it
+	// returns the counts checked and whether pkg was charged.
+	ReservePublication(key, pkg string, at, since, pending time.Time, daily, total int) (recent, registered int, ok bool, err error)
+	// ReleasePublication takes back the charge of pkg made at at.
+	ReleasePublication(key, pkg string, at time.Time) error
+
+	// CreateTransfer replaces any pending transfer of t.Package.
+	CreateTransfer(t Transfer) error
+	// PendingTransfer returns the transfer of a package, expired or not.
+	PendingTransfer(name string) (Transfer, error)
+	// CompleteTransfer gives t.Package to t.To and removes the transfer. It
+	// returns ErrNotFound when the transfer was replaced or cancelled, or
+	// t.From no longer owns the package.
+	CompleteTransfer(t Transfer) error
+	DeleteTransfer(name string) error
+
+	RecordAudit(e AuditEntry) error
+	// AuditLog returns the newest limit entries, only those of pkg unless
+	// it is empty.
+	AuditLog(pkg string, limit int) ([]AuditEntry, error)
+
+	ListTenants() ([]*Tenant, error)
+	CreateTenant(t Tenant) error
+	TenantGetPackage(tenant, name string) (Package, error)
+	TenantListPackages(tenant string) ([]Package, error)
+	TenantInsertPackage(tenant, name, url string) error
+	TenantDeletePackage(tenant, name string) error
+
+	// FeatureFlags returns the flags switched through the admin API, which
+	// override FEATURE_FLAGS.
+	FeatureFlags() (map[string]bool, error)
+	SetFeatureFlag(name string, enabled bool) error
+	// ResetFeatureFlag drops the switch of name, if there is one.
+	ResetFeatureFlag(name string) error
+
+	// RecordClientRequests adds to the per-day request counts by client.
+	RecordClientRequests(stats []ClientStat) error
+	// ClientStats returns the counts of the days since since, newest and
+	// busiest first.
+	ClientStats(since time.Time) ([]ClientStat, error)
+	// RecordDeprecatedRequests adds to the per-day counts of requests to
+	// the deprecated hosts.
+	RecordDeprecatedRequests(stats []DeprecatedRequestStat) error
+	// DeprecatedRequestStats returns the counts of the days since since.
+	DeprecatedRequestStats(since time.Time) ([]DeprecatedRequestStat, error)
+	// RecordDownloads adds to the download counts of the hour starting at
+	// hour, keyed by package name.
+	RecordDownloads(hour time.Time, downloads map[string]int64) error
+	// Downloads returns the buckets of every interval of name starting in
+	// [since, until), oldest first.
+	Downloads(name string, since, until time.Time) ([]DownloadBucket, error)
+	// CompactDownloads adds the buckets of interval starting before before
+	// to the buckets of into that contain them and deletes them, returning
+	// how many it deleted. With into empty they are only deleted.
+	CompactDownloads(interval, into string, before time.Time) (int, error)
+	// DownloadTotals returns the downloads of each package in the hours
+	// and days starting in [since, until).
+	DownloadTotals(since, until time.Time) (map[string]int64, error)
+
+	// Snapshot returns every package of every tenant.
+	Snapshot() ([]PackageRecord, error)
+	// Restore upserts records, which all have a visibility, in one
+	// transaction, deleting all other packages when replace is set. Like ApplyChanges, it copies packages
+	// as they are: of several sharing a repository, only the first keeps
+	// the repository to itself.
+	Restore(records []PackageRecord, replace bool) error
+	// ApplyChanges applies the changes of another registry to the default
+	// registry in one transaction, creating, updating and deleting
+	// packages as needed. Mirrors use it to replicate their upstream.
+	ApplyChanges(changes []PackageChange) error
+
+	Close()
+}
+
+// OpenStore connects to DATABASE_URL. A sqlite: URL, e.g.
+// sqlite:///var/lib/registry.db, selects the SQLite store and memory: the
+// in-memory store, persisted to the path that follows if there is one.
+// Anything else is a Postgres connection string.
+func OpenStore() (Store, error) {
+	url := os.Getenv("DATABASE_URL")
+	switch {
+	case strings.HasPrefix(url, "sqlite:"):
+		return openSQLite(strings.TrimPrefix(strings.TrimPrefix(url, "sqlite:"), "//"))
+	case strings.HasPrefix(url, "memory:"):
+		interval, err := time.ParseDuration(getEnv("MEMORY_FLUSH_INTERVAL", "5s"))
+		if err != nil {
+			return nil, fmt.Errorf("invalid MEMORY_FLUSH_INTERVAL: %s", err)
+		}
+		return openMemory(strings.TrimPrefix(strings.TrimPrefix(url, "memory:"), "//"), interval)
+	}
+	return connectDatabase()
+}
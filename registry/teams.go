@@ -0,0 +1,292 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Besides its own token, an organization can have members with tokens of
+// their own, grouped in teams. A team is granted read or maintain access
+// to packages of the organization: read lets its members look up private
+// packages, maintain also lets them deprecate packages and change their
+// visibility. Members and teams are managed with the organization's token
+// or the admin token.
+
+const (
+	permissionRead     = "read"
+	permissionMaintain = "maintain"
+)
+
+// Member is someone acting for an organization with a token of their own.
+type Member struct {
+	Organization string    `json:"-"`
+	Name         string    `json:"name"`
+	CreatedAt    time.Time `json:"created_at"`
+	TokenHash    string    `json:"-"`
+}
+
+// createdMember is returned once, when the member is added.
+type createdMember struct {
+	Member
+	Token string `json:"token"`
+}
+
+type Team struct {
+	Name     string        `json:"name"`
+	Members  []string      `json:"members"`
+	Packages []TeamPackage `json:"packages"`
+}
+
+// TeamPackage is the permission of a team on a package.
+type TeamPackage struct {
+	Package    string `json:"package"`
+	Permission string `json:"permission"`
+}
+
+type teamMember struct {
+	Member string `json:"member"`
+}
+
+var teamOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/orgs/{org}/members", Summary: "List the members of an organization", Result: []Member{}, Auth: true},
+	{Method: http.MethodPost, Path: "/orgs/{org}/members", Summary: "Add a member; their token is only returned once", Body: Member{}, Result: createdMember{}, Auth: true},
+	{Method: http.MethodDelete, Path: "/orgs/{org}/members/{name}", Summary: "Remove a member", Auth: true},
+	{Method: http.MethodGet, Path: "/orgs/{org}/teams", Summary: "List the teams of an organization", Result: []Team{}, Auth: true},
+	{Method: http.MethodPost, Path: "/orgs/{org}/teams", Summary: "Create a team", Body: Team{}, Result: Team{}, Auth: true},
+	{Method: http.MethodDelete, Path: "/orgs/{org}/teams/{team}", Summary: "Delete a team", Auth: true},
+	{Method: http.MethodPost, Path: "/orgs/{org}/teams/{team}/members", Summary: "Add a member to a team", Body: teamMember{}, Result: teamMember{}, Auth: true},
+	{Method: http.MethodDelete, Path: "/orgs/{org}/teams/{team}/members/{name}", Summary: "Remove a member from a team", Auth: true},
+	{Method: http.MethodPost, Path: "/orgs/{org}/teams/{team}/packages", Summary: "Grant a team read or maintain access to a package", Body: TeamPackage{}, Result: TeamPackage{}, Auth: true},
+	{Method: http.MethodDelete, Path: "/orgs/{org}/teams/{team}/packages/{name}", Summary: "Revoke the access of a team to a package", Auth: true},
+}
+
+func teamsPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		parts := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/orgs/"), "/", 3)
+		return strings.HasPrefix(req.URL.Path, "/orgs/") && len(parts) >= 2 && (parts[1] == "members" || parts[1] == "teams")
+	}
+}
+
+// teamsHandler serves /orgs/{org}/members and /orgs/{org}/teams.
+func (s *Server) teamsHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/orgs/"), "/", 3)
+	org := parts[0]
+	if !s.isAdmin(r) {
+		owner, err := s.isOrgMember(r, org)
+		if err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		if !owner {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Only the organization's token can manage its members and teams")
+		}
+	}
+	rest := ""
+	if len(parts) == 3 {
+		rest = parts[2]
+	}
+
+	if parts[1] == "members" {
+		switch {
+		case rest == "" && r.Method == http.MethodGet:
+			return r, s.listMembers(r, org)
+		case rest == "" && r.Method == http.MethodPost:
+			return r, s.createMember(r, org)
+		case rest != "" && r.Method == http.MethodDelete:
+			return r, s.deleteMember(r, org, rest)
+		}
+		return r, goproxy.NewResponse(r, "text/html", http.StatusMethodNotAllowed, "Method not allowed")
+	}
+
+	// rest is "", "{team}", "{team}/members[/{name}]" or "{team}/packages[/{name}]",
+	// where package names may contain a slash.
+	sub := strings.SplitN(rest, "/", 3)
+	switch {
+	case rest == "" && r.Method == http.MethodGet:
+		return r, s.listTeams(r, org)
+	case rest == "" && r.Method == http.MethodPost:
+		return r, s.createTeam(r, org)
+	case len(sub) == 1 && r.Method == http.MethodDelete:
+		return r, s.deleteTeam(r, org, sub[0])
+	case len(sub) == 2 && sub[1] == "members" && r.Method == http.MethodPost:
+		return r, s.addTeamMember(r, org, sub[0])
+	case len(sub) == 3 && sub[1] == "members" && r.Method == http.MethodDelete:
+		return r, s.removeTeamMember(r, org, sub[0], sub[2])
+	case len(sub) == 2 && sub[1] == "packages" && r.Method == http.MethodPost:
+		return r, s.grantTeamPackage(r, org, sub[0])
+	case len(sub) == 3 && sub[1] == "packages" && r.Method == http.MethodDelete:
+		return r, s.revokeTeamPackage(r, org, sub[0], sub[2])
+	}
+	return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+}
+
+func (s *Server) listMembers(r *http.Request, org string) *http.Response {
+	members, err := s.store.OrganizationMembers(org)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	return jsonResponse(r, http.StatusOK, members)
+}
+
+func (s *Server) createMember(r *http.Request, org string) *http.Response {
+	var m Member
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if !accountNameRe.MatchString(m.Name) {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid name, use letters, digits, dots, dashes and underscores")
+	}
+	token, err := newToken()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	m.Organization, m.TokenHash, m.CreatedAt = org, hashToken(token), time.Now().UTC()
+	switch err := s.store.CreateMember(m); err {
+	case nil:
+		s.audit("org:"+org, "member.added", "", m.Name)
+		return jsonResponse(r, http.StatusCreated, createdMember{m, token})
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "Member already exists")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Organization not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) deleteMember(r *http.Request, org, name string) *http.Response {
+	switch err := s.store.DeleteMember(org, name); err {
+	case nil:
+		s.audit("org:"+org, "member.removed", "", name)
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Member not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) listTeams(r *http.Request, org string) *http.Response {
+	teams, err := s.store.Teams(org)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	return jsonResponse(r, http.StatusOK, teams)
+}
+
+func (s *Server) createTeam(r *http.Request, org string) *http.Response {
+	var t Team
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if !accountNameRe.MatchString(t.Name) {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid name, use letters, digits, dots, dashes and underscores")
+	}
+	switch err := s.store.CreateTeam(org, t.Name); err {
+	case nil:
+		s.audit("org:"+org, "team.created", "", t.Name)
+		return jsonResponse(r, http.StatusCreated, Team{Name: t.Name, Members: []string{}, Packages: []TeamPackage{}})
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "Team already exists")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Organization not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) deleteTeam(r *http.Request, org, team string) *http.Response {
+	switch err := s.store.DeleteTeam(org, team); err {
+	case nil:
+		s.audit("org:"+org, "team.deleted", "", team)
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Team not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) addTeamMember(r *http.Request, org, team string) *http.Response {
+	var m teamMember
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	switch err := s.store.AddTeamMember(org, team, m.Member); err {
+	case nil, ErrExists:
+		if err == nil {
+			s.audit("org:"+org, "team.member_added", "", team+": "+m.Member)
+		}
+		return jsonResponse(r, http.StatusOK, m)
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Team or member not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) removeTeamMember(r *http.Request, org, team, member string) *http.Response {
+	switch err := s.store.RemoveTeamMember(org, team, member); err {
+	case nil:
+		s.audit("org:"+org, "team.member_removed", "", team+": "+member)
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Member not in team")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) grantTeamPackage(r *http.Request, org, team string) *http.Response {
+	var g TeamPackage
+	if err := json.NewDecoder(r.Body).Decode(&g); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if g.Permission != permissionRead && g.Permission != permissionMaintain {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid permission, expected read or maintain")
+	}
+	switch err := s.store.SetTeamPackage(org, team, g); err {
+	case nil:
+		s.audit("org:"+org, "team.package_granted", g.Package, team+": "+g.Permission)
+		return jsonResponse(r, http.StatusOK, g)
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Team not found or package not owned by the organization")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) revokeTeamPackage(r *http.Request, org, team, pkg string) *http.Response {
+	switch err := s.store.SetTeamPackage(org, team, TeamPackage{Package: pkg}); err {
+	case nil:
+		s.audit("org:"+org, "team.package_revoked", pkg, team)
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not granted to the team")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+// memberPermission returns the member r authenticates as and their
+// permission on a package owned by org, or "" for both.
+func (s *Server) memberPermission(r *http.Request, org, pkg string) (string, string, error) {
+	token := requestToken(r)
+	if token == "" || org == "" {
+		return "", "", nil
+	}
+	m, err := s.store.MemberByTokenHash(hashToken(token))
+	if err == ErrNotFound || err == nil && m.Organization != org {
+		return "", "", nil
+	} else if err != nil {
+		return "", "", err
+	}
+	permission, err := s.store.PackagePermission(org, m.Name, pkg)
+	if err != nil || permission == "" {
+		return "", "", err
+	}
+	return m.Name, permission, nil
+}
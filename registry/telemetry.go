@@ -0,0 +1,188 @@
+package registry
+
+import (
+	"expvar"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Requests that reach deprecatedHostHandler are counted by client version,
+// by the host of their referer and by the package they asked for, to tell
+// when the deprecated hosts can be turned off. The counts are kept apart,
+// so they never add up to a profile of one client, and no IP or search
+// query is kept. /metrics shows the counts since the start of the process
+// and /admin/deprecated-traffic a summary per day.
+
+// DeprecatedRequestStat counts the requests of one day to the deprecated
+// hosts with one value of a dimension: "client", "referer" or "package".
+type DeprecatedRequestStat struct {
+	Day       time.Time `json:"day"`
+	Dimension string    `json:"dimension"`
+	Value     string    `json:"value"`
+	Requests  int64     `json:"requests"`
+}
+
+// DeprecatedTrafficDay summarizes the requests of one day to the
+// deprecated hosts.
+type DeprecatedTrafficDay struct {
+	Day      time.Time        `json:"day"`
+	Requests int64            `json:"requests"`
+	Clients  map[string]int64 `json:"clients"`
+	Referers map[string]int64 `json:"referers"`
+	Packages map[string]int64 `json:"packages"`
+}
+
+type trafficKey struct {
+	dimension, value string
+}
+
+// trafficCounter counts requests per dimension value. Like clientCounter
+// it caps the values it tells apart.
+type trafficCounter struct {
+	mu      sync.Mutex
+	pending map[trafficKey]int64
+	totals  map[trafficKey]int64
+}
+
+func (c *trafficCounter) add(client, referer, pkg string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.pending == nil {
+		c.pending, c.totals = map[trafficKey]int64{}, map[trafficKey]int64{}
+	}
+	for _, key := range []trafficKey{{"client", client}, {"referer", referer}, {"package", pkg}} {
+		for _, counts := range []map[trafficKey]int64{c.pending, c.totals} {
+			k := key
+			if _, ok := counts[k]; !ok && len(counts) >= maxClientKeys {
+				k.value = "(other)"
+			}
+			counts[k]++
+		}
+	}
+}
+
+// take returns the counts collected since the last call and resets them.
+func (c *trafficCounter) take(day time.Time) []DeprecatedRequestStat {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = map[trafficKey]int64{}
+	c.mu.Unlock()
+
+	stats := make([]DeprecatedRequestStat, 0, len(pending))
+	for k, n := range pending {
+		stats = append(stats, DeprecatedRequestStat{Day: day, Dimension: k.dimension, Value: k.value, Requests: n})
+	}
+	return stats
+}
+
+// publish shows the counts since the start of the process in /metrics.
+func (c *trafficCounter) publish() {
+	metrics.Set("deprecated_traffic", expvar.Func(c.metric))
+}
+
+func (c *trafficCounter) metric() interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m := map[string]map[string]int64{"client": {}, "referer": {}, "package": {}}
+	for k, n := range c.totals {
+		m[k.dimension][k.value] = n
+	}
+	return m
+}
+
+// countDeprecatedRequest records r, which reached the deprecation path.
+func (s *Server) countDeprecatedRequest(r *http.Request) {
+	client, version := parseUserAgent(r.UserAgent())
+	if version != "" {
+		client += "/" + version
+	}
+	s.deprecatedTraffic.add(client, refererHost(r.Referer()), requestedPackage(r.URL.Path))
+	metrics.Add("deprecated_requests", 1)
+}
+
+// refererHost keeps only the host of a referer.
+func refererHost(referer string) string {
+	if referer == "" {
+		return "(none)"
+	}
+	u, err := url.Parse(referer)
+	if err != nil || u.Host == "" {
+		return "(invalid)"
+	}
+	return strings.ToLower(u.Hostname())
+}
+
+// requestedPackage names the package a path looks up. Searches and other
+// requests are counted as such, without their query.
+func requestedPackage(path string) string {
+	switch {
+	case path == "/packages":
+		return "(list)"
+	case strings.HasPrefix(path, "/packages/search/"):
+		return "(search)"
+	case strings.HasPrefix(path, "/packages/"):
+		name := strings.TrimPrefix(path, "/packages/")
+		if validatePackageName(name) == nil || validateScopedName(name) == nil {
+			return name
+		}
+	}
+	return "(other)"
+}
+
+// startDeprecatedTrafficStats adds the counted requests to the store every
+// interval.
+func (s *Server) startDeprecatedTrafficStats(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			stats := s.deprecatedTraffic.take(time.Now().UTC().Truncate(24 * time.Hour))
+			if len(stats) == 0 {
+				continue
+			}
+			if err := s.store.RecordDeprecatedRequests(stats); err != nil {
+				jobLog.Errorf("Could not record deprecated traffic: %s", err)
+			}
+		}
+	}()
+}
+
+func (s *Server) listDeprecatedTraffic(r *http.Request) *http.Response {
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 7
+	}
+	since := time.Now().UTC().Truncate(24*time.Hour).AddDate(0, 0, 1-days)
+	stats, err := s.store.DeprecatedRequestStats(since)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+
+	byDay := map[int64]*DeprecatedTrafficDay{}
+	summary := []*DeprecatedTrafficDay{}
+	for _, st := range stats {
+		d, ok := byDay[st.Day.Unix()]
+		if !ok {
+			d = &DeprecatedTrafficDay{Day: st.Day, Clients: map[string]int64{}, Referers: map[string]int64{}, Packages: map[string]int64{}}
+			byDay[st.Day.Unix()] = d
+			summary = append(summary, d)
+		}
+		switch st.Dimension {
+		case "client":
+			// Every request has exactly one client.
+			d.Requests += st.Requests
+			d.Clients[st.Value] += st.Requests
+		case "referer":
+			d.Referers[st.Value] += st.Requests
+		case "package":
+			d.Packages[st.Value] += st.Requests
+		}
+	}
+	sort.Slice(summary, func(i, j int) bool { return summary[i].Day.After(summary[j].Day) })
+	return jsonResponse(r, http.StatusOK, summary)
+}
@@ -0,0 +1,257 @@
+package registry
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Tenants are isolated registries sharing one deployment. A tenant is
+// addressed either by one of its hostnames or by the /r/{tenant}/ path
+// prefix; its packages live in the same table under their own namespace.
+// Packages of the default registry have an empty tenant.
+type Tenant struct {
+	Name           string   `json:"name"`
+	Hosts          []string `json:"hosts"`
+	AdminTokenHash string   `json:"admin_token_hash"`
+}
+
+type tenantRegistry struct {
+	sync.RWMutex
+	byName map[string]*Tenant
+	byHost map[string]*Tenant
+}
+
+// normalizeHost lowercases a Host header value and strips any port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
+}
+
+func (s *Server) loadTenants() error {
+	list, err := s.store.ListTenants()
+	if err != nil {
+		return err
+	}
+
+	byName := map[string]*Tenant{}
+	byHost := map[string]*Tenant{}
+	for _, t := range list {
+		byName[t.Name] = t
+		for _, h := range t.Hosts {
+			byHost[normalizeHost(h)] = t
+		}
+	}
+
+	s.tenants.Lock()
+	s.tenants.byName, s.tenants.byHost = byName, byHost
+	s.tenants.Unlock()
+	return nil
+}
+
+func (s *Server) startTenantRefresh(interval time.Duration) {
+	go func() {
+		for range time.Tick(interval) {
+			if err := s.loadTenants(); err != nil {
+				jobLog.Errorf("Tenant refresh error: %s", err)
+			}
+		}
+	}()
+}
+
+// resolveTenant returns the tenant a request is addressed to and the request
+// path within that tenant. prefixed reports whether /r/{tenant}/ was used.
+func (s *Server) resolveTenant(r *http.Request) (t *Tenant, path string, prefixed bool) {
+	s.tenants.RLock()
+	defer s.tenants.RUnlock()
+
+	if strings.HasPrefix(r.URL.Path, "/r/") {
+		rest := strings.TrimPrefix(r.URL.Path, "/r/")
+		name, path := rest, "/"
+		if i := strings.IndexByte(rest, '/'); i >= 0 {
+			name, path = rest[:i], rest[i:]
+		}
+		return s.tenants.byName[name], path, true
+	}
+	if t := s.tenants.byHost[normalizeHost(r.Host)]; t != nil {
+		return t, r.URL.Path, false
+	}
+	return nil, "", false
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// newToken returns a random secret to hand out once and store hashed.
+func newToken() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// requestToken returns the bearer token of r. Tokens are never read from
+// the query string, where they would end up in logs and browser history.
+func requestToken(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimPrefix(auth, "Bearer ")
+	}
+	return ""
+}
+
+func (t *Tenant) isAdmin(r *http.Request) bool {
+	token := requestToken(r)
+	if token == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(hashToken(token)), []byte(t.AdminTokenHash)) == 1
+}
+
+var tenantOperations = []apiOperation{
+	{Method: http.MethodGet, Path: "/r/{tenant}/packages", Summary: "List the packages of a registry", Result: []Package{}},
+	{Method: http.MethodPost, Path: "/r/{tenant}/packages", Summary: "Register a package in a registry", Form: []string{"name", "url"}, Auth: true},
+	{Method: http.MethodGet, Path: "/r/{tenant}/packages/{name}", Summary: "Look up a package in a registry", Result: Package{}},
+	{Method: http.MethodDelete, Path: "/r/{tenant}/packages/{name}", Summary: "Unregister a package from a registry", Auth: true},
+}
+
+// tenantHandler serves every request addressed to a tenant, so tenant traffic
+// never reaches the default registry handlers or the node sidecar.
+func (s *Server) tenantHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	t, path, prefixed := s.resolveTenant(r)
+	if t == nil {
+		if prefixed {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Registry not found")
+		}
+		return r, nil
+	}
+
+	switch {
+	case path == "/packages" && r.Method == http.MethodGet:
+		return r, s.tenantListPackages(r, t)
+	case path == "/packages" && r.Method == http.MethodPost:
+		return r, s.tenantCreatePackage(r, t)
+	case strings.HasPrefix(path, "/packages/") && r.Method == http.MethodGet:
+		return r, s.tenantGetPackage(r, t, strings.TrimPrefix(path, "/packages/"))
+	case strings.HasPrefix(path, "/packages/") && r.Method == http.MethodDelete:
+		return r, s.tenantDeletePackage(r, t, strings.TrimPrefix(path, "/packages/"))
+	}
+	return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Not found")
+}
+
+func (s *Server) tenantListPackages(r *http.Request, t *Tenant) *http.Response {
+	packages, err := s.store.TenantListPackages(t.Name)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	if packages == nil {
+		packages = []Package{}
+	}
+	return jsonResponse(r, http.StatusOK, packages)
+}
+
+func (s *Server) tenantGetPackage(r *http.Request, t *Tenant, packageName string) *http.Response {
+	p, err := s.store.TenantGetPackage(t.Name, packageName)
+	if err != nil {
+		if err == ErrNotFound {
+			return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+		}
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return jsonResponse(r, http.StatusOK, p)
+}
+
+func (s *Server) tenantCreatePackage(r *http.Request, t *Tenant) *http.Response {
+	if !t.isAdmin(r) {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Invalid admin token")
+	}
+	if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid form")
+	}
+	name, url := r.FormValue("name"), normalizeURL(r.FormValue("url"))
+	if err := validatePackageName(name); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid Package Name. "+err.Error())
+	}
+	if err := validateRepositoryURL(url); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL. "+err.Error())
+	}
+	if err := checkURL(url); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL")
+	}
+	switch err := s.store.TenantInsertPackage(t.Name, name, url); err {
+	case nil:
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Package already registered")
+	case ErrURLTaken:
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Repository already registered as another package")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	return goproxy.NewResponse(r, "text/html", http.StatusCreated, "")
+}
+
+func (s *Server) tenantDeletePackage(r *http.Request, t *Tenant, packageName string) *http.Response {
+	if !t.isAdmin(r) {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Invalid admin token")
+	}
+	switch err := s.store.TenantDeletePackage(t.Name, packageName); err {
+	case nil:
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+// runTenant implements `registry tenant create -name team -hosts a.example.com`,
+// printing the generated admin token once.
+func runTenant(args []string) {
+	if len(args) == 0 || args[0] != "create" {
+		log.Fatal("Usage: registry tenant create -name NAME [-hosts HOST,...]")
+	}
+	flags := flag.NewFlagSet("tenant create", flag.ExitOnError)
+	name := flags.String("name", "", "tenant name, used in the /r/{name}/ prefix")
+	hosts := flags.String("hosts", "", "comma separated hostnames served by the tenant")
+	flags.Parse(args[1:])
+
+	if err := validatePackageName(*name); err != nil {
+		log.Fatalf("Invalid tenant name: %s", err)
+	}
+	var hostList []string
+	for _, h := range strings.Split(*hosts, ",") {
+		if h = normalizeHost(strings.TrimSpace(h)); h != "" {
+			hostList = append(hostList, h)
+		}
+	}
+
+	token, err := newToken()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := OpenStore()
+	if err != nil {
+		log.Fatalf("Connection error: %s", err)
+	}
+	defer store.Close()
+	if err := store.CreateTenant(Tenant{Name: *name, Hosts: hostList, AdminTokenHash: hashToken(token)}); err != nil {
+		log.Fatalf("Could not create tenant: %s", err)
+	}
+	fmt.Printf("Created tenant %s\nAdmin token: %s\n", *name, token)
+}
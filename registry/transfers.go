@@ -0,0 +1,256 @@
+package registry
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// A package owned by an organization can be handed to another one. The
+// owner offers it; the confirmation token goes to TRANSFER_WEBHOOK_URL, for
+// an integration to pass on, and by email to the receiving organization, but
+// never back to the owner. The receiver accepts with its own token and the
+// confirmation before TRANSFER_TTL runs out, and either side can cancel.
+// Names keep their scope, so @acme/widget may end up owned by another
+// organization. Every step is recorded in the audit log.
+
+// Transfer is a pending change of a package's organization.
+type Transfer struct {
+	Package   string    `json:"package"`
+	From      string    `json:"from"`
+	To        string    `json:"to"`
+	TokenHash string    `json:"-"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+type transferRequest struct {
+	To string `json:"to"`
+}
+
+type acceptTransferRequest struct {
+	Token string `json:"token"`
+}
+
+// transferNotification is posted to TRANSFER_WEBHOOK_URL for every step;
+// only transfer.initiated carries the token.
+type transferNotification struct {
+	Event string `json:"event"`
+	Transfer
+	Token string `json:"token,omitempty"`
+}
+
+var transferOperations = []apiOperation{
+	{Method: http.MethodPost, Path: "/packages/{name}/transfer", Summary: "Offer a package to another organization", Body: transferRequest{}, Result: Transfer{}, Auth: true},
+	{Method: http.MethodDelete, Path: "/packages/{name}/transfer", Summary: "Cancel or decline a transfer", Auth: true},
+	{Method: http.MethodPost, Path: "/packages/{name}/transfer/accept", Summary: "Accept a transfer", Body: acceptTransferRequest{}, Result: Transfer{}, Auth: true},
+}
+
+func transferPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return strings.HasPrefix(req.URL.Path, "/packages/") &&
+			(strings.HasSuffix(req.URL.Path, "/transfer") || strings.HasSuffix(req.URL.Path, "/transfer/accept"))
+	}
+}
+
+func (s *Server) transferHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	path := strings.TrimPrefix(r.URL.Path, "/packages/")
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/transfer/accept"):
+		return r, s.acceptTransfer(r, strings.TrimSuffix(path, "/transfer/accept"))
+	case r.Method == http.MethodPost:
+		return r, s.startTransfer(r, strings.TrimSuffix(path, "/transfer"))
+	case r.Method == http.MethodDelete && strings.HasSuffix(path, "/transfer"):
+		return r, s.cancelTransfer(r, strings.TrimSuffix(path, "/transfer"))
+	}
+	return r, goproxy.NewResponse(r, "text/html", http.StatusMethodNotAllowed, "Method not allowed")
+}
+
+func (s *Server) startTransfer(r *http.Request, name string) *http.Response {
+	if s.config.transferWebhook == "" && s.mail == nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotImplemented, "Transfers need TRANSFER_WEBHOOK_URL or MAIL_PROVIDER")
+	}
+	owner, err := s.store.PackageOrganization(name)
+	if err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if owner == "" {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Only packages owned by an organization can be transferred")
+	}
+	member, err := s.isOrgMember(r, owner)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !member {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "You are not a member of the owning organization")
+	}
+
+	var req transferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if req.To == owner {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "The package already belongs to this organization")
+	}
+	if _, err := s.store.OrganizationTokenHash(req.To); err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Organization not found")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+
+	token, err := newToken()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	now := time.Now().UTC()
+	t := Transfer{Package: name, From: owner, To: req.To, TokenHash: hashToken(token), CreatedAt: now, ExpiresAt: now.Add(s.config.transferTTL)}
+	if err := s.store.CreateTransfer(t); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	delivered, err := s.offerTransfer(t, token)
+	if err != nil {
+		packageLog.Errorf("Could not deliver the transfer of %s: %s", name, err)
+		s.store.DeleteTransfer(name)
+		return goproxy.NewResponse(r, "text/html", http.StatusBadGateway, "Could not deliver the confirmation token")
+	}
+	if !delivered {
+		s.store.DeleteTransfer(name)
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "The receiving organization has no email address for notifications")
+	}
+	s.audit("org:"+owner, "transfer.initiated", name, "to "+t.To)
+	return jsonResponse(r, http.StatusAccepted, t)
+}
+
+func (s *Server) acceptTransfer(r *http.Request, name string) *http.Response {
+	t, err := s.store.PendingTransfer(name)
+	if err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "No pending transfer")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	member, err := s.isOrgMember(r, t.To)
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if !member {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "You are not a member of the receiving organization")
+	}
+
+	var req acceptTransferRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if subtle.ConstantTimeCompare([]byte(hashToken(req.Token)), []byte(t.TokenHash)) != 1 {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Invalid confirmation token")
+	}
+	if time.Now().After(t.ExpiresAt) {
+		return goproxy.NewResponse(r, "text/html", http.StatusGone, "The transfer has expired")
+	}
+
+	if err := s.store.CompleteTransfer(t); err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "The transfer is no longer valid")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.audit("org:"+t.To, "transfer.accepted", name, "from "+t.From)
+	go s.transferSettled("transfer.accepted", t)
+	return jsonResponse(r, http.StatusOK, t)
+}
+
+func (s *Server) cancelTransfer(r *http.Request, name string) *http.Response {
+	t, err := s.store.PendingTransfer(name)
+	if err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "No pending transfer")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	actor := ""
+	for _, org := range []string{t.From, t.To} {
+		member, err := s.isOrgMember(r, org)
+		if err != nil {
+			return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		if member {
+			actor = org
+			break
+		}
+	}
+	if actor == "" {
+		return goproxy.NewResponse(r, "text/html", http.StatusForbidden, "You are not a member of either organization")
+	}
+
+	if err := s.store.DeleteTransfer(name); err != nil && err != ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.audit("org:"+actor, "transfer.cancelled", name, "")
+	go s.transferSettled("transfer.cancelled", t)
+	return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+}
+
+// offerTransfer sends the confirmation token to the webhook and emails it
+// to the receiving organization, reporting whether it got anywhere.
+func (s *Server) offerTransfer(t Transfer, token string) (bool, error) {
+	delivered := false
+	if s.config.transferWebhook != "" {
+		if err := s.notifyTransfer("transfer.initiated", t, token); err != nil {
+			return false, err
+		}
+		delivered = true
+	}
+	mailed, err := s.mail.send(t.To, "transfer_offered", mailData{Transfer: t, Token: token})
+	if err != nil && !delivered {
+		return false, err
+	} else if err != nil {
+		packageLog.Errorf("Could not email the transfer of %s: %s", t.Package, err)
+	}
+	return delivered || mailed, nil
+}
+
+// transferSettled tells the webhook and both organizations how a transfer
+// ended.
+func (s *Server) transferSettled(event string, t Transfer) {
+	if s.config.transferWebhook != "" {
+		if err := s.notifyTransfer(event, t, ""); err != nil {
+			packageLog.Errorf("Could not notify the transfer of %s: %s", t.Package, err)
+		}
+	}
+	name := strings.Replace(event, ".", "_", 1)
+	for _, org := range []string{t.From, t.To} {
+		s.mail.notify(org, name, mailData{Transfer: t})
+	}
+}
+
+// notifyTransfer posts a step of t to the webhook, signed with
+// TRANSFER_WEBHOOK_SECRET when it is set.
+func (s *Server) notifyTransfer(event string, t Transfer, token string) error {
+	body, err := json.Marshal(transferNotification{Event: event, Transfer: t, Token: token})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.config.transferWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if secret := s.config.transferWebhookSecret; secret != "" {
+		req.Header.Set(signatureHeader, webhookSignature(secret, body))
+	}
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// /packages/top lists the packages downloaded most in the last seven full
+// days (UTC), and /packages/trending those whose downloads grew most over
+// the seven days before, for the home page and newsletters. Packages with
+// fewer than trendingMinDownloads downloads in either week don't trend, so
+// a package going from one download to five doesn't top the list. Both
+// lists are computed from the download statistics, see downloads.go, and
+// cached for an hour in the shared cache.
+
+const (
+	trendingTTL          = time.Hour
+	trendingMinDownloads = 50
+	// maxRankedPackages is how many packages the lists hold.
+	maxRankedPackages = 100
+)
+
+// RankedPackage is a package with its downloads in the last week and the
+// week before. Growth is the change between them, 0.5 for 50% more.
+type RankedPackage struct {
+	Name              string  `json:"name"`
+	URL               string  `json:"url"`
+	Downloads         int64   `json:"downloads"`
+	PreviousDownloads int64   `json:"previous_downloads"`
+	Growth            float64 `json:"growth"`
+}
+
+// rankPackages computes both lists, top first.
+func (s *Server) rankPackages(now time.Time) (top, trending []RankedPackage, err error) {
+	until := truncateToInterval(now, "day")
+	since := until.AddDate(0, 0, -7)
+	current, err := s.store.DownloadTotals(since, until)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous, err := s.store.DownloadTotals(since.AddDate(0, 0, -7), since)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var all []RankedPackage
+	for name, n := range current {
+		p := RankedPackage{Name: name, Downloads: n, PreviousDownloads: previous[name]}
+		if p.PreviousDownloads > 0 {
+			p.Growth = float64(p.Downloads-p.PreviousDownloads) / float64(p.PreviousDownloads)
+		}
+		all = append(all, p)
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if all[i].Downloads != all[j].Downloads {
+			return all[i].Downloads > all[j].Downloads
+		}
+		return all[i].Name < all[j].Name
+	})
+	var growing []RankedPackage
+	for _, p := range all {
+		if p.Downloads >= trendingMinDownloads && p.PreviousDownloads >= trendingMinDownloads && p.Growth > 0 {
+			growing = append(growing, p)
+		}
+	}
+	sort.SliceStable(growing, func(i, j int) bool { return growing[i].Growth > growing[j].Growth })
+
+	if top, err = s.publicRanked(all); err != nil {
+		return nil, nil, err
+	}
+	if trending, err = s.publicRanked(growing); err != nil {
+		return nil, nil, err
+	}
+	return top, trending, nil
+}
+
+// publicRanked returns the first maxRankedPackages of ranked that are still
+// registered and public, with their URL.
+func (s *Server) publicRanked(ranked []RankedPackage) ([]RankedPackage, error) {
+	list := []RankedPackage{}
+	for _, p := range ranked {
+		if len(list) == maxRankedPackages {
+			break
+		}
+		pkg, err := s.store.GetPackage(p.Name)
+		if err == ErrNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		if pkg.Private {
+			continue
+		}
+		p.URL = pkg.URL
+		list = append(list, p)
+	}
+	return list, nil
+}
+
+// refreshRankings recomputes both lists and caches them.
+func (s *Server) refreshRankings() (string, error) {
+	top, trending, err := s.rankPackages(time.Now())
+	if err != nil {
+		return "", err
+	}
+	data, err := json.Marshal(map[string][]RankedPackage{"top": top, "trending": trending})
+	if err != nil {
+		return "", err
+	}
+	val := string(data)
+	if s.cache.Set("packages_rankings", val, trendingTTL) == nil {
+		s.cacheKeys.add("packages_rankings", len(val), trendingTTL)
+	}
+	return val, nil
+}
+
+// servePackageRanking serves the list named by the last element of the
+// path, top or trending.
+func (s *Server) servePackageRanking(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	list := "trending"
+	if r.URL.Path == "/packages/top" {
+		list = "top"
+	}
+	val, err := s.cacheFor(r).Get("packages_rankings")
+	if err != nil {
+		if val, err = s.refresh.Do("packages_rankings", s.refreshRankings); err != nil {
+			return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+	}
+	var rankings map[string][]RankedPackage
+	if err := json.Unmarshal([]byte(val), &rankings); err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	ranked := rankings[list]
+	if limit, err := strconv.Atoi(r.URL.Query().Get("limit")); err == nil && limit > 0 && limit < len(ranked) {
+		ranked = ranked[:limit]
+	}
+	if ranked == nil {
+		ranked = []RankedPackage{}
+	}
+	response := jsonResponse(r, http.StatusOK, ranked)
+	response.Header.Set("Cache-Control", "public, max-age="+strconv.Itoa(int(trendingTTL/time.Second)))
+	return r, response
+}
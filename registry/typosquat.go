@@ -0,0 +1,284 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// New unscoped names are compared with the most popular packages before
+// the registration reaches the sidecar. A name within TYPOSQUAT_REJECT
+// edits of a popular one is rejected, within TYPOSQUAT_REVIEW edits it is
+// held until an admin approves it, and within TYPOSQUAT_WARN edits it is
+// registered with a Warning header. Every detection is written to the audit
+// log for moderation. Admins registering a package are not checked.
+
+// typosquatMinLength leaves short popular names out: nearly every short
+// name is a couple of edits away from one of them.
+const typosquatMinLength = 4
+
+// typosquatRefresh is how often the popular names are read again.
+const typosquatRefresh = 10 * time.Minute
+
+type typosquatConfig struct {
+	// popular is how many of the most popular packages are compared.
+	popular int
+	// The distances at most which a registration is rejected, held or
+	// warned about; 0 turns the action off.
+	reject, review, warn int
+}
+
+func loadTyposquatConfig() (typosquatConfig, error) {
+	var cfg typosquatConfig
+	for _, v := range []struct {
+		key, def string
+		n        *int
+	}{
+		{"TYPOSQUAT_POPULAR", "1000", &cfg.popular},
+		{"TYPOSQUAT_REJECT", "0", &cfg.reject},
+		{"TYPOSQUAT_REVIEW", "0", &cfg.review},
+		{"TYPOSQUAT_WARN", "1", &cfg.warn},
+	} {
+		n, err := strconv.Atoi(getEnv(v.key, v.def))
+		if err != nil || n < 0 {
+			return cfg, fmt.Errorf("Invalid %s: %s", v.key, getEnv(v.key, ""))
+		}
+		*v.n = n
+	}
+	return cfg, nil
+}
+
+func (c typosquatConfig) enabled() bool {
+	return c.popular > 0 && (c.reject > 0 || c.review > 0 || c.warn > 0)
+}
+
+// maxDistance is the largest distance any action applies to.
+func (c typosquatConfig) maxDistance() int {
+	max := c.reject
+	if c.review > max {
+		max = c.review
+	}
+	if c.warn > max {
+		max = c.warn
+	}
+	return max
+}
+
+// HeldRegistration is a registration waiting for an admin because its name
+// is close to a popular package.
+type HeldRegistration struct {
+	Name      string    `json:"name"`
+	URL       string    `json:"url"`
+	SimilarTo string    `json:"similar_to"`
+	Distance  int       `json:"distance"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// popularNames caches the names of the most popular packages.
+type popularNames struct {
+	mu     sync.Mutex
+	names  []string
+	loaded time.Time
+}
+
+func (p *popularNames) get(store Store, limit int) ([]string, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.names != nil && time.Since(p.loaded) < typosquatRefresh {
+		return p.names, nil
+	}
+	results, err := store.Search("", limit)
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, r := range results {
+		if len(r.Name) >= typosquatMinLength {
+			names = append(names, strings.ToLower(r.Name))
+		}
+	}
+	p.names, p.loaded = names, time.Now()
+	return names, nil
+}
+
+// nameDistance is the optimal string alignment distance between a and b:
+// the edits, counting a swap of neighbours as one, that turn a into b.
+func nameDistance(a, b string) int {
+	d := make([][]int, len(a)+1)
+	for i := range d {
+		d[i] = make([]int, len(b)+1)
+		d[i][0] = i
+	}
+	for j := range d[0] {
+		d[0][j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			d[i][j] = minInt(d[i-1][j]+1, minInt(d[i][j-1]+1, d[i-1][j-1]+cost))
+			if i > 1 && j > 1 && a[i-1] == b[j-2] && a[i-2] == b[j-1] {
+				d[i][j] = minInt(d[i][j], d[i-2][j-2]+1)
+			}
+		}
+	}
+	return d[len(a)][len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// similarName returns the popular name closest to name within max edits,
+// not counting name itself.
+func similarName(name string, popular []string, max int) (string, int) {
+	name = strings.ToLower(name)
+	best, bestDistance := "", max+1
+	for _, p := range popular {
+		if p == name || len(p)-len(name) > max || len(name)-len(p) > max {
+			continue
+		}
+		if d := nameDistance(name, p); d < bestDistance {
+			best, bestDistance = p, d
+		}
+	}
+	return best, bestDistance
+}
+
+// registration is kept in the proxy context of a registration that is let
+// through to the sidecar, to act on its response.
+type registration struct {
+	name string
+	// warning is added to the response, see addTyposquatWarning.
+	warning string
+	// apiKey was charged with the package at chargedAt, see
+	// settlePublication.
+	apiKey    string
+	chargedAt time.Time
+}
+
+func registrationOf(ctx *goproxy.ProxyCtx) *registration {
+	if reg, ok := ctx.UserData.(*registration); ok {
+		return reg
+	}
+	reg := &registration{}
+	ctx.UserData = reg
+	return reg
+}
+
+// screenRegistration checks the name of an unscoped registration. It
+// returns the response when the registration is rejected or held, and nil
+// to let it through.
+func (s *Server) screenRegistration(r *http.Request, ctx *goproxy.ProxyCtx, name, url string) *http.Response {
+	cfg := s.config.typosquat
+	if !cfg.enabled() || strings.HasPrefix(name, "@") || validatePackageName(name) != nil || s.isAdmin(r) {
+		return nil
+	}
+	popular, err := s.popular.get(s.store, cfg.popular)
+	if err != nil {
+		packageLog.Errorf("Could not read popular packages: %s", err)
+		return nil
+	}
+	similar, distance := similarName(name, popular, cfg.maxDistance())
+	if similar == "" {
+		return nil
+	}
+
+	detail := fmt.Sprintf("similar to %s (distance %d)", similar, distance)
+	actor := "ip:" + s.clientIP(r)
+	switch {
+	case distance <= cfg.reject:
+		packageLog.Infof("Rejected the registration of %s, %s", name, detail)
+		metrics.Add("typosquat_rejected", 1)
+		s.audit(actor, "registration.rejected", name, detail)
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Package name is too similar to "+similar)
+	case distance <= cfg.review:
+		// Anyone can register, so the repository isn't probed here; the URL
+		// checker reaches it once the registration is approved.
+		if err := validateRepositoryURL(url); err != nil {
+			return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid URL. "+err.Error())
+		}
+		h := HeldRegistration{Name: name, URL: url, SimilarTo: similar, Distance: distance, CreatedAt: time.Now().UTC()}
+		switch err := s.store.HoldRegistration(h); err {
+		case nil:
+		case ErrExists:
+			return goproxy.NewResponse(r, "text/html", http.StatusConflict, "A registration of this name is already waiting for review")
+		default:
+			return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+		}
+		packageLog.Infof("Held the registration of %s for review, %s", name, detail)
+		metrics.Add("typosquat_held", 1)
+		s.audit(actor, "registration.held", name, detail)
+		return goproxy.NewResponse(r, "text/html", http.StatusAccepted, "The name is similar to "+similar+", so the package will be registered once an admin approves it")
+	case distance <= cfg.warn:
+		packageLog.Infof("Warned about the registration of %s, %s", name, detail)
+		metrics.Add("typosquat_warned", 1)
+		s.audit(actor, "registration.warned", name, detail)
+		registrationOf(ctx).warning = "299 - " + strconv.Quote(name+" is similar to the popular package "+similar)
+	}
+	return nil
+}
+
+// addTyposquatWarning adds the warning of a registration to its response,
+// which comes from the sidecar.
+func addTyposquatWarning(resp *http.Response, ctx *goproxy.ProxyCtx) *http.Response {
+	if reg, ok := ctx.UserData.(*registration); ok && reg.warning != "" && resp != nil && resp.StatusCode < 300 {
+		resp.Header.Add("Warning", reg.warning)
+	}
+	return resp
+}
+
+func (s *Server) listHeldRegistrations(r *http.Request) *http.Response {
+	held, err := s.store.HeldRegistrations()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return jsonResponse(r, http.StatusOK, held)
+}
+
+// approveRegistration registers a held package, rejectRegistration drops
+// it.
+func (s *Server) approveRegistration(r *http.Request) *http.Response {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/registrations/")
+	h, err := s.store.ReleaseRegistration(name)
+	if err == ErrNotFound {
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Registration not found")
+	} else if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	switch err := s.store.InsertPackage(h.Name, h.URL); err {
+	case nil:
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "Package already registered")
+	case ErrURLTaken:
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "Repository already registered as another package")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.audit(s.adminActor(r), "registration.approved", h.Name, h.URL)
+	s.packagesChanged(h.URL)
+	return jsonResponse(r, http.StatusCreated, h)
+}
+
+func (s *Server) rejectRegistration(r *http.Request) *http.Response {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/registrations/")
+	switch _, err := s.store.ReleaseRegistration(name); err {
+	case nil:
+		s.audit(s.adminActor(r), "registration.dismissed", name, "")
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Registration not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
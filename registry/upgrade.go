@@ -0,0 +1,177 @@
+package registry
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Sockets can be passed in the way systemd's socket activation does:
+// LISTEN_FDS sockets starting at file descriptor 3, optionally named in
+// LISTEN_FDNAMES. Named sockets go to the first listener with that role
+// (FileDescriptorName=public in the socket unit); unnamed ones go to the
+// listeners in LISTEN order. Listeners without a socket open their own.
+//
+// The same mechanism hands the sockets to a new binary for deploys without
+// downtime: on SIGUSR2 the registry starts its executable again with its
+// sockets and, once the new process serves requests, it sends the old one
+// SIGTERM, which finishes the requests in flight, stops its node process
+// and exits. Until then the new process uses the old one's node process,
+// which holds the sidecar's address, and starts its own once the old
+// process is gone.
+
+// firstListenFD is the first file descriptor of socket activation.
+const firstListenFD = 3
+
+type inheritedFiles struct {
+	files []*os.File
+	names []string
+}
+
+// inheritedSockets reads the sockets passed to the process. LISTEN_PID,
+// which systemd sets, must be this process; the variables are cleared so
+// children don't take the sockets as theirs.
+func inheritedSockets() (*inheritedFiles, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	inherited := &inheritedFiles{}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return inherited, nil
+	}
+	value := os.Getenv("LISTEN_FDS")
+	if value == "" {
+		return inherited, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS: %q", value)
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+	for i := 0; i < n; i++ {
+		fd := firstListenFD + i
+		closeOnExec(fd)
+		name := ""
+		if i < len(names) && names[i] != "unknown" {
+			name = names[i]
+		}
+		inherited.files = append(inherited.files, os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)))
+		inherited.names = append(inherited.names, name)
+	}
+	return inherited, nil
+}
+
+// take returns the socket for the i-th listener, which has role, or nil.
+func (in *inheritedFiles) take(i int, role string) *os.File {
+	for j, f := range in.files {
+		if f != nil && in.names[j] != "" && in.names[j] == role {
+			in.files[j] = nil
+			return f
+		}
+	}
+	if i < len(in.files) && in.files[i] != nil && in.names[i] == "" {
+		f := in.files[i]
+		in.files[i] = nil
+		return f
+	}
+	return nil
+}
+
+// closeRest closes the sockets no listener took.
+func (in *inheritedFiles) closeRest() {
+	for j, f := range in.files {
+		if f != nil {
+			serverLog.Warnf("Closing inherited socket %d (%q), no listener for it", firstListenFD+j, in.names[j])
+			f.Close()
+		}
+	}
+}
+
+// upgradeOnSignal starts a new process with the sockets on SIGUSR2.
+func upgradeOnSignal(listeners []listenerConfig, lns []net.Listener) {
+	sig := make(chan os.Signal, 1)
+	notifyUpgrade(sig)
+	go func() {
+		for range sig {
+			serverLog.Infof("Starting a new process")
+			if err := startUpgrade(listeners, lns); err != nil {
+				serverLog.Errorf("Upgrade failed: %s", err)
+			}
+		}
+	}()
+}
+
+func startUpgrade(listeners []listenerConfig, lns []net.Listener) error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var files []*os.File
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	names := make([]string, len(lns))
+	for i, ln := range lns {
+		fl, ok := ln.(interface{ File() (*os.File, error) })
+		if !ok {
+			return fmt.Errorf("can't pass the socket of %s", listeners[i].addr)
+		}
+		f, err := fl.File()
+		if err != nil {
+			return err
+		}
+		files = append(files, f)
+		names[i] = listeners[i].role
+	}
+
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Stdout, cmd.Stderr = os.Stdout, os.Stderr
+	cmd.ExtraFiles = files
+	for _, kv := range os.Environ() {
+		if !strings.HasPrefix(kv, "LISTEN_PID=") && !strings.HasPrefix(kv, "LISTEN_FDS=") && !strings.HasPrefix(kv, "LISTEN_FDNAMES=") && !strings.HasPrefix(kv, "UPGRADE_PARENT=") {
+			cmd.Env = append(cmd.Env, kv)
+		}
+	}
+	cmd.Env = append(cmd.Env,
+		"LISTEN_FDS="+strconv.Itoa(len(files)),
+		"LISTEN_FDNAMES="+strings.Join(names, ":"),
+		"UPGRADE_PARENT="+strconv.Itoa(os.Getpid()))
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	serverLog.Infof("Started process %d", cmd.Process.Pid)
+	// Reap the process should it exit before taking over.
+	go cmd.Wait()
+	return nil
+}
+
+// upgradeParent returns the process this one takes over from, or 0.
+func upgradeParent() int {
+	pid, err := strconv.Atoi(os.Getenv("UPGRADE_PARENT"))
+	if err != nil || pid != os.Getppid() {
+		return 0
+	}
+	return pid
+}
+
+// finishUpgrade tells the process that started this one to stop, now that
+// this one serves requests.
+func finishUpgrade() {
+	pid := upgradeParent()
+	os.Unsetenv("UPGRADE_PARENT")
+	if pid == 0 {
+		return
+	}
+	serverLog.Infof("Taking over from process %d", pid)
+	terminateProcess(pid)
+}
@@ -0,0 +1,141 @@
+package registry
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Package URLs are normalized before they are stored, as lib/normalizeURL.js
+// does for registrations through the sidecar: GitHub repositories, whether
+// given as git://, http(s)://, ssh or owner/repo shorthand, become
+// https://github.com/owner/repo. Other URLs are stored as given. The
+// database keeps repositoryKey of the URL in normalized_url, unique per
+// tenant, so a repository is registered once and older packages, whose URL
+// was stored as given, are found by the normalized one; packages that shared a repository
+// before are listed by GET /admin/duplicates.
+
+// shorthandMaxAge is the max-age of shorthand lookups resolved without a
+// package, which may be registered any time.
+const shorthandMaxAge = 3600
+
+// githubShorthand matches owner/repo, which Bower resolves on GitHub.
+var githubShorthand = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9-]*/[A-Za-z0-9._-]+$`)
+
+// normalizeURL returns the URL a package is stored with.
+func normalizeURL(raw string) string {
+	u := strings.TrimSpace(raw)
+	if githubShorthand.MatchString(u) {
+		u = "https://github.com/" + u
+	}
+	if owner, repo, ok := parseGitHubURL(u); ok {
+		return "https://github.com/" + owner + "/" + repo
+	}
+	return u
+}
+
+// repositoryKey is the normalized_url of a package: URLs with the same key
+// point at the same repository.
+func repositoryKey(url string) string {
+	return strings.ToLower(normalizeURL(url))
+}
+
+// DuplicateRepository is a repository registered as several packages, oldest
+// first.
+type DuplicateRepository struct {
+	Tenant   string          `json:"tenant,omitempty"`
+	URL      string          `json:"url"`
+	Packages []PackageRecord `json:"packages"`
+}
+
+// duplicateRepositories groups the packages of every tenant by repository.
+func duplicateRepositories(records []PackageRecord) []DuplicateRepository {
+	groups := map[string][]PackageRecord{}
+	for _, p := range records {
+		key := p.Tenant + " " + repositoryKey(p.URL)
+		groups[key] = append(groups[key], p)
+	}
+	duplicates := []DuplicateRepository{}
+	for _, packages := range groups {
+		if len(packages) < 2 {
+			continue
+		}
+		sort.Slice(packages, func(i, j int) bool {
+			// Packages without a creation date come last.
+			a, b := packages[i].CreatedAt, packages[j].CreatedAt
+			switch {
+			case a != nil && b != nil && !a.Equal(*b):
+				return a.Before(*b)
+			case (a == nil) != (b == nil):
+				return a != nil
+			}
+			return packages[i].Name < packages[j].Name
+		})
+		duplicates = append(duplicates, DuplicateRepository{
+			Tenant:   packages[0].Tenant,
+			URL:      normalizeURL(packages[0].URL),
+			Packages: packages,
+		})
+	}
+	sort.Slice(duplicates, func(i, j int) bool {
+		if duplicates[i].Tenant != duplicates[j].Tenant {
+			return duplicates[i].Tenant < duplicates[j].Tenant
+		}
+		return strings.ToLower(duplicates[i].URL) < strings.ToLower(duplicates[j].URL)
+	})
+	return duplicates
+}
+
+// shorthandLookup returns owner/repo for lookups of /packages/owner%2Frepo.
+// The escaped slash keeps them apart from the routes under a package.
+func shorthandLookup(r *http.Request) (string, bool) {
+	escaped := strings.TrimPrefix(r.URL.EscapedPath(), "/packages/")
+	if !strings.Contains(strings.ToUpper(escaped), "%2F") {
+		return "", false
+	}
+	repo, err := url.PathUnescape(escaped)
+	if err != nil || !githubShorthand.MatchString(repo) {
+		return "", false
+	}
+	return repo, true
+}
+
+// getShorthand answers with the package registered for a GitHub repository
+// or, when there is none, with the repository itself under the shorthand
+// name.
+func (s *Server) getShorthand(r *http.Request, repo string) *http.Response {
+	repoURL := normalizeURL(repo)
+	key := repositoryKey(repo)
+	pkg, err := s.store.PackageByURL(key, key+".git")
+	if err == nil {
+		pkg, err = s.readPackage(r, pkg.Name)
+	}
+	maxAge := packageMaxAge(pkg)
+	if err == ErrNotFound {
+		pkg, err = Package{Name: repo, URL: repoURL}, nil
+		maxAge = shorthandMaxAge
+		metrics.Add("shorthand_lookups", 1)
+	}
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	response := jsonResponse(r, http.StatusOK, pkg)
+	response.Header.Add("Cache-Control", cacheControl(pkg, maxAge))
+	response.Header.Add("Vary", "Accept")
+	if pkg.Deprecated != nil {
+		response.Header.Set("Warning", pkg.Deprecated.warning(pkg.Name))
+	}
+	return response
+}
+
+func (s *Server) listDuplicates(r *http.Request) *http.Response {
+	records, err := s.store.Snapshot()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	return jsonResponse(r, http.StatusOK, duplicateRepositories(records))
+}
@@ -0,0 +1,152 @@
+package registry
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/elazarl/goproxy"
+)
+
+// The /v2 API serves the packages of /packages with their metadata in
+// {data, meta, links} envelopes. Lists are paginated with page and
+// per_page, and links are relative to the registry root so they work
+// behind any proxy. /packages itself keeps the format Bower clients expect.
+
+const (
+	v2DefaultPerPage = 100
+	v2MaxPerPage     = 1000
+)
+
+var v2Operations = []apiOperation{
+	{Method: http.MethodGet, Path: "/v2/packages", Summary: "List packages with their metadata", Query: []string{"page", "per_page"}},
+	{Method: http.MethodGet, Path: "/v2/packages/{name}", Summary: "Look up a package with its metadata by name or alias"},
+}
+
+func v2Error(r *http.Request, status int, msg string) *http.Response {
+	return jsonResponse(r, status, map[string]string{"error": msg})
+}
+
+func (s *Server) v2Handler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	switch {
+	case r.URL.Path == "/v2/packages":
+		return r, s.v2ListPackages(r)
+	case strings.HasPrefix(r.URL.Path, "/v2/packages/"):
+		return r, s.v2GetPackage(r, strings.TrimPrefix(r.URL.Path, "/v2/packages/"))
+	}
+	return r, v2Error(r, http.StatusNotFound, "Not found")
+}
+
+// queryInt reads a positive integer query parameter, returning def when it
+// is absent.
+func queryInt(r *http.Request, key string, def int) (int, bool) {
+	v := r.URL.Query().Get(key)
+	if v == "" {
+		return def, true
+	}
+	n, err := strconv.Atoi(v)
+	return n, err == nil && n > 0
+}
+
+func (s *Server) v2ListPackages(r *http.Request) *http.Response {
+	page, ok := queryInt(r, "page", 1)
+	if !ok {
+		return v2Error(r, http.StatusBadRequest, "Invalid page")
+	}
+	perPage, ok := queryInt(r, "per_page", v2DefaultPerPage)
+	if !ok || perPage > v2MaxPerPage {
+		return v2Error(r, http.StatusBadRequest, "Invalid per_page, the maximum is "+strconv.Itoa(v2MaxPerPage))
+	}
+
+	total, err := s.store.CountPackages()
+	if err != nil {
+		return v2Error(r, http.StatusInternalServerError, "Internal server error")
+	}
+	list, err := s.store.ListPackageDetails((page-1)*perPage, perPage)
+	if err != nil {
+		return v2Error(r, http.StatusInternalServerError, "Internal server error")
+	}
+
+	f := s.config.responseFormat
+	data := make([]interface{}, len(list))
+	for i, d := range list {
+		doc := f.extendedDocument(d, d.Name, "")
+		doc["links"] = map[string]string{"self": "/v2/packages/" + d.Name}
+		data[i] = doc
+	}
+
+	pages := int((total + int64(perPage) - 1) / int64(perPage))
+	if pages == 0 {
+		pages = 1
+	}
+	pageURL := func(n int) string {
+		return "/v2/packages?page=" + strconv.Itoa(n) + "&per_page=" + strconv.Itoa(perPage)
+	}
+	links := map[string]string{
+		"self":  pageURL(page),
+		"first": pageURL(1),
+		"last":  pageURL(pages),
+	}
+	if page > 1 {
+		links["prev"] = pageURL(page - 1)
+	}
+	if page < pages {
+		links["next"] = pageURL(page + 1)
+	}
+
+	response := jsonResponse(r, http.StatusOK, map[string]interface{}{
+		"data": data,
+		"meta": map[string]interface{}{
+			f.field("total"):    total,
+			f.field("page"):     page,
+			f.field("per_page"): perPage,
+			f.field("pages"):    pages,
+		},
+		"links": links,
+	})
+	// The same links as an RFC 8288 Link header, for clients that page
+	// without parsing the body.
+	var header []string
+	for _, rel := range []string{"first", "prev", "next", "last"} {
+		if link, ok := links[rel]; ok {
+			header = append(header, "<"+link+`>; rel="`+rel+`"`)
+		}
+	}
+	response.Header.Set("Link", strings.Join(header, ", "))
+	response.Header.Set("Cache-Control", "public, max-age=600")
+	return response
+}
+
+func (s *Server) v2GetPackage(r *http.Request, packageName string) *http.Response {
+	pkg, err := s.readPackage(r, packageName)
+	if err != nil {
+		if err == ErrNotFound {
+			return v2Error(r, http.StatusNotFound, "Package not found")
+		}
+		return v2Error(r, http.StatusInternalServerError, "Internal server error")
+	}
+
+	canonical := pkg.Name
+	if pkg.CanonicalName != "" {
+		canonical = pkg.CanonicalName
+	}
+	details, err := s.store.PackageDetails(canonical)
+	if err != nil {
+		return v2Error(r, http.StatusInternalServerError, "Internal server error")
+	}
+
+	links := map[string]string{
+		"self":       "/v2/packages/" + pkg.Name,
+		"collection": "/v2/packages",
+		"classic":    "/packages/" + pkg.Name,
+	}
+	if pkg.CanonicalName != "" {
+		links["canonical"] = "/v2/packages/" + pkg.CanonicalName
+	}
+	response := jsonResponse(r, http.StatusOK, map[string]interface{}{
+		"data":  s.config.responseFormat.extendedDocument(details, pkg.Name, pkg.CanonicalName),
+		"links": links,
+	})
+	response.Header.Set("Cache-Control", cacheControl(pkg, packageMaxAge(pkg)))
+	return response
+}
@@ -0,0 +1,408 @@
+package registry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const tagCacheTTL = 10 * time.Minute
+
+// Version is a semantic version parsed from a git tag.
+type Version struct {
+	Major, Minor, Patch int
+	Pre                 string
+	Tag                 string
+}
+
+func (v Version) String() string {
+	s := fmt.Sprintf("%d.%d.%d", v.Major, v.Minor, v.Patch)
+	if v.Pre != "" {
+		s += "-" + v.Pre
+	}
+	return s
+}
+
+// parseVersion accepts tags such as "1.2.3", "v1.2.3" and "v1.2.3-beta.1+build".
+func parseVersion(tag string) (Version, bool) {
+	s := strings.TrimLeft(strings.TrimSpace(tag), "v=")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	v := Version{Tag: tag}
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		v.Pre = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return Version{}, false
+	}
+	nums := make([]int, 3)
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 0 {
+			return Version{}, false
+		}
+		nums[i] = n
+	}
+	v.Major, v.Minor, v.Patch = nums[0], nums[1], nums[2]
+	return v, true
+}
+
+// compareVersions returns -1, 0 or 1. Pre-releases sort before the release
+// they precede; pre-release identifiers are compared as in semver 2.0.
+func compareVersions(a, b Version) int {
+	for _, d := range []int{a.Major - b.Major, a.Minor - b.Minor, a.Patch - b.Patch} {
+		if d < 0 {
+			return -1
+		}
+		if d > 0 {
+			return 1
+		}
+	}
+	switch {
+	case a.Pre == b.Pre:
+		return 0
+	case a.Pre == "":
+		return 1
+	case b.Pre == "":
+		return -1
+	}
+	ap, bp := strings.Split(a.Pre, "."), strings.Split(b.Pre, ".")
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aerr := strconv.Atoi(ap[i])
+		bn, berr := strconv.Atoi(bp[i])
+		switch {
+		case aerr == nil && berr == nil && an != bn:
+			if an < bn {
+				return -1
+			}
+			return 1
+		case aerr == nil && berr != nil:
+			return -1
+		case aerr != nil && berr == nil:
+			return 1
+		case ap[i] != bp[i]:
+			if ap[i] < bp[i] {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(ap) < len(bp):
+		return -1
+	case len(ap) > len(bp):
+		return 1
+	}
+	return 0
+}
+
+type tagCacheEntry struct {
+	tags    []string
+	fetched time.Time
+}
+
+var (
+	tagCacheMu sync.Mutex
+	tagCache   = map[string]tagCacheEntry{}
+)
+
+func flushTagCache() {
+	tagCacheMu.Lock()
+	tagCache = map[string]tagCacheEntry{}
+	tagCacheMu.Unlock()
+}
+
+func forgetTags(repoURL string) {
+	tagCacheMu.Lock()
+	delete(tagCache, repoURL)
+	tagCacheMu.Unlock()
+}
+
+// repoTags lists the tags of a git repository, caching the result in
+// process for tagCacheTTL.
+func repoTags(repoURL string) ([]string, error) {
+	tagCacheMu.Lock()
+	entry, ok := tagCache[repoURL]
+	tagCacheMu.Unlock()
+	if ok && time.Since(entry.fetched) < tagCacheTTL {
+		return entry.tags, nil
+	}
+
+	git, err := exec.LookPath("git")
+	if err != nil {
+		return nil, errors.New("git is not installed")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, git, "ls-remote", "--tags", "--refs", repoURL)
+	cmd.Env = append(os.Environ(), "GIT_TERMINAL_PROMPT=0")
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git ls-remote: %s", err)
+	}
+
+	var tags []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && strings.HasPrefix(fields[1], "refs/tags/") {
+			tags = append(tags, strings.TrimPrefix(fields[1], "refs/tags/"))
+		}
+	}
+
+	tagCacheMu.Lock()
+	tagCache[repoURL] = tagCacheEntry{tags: tags, fetched: time.Now()}
+	tagCacheMu.Unlock()
+	return tags, nil
+}
+
+// repoVersions returns the semver tags of a repository in ascending order.
+func repoVersions(repoURL string) ([]Version, error) {
+	tags, err := repoTags(repoURL)
+	if err != nil {
+		return nil, err
+	}
+	var versions []Version
+	for _, tag := range tags {
+		if v, ok := parseVersion(tag); ok {
+			versions = append(versions, v)
+		}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		return compareVersions(versions[i], versions[j]) < 0
+	})
+	return versions, nil
+}
+
+// latestVersion returns the highest non pre-release version, or the highest
+// pre-release when nothing else has been tagged.
+func latestVersion(versions []Version) (Version, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if versions[i].Pre == "" {
+			return versions[i], true
+		}
+	}
+	if len(versions) > 0 {
+		return versions[len(versions)-1], true
+	}
+	return Version{}, false
+}
+
+// parseGitHubURL extracts owner and repository from the URL forms Bower
+// accepts for GitHub: git://, https://, ssh:// and git@github.com:owner/repo.
+func parseGitHubURL(rawurl string) (owner, repo string, ok bool) {
+	var host, p string
+	if strings.HasPrefix(rawurl, "git@") {
+		parts := strings.SplitN(strings.TrimPrefix(rawurl, "git@"), ":", 2)
+		if len(parts) != 2 {
+			return "", "", false
+		}
+		host, p = parts[0], parts[1]
+	} else {
+		u, err := url.Parse(rawurl)
+		if err != nil {
+			return "", "", false
+		}
+		host, p = u.Hostname(), u.Path
+	}
+	if host != "github.com" && host != "www.github.com" {
+		return "", "", false
+	}
+	parts := strings.Split(strings.Trim(p, "/"), "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return "", "", false
+	}
+	return parts[0], strings.TrimSuffix(path.Base(parts[1]), ".git"), true
+}
+
+// githubArchiveURL returns the codeload URL of a tag's archive in the given
+// format ("tar.gz" or "zip"), if the repository is hosted on GitHub.
+func githubArchiveURL(repoURL, format, tag string) (string, bool) {
+	owner, repo, ok := parseGitHubURL(repoURL)
+	if !ok {
+		return "", false
+	}
+	return "https://codeload.github.com/" + owner + "/" + repo + "/" + format + "/" + url.PathEscape(tag), true
+}
+
+// versionRange is a semver range as npm and Bower write them: sets of
+// constraints separated by ||, any of which has to hold entirely.
+type versionRange [][]versionConstraint
+
+// parseRange parses ranges such as "^1.2.0", "~1.2", "1.x", ">=1.0 <2",
+// "1.2.3 - 1.4" and "1.2.7 || >=1.2.9 <2.0.0". "*" and "" allow every
+// release.
+func parseRange(s string) (versionRange, error) {
+	var r versionRange
+	for _, part := range strings.Split(s, "||") {
+		fields := strings.Fields(part)
+		var set []versionConstraint
+		if len(fields) == 3 && fields[1] == "-" {
+			from, ok := parsePartialVersion(fields[0])
+			to, ok2 := parsePartialVersion(fields[2])
+			if !ok || !ok2 {
+				return nil, fmt.Errorf("invalid range %q", s)
+			}
+			set = append(set, versionConstraint{">=", from.v})
+			switch to.n {
+			case 3:
+				set = append(set, versionConstraint{"<=", to.v})
+			case 1, 2:
+				set = append(set, versionConstraint{"<", to.next()})
+			}
+			r = append(r, set)
+			continue
+		}
+		for _, field := range fields {
+			constraints, ok := parseComparator(field)
+			if !ok {
+				return nil, fmt.Errorf("invalid range %q", s)
+			}
+			set = append(set, constraints...)
+		}
+		r = append(r, set)
+	}
+	return r, nil
+}
+
+// partialVersion is a version of which only the first n numbers are given,
+// as in "1", "1.2" or "1.2.x".
+type partialVersion struct {
+	v Version
+	n int
+}
+
+func parsePartialVersion(s string) (partialVersion, bool) {
+	s = strings.TrimLeft(s, "v=")
+	if i := strings.IndexByte(s, '+'); i >= 0 {
+		s = s[:i]
+	}
+	var p partialVersion
+	if i := strings.IndexByte(s, '-'); i >= 0 {
+		p.v.Pre = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) > 3 {
+		return p, false
+	}
+	nums := []*int{&p.v.Major, &p.v.Minor, &p.v.Patch}
+	for i, part := range parts {
+		if part == "x" || part == "X" || part == "*" {
+			break
+		}
+		n, err := strconv.Atoi(part)
+		if err != nil || n < 0 || p.n != i {
+			return p, false
+		}
+		*nums[i] = n
+		p.n++
+	}
+	if p.v.Pre != "" && p.n < 3 {
+		return p, false
+	}
+	return p, true
+}
+
+// next returns the first version after everything p matches.
+func (p partialVersion) next() Version {
+	switch p.n {
+	case 1:
+		return Version{Major: p.v.Major + 1}
+	case 2:
+		return Version{Major: p.v.Major, Minor: p.v.Minor + 1}
+	}
+	return Version{Major: p.v.Major, Minor: p.v.Minor, Patch: p.v.Patch + 1}
+}
+
+func parseComparator(s string) ([]versionConstraint, bool) {
+	op := s[:len(s)-len(strings.TrimLeft(s, "<>=^~"))]
+	p, ok := parsePartialVersion(s[len(op):])
+	if !ok {
+		return nil, false
+	}
+	lower := versionConstraint{">=", p.v}
+	switch op {
+	case "", "=":
+		if p.n == 3 {
+			return []versionConstraint{{"=", p.v}}, true
+		}
+	case "^":
+		switch {
+		case p.v.Major > 0 || p.n == 1:
+			p.n = 1
+		case p.v.Minor > 0 || p.n == 2:
+			p.n = 2
+		}
+	case "~", "~>":
+		if p.n == 3 {
+			p.n = 2
+		}
+	case ">=":
+		return []versionConstraint{lower}, true
+	case "<":
+		return []versionConstraint{{"<", p.v}}, true
+	case ">":
+		if p.n == 3 {
+			return []versionConstraint{{">", p.v}}, true
+		}
+		if p.n == 0 {
+			return []versionConstraint{{"<", Version{}}}, true
+		}
+		return []versionConstraint{{">=", p.next()}}, true
+	case "<=":
+		if p.n == 3 {
+			return []versionConstraint{{"<=", p.v}}, true
+		}
+		if p.n == 0 {
+			return nil, true
+		}
+		return []versionConstraint{{"<", p.next()}}, true
+	default:
+		return nil, false
+	}
+	if p.n == 0 {
+		return nil, true
+	}
+	return []versionConstraint{lower, {"<", p.next()}}, true
+}
+
+// allows reports whether v is in the range. As with npm, pre-releases only
+// match a set that names a pre-release of the same version.
+func (r versionRange) allows(v Version) bool {
+	for _, set := range r {
+		ok := true
+		pre := v.Pre == ""
+		for _, c := range set {
+			ok = ok && c.allows(v)
+			if c.version.Pre != "" && c.version.Major == v.Major && c.version.Minor == v.Minor && c.version.Patch == v.Patch {
+				pre = true
+			}
+		}
+		if ok && pre {
+			return true
+		}
+	}
+	return false
+}
+
+// maxSatisfying returns the highest of the ascending versions in r.
+func (r versionRange) maxSatisfying(versions []Version) (Version, bool) {
+	for i := len(versions) - 1; i >= 0; i-- {
+		if r.allows(versions[i]) {
+			return versions[i], true
+		}
+	}
+	return Version{}, false
+}
@@ -0,0 +1,235 @@
+package registry
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/elazarl/goproxy"
+)
+
+// Packages are public unless made private, which lets one instance serve
+// internal packages next to public ones. Private packages are left out of
+// every listing, the change feed included, and lookups only find them for
+// admins, API keys with the read scope and members of the owning
+// organization; everyone else gets a 404 as if they didn't exist.
+
+const (
+	scopeRead    = "read"
+	scopePublish = "publish"
+)
+
+// apiKeyScopes are the scopes an API key can be given.
+var apiKeyScopes = []string{scopeRead, scopePublish}
+
+// APIKey lets a client such as a CI system act with the given scopes. Only
+// the hash of its token is kept. Keys with the publish scope register
+// packages within their quotas, see quota.go.
+type APIKey struct {
+	Name       string    `json:"name"`
+	Scopes     []string  `json:"scopes"`
+	DailyQuota int       `json:"daily_quota,omitempty"`
+	TotalQuota int       `json:"total_quota,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	TokenHash  string    `json:"-"`
+}
+
+// createdAPIKey is returned once, when the key is created.
+type createdAPIKey struct {
+	APIKey
+	Token string `json:"token"`
+}
+
+// accountNameRe matches the names of API keys, members and teams.
+var accountNameRe = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+func visibility(private bool) string {
+	if private {
+		return "private"
+	}
+	return "public"
+}
+
+func (s *Server) listAPIKeys(r *http.Request) *http.Response {
+	keys, err := s.store.ListAPIKeys()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	return jsonResponse(r, http.StatusOK, keys)
+}
+
+func (s *Server) createAPIKey(r *http.Request) *http.Response {
+	var k APIKey
+	if err := json.NewDecoder(r.Body).Decode(&k); err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if !accountNameRe.MatchString(k.Name) {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid name, use letters, digits, dots, dashes and underscores")
+	}
+	if len(k.Scopes) == 0 {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "At least one scope is required")
+	}
+	if k.DailyQuota < 0 || k.TotalQuota < 0 {
+		return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Quotas can't be negative")
+	}
+	for _, scope := range k.Scopes {
+		if !containsString(apiKeyScopes, scope) {
+			return goproxy.NewResponse(r, "text/html", http.StatusBadRequest, fmt.Sprintf("Unknown scope %q, expected one of %s", scope, strings.Join(apiKeyScopes, ", ")))
+		}
+	}
+	token, err := newToken()
+	if err != nil {
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Internal server error")
+	}
+	k.TokenHash, k.CreatedAt = hashToken(token), time.Now().UTC()
+	switch err := s.store.CreateAPIKey(k); err {
+	case nil:
+		s.audit(s.adminActor(r), "api_key.created", "", k.Name)
+		return jsonResponse(r, http.StatusCreated, createdAPIKey{k, token})
+	case ErrExists:
+		return goproxy.NewResponse(r, "text/html", http.StatusConflict, "API key already exists")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+func (s *Server) deleteAPIKey(r *http.Request) *http.Response {
+	name := strings.TrimPrefix(r.URL.Path, "/admin/api-keys/")
+	switch err := s.store.DeleteAPIKey(name); err {
+	case nil:
+		s.audit(s.adminActor(r), "api_key.deleted", "", name)
+		return goproxy.NewResponse(r, "text/html", http.StatusNoContent, "")
+	case ErrNotFound:
+		return goproxy.NewResponse(r, "text/html", http.StatusNotFound, "API key not found")
+	default:
+		return goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+}
+
+// requestAPIKey returns the API key r authenticates with, if any.
+func (s *Server) requestAPIKey(r *http.Request) (APIKey, bool, error) {
+	token := requestToken(r)
+	if token == "" {
+		return APIKey{}, false, nil
+	}
+	k, err := s.store.APIKeyByTokenHash(hashToken(token))
+	if err == ErrNotFound {
+		return APIKey{}, false, nil
+	}
+	return k, err == nil, err
+}
+
+// canReadPrivate reports whether r may see the private package name: admins,
+// API keys with the read scope, the owning organization and members of its
+// teams with access to the package can.
+func (s *Server) canReadPrivate(r *http.Request, name string) (bool, error) {
+	if s.isAdmin(r) {
+		return true, nil
+	}
+	k, ok, err := s.requestAPIKey(r)
+	if err != nil {
+		return false, err
+	}
+	if ok && containsString(k.Scopes, scopeRead) {
+		return true, nil
+	}
+	owner, err := s.store.PackageOrganization(name)
+	if err != nil || owner == "" {
+		return false, err
+	}
+	if owns, err := s.isOrgMember(r, owner); err != nil || owns {
+		return owns, err
+	}
+	_, permission, err := s.memberPermission(r, owner, name)
+	return permission != "", err
+}
+
+// readPackage is lookupPackage for r, returning ErrNotFound for private
+// packages r may not see.
+func (s *Server) readPackage(r *http.Request, name string) (Package, error) {
+	pkg, err := s.lookupPackage(name)
+	if err == nil {
+		err = s.checkVisible(r, pkg)
+	}
+	if err != nil {
+		return Package{}, err
+	}
+	return pkg, nil
+}
+
+// checkVisible returns ErrNotFound when pkg is private and r may not see
+// it.
+func (s *Server) checkVisible(r *http.Request, pkg Package) error {
+	if !pkg.Private {
+		return nil
+	}
+	canonical := pkg.Name
+	if pkg.CanonicalName != "" {
+		canonical = pkg.CanonicalName
+	}
+	ok, err := s.canReadPrivate(r, canonical)
+	if err == nil && !ok {
+		err = ErrNotFound
+	}
+	return err
+}
+
+// cacheControl keeps responses about private packages out of shared caches.
+func cacheControl(pkg Package, maxAge int) string {
+	if pkg.Private {
+		return fmt.Sprintf("private, max-age=%d", maxAge)
+	}
+	return fmt.Sprintf("public, max-age=%d", maxAge)
+}
+
+var visibilityOperations = []apiOperation{
+	{Method: http.MethodPost, Path: "/packages/{name}/visibility", Summary: "Make a package public or private", Body: packageVisibility{}, Result: packageVisibility{}, Auth: true},
+}
+
+type packageVisibility struct {
+	Visibility string `json:"visibility"`
+}
+
+func visibilityPath() goproxy.ReqConditionFunc {
+	return func(req *http.Request, ctx *goproxy.ProxyCtx) bool {
+		return strings.HasPrefix(req.URL.Path, "/packages/") && strings.HasSuffix(req.URL.Path, "/visibility")
+	}
+}
+
+func (s *Server) visibilityHandler(r *http.Request, ctx *goproxy.ProxyCtx) (*http.Request, *http.Response) {
+	if r.Method != http.MethodPost {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusMethodNotAllowed, "Method not allowed")
+	}
+	name := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/packages/"), "/visibility")
+	actor, err := s.packageMaintainer(r, name)
+	if err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	if actor == "" {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusForbidden, "Only admins, the owning organization and its maintainers can change the visibility of a package")
+	}
+
+	var v packageVisibility
+	if err := json.NewDecoder(r.Body).Decode(&v); err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid JSON")
+	}
+	if v.Visibility != "public" && v.Visibility != "private" {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusBadRequest, "Invalid visibility, expected public or private")
+	}
+	if err := s.store.SetVisibility(name, v.Visibility == "private"); err == ErrNotFound {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusNotFound, "Package not found")
+	} else if err != nil {
+		return r, goproxy.NewResponse(r, "text/html", http.StatusInternalServerError, "Database error")
+	}
+	s.audit(actor, "package.visibility", name, v.Visibility)
+	// The packages trigger doesn't watch visibility.
+	if err := s.invalidate(invalidation{Keys: packageListKeys}); err != nil {
+		cacheLog.Errorf("Could not invalidate the package list: %s", err)
+	}
+	return r, jsonResponse(r, http.StatusOK, v)
+}
@@ -0,0 +1,97 @@
+package registry
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// warmUp runs before the listener is bound when the registry is started
+// with -warm, so the first requests after a deploy don't all miss. It waits
+// for the sidecar to answer, fills the cached package list and fetches the
+// tags of the popular packages into the in-process tag cache.
+func (s *Server) warmUp(popular int, timeout time.Duration) error {
+	started := time.Now()
+	if !sidecarDisabled {
+		if err := waitForSidecarResponse(timeout); err != nil {
+			return err
+		}
+	}
+
+	if _, err := s.refreshPackageList(); err != nil {
+		return fmt.Errorf("could not fill the package list: %s", err)
+	}
+
+	if popular > 0 && (s.config.npmFacade || s.config.composerFacade || s.config.htmlPages) {
+		results, err := s.store.Search("", popular)
+		if err != nil {
+			return fmt.Errorf("could not list popular packages: %s", err)
+		}
+		urls := make(chan string)
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for url := range urls {
+					if _, err := repoTags(url); err != nil {
+						cacheLog.Warnf("Warm-up: could not list tags of %s: %s", url, err)
+					}
+				}
+			}()
+		}
+		for _, p := range results {
+			urls <- p.URL
+		}
+		close(urls)
+		wg.Wait()
+	}
+
+	cacheLog.Infof("Warm-up finished in %s", time.Since(started))
+	return nil
+}
+
+// waitForSidecarResponse waits until the sidecar accepts connections and
+// answers an HTTP request without a server error.
+func waitForSidecarResponse(timeout time.Duration) error {
+	client := &http.Client{Transport: sidecarTransport, Timeout: 5 * time.Second}
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if sidecarReady() {
+			resp, err := client.Get("http://" + sidecarAddr + "/")
+			if err == nil {
+				resp.Body.Close()
+				if resp.StatusCode < 500 {
+					return nil
+				}
+			}
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+	return fmt.Errorf("sidecar did not respond within %s", timeout)
+}
+
+// reloadOnSignal flushes the in-process caches and rebuilds the cached
+// package list from the store on SIGUSR1, e.g. after bad data has been fixed
+// in the database. Entries of a shared cache other than the package list
+// expire on their own.
+func (s *Server) reloadOnSignal() {
+	sig := make(chan os.Signal, 1)
+	notifyReload(sig)
+	go func() {
+		for range sig {
+			cacheLog.Infof("Reloading caches")
+			flushTagCache()
+			if c, ok := s.cache.(*memoryCache); ok {
+				c.Flush()
+			}
+			if _, err := s.refresh.Do("packages", s.refreshPackageList); err != nil {
+				cacheLog.Errorf("Cache reload failed: %s", err)
+				continue
+			}
+			cacheLog.Infof("Caches reloaded")
+		}
+	}()
+}
@@ -0,0 +1,159 @@
+package registry
+
+import (
+	"expvar"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The watchdog samples the goroutines, open file descriptors and database
+// connections in use every WATCHDOG_INTERVAL and logs a warning for each
+// one past its threshold. Requests stuck in the sidecar or a slow lookup pile
+// up quietly otherwise. With WATCHDOG_DUMP_DIR set, the first warning also
+// writes a heap profile and a goroutine dump there, at most once per
+// watchdogDumpInterval.
+
+// watchdogDumpInterval keeps a lasting leak from filling the disk.
+const watchdogDumpInterval = time.Hour
+
+type watchdogConfig struct {
+	interval time.Duration
+	// goroutines and fds are counts, pool the share of the database pool in
+	// use.
+	goroutines int
+	fds        int
+	pool       float64
+	dumpDir    string
+}
+
+func loadWatchdogConfig() (watchdogConfig, error) {
+	cfg := watchdogConfig{dumpDir: getEnv("WATCHDOG_DUMP_DIR", "")}
+	var err error
+	if cfg.interval, err = time.ParseDuration(getEnv("WATCHDOG_INTERVAL", "30s")); err != nil {
+		return cfg, fmt.Errorf("Invalid WATCHDOG_INTERVAL: %s", err)
+	}
+	if cfg.goroutines, err = strconv.Atoi(getEnv("WATCHDOG_GOROUTINES", "10000")); err != nil {
+		return cfg, fmt.Errorf("Invalid WATCHDOG_GOROUTINES: %s", err)
+	}
+	// Without WATCHDOG_FDS, warn at 80% of the soft limit of the process.
+	if v := getEnv("WATCHDOG_FDS", ""); v != "" {
+		if cfg.fds, err = strconv.Atoi(v); err != nil {
+			return cfg, fmt.Errorf("Invalid WATCHDOG_FDS: %s", err)
+		}
+	} else {
+		cfg.fds = openFileLimit() / 10 * 8
+	}
+	if cfg.pool, err = strconv.ParseFloat(getEnv("WATCHDOG_POOL", "0.9"), 64); err != nil {
+		return cfg, fmt.Errorf("Invalid WATCHDOG_POOL: %s", err)
+	}
+	return cfg, nil
+}
+
+type resourceSample struct {
+	goroutines int
+	// fds is -1 where /proc isn't available.
+	fds int
+	// poolInUse and poolMax are 0 without Postgres.
+	poolInUse, poolMax int
+}
+
+func sampleResources(store Store) resourceSample {
+	s := resourceSample{goroutines: runtime.NumGoroutine(), fds: -1}
+	if entries, err := ioutil.ReadDir("/proc/self/fd"); err == nil {
+		s.fds = len(entries)
+	}
+	if pg, ok := store.(*postgresStore); ok {
+		stat := pg.pool.Stat()
+		s.poolInUse, s.poolMax = stat.CurrentConnections-stat.AvailableConnections, stat.MaxConnections
+	}
+	return s
+}
+
+// warnings lists the resources of s past their threshold.
+func (cfg watchdogConfig) warnings(s resourceSample) []string {
+	var warnings []string
+	if cfg.goroutines > 0 && s.goroutines >= cfg.goroutines {
+		warnings = append(warnings, fmt.Sprintf("resource=goroutines value=%d threshold=%d", s.goroutines, cfg.goroutines))
+	}
+	if cfg.fds > 0 && s.fds >= cfg.fds {
+		warnings = append(warnings, fmt.Sprintf("resource=fds value=%d threshold=%d", s.fds, cfg.fds))
+	}
+	if cfg.pool > 0 && s.poolMax > 0 && float64(s.poolInUse) >= cfg.pool*float64(s.poolMax) {
+		warnings = append(warnings, fmt.Sprintf("resource=db_pool value=%d max=%d threshold=%g", s.poolInUse, s.poolMax, cfg.pool))
+	}
+	return warnings
+}
+
+// startWatchdog samples the resources of the process every interval and
+// publishes the last sample in /metrics.
+func startWatchdog(cfg watchdogConfig, store Store) {
+	if cfg.interval <= 0 {
+		return
+	}
+	var mu sync.Mutex
+	var last resourceSample
+	var lastDump time.Time
+	sample := func() {
+		s := sampleResources(store)
+		mu.Lock()
+		last = s
+		mu.Unlock()
+		warnings := cfg.warnings(s)
+		for _, w := range warnings {
+			serverLog.Warnf("Watchdog: %s", w)
+			metrics.Add("watchdog_warnings", 1)
+		}
+		if len(warnings) > 0 && cfg.dumpDir != "" && time.Since(lastDump) >= watchdogDumpInterval {
+			lastDump = time.Now()
+			if err := writeDumps(cfg.dumpDir, lastDump); err != nil {
+				serverLog.Errorf("Watchdog: could not write dumps: %s", err)
+			}
+		}
+	}
+	sample()
+	metrics.Set("resources", expvar.Func(func() interface{} {
+		mu.Lock()
+		defer mu.Unlock()
+		return map[string]int{"goroutines": last.goroutines, "open_fds": last.fds, "db_pool_in_use": last.poolInUse, "db_pool_max": last.poolMax}
+	}))
+	go func() {
+		for range time.Tick(cfg.interval) {
+			sample()
+		}
+	}()
+}
+
+// writeDumps writes a heap profile, for go tool pprof, and a goroutine dump
+// with full stacks to dir.
+func writeDumps(dir string, at time.Time) error {
+	stamp := at.UTC().Format("20060102T150405Z")
+	for _, dump := range []struct {
+		profile, file string
+		debug         int
+	}{
+		{"heap", "heap-" + stamp + ".pb.gz", 0},
+		{"goroutine", "goroutines-" + stamp + ".txt", 2},
+	} {
+		path := filepath.Join(dir, dump.file)
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		err = pprof.Lookup(dump.profile).WriteTo(f, dump.debug)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		serverLog.Infof("Watchdog: wrote %s", path)
+	}
+	return nil
+}